@@ -0,0 +1,303 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/bits"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/state"
+)
+
+const (
+	// dedupDict is the dictionary that keeps the sequences of the recently
+	// handled messages of each sender.
+	dedupDict = "__dedup__"
+	// dedupWindow is the number of sequences above the watermark of a sender
+	// that are tracked. It is also the maximum number of messages a proxy keeps
+	// unacked, so the sequences below the window are acked or dead-lettered.
+	dedupWindow = 1024
+	// dedupExpiry is how long the sequences of a sender are kept after its last
+	// message.
+	dedupExpiry = time.Hour
+	// dedupSweep is how often a bee expires the sequences of the senders that
+	// are gone.
+	dedupSweep = time.Minute
+	// ackMaxAttempts is the number of times a proxy delivers a message before
+	// dead-lettering it.
+	ackMaxAttempts = 10
+)
+
+// ErrNotAcked is the error of the messages dead-lettered because their
+// destination has not acked them.
+var ErrNotAcked = errors.New("beehive: message is not acked")
+
+// dedupSeqs are the sequences of the handled messages of a sender: a low
+// watermark at or below which all the sequences are handled, and a bitmap of
+// the window above it in which bit i is set if sequence Low+1+i is handled.
+type dedupSeqs struct {
+	Low  uint64
+	Seen [dedupWindow / 64]uint64
+	Last int64 // When the last message is handled, in unix nanoseconds.
+}
+
+// mark records seq, and returns whether it is already handled.
+func (s *dedupSeqs) mark(seq uint64) (dup bool) {
+	if seq <= s.Low {
+		return true
+	}
+	if seq-s.Low > dedupWindow {
+		// The sequences below the window are acked or dead-lettered by the
+		// sender, and are never redelivered.
+		s.shift(seq - s.Low - dedupWindow)
+	}
+
+	i := seq - s.Low - 1
+	w, bit := i/64, uint64(1)<<(i%64)
+	if s.Seen[w]&bit != 0 {
+		return true
+	}
+	s.Seen[w] |= bit
+	s.shift(s.handled())
+	return false
+}
+
+// handled returns the number of contiguous handled sequences above the
+// watermark.
+func (s *dedupSeqs) handled() (n uint64) {
+	for _, w := range s.Seen {
+		if w != ^uint64(0) {
+			return n + uint64(bits.TrailingZeros64(^w))
+		}
+		n += 64
+	}
+	return n
+}
+
+// shift advances the watermark by n sequences.
+func (s *dedupSeqs) shift(n uint64) {
+	s.Low += n
+	if n >= dedupWindow {
+		s.Seen = [dedupWindow / 64]uint64{}
+		return
+	}
+	w, b := int(n/64), n%64
+	for i := range s.Seen {
+		var v uint64
+		if j := i + w; j < len(s.Seen) {
+			v = s.Seen[j] >> b
+			if b != 0 && j+1 < len(s.Seen) {
+				v |= s.Seen[j+1] << (64 - b)
+			}
+		}
+		s.Seen[i] = v
+	}
+}
+
+// unackedMsg is a message sent by a proxy bee that is not acked by its
+// destination yet.
+type unackedMsg struct {
+	msg      msg
+	sent     time.Time
+	attempts int
+}
+
+// trackAck assigns a sequence to the message sent by the proxy bee, and keeps
+// it until it is acked by its destination. The messages that are already
+// tracked by another bee are not tracked, since their destination acks the
+// original sender. The messages older than the dedup window of the
+// destination are dead-lettered, which bounds the unacked messages.
+func (b *bee) trackAck(m *msg) {
+	if b.app.ackTimeout <= 0 || m.MsgAckBee != Nil {
+		return
+	}
+
+	if b.unacked == nil {
+		b.unacked = make(map[uint64]unackedMsg)
+		// Sequences start from the current time, so that they are not reused
+		// when the proxy is recreated.
+		b.ackSeq = uint64(time.Now().UnixNano())
+		b.ackLow = b.ackSeq + 1
+	}
+	b.ackSeq++
+	m.MsgSeq = b.ackSeq
+	m.MsgAckHive = b.hive.ID()
+	m.MsgAckBee = b.ID()
+	b.unacked[m.MsgSeq] = unackedMsg{msg: *m, sent: time.Now(), attempts: 1}
+
+	for ; b.ackLow+dedupWindow <= b.ackSeq; b.ackLow++ {
+		if u, ok := b.unacked[b.ackLow]; ok {
+			b.deadLetterUnacked(u)
+		}
+	}
+}
+
+// deadLetterUnacked stops redelivering u, and adds it to the dead letters of
+// the app.
+func (b *bee) deadLetterUnacked(u unackedMsg) {
+	delete(b.unacked, u.msg.MsgSeq)
+	glog.Warningf("%v gives up on message %v after %v attempts", b, u.msg,
+		u.attempts)
+	// The message is tracked again if it is reprocessed.
+	m := u.msg
+	m.MsgSeq, m.MsgAckHive, m.MsgAckBee = 0, 0, Nil
+	b.app.deadLetters.add(msgAndHandler{msg: &m, attempts: u.attempts - 1},
+		ErrNotAcked)
+}
+
+// handleAck drops the messages acked by their destination.
+func (b *bee) handleAck(seqs []uint64) {
+	for _, s := range seqs {
+		delete(b.unacked, s)
+	}
+}
+
+// redeliver resends the messages that are not acked in the ack timeout of the
+// app, and dead-letters the ones delivered ackMaxAttempts times.
+func (b *bee) redeliver() {
+	now := time.Now()
+	var mhs []msgAndHandler
+	for s, u := range b.unacked {
+		if now.Sub(u.sent) < b.app.ackTimeout {
+			continue
+		}
+		if u.attempts >= ackMaxAttempts {
+			b.deadLetterUnacked(u)
+			continue
+		}
+		u.sent = now
+		u.attempts++
+		b.unacked[s] = u
+		m := u.msg
+		mhs = append(mhs, msgAndHandler{msg: &m})
+	}
+
+	if len(mhs) == 0 {
+		return
+	}
+	glog.V(2).Infof("%v redelivers %v messages", b, len(mhs))
+	b.handleMsg(mhs)
+}
+
+// maybeAckMsgs acks the messages handled by the bee, if the bee is the one
+// handling them. Proxies and followers forward the messages to the leader,
+// which acks them.
+func (b *bee) maybeAckMsgs(mhs []msgAndHandler) {
+	if b.app.ackTimeout <= 0 || b.proxy || b.detached ||
+		b.colony().Leader != b.ID() {
+
+		return
+	}
+	b.ackMsgs(mhs)
+}
+
+// ackMsgs acks the messages handled by the bee to the bees that sent them.
+func (b *bee) ackMsgs(mhs []msgAndHandler) {
+	type sender struct {
+		hive uint64
+		bee  uint64
+	}
+	var acks map[sender][]uint64
+	for _, mh := range mhs {
+		if mh.msg == nil || mh.msg.MsgAckBee == Nil {
+			continue
+		}
+		if acks == nil {
+			acks = make(map[sender][]uint64)
+		}
+		s := sender{hive: mh.msg.MsgAckHive, bee: mh.msg.MsgAckBee}
+		acks[s] = append(acks[s], mh.msg.MsgSeq)
+	}
+
+	if len(acks) == 0 {
+		return
+	}
+
+	// The acks to the proxies on the same hive are sent in one round trip.
+	cmds := make([]cmd, 0, len(acks))
+	for s, seqs := range acks {
+		cmds = append(cmds, cmd{
+			Hive: s.hive,
+			App:  b.app.Name(),
+			Bee:  s.bee,
+			Data: cmdAckMsgs{Seqs: seqs},
+		})
+	}
+	go func() {
+		for _, r := range b.hive.client.sendCmds(cmds) {
+			if r.Err != nil {
+				glog.V(2).Infof("%v cannot ack messages: %v", b, r.Err)
+			}
+		}
+	}()
+}
+
+// isDuplicate returns whether the message is already handled by the colony,
+// and otherwise records it in the dedup window of its sender. The dedup
+// window is stored in the state of the bee, so it is part of the current
+// transaction: it is replicated with the changes of the message, and is
+// discarded if the transaction is aborted.
+func (b *bee) isDuplicate(m *msg) bool {
+	if m == nil || m.MsgAckBee == Nil {
+		return false
+	}
+
+	dicts, _ := b.currentState()
+	d := dicts.Dict(dedupDict)
+	now := time.Now()
+	if now.Sub(b.dedupSwept) >= dedupSweep {
+		b.expireDedup(d, now)
+		b.dedupSwept = now
+	}
+
+	k := fmt.Sprintf("%v-%v", m.MsgAckHive, m.MsgAckBee)
+	var seqs dedupSeqs
+	if v, err := d.Get(k); err == nil {
+		// Sequences stored in older formats are discarded.
+		seqs, _ = v.(dedupSeqs)
+	}
+	if seqs.mark(m.MsgSeq) {
+		return true
+	}
+	seqs.Last = now.UnixNano()
+	if err := d.Put(k, seqs); err != nil {
+		glog.Errorf("%v cannot record message %v: %v", b, m, err)
+	}
+	return false
+}
+
+// expireDedup removes the sequences of the senders that have not sent any
+// message in dedupExpiry, or whose hives are removed from the cluster.
+func (b *bee) expireDedup(d state.Dict, now time.Time) {
+	var expired []string
+	d.ForEach(func(k string, v interface{}) bool {
+		seqs, ok := v.(dedupSeqs)
+		if !ok || now.Sub(time.Unix(0, seqs.Last)) >= dedupExpiry {
+			expired = append(expired, k)
+			return true
+		}
+		var hive, bee uint64
+		if _, err := fmt.Sscanf(k, "%d-%d", &hive, &bee); err != nil {
+			return true
+		}
+		if b.hive != nil {
+			if _, err := b.hive.registry.hive(hive); err == ErrNoSuchHive {
+				expired = append(expired, k)
+			}
+		}
+		return true
+	})
+	for _, k := range expired {
+		d.Del(k)
+	}
+	if len(expired) != 0 {
+		glog.V(2).Infof("%v expires the sequences of %v senders", b,
+			len(expired))
+	}
+}
+
+func init() {
+	gob.Register(dedupSeqs{})
+}
@@ -0,0 +1,239 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/state"
+)
+
+func TestAckRedeliver(t *testing.T) {
+	h := newHiveForTest().(*hive)
+	b := &bee{
+		beeID: 1,
+		hive:  h,
+		app:   &app{name: "ack", ackTimeout: time.Millisecond},
+	}
+	var sent []msg
+	b.handleMsg = func(mhs []msgAndHandler) {
+		for _, mh := range mhs {
+			sent = append(sent, *mh.msg)
+		}
+	}
+
+	var seqs []uint64
+	for i := 0; i < 2; i++ {
+		m := msg{MsgData: i}
+		b.trackAck(&m)
+		if m.MsgSeq == 0 || m.MsgAckBee != b.ID() {
+			t.Errorf("message is not tracked: %#v", m)
+		}
+		seqs = append(seqs, m.MsgSeq)
+	}
+
+	b.handleAck(seqs[:1])
+	time.Sleep(2 * time.Millisecond)
+	b.redeliver()
+	if len(sent) != 1 || sent[0].MsgSeq != seqs[1] {
+		t.Fatalf("invalid redelivered messages: %#v", sent)
+	}
+
+	// Redelivered messages are not tracked again.
+	m := sent[0]
+	b.trackAck(&m)
+	if m.MsgSeq != seqs[1] || len(b.unacked) != 1 {
+		t.Errorf("redelivered message is tracked again: %#v", m)
+	}
+}
+
+func TestAckGiveUp(t *testing.T) {
+	h := newHiveForTest().(*hive)
+	b := &bee{
+		beeID: 1,
+		hive:  h,
+		app: &app{
+			name:        "ack",
+			ackTimeout:  time.Millisecond,
+			deadLetters: newDeadLetterQueue(10),
+		},
+	}
+	sent := 0
+	b.handleMsg = func(mhs []msgAndHandler) {
+		sent += len(mhs)
+	}
+
+	m := msg{MsgData: 1}
+	b.trackAck(&m)
+	for i := 0; i < 2*ackMaxAttempts; i++ {
+		time.Sleep(2 * time.Millisecond)
+		b.redeliver()
+	}
+	if sent != ackMaxAttempts-1 {
+		t.Errorf("invalid redeliveries: actual=%v want=%v", sent,
+			ackMaxAttempts-1)
+	}
+	if len(b.unacked) != 0 {
+		t.Errorf("message is redelivered forever: %v", b.unacked)
+	}
+	l := b.app.DeadLetters()
+	if len(l) != 1 || l[0].Attempts != ackMaxAttempts ||
+		l[0].Err != ErrNotAcked.Error() {
+
+		t.Fatalf("invalid dead letters: %#v", l)
+	}
+	if d := l[0].Msg.(*msg); d.MsgAckBee != Nil {
+		t.Errorf("dead letter is still tracked by %v", d.MsgAckBee)
+	}
+
+	// Messages older than the dedup window are dead-lettered.
+	for i := 0; i <= dedupWindow; i++ {
+		m := msg{MsgData: i}
+		b.trackAck(&m)
+	}
+	if len(b.unacked) != dedupWindow {
+		t.Errorf("invalid unacked messages: actual=%v want=%v", len(b.unacked),
+			dedupWindow)
+	}
+	if l := b.app.DeadLetters(); len(l) != 2 {
+		t.Errorf("invalid dead letters: actual=%v want=2", len(l))
+	}
+}
+
+func TestAckedDelivery(t *testing.T) {
+	type rcv struct {
+		hive uint64
+		data int
+	}
+	ch := make(chan rcv, 10)
+	register := func(h Hive) {
+		a := h.NewApp("acked", AckedDelivery(50*time.Millisecond))
+		mf := func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}
+		rf := func(msg Msg, ctx RcvContext) error {
+			ch <- rcv{hive: ctx.Hive().ID(), data: msg.Data().(int)}
+			return nil
+		}
+		a.HandleFunc(0, mf, rf)
+	}
+
+	h1 := newHiveForTest()
+	register(h1)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	register(h2)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	h1.Emit(1)
+	if r := <-ch; r.hive != h1.ID() {
+		t.Fatalf("message is handled on %v instead of %v", r.hive, h1.ID())
+	}
+
+	// The message is sent by a proxy on h2, and is acked by the bee on h1.
+	h2.Emit(2)
+	if r := <-ch; r.data != 2 {
+		t.Fatalf("invalid message: %v", r.data)
+	}
+	select {
+	case r := <-ch:
+		t.Errorf("acked message is redelivered: %v", r.data)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestAckDedup(t *testing.T) {
+	b := &bee{beeID: 1}
+	b.setState(state.NewInMem())
+	m := func(seq uint64) *msg {
+		return &msg{MsgSeq: seq, MsgAckHive: 2, MsgAckBee: 3}
+	}
+
+	b.BeginTx()
+	if b.isDuplicate(m(10)) {
+		t.Error("first delivery is a duplicate")
+	}
+	b.AbortTx()
+	if b.isDuplicate(m(10)) {
+		t.Error("message of an aborted transaction is a duplicate")
+	}
+	if !b.isDuplicate(m(10)) {
+		t.Error("duplicate is not detected")
+	}
+	if b.isDuplicate(&msg{MsgSeq: 10, MsgAckHive: 2, MsgAckBee: 4}) {
+		t.Error("message of another sender is a duplicate")
+	}
+
+	for i := uint64(0); i < dedupWindow; i++ {
+		b.isDuplicate(m(100 + i))
+	}
+	if !b.isDuplicate(m(11)) {
+		t.Error("message older than the window is not dropped")
+	}
+}
+
+func TestAckDedupWindow(t *testing.T) {
+	var s dedupSeqs
+	for _, seq := range []uint64{1000, 990, 1100, 1050} {
+		if s.mark(seq) {
+			t.Errorf("first delivery of %v is a duplicate", seq)
+		}
+	}
+	for _, seq := range []uint64{1000, 990, 1100, 1050} {
+		if !s.mark(seq) {
+			t.Errorf("duplicate %v is not detected", seq)
+		}
+	}
+
+	// A lost message is accepted when it is redelivered after many newer
+	// messages.
+	s = dedupSeqs{}
+	s.mark(1)
+	for seq := uint64(3); seq < dedupWindow; seq++ {
+		s.mark(seq)
+	}
+	if s.mark(2) {
+		t.Error("first delivery of 2 is a duplicate")
+	}
+	if s.Low != dedupWindow-1 {
+		t.Errorf("invalid watermark: actual=%v want=%v", s.Low, dedupWindow-1)
+	}
+	for _, seq := range []uint64{2, dedupWindow / 2, dedupWindow - 1} {
+		if !s.mark(seq) {
+			t.Errorf("duplicate %v is not detected", seq)
+		}
+	}
+	if s.mark(dedupWindow + 10) {
+		t.Errorf("first delivery of %v is a duplicate", dedupWindow+10)
+	}
+	if s.mark(dedupWindow) {
+		t.Errorf("first delivery of %v is a duplicate", dedupWindow)
+	}
+	if s.Low != dedupWindow {
+		t.Errorf("invalid watermark: actual=%v want=%v", s.Low, dedupWindow)
+	}
+}
+
+func TestAckDedupExpiry(t *testing.T) {
+	b := &bee{beeID: 1}
+	b.setState(state.NewInMem())
+	m := &msg{MsgSeq: 10, MsgAckHive: 2, MsgAckBee: 3}
+	if b.isDuplicate(m) {
+		t.Error("first delivery is a duplicate")
+	}
+
+	d := b.stateL1.Dict(dedupDict)
+	b.expireDedup(d, time.Now())
+	if _, err := d.Get("2-3"); err != nil {
+		t.Errorf("sequences are expired before the expiry: %v", err)
+	}
+	b.expireDedup(d, time.Now().Add(dedupExpiry))
+	if _, err := d.Get("2-3"); err != state.ErrNoSuchKey {
+		t.Errorf("sequences are not expired: actual=%v want=%v", err,
+			state.ErrNoSuchKey)
+	}
+}
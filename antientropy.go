@@ -0,0 +1,181 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"sync/atomic"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/state"
+)
+
+// stateDigest is the digest of the state of a bee after applying the
+// transaction Seq of the colony leader in term Term.
+type stateDigest struct {
+	Term  uint64
+	Seq   uint64
+	Dicts map[string]uint64
+}
+
+// stateDigest returns the digest of the state of the bee, and the last
+// transaction of leader applied on the state.
+func (b *bee) stateDigest(leader uint64) stateDigest {
+	b.Lock()
+	defer b.Unlock()
+
+	return stateDigest{
+		Term:  b.txTerm,
+		Seq:   b.txApplied[leader],
+		Dicts: state.Digest(b.stateL1),
+	}
+}
+
+// antiEntropy compares the state of the bee with the state of its followers
+// in the background, and repairs the dictionaries that have diverged. It
+// must be called on the bee's goroutine.
+func (b *bee) antiEntropy() {
+	c := b.colony()
+	if b.detached || !b.app.persistent() || b.app.replMode == ReplicateNone ||
+		c.Leader != b.ID() || len(c.Followers) == 0 {
+
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&b.syncing, 0, 1) {
+		glog.V(2).Infof("%v skips anti-entropy: the previous one is running", b)
+		return
+	}
+
+	local := b.stateDigest(b.ID())
+	go func() {
+		defer atomic.StoreInt32(&b.syncing, 0)
+		for _, f := range c.Followers {
+			if c.IsWitness(f) {
+				continue
+			}
+			b.syncFollower(f, local)
+		}
+	}()
+}
+
+// syncFollower compares the digest of follower f with the local digest.
+// Followers that have not applied the same transactions as the leader are
+// skipped. The diverged dictionaries are fetched from the follower and
+// repaired by replicating the operations that make them equal to the
+// dictionaries of the leader.
+func (b *bee) syncFollower(f uint64, local stateDigest) {
+	info, err := b.hive.registry.bee(f)
+	if err != nil {
+		glog.Errorf("%v cannot find follower %v: %v", b, f, err)
+		return
+	}
+
+	fcmd := cmd{
+		Hive:  info.Hive,
+		App:   b.app.Name(),
+		Bee:   f,
+		Data:  cmdStateDigest{},
+		Fence: b.fence(),
+	}
+	res, err := b.hive.client.sendCmd(fcmd)
+	if err != nil {
+		glog.Errorf("%v cannot get the state digest of %v: %v", b, f, err)
+		return
+	}
+
+	remote := res.(stateDigest)
+	if remote.Term != local.Term || remote.Seq != local.Seq {
+		glog.V(2).Infof("%v skips anti-entropy with %v: follower is at %v/%v",
+			b, f, remote.Term, remote.Seq)
+		return
+	}
+
+	// The diverged dictionaries are fetched in one round trip.
+	dicts := divergedDicts(local.Dicts, remote.Dicts)
+	if len(dicts) == 0 {
+		return
+	}
+	cmds := make([]cmd, len(dicts))
+	for i, d := range dicts {
+		cmds[i] = fcmd
+		cmds[i].Data = cmdSaveDict{Dict: d}
+	}
+	for i, r := range b.hive.client.sendCmds(cmds) {
+		if r.Err != nil {
+			glog.Errorf("%v cannot get dictionary %v of %v: %v", b, dicts[i], f,
+				r.Err)
+			continue
+		}
+		glog.Warningf("%v repairs dictionary %v on follower %v", b, dicts[i], f)
+		_, err := b.processCmd(cmdRepairDict{
+			Dict:  dicts[i],
+			State: r.Data.([]byte),
+		})
+		if err != nil {
+			glog.Errorf("%v cannot repair dictionary %v on %v: %v", b, dicts[i],
+				f, err)
+			continue
+		}
+		antiEntropyRepairs.WithLabelValues(b.app.Name()).Inc()
+	}
+}
+
+func divergedDicts(local, remote map[string]uint64) (diverged []string) {
+	for d, h := range local {
+		if remote[d] != h {
+			diverged = append(diverged, d)
+		}
+	}
+	for d := range remote {
+		if _, ok := local[d]; !ok {
+			diverged = append(diverged, d)
+		}
+	}
+	return
+}
+
+// saveDict saves a dictionary of the bee in the format of state.InMem.
+func (b *bee) saveDict(name string) ([]byte, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	inm := state.NewInMem()
+	d := inm.Dict(name)
+	b.stateL1.Dict(name).ForEach(func(k string, v interface{}) bool {
+		d.Put(k, v)
+		return true
+	})
+	return inm.Save()
+}
+
+// repairDict replicates the operations that make the dictionary saved in
+// data, which is the dictionary of a follower, equal to the dictionary of the
+// bee. These operations do not change the state of the bee itself.
+func (b *bee) repairDict(name string, data []byte) error {
+	if !b.isLeader() {
+		return ErrIsNotMaster
+	}
+
+	inm := state.NewInMem()
+	if err := inm.Restore(data); err != nil {
+		return err
+	}
+
+	ops := state.DiffDict(b.stateL1.Dict(name), inm.Dict(name))
+	if len(ops) == 0 {
+		return nil
+	}
+	glog.V(2).Infof("%v repairs dictionary %v with %v operations", b, name,
+		len(ops))
+	if err := b.BeginTx(); err != nil {
+		return err
+	}
+	if err := b.stateL1.AddOps(ops); err != nil {
+		b.AbortTx()
+		return err
+	}
+	return b.CommitTx()
+}
+
+func init() {
+	gob.Register(stateDigest{})
+}
@@ -1,6 +1,7 @@
 package beehive
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"net/http"
@@ -30,6 +31,14 @@ type App interface {
 	// the qualified name of msgType's reflection type.
 	HandleFunc(msgType interface{}, m MapFunc, r RcvFunc) error
 
+	// Subscribe handles the messages published on the topic using the handler
+	// (see Publish). The handler receives the data of the published messages,
+	// and is not coupled to their types.
+	Subscribe(topic string, h Handler) error
+	// SubscribeFunc handles the messages published on the topic using the map
+	// and receive functions.
+	SubscribeFunc(topic string, m MapFunc, r RcvFunc) error
+
 	// Regsiters the app's detached handler.
 	Detached(h DetachedHandler)
 	// Registers the detached handler using functions.
@@ -52,14 +61,33 @@ type App interface {
 	// parameters.
 	HandleHTTPFunc(path string,
 		handler func(http.ResponseWriter, *http.Request)) *mux.Route
+
+	// DeadLetters returns the messages of this app that are dropped on this hive
+	// because the app has failed to map or to handle them.
+	DeadLetters() []DeadLetter
+	// Reprocess removes the dead letter from the dead letters and routes its
+	// message to the app again.
+	Reprocess(id uint64) error
+
+	// Replay routes the messages journaled on this hive from time from until
+	// time to to the app again, in the order they were journaled, and returns
+	// the number of replayed messages. If to is zero, all the messages
+	// journaled after from are replayed. The app must have a journal (see
+	// Journal).
+	Replay(from, to time.Time) (n int, err error)
 }
 
 // AppOption represents an option for applications.
 type AppOption func(a *app)
 
 // Persistent is an application option that makes the application's state
-// persistent. The app state will be replciated on "replicationFactor" hives.
+// persistent. The app state will be replicated on "replicationFactor" hives.
 // This option also makes the application transactional.
+//
+// Each bee of a persistent application forms a colony with its followers on
+// other hives, and the colony is a raft group: transactions are committed
+// when a majority of the colony has them in its log, and a new leader is
+// elected by raft when the leader fails.
 func Persistent(replicationFactor int) AppOption {
 	return func(a *app) {
 		a.flags = a.flags | appFlagPersistent | appFlagTransactional
@@ -67,6 +95,66 @@ func Persistent(replicationFactor int) AppOption {
 	}
 }
 
+// Witnesses is an application option that makes n of the followers of each
+// colony witnesses. A witness stores the transactions of the colony in its
+// raft log and votes in the commit quorum, but does not apply them to a state.
+// Witnesses reduce the memory cost of large replication factors: with
+// Persistent(3) and Witnesses(1), the state is kept on two hives while the
+// colony tolerates the failure of one hive. Witnesses never lead a colony: a
+// witness elected in raft, e.g., when the leader fails after a transaction is
+// stored only on the witness, replicates its log to a follower and hands the
+// leadership to it. As such, n must be smaller than the replication factor
+// minus one.
+func Witnesses(n int) AppOption {
+	return func(a *app) {
+		a.witnesses = n
+	}
+}
+
+// ReplicationPriority is an application option that sets the priority of the
+// application's colonies when they recruit followers to replace failed ones.
+// When the hive limits the rate of re-replication (see ReReplRate), colonies
+// of applications with a higher priority are re-replicated first. The default
+// priority is 0.
+func ReplicationPriority(p int) AppOption {
+	return func(a *app) {
+		a.replPrio = p
+	}
+}
+
+// ReplicationMode is the mode of replicating the transactions of a persistent
+// application.
+type ReplicationMode int
+
+// Replication modes.
+const (
+	// ReplicateSync commits a transaction when it is replicated on the majority
+	// of the colony. This is the default mode.
+	ReplicateSync ReplicationMode = iota
+	// ReplicateAsync commits a transaction locally, and replicates it in the
+	// background. Committed transactions can be lost when the bee fails.
+	ReplicateAsync
+	// ReplicateNone commits transactions only locally. Followers are not
+	// updated.
+	ReplicateNone
+	// ReplicateChain sends a transaction only to the first follower of the
+	// colony, and each follower forwards it to the next one (i.e., leader ->
+	// f1 -> f2). The transaction is committed when the last follower applies
+	// it. This cuts the egress bandwidth of the leader for large transactions.
+	// Followers that fail are spliced out of the chain and removed from the
+	// colony. Transactions are not stored in the raft log of the colony, and
+	// new followers receive the state of the leader when they join.
+	ReplicateChain
+)
+
+// Replication is an application option that sets the replication mode of a
+// persistent application.
+func Replication(mode ReplicationMode) AppOption {
+	return func(a *app) {
+		a.replMode = mode
+	}
+}
+
 // Transactional is an application option that makes the application
 // transactional. Transactions embody both application messages and its state.
 func Transactional() AppOption {
@@ -99,6 +187,33 @@ func Placement(m PlacementMethod) AppOption {
 	}
 }
 
+// PlaceOn is an application option that places the bees of the application,
+// and their followers, only on the hives that have all the given labels. See
+// the Labels hive option.
+func PlaceOn(labels ...string) AppOption {
+	return func(a *app) {
+		a.placeRules.labels = append(a.placeRules.labels, labels...)
+	}
+}
+
+// NotWith is an application option that never places the bees of the
+// application, or their followers, on the hives that run a bee of any of the
+// given applications.
+func NotWith(apps ...string) AppOption {
+	return func(a *app) {
+		a.placeRules.notWith = append(a.placeRules.notWith, apps...)
+	}
+}
+
+// PreferLocal is an application option that places new bees on the local hive
+// whenever it satisfies the placement constraints of the application,
+// regardless of the application's placement method.
+func PreferLocal() AppOption {
+	return func(a *app) {
+		a.placeRules.preferLocal = true
+	}
+}
+
 // InRate is an application option that limits the rate of incoming messages of
 // each bee of an application using a token bucket with the given rate and the
 // given maximum.
@@ -119,11 +234,106 @@ func OutRate(rate bucket.Rate, max uint64) AppOption {
 	}
 }
 
+// SQLState is an application option that stores the state of the
+// application's bees in the given table of a SQL database, instead of memory.
+// The rows of each bee are keyed by its ID. The table is created, if it does
+// not exist, when the hive starts. The state is written to the
+// database when transactions are committed, and this option also makes the
+// application transactional. Only the leader of a colony writes its state, and
+// the rows of a bee are deleted when it hands off its colony or stops.
+//
+// Note that the state used in map functions is always in memory.
+func SQLState(db *sql.DB, dialect state.SQLDialect, table string) AppOption {
+	return func(a *app) {
+		a.flags |= appFlagTransactional
+		a.sql = appSQL{
+			db:      db,
+			dialect: dialect,
+			table:   table,
+		}
+	}
+}
+
+// AckedDelivery is an application option that enables at-least-once delivery
+// of the messages sent to the bees of the application on other hives. The
+// proxy bee that sends the messages keeps them until the destination bee acks
+// that it has handled them, and redelivers the messages that are not acked in
+// timeout. Messages that are not acked after 10 deliveries, or that fall 1024
+// messages behind the latest message to their destination, are moved to the
+// dead letters of the application. Transactional applications drop the
+// redelivered messages that they have already handled, using a window of
+// recent messages that is kept in the state of bees. Handlers of other
+// applications should be idempotent, as messages may be delivered more than
+// once.
+func AckedDelivery(timeout time.Duration) AppOption {
+	return func(a *app) {
+		a.ackTimeout = timeout
+	}
+}
+
+// DeadLetterSize is an application option that sets the number of dead letters
+// kept for the application on each hive (see App.DeadLetters). When there are
+// more dead letters, the oldest ones are discarded. 0 disables dead letters.
+func DeadLetterSize(n int) AppOption {
+	return func(a *app) {
+		a.deadLetters = newDeadLetterQueue(n)
+	}
+}
+
+// Batch is an application option that groups up to size messages into one
+// transaction, waiting at most wait for the messages to arrive. For persistent
+// applications, this amortizes the replication round trip over all the
+// messages of the batch. Replies and other messages emitted in the batch are
+// released when the batch commits. The zero size uses the batch size of the
+// hive, and the zero wait groups only the messages already in the queue.
+//
+// Note that the bee does not process commands while waiting for a batch.
+func Batch(size uint, wait time.Duration) AppOption {
+	return func(a *app) {
+		a.batch.size = size
+		a.batch.wait = wait
+	}
+}
+
+// ReadReplicas is an application option that lets the followers of the
+// application's colonies handle the messages of read-only handlers (see
+// ReadOnly) emitted on their hive, instead of forwarding them to the leader.
+// A follower serves reads from a state that is at most staleness behind its
+// leader: if its last sync with the leader is older than staleness, the
+// follower waits for the transactions committed on the leader before
+// handling the messages.
+func ReadReplicas(staleness time.Duration) AppOption {
+	return func(a *app) {
+		a.readRepl.enabled = true
+		a.readRepl.staleness = staleness
+	}
+}
+
+type appReadReplicas struct {
+	enabled   bool
+	staleness time.Duration
+}
+
+// ConcurrentMap is an application option that invokes the map functions of
+// the application on up to n messages concurrently, so that a slow map
+// function does not stall mapping the other messages of the application.
+// Messages are still handed to bees in the order they are received, which
+// preserves the order of messages mapped to the same cells. With this option,
+// map functions must be safe for concurrent use, and they cannot use the
+// dictionaries of their context: the operations on those dictionaries fail
+// with ErrMapState. n of at most 1 invokes map functions sequentially, which
+// is the default.
+func ConcurrentMap(n int) AppOption {
+	return func(a *app) {
+		a.mapWorkers = n
+	}
+}
+
 // MapFunc is a map function that maps a specific message to the set of keys
 // in state dictionaries. This method is assumed not to be thread-safe and is
-// called sequentially. If the return value is an empty set the message is
-// broadcasted to all local bees. Also, if the return value is nil, the message
-// is drop.
+// called sequentially, unless the application is created with ConcurrentMap.
+// If the return value is an empty set the message is broadcasted to all local
+// bees. Also, if the return value is nil, the message is drop.
 type MapFunc func(m Msg, c MapContext) MappedCells
 
 // RcvFunc is the function that handles a message. This method is called in
@@ -142,6 +352,53 @@ type Handler interface {
 	Map(m Msg, c MapContext) MappedCells
 }
 
+// ReadOnlyHandler is implemented by handlers that can declare they never
+// modify the state. When all the messages of a batch are handled by read-only
+// handlers, the bee skips transactions and replication entirely. Writes in a
+// read-only handler fail with state.ErrReadOnly.
+type ReadOnlyHandler interface {
+	Handler
+	// ReadOnly returns whether the handler is read-only.
+	ReadOnly() bool
+}
+
+// ReadOnly wraps h and declares it as a read-only handler.
+func ReadOnly(h Handler) ReadOnlyHandler {
+	return readOnlyHandler{Handler: h}
+}
+
+type readOnlyHandler struct {
+	Handler
+}
+
+func (h readOnlyHandler) ReadOnly() bool {
+	return true
+}
+
+func isReadOnly(h Handler) bool {
+	ro, ok := h.(ReadOnlyHandler)
+	return ok && ro.ReadOnly()
+}
+
+// BatchHandler is implemented by handlers that handle a batch of messages at
+// once, such as counters and aggregators. When a bee dequeues consecutive
+// messages of the same type for a batch handler, it calls RcvBatch once for
+// all of them in one transaction, instead of calling Rcv for each message. If
+// RcvBatch fails, the transaction is aborted for all the messages of the batch.
+//
+// The size of batches is bounded by the batch size of the application (see
+// Batch).
+type BatchHandler interface {
+	Handler
+	// RcvBatch handles the messages of a batch.
+	RcvBatch(msgs []Msg, c RcvContext) error
+}
+
+func isBatch(h Handler) bool {
+	_, ok := h.(BatchHandler)
+	return ok
+}
+
 // DetachedHandler in contrast to normal Handlers with Map and Rcv, starts in
 // their own go-routine and emit messages. They do not listen on a particular
 // message and only recv replys in their receive functions.
@@ -196,6 +453,7 @@ func (h *funcDetached) Rcv(m Msg, c RcvContext) error {
 type runtimeRcvContext struct {
 	*qee
 	state *state.Transactional
+	local state.Dict
 }
 
 func (c runtimeRcvContext) ID() uint64 {
@@ -236,12 +494,30 @@ func (c runtimeRcvContext) LockCells(keys []CellKey) error {
 
 func (c runtimeRcvContext) Snooze(d time.Duration) {}
 
+func (c runtimeRcvContext) EmitAfter(d time.Duration, msgData interface{}) {}
+
+func (c runtimeRcvContext) Multicast(msgData interface{},
+	to ...uint64) map[uint64]error {
+
+	return nil
+}
+
+func (c runtimeRcvContext) BroadcastToHives(
+	msgData interface{}) map[uint64]error {
+
+	return nil
+}
+
 func (c runtimeRcvContext) BeeLocal() interface{} {
 	return nil
 }
 
 func (c runtimeRcvContext) SetBeeLocal(d interface{}) {}
 
+func (c runtimeRcvContext) LocalState() state.Dict {
+	return c.local
+}
+
 func (c runtimeRcvContext) Dict(name string) state.Dict {
 	return c.state.Dict(name)
 }
@@ -258,6 +534,29 @@ func (c runtimeRcvContext) CommitTx() error {
 	return c.state.CommitTx()
 }
 
+func (c runtimeRcvContext) Savepoint() (Savepoint, error) {
+	ssp, err := c.state.Savepoint()
+	return Savepoint{state: ssp}, err
+}
+
+func (c runtimeRcvContext) RollbackTo(sp Savepoint) error {
+	return c.state.RollbackTo(sp.state)
+}
+
+func (c runtimeRcvContext) CommitWith(writes []CellWrite) error {
+	return errors.New("runtime map cannot commit distributed transactions")
+}
+
+func (c runtimeRcvContext) Update(fn func(tx StateTx) error) error {
+	return state.Update(c.state, func(tx state.State) error {
+		return fn(tx)
+	})
+}
+
+func (c runtimeRcvContext) BeeState(id uint64) (state.State, error) {
+	return nil, errors.New("runtime map cannot access the state of bees")
+}
+
 // RuntimeMap generates an automatic runtime map function based on the given
 // rcv function.
 //
@@ -276,6 +575,7 @@ func RuntimeMap(rcv RcvFunc) MapFunc {
 		rCtx := runtimeRcvContext{
 			qee:   q,
 			state: state.NewTransactional(q.app.newState()),
+			local: state.NewInMem().Dict(localStateDict),
 		}
 
 		if err := rcv(msg, rCtx); err != nil {
@@ -312,6 +612,17 @@ type appRate struct {
 	outMaxTokens uint64
 }
 
+type appBatch struct {
+	size uint
+	wait time.Duration
+}
+
+type appSQL struct {
+	db      *sql.DB
+	dialect state.SQLDialect
+	table   string
+}
+
 type app struct {
 	name       string
 	hive       *hive
@@ -319,9 +630,36 @@ type app struct {
 	handlers   map[string]Handler
 	flags      appFlag
 	replFactor int
+	replMode   ReplicationMode
+	replPrio   int
+	witnesses  int
 	placement  PlacementMethod
+	placeRules placementRules
 	router     *mux.Router
 	rate       appRate
+	batch      appBatch
+	pressure   appBackpressure
+	txTimeout  appTxTimeout
+	ackTimeout time.Duration
+	fifoWait   time.Duration
+	readRepl   appReadReplicas
+	watched    map[string]struct{}
+	sql        appSQL
+	preCommit  []PreCommitFunc
+	postCommit []PostCommitFunc
+	journal    *journal
+	quarantine int
+	limiter    *rateLimiter
+	cipher     PayloadCipher
+	isolate    bool
+	mapWorkers int
+	hibernate  time.Duration
+	maxBees    appMaxBees
+	warmBees   int
+
+	interceptors interceptors
+
+	deadLetters *deadLetterQueue
 }
 
 func (a *app) String() string {
@@ -332,6 +670,14 @@ func (a *app) HandleFunc(msg interface{}, m MapFunc, r RcvFunc) error {
 	return a.Handle(msg, &funcHandler{m, r})
 }
 
+func (a *app) Subscribe(topic string, h Handler) error {
+	return a.registerHandler(topicType(topic), topicHandler{handler: h})
+}
+
+func (a *app) SubscribeFunc(topic string, m MapFunc, r RcvFunc) error {
+	return a.Subscribe(topic, &funcHandler{m, r})
+}
+
 func (a *app) DetachedFunc(start StartFunc, stop StopFunc, rcv RcvFunc) {
 	a.Detached(&funcDetached{start, stop, rcv})
 }
@@ -408,6 +754,9 @@ func (a *app) initQee() {
 		hive:         a.hive,
 		app:          a,
 		bees:         make(map[uint64]*bee),
+		hibernated:   make(map[uint64]*hibernatedBee),
+		migrating:    make(map[uint64]struct{}),
+		metrics:      newQueenMetrics(a.name),
 		state:        state.NewTransactional(a.newState()),
 		pendingCells: make(map[CellKey]*pendingCells),
 	}
@@ -417,6 +766,26 @@ func (a *app) newState() state.State {
 	return state.NewInMem()
 }
 
+// newBeeState returns a new state for bee of this app.
+func (a *app) newBeeState(bee uint64) state.State {
+	if a.sql.db != nil {
+		return state.NewSQL(a.sql.db, a.sql.dialect, a.sql.table, bee)
+	}
+	return a.newState()
+}
+
+// init prepares the resources of the app before the hive starts.
+func (a *app) init() error {
+	if a.sql.db == nil {
+		return nil
+	}
+	err := state.NewSQL(a.sql.db, a.sql.dialect, a.sql.table, 0).CreateTable()
+	if err != nil {
+		return fmt.Errorf("%v cannot create table %s: %v", a, a.sql.table, err)
+	}
+	return nil
+}
+
 func (a *app) persistent() bool {
 	return a.flags&appFlagPersistent != 0
 }
@@ -1,10 +1,19 @@
 package beehive
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"testing"
 	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/prometheus/client_golang/prometheus"
+	dto "github.com/kandoo/beehive/Godeps/_workspace/src/github.com/prometheus/client_model/go"
+	"github.com/kandoo/beehive/state"
 )
 
 type AppTestMsg int
@@ -87,6 +96,504 @@ func TestReplicatedApp(t *testing.T) {
 	h3.Stop()
 }
 
+func TestReplicatedAppDelFollower(t *testing.T) {
+	ch := make(chan hiveAndBeeID)
+
+	h1 := newHiveForTest()
+	a := registerPersistentApp(h1, ch)
+	go h1.Start()
+	waitTilStareted(h1)
+
+	cfg1 := h1.Config()
+
+	h2 := newHiveForTest(PeerAddrs(cfg1.Addr))
+	registerPersistentApp(h2, ch)
+	go h2.Start()
+	waitTilStareted(h2)
+
+	h3 := newHiveForTest(PeerAddrs(cfg1.Addr))
+	registerPersistentApp(h3, ch)
+	go h3.Start()
+	waitTilStareted(h3)
+
+	h1.Emit(AppTestMsg(0))
+	id := <-ch
+	// Followers are recruited when the first transaction is committed.
+	h1.Emit(AppTestMsg(0))
+	<-ch
+
+	b, ok := a.(*app).qee.beeByID(id.Bee)
+	if !ok {
+		t.Fatalf("cannot find bee %v", id.Bee)
+	}
+	c := b.colony()
+	if len(c.Followers) != 2 || c.Quorum() != 2 {
+		t.Fatalf("invalid colony: %v", c)
+	}
+
+	f, err := h1.(*hive).registry.bee(c.Followers[0])
+	if err != nil {
+		t.Fatalf("cannot find follower: %v", err)
+	}
+	if _, err := b.processCmd(cmdDelFollower{Bee: f.ID,
+		Hive: f.Hive}); err != nil {
+
+		t.Fatalf("cannot remove follower: %v", err)
+	}
+	if c = b.colony(); len(c.Followers) != 1 || c.IsFollower(f.ID) {
+		t.Errorf("follower is not removed: %v", c)
+	}
+
+	h1.Emit(AppTestMsg(0))
+	<-ch
+
+	h1.Stop()
+	h2.Stop()
+	h3.Stop()
+}
+
+func TestReplicatedAppAntiEntropy(t *testing.T) {
+	ch := make(chan hiveAndBeeID)
+
+	tick := AntiEntropyTick(100 * time.Millisecond)
+	h1 := newHiveForTest(tick)
+	a := registerPersistentApp(h1, ch)
+	go h1.Start()
+	waitTilStareted(h1)
+
+	cfg1 := h1.Config()
+
+	var hives []Hive
+	for i := 0; i < 2; i++ {
+		h := newHiveForTest(tick, PeerAddrs(cfg1.Addr))
+		registerPersistentApp(h, ch)
+		go h.Start()
+		waitTilStareted(h)
+		hives = append(hives, h)
+	}
+
+	h1.Emit(AppTestMsg(0))
+	id := <-ch
+	h1.Emit(AppTestMsg(0))
+	<-ch
+
+	b, _ := a.(*app).qee.beeByID(id.Bee)
+	var f *bee
+	for _, h := range hives {
+		fa, _ := h.(*hive).app("persistent")
+		for _, fid := range b.colony().Followers {
+			if fb, ok := fa.qee.beeByID(fid); ok {
+				f = fb
+			}
+		}
+	}
+	if f == nil {
+		t.Fatal("cannot find any follower")
+	}
+
+	f.Lock()
+	f.stateL1.Dict("Test").Put("X", []byte{1})
+	f.Unlock()
+
+	for i := 0; ; i++ {
+		if i == 50 {
+			t.Fatal("the follower is not repaired")
+		}
+		time.Sleep(100 * time.Millisecond)
+		f.Lock()
+		_, err := f.stateL1.Dict("Test").Get("X")
+		f.Unlock()
+		if err == state.ErrNoSuchKey {
+			break
+		}
+	}
+
+	h1.Stop()
+	for _, h := range hives {
+		h.Stop()
+	}
+}
+
+func TestReplicatedAppWitnesses(t *testing.T) {
+	ch := make(chan hiveAndBeeID)
+	register := func(h Hive) App {
+		a := h.NewApp("persistent", Persistent(3), Witnesses(1))
+		mf := func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}
+		a.HandleFunc(AppTestMsg(0), mf, func(msg Msg, ctx RcvContext) error {
+			ch <- hiveAndBeeID{Hive: h.ID(), Bee: ctx.ID()}
+			return ctx.Dict("Test").Put("K", []byte{})
+		})
+		return a
+	}
+
+	h1 := newHiveForTest()
+	a := register(h1)
+	go h1.Start()
+	waitTilStareted(h1)
+
+	var hives []Hive
+	for i := 0; i < 2; i++ {
+		h := newHiveForTest(PeerAddrs(h1.Config().Addr))
+		register(h)
+		go h.Start()
+		waitTilStareted(h)
+		hives = append(hives, h)
+	}
+
+	h1.Emit(AppTestMsg(0))
+	id := <-ch
+	h1.Emit(AppTestMsg(0))
+	<-ch
+
+	b, _ := a.(*app).qee.beeByID(id.Bee)
+	c := b.colony()
+	if len(c.Followers) != 2 || len(c.Witnesses) != 1 {
+		t.Fatalf("invalid colony: actual=%v want 2 followers and 1 witness", c)
+	}
+
+	// The full follower is checked first, so that the witness has received the
+	// transaction when it is checked.
+	var fids []uint64
+	for _, fid := range c.Followers {
+		if !c.IsWitness(fid) {
+			fids = append(fids, fid)
+		}
+	}
+	fids = append(fids, c.Witnesses...)
+	for _, fid := range fids {
+		for _, h := range hives {
+			fa, _ := h.(*hive).app("persistent")
+			f, ok := fa.qee.beeByID(fid)
+			if !ok {
+				continue
+			}
+			want := !c.IsWitness(fid)
+			for i := 0; ; i++ {
+				f.Lock()
+				_, err := f.stateL1.Dict("Test").Get("K")
+				f.Unlock()
+				if (err == nil) == want {
+					break
+				}
+				if i == 50 {
+					t.Fatalf("invalid state on %v: has key=%v want=%v", f, !want, want)
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+	}
+
+	h1.Stop()
+	for _, h := range hives {
+		h.Stop()
+	}
+}
+
+func TestReplicatedAppColonyMetrics(t *testing.T) {
+	ch := make(chan hiveAndBeeID)
+	register := func(h Hive) App {
+		a := h.NewApp("persistent", Persistent(3))
+		mf := func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}
+		a.HandleFunc(AppTestMsg(0), mf, func(msg Msg, ctx RcvContext) error {
+			ch <- hiveAndBeeID{Hive: h.ID(), Bee: ctx.ID()}
+			return ctx.Dict("Test").Put("K", []byte{})
+		})
+		return a
+	}
+
+	h1 := newHiveForTest()
+	a := register(h1)
+	go h1.Start()
+	waitTilStareted(h1)
+
+	var hives []Hive
+	for i := 0; i < 2; i++ {
+		h := newHiveForTest(PeerAddrs(h1.Config().Addr))
+		register(h)
+		go h.Start()
+		waitTilStareted(h)
+		hives = append(hives, h)
+	}
+
+	h1.Emit(AppTestMsg(0))
+	id := <-ch
+	h1.Emit(AppTestMsg(0))
+	<-ch
+
+	b, _ := a.(*app).qee.beeByID(id.Bee)
+	l := colonyLabels(b, b.colony())
+	gauge := func(g *prometheus.GaugeVec) float64 {
+		var m dto.Metric
+		g.WithLabelValues(l...).Write(&m)
+		return m.GetGauge().GetValue()
+	}
+	if f := gauge(colonyFollowers); f != 2 {
+		t.Errorf("invalid number of followers: actual=%v want=2", f)
+	}
+	if r := gauge(colonyReplFactor); r != 3 {
+		t.Errorf("invalid replication factor: actual=%v want=3", r)
+	}
+	if lag := gauge(colonyReplLag); lag != 0 {
+		t.Errorf("invalid replication lag: actual=%v want=0", lag)
+	}
+	if ack := gauge(colonyLastAck); ack == 0 {
+		t.Error("no transaction is acked")
+	}
+
+	h1.Stop()
+	for _, h := range hives {
+		h.Stop()
+	}
+}
+
+func TestReplicatedAppChain(t *testing.T) {
+	ch := make(chan hiveAndBeeID)
+	register := func(h Hive) App {
+		a := h.NewApp("persistent", Persistent(3), Replication(ReplicateChain))
+		mf := func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}
+		a.HandleFunc(AppTestMsg(0), mf, func(msg Msg, ctx RcvContext) error {
+			ch <- hiveAndBeeID{Hive: h.ID(), Bee: ctx.ID()}
+			return ctx.Dict("Test").Put("K", int(msg.Data().(AppTestMsg)))
+		})
+		return a
+	}
+
+	h1 := newHiveForTest()
+	a := register(h1)
+	go h1.Start()
+	waitTilStareted(h1)
+	defer h1.Stop()
+
+	hives := make(map[uint64]Hive)
+	for i := 0; i < 2; i++ {
+		h := newHiveForTest(PeerAddrs(h1.Config().Addr))
+		register(h)
+		go h.Start()
+		waitTilStareted(h)
+		hives[h.ID()] = h
+	}
+
+	h1.Emit(AppTestMsg(1))
+	id := <-ch
+	h1.Emit(AppTestMsg(2))
+	<-ch
+
+	b, _ := a.(*app).qee.beeByID(id.Bee)
+	c := b.colony()
+	if len(c.Followers) != 2 {
+		t.Fatalf("invalid colony: actual=%v want 2 followers", c)
+	}
+
+	var tail Hive
+	for i, f := range c.Followers {
+		info, _ := h1.(*hive).bee(f)
+		h := hives[info.Hive]
+		fa, _ := h.(*hive).app("persistent")
+		fb, _ := fa.qee.beeByID(f)
+		for j := 0; ; j++ {
+			fb.Lock()
+			v, err := fb.stateL1.Dict("Test").Get("K")
+			fb.Unlock()
+			if err == nil && v.(int) == 2 {
+				break
+			}
+			if j == 50 {
+				t.Fatalf("invalid state on follower %v: actual=%v want=2", f, v)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if i == 0 {
+			h.Stop()
+		} else {
+			tail = h
+		}
+	}
+	defer tail.Stop()
+
+	h1.Emit(AppTestMsg(3))
+	<-ch
+
+	for i := 0; len(b.colony().Followers) != 1; i++ {
+		if i == 100 {
+			t.Fatalf("failed follower is not spliced out: %v", b.colony())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// partitionHives stops the hives from dialing each other.
+func partitionHives(h1, h2 Hive) {
+	for _, p := range [][2]*hive{{h1.(*hive), h2.(*hive)},
+		{h2.(*hive), h1.(*hive)}} {
+
+		t := p[0].client.lookupRetry(p[1].ID())
+		t.Lock()
+		t.next = time.Now().Add(time.Hour)
+		t.Unlock()
+		p[0].client.deleteHive(p[1].ID())
+	}
+}
+
+func TestReplicatedAppWitnessFailover(t *testing.T) {
+	ch := make(chan hiveAndBeeID, 16)
+	register := func(h Hive) App {
+		a := h.NewApp("persistent", Persistent(3), Witnesses(1))
+		mf := func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}
+		a.HandleFunc(AppTestMsg(0), mf, func(msg Msg, ctx RcvContext) error {
+			ch <- hiveAndBeeID{Hive: h.ID(), Bee: ctx.ID()}
+			return ctx.Dict("Test").Put("K", int(msg.Data().(AppTestMsg)))
+		})
+		return a
+	}
+
+	h1 := newHiveForTest()
+	a := register(h1)
+	go h1.Start()
+	waitTilStareted(h1)
+
+	hives := make(map[uint64]Hive)
+	for i := 0; i < 2; i++ {
+		h := newHiveForTest(PeerAddrs(h1.Config().Addr))
+		register(h)
+		go h.Start()
+		waitTilStareted(h)
+		hives[h.ID()] = h
+	}
+
+	h1.Emit(AppTestMsg(1))
+	id := <-ch
+	h1.Emit(AppTestMsg(1))
+	<-ch
+
+	b, _ := a.(*app).qee.beeByID(id.Bee)
+	c := b.colony()
+	if len(c.Followers) != 2 || len(c.Witnesses) != 1 {
+		t.Fatalf("invalid colony: actual=%v want 2 followers and 1 witness", c)
+	}
+
+	var f, w *bee
+	var fh, wh Hive
+	for _, fid := range c.Followers {
+		info, _ := h1.(*hive).bee(fid)
+		h := hives[info.Hive]
+		fa, _ := h.(*hive).app("persistent")
+		fb, _ := fa.qee.beeByID(fid)
+		if c.IsWitness(fid) {
+			w, wh = fb, h
+		} else {
+			f, fh = fb, h
+		}
+	}
+	defer fh.Stop()
+	defer wh.Stop()
+
+	value := func(b *bee) int {
+		b.Lock()
+		defer b.Unlock()
+		v, err := b.stateL1.Dict("Test").Get("K")
+		if err != nil {
+			return 0
+		}
+		return v.(int)
+	}
+	applied := func() uint64 {
+		w.Lock()
+		defer w.Unlock()
+		return w.txApplied[b.ID()]
+	}
+	for i := 0; value(f) != 1; i++ {
+		if i == 50 {
+			t.Fatalf("invalid state on the follower: actual=%v want=1", value(f))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// The transaction is committed only by the leader and the witness.
+	partitionHives(h1, fh)
+	seq := applied()
+	h1.Emit(AppTestMsg(2))
+	<-ch
+	for i := 0; applied() == seq; i++ {
+		if i == 100 {
+			t.Fatal("the witness has not received the transaction")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	h1.Stop()
+
+	for i := 0; value(f) != 2 || f.colony().Leader != f.ID(); i++ {
+		if i == 200 {
+			t.Fatalf("the follower has not taken over: value=%v colony=%v",
+				value(f), f.colony())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+type AppTestReadMsg int
+
+func TestReplicatedAppReadReplicas(t *testing.T) {
+	ch := make(chan hiveAndBeeID)
+	register := func(h Hive) {
+		a := h.NewApp("persistent", Persistent(3), ReadReplicas(0))
+		mf := func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}
+		a.HandleFunc(AppTestMsg(0), mf, func(msg Msg, ctx RcvContext) error {
+			ch <- hiveAndBeeID{Hive: h.ID(), Bee: ctx.ID()}
+			return ctx.Dict("Test").Put("K", int(msg.Data().(AppTestMsg)))
+		})
+		a.Handle(AppTestReadMsg(0), ReadOnly(&funcHandler{mf,
+			func(msg Msg, ctx RcvContext) error {
+				v, err := ctx.Dict("Test").Get("K")
+				if err != nil || v.(int) != 1 {
+					t.Errorf("invalid value on the read replica: %v %v", v, err)
+				}
+				ch <- hiveAndBeeID{Hive: h.ID(), Bee: ctx.ID()}
+				return nil
+			}}))
+	}
+
+	h1 := newHiveForTest()
+	register(h1)
+	go h1.Start()
+	waitTilStareted(h1)
+
+	cfg1 := h1.Config()
+
+	h2 := newHiveForTest(PeerAddrs(cfg1.Addr))
+	register(h2)
+	go h2.Start()
+	waitTilStareted(h2)
+
+	h3 := newHiveForTest(PeerAddrs(cfg1.Addr))
+	register(h3)
+	go h3.Start()
+	waitTilStareted(h3)
+
+	h1.Emit(AppTestMsg(0))
+	leader := <-ch
+	h1.Emit(AppTestMsg(1))
+	<-ch
+
+	h2.Emit(AppTestReadMsg(0))
+	if r := <-ch; r.Hive != h2.ID() || r.Bee == leader.Bee {
+		t.Errorf("read-only message is not handled by the replica: %v", r)
+	}
+
+	h1.Stop()
+	h2.Stop()
+	h3.Stop()
+}
+
 func TestReplicatedAppFailure(t *testing.T) {
 	ch := make(chan hiveAndBeeID)
 
@@ -146,6 +653,61 @@ func TestReplicatedAppFailure(t *testing.T) {
 	h3.Stop()
 }
 
+func TestReplicatedAppEvictUnreachable(t *testing.T) {
+	ch := make(chan hiveAndBeeID)
+
+	h1 := newHiveForTest()
+	registerPersistentApp(h1, ch)
+	go h1.Start()
+	waitTilStareted(h1)
+
+	cfg1 := h1.Config()
+
+	var hives []Hive
+	for i := 0; i < 3; i++ {
+		h := newHiveForTest(PeerAddrs(cfg1.Addr))
+		registerPersistentApp(h, ch)
+		go h.Start()
+		waitTilStareted(h)
+		hives = append(hives, h)
+	}
+
+	h1.Emit(AppTestMsg(0))
+	id := <-ch
+	h1.Emit(AppTestMsg(0))
+	<-ch
+
+	elect := cfg1.RaftElectTimeout()
+	time.Sleep(3 * elect)
+	h1.Stop()
+
+	h2 := hives[0].(*hive)
+	for i := 0; ; i++ {
+		if i == 100 {
+			t.Fatalf("unreachable leader %v is not replaced", id.Bee)
+		}
+		time.Sleep(elect)
+		if _, err := h2.processCmd(cmdSync{}); err != nil {
+			continue
+		}
+		var c Colony
+		for _, b := range h2.registry.bees() {
+			if b.App == "persistent" && b.Colony.Leader == b.ID &&
+				b.Hive != h1.ID() {
+
+				c = b.Colony
+			}
+		}
+		if !c.IsNil() && !c.Contains(id.Bee) && len(c.Followers) == 2 {
+			break
+		}
+	}
+
+	for _, h := range hives {
+		h.Stop()
+	}
+}
+
 func TestReplicatedAppHandoff(t *testing.T) {
 	ch := make(chan hiveAndBeeID)
 
@@ -199,6 +761,59 @@ func TestReplicatedAppHandoff(t *testing.T) {
 	h3.Stop()
 }
 
+func TestReplicatedAppHandoffHTTP(t *testing.T) {
+	ch := make(chan hiveAndBeeID)
+
+	h1 := newHiveForTest()
+	registerPersistentApp(h1, ch)
+	go h1.Start()
+	waitTilStareted(h1)
+
+	var hives []Hive
+	for i := 0; i < 2; i++ {
+		h := newHiveForTest(PeerAddrs(h1.Config().Addr))
+		registerPersistentApp(h, ch)
+		go h.Start()
+		waitTilStareted(h)
+		hives = append(hives, h)
+	}
+
+	h1.Emit(AppTestMsg(0))
+	<-ch
+	h1.Emit(AppTestMsg(0))
+	id0 := <-ch
+
+	// The handoff is requested from a hive other than the leader's.
+	url := fmt.Sprintf("http://%s/api/v1/bees/%v/handoff",
+		hives[0].Config().Addr, id0.Bee)
+	resp, err := http.Post(url, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("reponse status: actual=%v want=200 Ok", resp.Status)
+	}
+	var res HandoffResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Leader == id0.Bee || res.Leader == Nil {
+		t.Errorf("invalid new leader: %v", res.Leader)
+	}
+
+	h1.Emit(AppTestMsg(0))
+	if id1 := <-ch; id1.Bee != res.Leader {
+		t.Errorf("different bees want=%v got=%v", res.Leader, id1.Bee)
+	}
+
+	time.Sleep(h1.Config().RaftElectTimeout())
+	h1.Stop()
+	for _, h := range hives {
+		h.Stop()
+	}
+}
+
 func TestReplicatedAppMigrateToFollower(t *testing.T) {
 	ch := make(chan hiveAndBeeID)
 	apps := make([]App, 3)
@@ -322,6 +937,91 @@ func TestReplicatedAppMigrateToNewHive(t *testing.T) {
 	h4.Stop()
 }
 
+func registerCounterApp(h Hive, ch chan int) App {
+	app := h.NewApp("counter")
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	rf := func(msg Msg, ctx RcvContext) error {
+		d := ctx.Dict("D")
+		n := 1
+		if v, err := d.Get("0"); err == nil {
+			n += v.(int)
+		}
+		d.Put("0", n)
+		ch <- n
+		return nil
+	}
+	app.HandleFunc(AppTestMsg(0), mf, rf)
+	return app
+}
+
+func TestAppMigrateState(t *testing.T) {
+	ch := make(chan int)
+
+	h1 := newHiveForTest()
+	app1 := registerCounterApp(h1, ch)
+	go h1.Start()
+	waitTilStareted(h1)
+	defer h1.Stop()
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	registerCounterApp(h2, ch)
+	go h2.Start()
+	waitTilStareted(h2)
+	defer h2.Stop()
+
+	for i := 1; i <= 2; i++ {
+		h1.Emit(AppTestMsg(0))
+		<-ch
+	}
+
+	b1 := findBee(app1.Name(), h1)
+	_, err := app1.(*app).qee.processCmd(cmdMigrate{Bee: b1, To: h2.ID()})
+	if err != nil {
+		t.Fatalf("cannot migrate bee: %v", err)
+	}
+
+	h2.Emit(AppTestMsg(0))
+	if n := <-ch; n != 3 {
+		t.Errorf("state is not migrated: actual=%v want=3", n)
+	}
+}
+
+// appTestNoSQL is a database/sql driver that cannot connect to its database.
+type appTestNoSQL struct{}
+
+func (appTestNoSQL) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("no database")
+}
+
+func init() {
+	sql.Register("beehive-nosql", appTestNoSQL{})
+}
+
+func TestAppSQLStateStartError(t *testing.T) {
+	db, err := sql.Open("beehive-nosql", "")
+	if err != nil {
+		t.Fatalf("cannot open the database: %v", err)
+	}
+
+	h := newHiveForTest()
+	h.NewApp("sql", SQLState(db, state.MySQL, "t"))
+	errs := make(chan error, 1)
+	go func() {
+		errs <- h.Start()
+	}()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("no error when the table of the application cannot be created")
+		}
+	case <-time.After(5 * time.Second):
+		h.Stop()
+		t.Error("hive starts without the table of its application")
+	}
+}
+
 func TestAppHTTP(t *testing.T) {
 	h := hive{config: hiveConfig()}
 	h.httpServer = newServer(&h)
@@ -351,13 +1051,19 @@ func TestRuntimeMap(t *testing.T) {
 	waitTilStareted(h)
 
 	cells := MappedCells{{"1", "11"}, {"1", "12"}, {"2", "21"}}
+	var local error
 	rcv := func(msg Msg, ctx RcvContext) error {
 		for _, c := range cells {
 			ctx.Dict(c.Dict).Put(c.Key, []byte{})
 		}
+		ctx.LocalState().Put("k", true)
+		_, local = ctx.LocalState().Get("k")
 		return nil
 	}
 	mapped := RuntimeMap(rcv)(nil, a.(*app).qee)
+	if local != nil {
+		t.Errorf("local state is not kept between calls: %v", local)
+	}
 
 	for _, rc := range cells {
 		found := false
@@ -381,3 +1087,375 @@ func findBee(a string, h Hive) uint64 {
 	}
 	return 0
 }
+
+func TestAppLocalState(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("localstate")
+	ch := make(chan [2]error)
+	app.HandleFunc(AppTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			if msg.Data().(AppTestMsg) == 1 {
+				_, derr := ctx.Dict("D").Get("0")
+				_, lerr := ctx.LocalState().Get("0")
+				ch <- [2]error{derr, lerr}
+				return nil
+			}
+			ctx.Dict("D").Put("0", 1)
+			ctx.LocalState().Put("0", 1)
+			return errors.New("abort the transaction")
+		})
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(AppTestMsg(0))
+	h.Emit(AppTestMsg(1))
+	errs := <-ch
+	if errs[0] != state.ErrNoSuchKey {
+		t.Errorf("the aborted put is in the state: %v", errs[0])
+	}
+	if errs[1] != nil {
+		t.Errorf("the local state is rolled back: %v", errs[1])
+	}
+}
+
+func TestAppSavepoint(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("savepoint")
+	ch := make(chan [2]error)
+	app.HandleFunc(AppTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			d := ctx.Dict("D")
+			d.Put("a", 1)
+			sp, err := ctx.Savepoint()
+			if err != nil {
+				return err
+			}
+			d.Put("b", 1)
+			if err := ctx.RollbackTo(sp); err != nil {
+				return err
+			}
+			_, aerr := d.Get("a")
+			_, berr := d.Get("b")
+			ch <- [2]error{aerr, berr}
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(AppTestMsg(0))
+	errs := <-ch
+	if errs[0] != nil {
+		t.Errorf("the put before the savepoint is rolled back: %v", errs[0])
+	}
+	if errs[1] == nil {
+		t.Errorf("the put after the savepoint is not rolled back")
+	}
+}
+
+type appTestReadMsg struct{}
+
+type appTestReadHandler struct {
+	ch chan [2]interface{}
+}
+
+func (h appTestReadHandler) Map(msg Msg, ctx MapContext) MappedCells {
+	return MappedCells{{"D", "0"}}
+}
+
+func (h appTestReadHandler) Rcv(msg Msg, ctx RcvContext) error {
+	v, _ := ctx.Dict("D").Get("0")
+	h.ch <- [2]interface{}{v, ctx.Dict("D").Put("0", 2)}
+	return nil
+}
+
+func TestAppReadOnly(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("readonly")
+	app.HandleFunc(AppTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			return ctx.Dict("D").Put("0", 1)
+		})
+	ch := make(chan [2]interface{})
+	app.Handle(appTestReadMsg{}, ReadOnly(appTestReadHandler{ch: ch}))
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(AppTestMsg(0))
+	h.Emit(appTestReadMsg{})
+	res := <-ch
+	if res[0] != 1 {
+		t.Errorf("invalid value in read-only handler: actual=%v want=1", res[0])
+	}
+	if res[1] != state.ErrReadOnly {
+		t.Errorf("read-only handler can write: %v", res[1])
+	}
+}
+
+func TestAppBatch(t *testing.T) {
+	h := newHiveForTest()
+	ch := make(chan int)
+	post := func(ops []state.Op, ctx RcvContext) {
+		ch <- len(ops)
+	}
+	app := h.NewApp("batch", Batch(3, time.Second), PostCommit(post))
+	app.HandleFunc(AppTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			k := fmt.Sprintf("%v", msg.Data())
+			return ctx.Dict("D").Put(k, true)
+		})
+
+	go h.Start()
+	defer h.Stop()
+
+	for i := 0; i < 3; i++ {
+		h.Emit(AppTestMsg(i))
+	}
+	if n := <-ch; n != 3 {
+		t.Errorf("invalid number of ops in the batch: actual=%v want=3", n)
+	}
+}
+
+type appTestBatchHandler struct {
+	ch chan [2]int
+}
+
+func (h appTestBatchHandler) Map(msg Msg, ctx MapContext) MappedCells {
+	return MappedCells{{"D", "0"}}
+}
+
+func (h appTestBatchHandler) Rcv(msg Msg, ctx RcvContext) error {
+	return errors.New("batch handler is called for a single message")
+}
+
+func (h appTestBatchHandler) RcvBatch(msgs []Msg, ctx RcvContext) error {
+	d := ctx.Dict("D")
+	sum := 0
+	if v, err := d.Get("sum"); err == nil {
+		sum = v.(int)
+	}
+	for _, m := range msgs {
+		sum += int(m.Data().(AppTestMsg))
+	}
+	h.ch <- [2]int{len(msgs), sum}
+	return d.Put("sum", sum)
+}
+
+func TestAppBatchHandler(t *testing.T) {
+	h := newHiveForTest()
+	ch := make(chan [2]int, 10)
+	app := h.NewApp("batchhandler", Batch(3, 100*time.Millisecond))
+	app.Handle(AppTestMsg(0), appTestBatchHandler{ch: ch})
+
+	go h.Start()
+	defer h.Stop()
+
+	for i := 1; i <= 3; i++ {
+		h.Emit(AppTestMsg(i))
+	}
+	if res := <-ch; res != [2]int{3, 6} {
+		t.Errorf("invalid batch: actual=%v want=[3 6]", res)
+	}
+
+	h.Emit(AppTestMsg(4))
+	if res := <-ch; res != [2]int{1, 10} {
+		t.Errorf("invalid batch: actual=%v want=[1 10]", res)
+	}
+}
+
+func TestAppTxTimeout(t *testing.T) {
+	h := newHiveForTest()
+	block := make(chan struct{})
+	ch := make(chan error)
+	app := h.NewApp("timeout", TxTimeout(100*time.Millisecond, true))
+	app.HandleFunc(AppTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			d := ctx.Dict("D")
+			if msg.Data().(AppTestMsg) == 0 {
+				d.Put("0", true)
+				<-block
+				ch <- d.Put("1", true)
+				return nil
+			}
+			_, err := d.Get("0")
+			ch <- err
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(AppTestMsg(0))
+	h.Emit(AppTestMsg(1))
+	if err := <-ch; err != state.ErrNoSuchKey {
+		t.Errorf("the timed out transaction is not aborted: %v", err)
+	}
+
+	// The abandoned handler cannot use its context anymore.
+	close(block)
+	if err := <-ch; err != ErrTxTimeout {
+		t.Errorf("abandoned handler can use its context: %v", err)
+	}
+}
+
+func TestAppTxTimeoutCallbacks(t *testing.T) {
+	h := newHiveForTest()
+	block := make(chan struct{})
+	defer close(block)
+	ch := make(chan AppTestMsg, 4)
+	app := h.NewApp("timeout", TxTimeout(100*time.Millisecond, true))
+	app.HandleFunc(AppTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			d := ctx.Dict("D")
+			switch msg.Data().(AppTestMsg) {
+			case 0:
+				d.ForEach(func(k string, v interface{}) bool {
+					<-block
+					return true
+				})
+			case 1:
+				ctx.Update(func(tx StateTx) error {
+					<-block
+					return nil
+				})
+			case 2:
+				d.Put("0", true)
+			}
+			ch <- msg.Data().(AppTestMsg)
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(AppTestMsg(2))
+	<-ch
+
+	// Handlers blocked in the callbacks of ForEach and Update are abandoned.
+	for _, m := range []AppTestMsg{0, 1} {
+		h.Emit(m)
+		h.Emit(AppTestMsg(2))
+		timeout := time.After(5 * time.Second)
+		for done := false; !done; {
+			select {
+			case r := <-ch:
+				done = r == 2
+			case <-timeout:
+				t.Fatalf("bee is blocked by the callback of message %v", m)
+			}
+		}
+	}
+}
+
+func TestAppAsyncReplication(t *testing.T) {
+	h := newHiveForTest()
+	ch := make(chan int)
+	app := h.NewApp("async", Persistent(1), Replication(ReplicateAsync))
+	app.HandleFunc(AppTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			d := ctx.Dict("D")
+			n := 0
+			if v, err := d.Get("n"); err == nil {
+				n = v.(int)
+			}
+			if msg.Data().(AppTestMsg) < 0 {
+				ch <- n
+				return nil
+			}
+			return d.Put("n", n+1)
+		})
+
+	go h.Start()
+	defer h.Stop()
+
+	for i := 0; i < 3; i++ {
+		h.Emit(AppTestMsg(i))
+	}
+	h.Emit(AppTestMsg(-1))
+	if n := <-ch; n != 3 {
+		t.Errorf("invalid value: actual=%v want=3", n)
+	}
+}
+
+func TestAppMigrateConcurrently(t *testing.T) {
+	ch := make(chan uint64)
+	register := func(h Hive) App {
+		a := h.NewApp("migrateconc")
+		a.HandleFunc(int(0), func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", strconv.Itoa(msg.Data().(int))}}
+		}, func(msg Msg, ctx RcvContext) error {
+			ch <- ctx.ID()
+			return nil
+		})
+		return a
+	}
+
+	h1 := newHiveForTest()
+	a1 := register(h1)
+	go h1.Start()
+	waitTilStareted(h1)
+	defer h1.Stop()
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	a2 := register(h2)
+	go h2.Start()
+	waitTilStareted(h2)
+	defer h2.Stop()
+
+	// Each hive creates local bees for the messages it emits.
+	const n = 4
+	var bees1, bees2 []uint64
+	for i := 0; i < n; i++ {
+		h1.Emit(i)
+		bees1 = append(bees1, <-ch)
+		h2.Emit(n + i)
+		bees2 = append(bees2, <-ch)
+	}
+
+	errs := make(chan error, 2*n)
+	migrate := func(a App, bees []uint64, to uint64) {
+		for _, b := range bees {
+			go func(b uint64) {
+				_, err := a.(*app).qee.processCmd(cmdMigrate{Bee: b, To: to})
+				errs <- err
+			}(b)
+		}
+	}
+	migrate(a1, bees1, h2.ID())
+	migrate(a2, bees2, h1.ID())
+
+	timeout := time.After(30 * time.Second)
+	for i := 0; i < 2*n; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Errorf("cannot migrate: %v", err)
+			}
+		case <-timeout:
+			t.Fatal("migrations are deadlocked")
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package beehive
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// BackpressurePolicy is what the bees of an application do with the messages
+// that arrive when their queue is full.
+type BackpressurePolicy int
+
+// Backpressure policies.
+const (
+	// BackpressureGrow queues the messages beyond the limit. This is the
+	// default policy.
+	BackpressureGrow BackpressurePolicy = iota
+	// BackpressureBlock blocks the sender (e.g., the queen of the application
+	// or the RPC server) until there is room in the queue. If there is no room
+	// in the timeout, the message is shed.
+	BackpressureBlock
+	// BackpressureShed sheds the messages immediately.
+	BackpressureShed
+)
+
+// Backpressure is an application option that limits the number of messages
+// queued for each bee of the application, and sets the policy for the
+// messages that arrive when the queue is full. The timeout is used only by
+// BackpressureBlock.
+//
+// Shed messages are added to the dead letters of the application. If the
+// application of the bee that emitted a shed message handles QueueFullError,
+// a QueueFullError is sent to that bee.
+func Backpressure(p BackpressurePolicy, limit uint,
+	timeout time.Duration) AppOption {
+
+	return func(a *app) {
+		a.pressure = appBackpressure{
+			policy:  p,
+			limit:   limit,
+			timeout: timeout,
+		}
+	}
+}
+
+type appBackpressure struct {
+	policy  BackpressurePolicy
+	limit   uint
+	timeout time.Duration
+}
+
+// QueueFullError is the error of a message that is shed because the queue of
+// its destination bee is full.
+type QueueFullError struct {
+	App   string // The application of the destination bee.
+	Bee   uint64 // The destination bee.
+	Type  string // The type of the shed message.
+	Trace uint64 // The trace of the shed message.
+}
+
+func (e QueueFullError) Error() string {
+	return fmt.Sprintf("queue of %v/%v is full: %v is shed", e.App, e.Bee,
+		e.Type)
+}
+
+// admit reserves room for the message in the queue of the bee, and returns
+// false if the message is shed.
+func (b *bee) admit(mh msgAndHandler) bool {
+	bp := b.app.pressure
+	if bp.limit == 0 || b.detached {
+		return true
+	}
+
+	if b.reserve(bp.limit) {
+		return true
+	}
+
+	switch bp.policy {
+	case BackpressureGrow:
+		atomic.AddInt64(&b.queued, 1)
+		overflowMsgs.WithLabelValues(b.app.Name()).Inc()
+		return true
+	case BackpressureBlock:
+		start := time.Now()
+		ok := b.waitForRoom(bp.limit, bp.timeout)
+		blockedTime.WithLabelValues(b.app.Name()).
+			Observe(time.Since(start).Seconds())
+		if ok {
+			return true
+		}
+	}
+
+	b.shed(mh)
+	return false
+}
+
+// reserve reserves room for a message if the bee has less than limit queued
+// messages.
+func (b *bee) reserve(limit uint) bool {
+	for {
+		n := atomic.LoadInt64(&b.queued)
+		if n >= int64(limit) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.queued, n, n+1) {
+			return true
+		}
+	}
+}
+
+// waitForRoom waits at most timeout for room in the queue of the bee.
+func (b *bee) waitForRoom(limit uint, timeout time.Duration) bool {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.room:
+			if !b.reserve(limit) {
+				continue
+			}
+			// Wake up the next sender, if there is still room.
+			if atomic.LoadInt64(&b.queued) < int64(limit) {
+				b.signalRoom()
+			}
+			return true
+		case <-t.C:
+			return false
+		}
+	}
+}
+
+// release releases the room of n messages dequeued by the bee.
+func (b *bee) release(n int) {
+	if b.app.pressure.limit == 0 || n == 0 {
+		return
+	}
+	atomic.AddInt64(&b.queued, -int64(n))
+	b.signalRoom()
+}
+
+func (b *bee) signalRoom() {
+	select {
+	case b.room <- struct{}{}:
+	default:
+	}
+}
+
+// shed drops the message, and notifies its emitter.
+func (b *bee) shed(mh msgAndHandler) {
+	shedMsgs.WithLabelValues(b.app.Name()).Inc()
+	err := QueueFullError{
+		App:   b.app.Name(),
+		Bee:   b.ID(),
+		Type:  mh.msg.Type(),
+		Trace: mh.msg.Trace(),
+	}
+	glog.V(2).Infof("%v sheds message %v", b, mh.msg)
+	b.app.deadLetters.add(mh, err)
+
+	from := mh.msg.From()
+	if from == Nil {
+		return
+	}
+	info, ierr := b.hive.bee(from)
+	if ierr != nil {
+		return
+	}
+	if a, ok := b.hive.app(info.App); !ok || a.handler(MsgType(err)) == nil {
+		return
+	}
+	b.hive.enqueMsg(&msg{MsgData: err, MsgTo: from})
+}
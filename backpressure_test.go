@@ -0,0 +1,81 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type backpressureTestMsg struct{}
+
+func newBeeForBackpressureTest(p BackpressurePolicy, limit uint,
+	timeout time.Duration) *bee {
+
+	a := &app{name: "backpressure", deadLetters: newDeadLetterQueue(10)}
+	Backpressure(p, limit, timeout)(a)
+	return &bee{beeID: 1, app: a, room: make(chan struct{}, 1)}
+}
+
+func TestBackpressureShed(t *testing.T) {
+	b := newBeeForBackpressureTest(BackpressureShed, 2, 0)
+	mh := msgAndHandler{msg: &msg{MsgData: backpressureTestMsg{}}}
+	for i := 0; i < 2; i++ {
+		if !b.admit(mh) {
+			t.Fatalf("message %v is shed before the queue is full", i)
+		}
+	}
+	if b.admit(mh) {
+		t.Fatal("message is not shed when the queue is full")
+	}
+
+	dl := b.app.DeadLetters()
+	if len(dl) != 1 {
+		t.Fatalf("invalid number of dead letters: actual=%v want=1", len(dl))
+	}
+	want := QueueFullError{App: "backpressure", Bee: 1,
+		Type: MsgType(backpressureTestMsg{})}
+	if dl[0].Err != want.Error() {
+		t.Errorf("invalid error of the shed message: actual=%v want=%v",
+			dl[0].Err, want)
+	}
+
+	b.release(1)
+	if !b.admit(mh) {
+		t.Error("message is shed after the queue is released")
+	}
+}
+
+func TestBackpressureBlock(t *testing.T) {
+	b := newBeeForBackpressureTest(BackpressureBlock, 1, time.Second)
+	mh := msgAndHandler{msg: &msg{MsgData: backpressureTestMsg{}}}
+	b.admit(mh)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		b.release(1)
+	}()
+	start := time.Now()
+	if !b.admit(mh) {
+		t.Fatal("message is shed while waiting for room")
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("sender is not blocked when the queue is full")
+	}
+
+	b.app.pressure.timeout = 10 * time.Millisecond
+	if b.admit(mh) {
+		t.Error("message is not shed after the timeout")
+	}
+}
+
+func TestBackpressureGrow(t *testing.T) {
+	b := newBeeForBackpressureTest(BackpressureGrow, 1, 0)
+	mh := msgAndHandler{msg: &msg{MsgData: backpressureTestMsg{}}}
+	for i := 0; i < 3; i++ {
+		if !b.admit(mh) {
+			t.Fatalf("message %v is shed", i)
+		}
+	}
+	if b.queued != 3 {
+		t.Errorf("invalid number of queued messages: actual=%v want=3", b.queued)
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
 
 	"github.com/kandoo/beehive/bucket"
+	bhgob "github.com/kandoo/beehive/gob"
 	"github.com/kandoo/beehive/raft"
 	"github.com/kandoo/beehive/state"
 )
@@ -28,6 +29,18 @@ const (
 	beeStatusStarted
 )
 
+// asyncReplicationBuf is the number of transactions buffered for asynchronous
+// replication.
+const asyncReplicationBuf = 1024
+
+// witnessHandoffTimeout is the number of election timeouts in which a witness
+// elected as the raft leader of its colony hands the leadership to a follower.
+const witnessHandoffTimeout = 10
+
+// followerPingTries is the number of pings after which a follower is
+// considered unreachable.
+const followerPingTries = 3
+
 var (
 	ErrOldTx       = errors.New("transaction has an old term")
 	ErrIsNotMaster = errors.New("bee is not master")
@@ -35,6 +48,8 @@ var (
 
 type bee struct {
 	sync.Mutex
+	// stateM guards the state of followers that serve reads.
+	stateM sync.RWMutex
 
 	beeID     uint64
 	beeColony Colony
@@ -54,6 +69,30 @@ type bee struct {
 	handleCmd func(cc cmdAndChannel)
 	batchSize uint
 	prxClient clientBackoff
+	// unacked has the messages sent by this proxy that are not acked yet.
+	unacked map[uint64]unackedMsg
+	ackSeq  uint64
+	// ackLow is the oldest sequence that may be unacked.
+	ackLow uint64
+	// streams are the streams of ordered messages received by the bee.
+	streams map[uint64]*inStream
+	// streamsSwept and orderSwept are when the idle streams of the bee were
+	// last expired from memory and from its state.
+	streamsSwept time.Time
+	orderSwept   time.Time
+	// dedupSwept is when the dedup sequences of the bee were last expired.
+	dedupSwept time.Time
+	// trace is the trace of the message being handled.
+	trace uint64
+	// queued is the number of messages in dataCh, and room is signaled when
+	// messages are dequeued. See Backpressure.
+	queued int64
+	room   chan struct{}
+	// syncing is set while anti-entropy runs in the background.
+	syncing int32
+	// active is when the bee last received a message, in nanoseconds. See
+	// Hibernate.
+	active int64
 
 	inBucket  *bucket.Bucket
 	outBucket *bucket.Bucket
@@ -61,13 +100,35 @@ type bee struct {
 	emitInRaft bool
 	raftTerm   uint64
 	txTerm     uint64
+	commitSeq  uint64
+	// txApplied has the sequence of the last applied transaction of each origin
+	// in txTerm.
+	txApplied map[uint64]uint64
+	// asyncCh has the transactions to be replicated in the background.
+	asyncCh chan commitTx
+	// evicted is the number of followers removed from the colony that are not
+	// replaced yet. Their replacements are throttled by the hive.
+	evicted int
 
 	stateL1  *state.Transactional
 	stateL2  *state.Transactional
 	msgBufL1 []*msg
 	msgBufL2 []*msg
 
-	local interface{}
+	local      interface{}
+	localState state.Dict
+
+	readOnly      bool
+	replicaSync   time.Time
+	txSeq         uint64
+	prepared      map[string]preparedTx
+	preparedCells map[CellKey]string
+	// abortedTxs are the distributed transactions aborted on this bee, and
+	// when they are forgotten.
+	abortedTxs map[string]time.Time
+	// distTxs are the distributed transactions coordinated in the current
+	// transaction.
+	distTxs []distTx
 }
 
 func (b *bee) ID() uint64 {
@@ -88,6 +149,10 @@ func (b *bee) String() string {
 }
 
 func (b *bee) Printf(format string, a ...interface{}) {
+	if b.trace != 0 {
+		fmt.Printf("%v[%x]> "+format, append([]interface{}{b, b.trace}, a...)...)
+		return
+	}
 	fmt.Printf("%v> "+format, append([]interface{}{b}, a...)...)
 }
 
@@ -102,6 +167,7 @@ func (b *bee) setColony(c Colony) {
 	b.Lock()
 	b.beeColony = c
 	b.Unlock()
+	updateColonyMetrics(b, c)
 }
 
 func (b *bee) isColonyNil() bool {
@@ -159,7 +225,9 @@ func (b *bee) createGroup() error {
 		StateMachine:   b,
 		Peers:          b.peers(),
 		DataDir:        b.statePath(),
-		SnapCount:      1024,
+		SnapCount:      b.hive.config.RaftSnapCount,
+		CatchUpEntries: b.hive.config.RaftCatchUp,
+		SnapOnJoin:     true,
 		FsyncTick:      b.hive.config.RaftFsyncTick,
 		ElectionTicks:  b.hive.config.RaftElectTicks,
 		HeartbeatTicks: b.hive.config.RaftHBTicks,
@@ -200,23 +268,41 @@ func (b *bee) ProcessStatusChange(sch interface{}) {
 			// just change the colony?
 			return
 		}
+		// Followers track the term as well, to reject the commands of deposed
+		// leaders.
+		b.setTerm(ev.Term)
 
 		oldc := b.colony()
 		oldi, err := b.hive.bee(oldc.Leader)
 		if err != nil {
-			glog.Fatalf("%v cannot find leader: %v", b, err)
-		}
-		if oldi.Hive == ev.New {
+			glog.Errorf("%v cannot find leader %v: %v", b, oldc.Leader, err)
+		} else if oldi.Hive == ev.New {
 			glog.V(2).Infof("%v has no need to change %v", b, oldc)
 			return
 		}
 
+		newi, err := b.fellowBeeOnHive(ev.New)
+		if err != nil {
+			glog.Errorf("%v cannot find the new leader: %v", b, err)
+			return
+		}
+
+		if oldc.IsWitness(newi.ID) {
+			// Witnesses have no state to lead the colony with. A witness is elected
+			// when no follower has the transactions committed by the old leader and
+			// the witness, and it hands the leadership over once a follower has
+			// caught up with its log.
+			if newi.ID == b.ID() {
+				go b.handoffWitness()
+			}
+			return
+		}
+
 		newc := oldc.DeepCopy()
 		if oldc.Leader != Nil {
 			newc.Leader = Nil
 			newc.AddFollower(oldc.Leader)
 		}
-		newi := b.fellowBeeOnHive(ev.New)
 		newc.DelFollower(newi.ID)
 		newc.Leader = newi.ID
 		b.setColony(newc)
@@ -227,8 +313,6 @@ func (b *bee) ProcessStatusChange(sch interface{}) {
 			return
 		}
 
-		b.setTerm(ev.Term)
-
 		go func() {
 			// FIXME(): add raft term to make sure it's versioned.
 			glog.V(2).Infof("%v is the new leader of %v", b, oldc)
@@ -239,36 +323,37 @@ func (b *bee) ProcessStatusChange(sch interface{}) {
 			}
 
 			// TODO(soheil): should we have a max retry?
-			_, err := b.hive.node.ProposeRetry(hiveGroup, up,
+			_, err := b.hive.proposeRetryAmongHives(up,
 				b.hive.config.RaftElectTimeout(), -1)
 			if err != nil {
 				glog.Errorf("%v cannot update its colony: %v", b, err)
+				return
+			}
+
+			// The old leader, and possibly other followers, may be unreachable.
+			if _, err := b.processCmd(cmdCheckFollowers{}); err != nil {
+				glog.Errorf("%v cannot check its followers: %v", b, err)
 			}
 		}()
-		// TODO(soheil): add health checks here and recruit if needed.
 	}
 }
 
-func (b *bee) fellowBeeOnHive(hive uint64) (fellow BeeInfo) {
+func (b *bee) fellowBeeOnHive(hive uint64) (fellow BeeInfo, err error) {
 	c := b.colony()
-	i, err := b.hive.bee(c.Leader)
-	if err != nil {
-		glog.Fatalf("%v cannot find leader %v", b, c.Leader)
-	}
-	if i.Hive == hive {
-		return i
+	if i, err := b.hive.bee(c.Leader); err == nil && i.Hive == hive {
+		return i, nil
 	}
 	for _, f := range c.Followers {
-		i, err = b.hive.bee(f)
+		i, err := b.hive.bee(f)
 		if err != nil {
-			glog.Fatalf("%v cannot find bee %v", b, f)
+			glog.Errorf("%v cannot find bee %v: %v", b, f, err)
+			continue
 		}
 		if i.Hive == hive {
-			return i
+			return i, nil
 		}
 	}
-	glog.Fatalf("%v cannot find fellow on hive %v", b, hive)
-	return
+	return BeeInfo{}, fmt.Errorf("%v cannot find fellow on hive %v", b, hive)
 }
 
 func (b *bee) statePath() string {
@@ -280,13 +365,21 @@ func (b *bee) isLeader() bool {
 	return b.beeColony.Leader == b.beeID
 }
 
-func (b *bee) addFollower(bid uint64, hid uint64) error {
+func (b *bee) isWitness() bool {
+	return b.beeColony.IsWitness(b.beeID)
+}
+
+func (b *bee) addFollower(bid uint64, hid uint64, witness bool) error {
 	oldc := b.colony()
 	if oldc.Leader != b.beeID {
 		return fmt.Errorf("%v is not the leader", b)
 	}
 	newc := oldc.DeepCopy()
-	if !newc.AddFollower(bid) {
+	add := newc.AddFollower
+	if witness {
+		add = newc.AddWitness
+	}
+	if !add(bid) {
 		return ErrDuplicateBee
 	}
 
@@ -314,23 +407,251 @@ func (b *bee) addFollower(bid uint64, hid uint64) error {
 	}
 
 	cmd := cmd{
-		Hive: hid,
-		App:  b.app.Name(),
-		Bee:  bid,
-		Data: cmdJoinColony{Colony: newc},
+		Hive:  hid,
+		App:   b.app.Name(),
+		Bee:   bid,
+		Data:  cmdJoinColony{Colony: newc},
+		Fence: b.fence(),
 	}
 	if _, err := b.hive.client.sendCmd(cmd); err != nil {
 		return err
 	}
 
+	if b.app.replMode == ReplicateChain && !witness {
+		if err := b.sendState(bid); err != nil {
+			return err
+		}
+	}
+
+	b.setColony(newc)
+	return nil
+}
+
+// delFollower removes a follower, for example a follower on a failed hive,
+// from the colony. This shrinks the colony, and the quorum of the colony is
+// recomputed accordingly.
+func (b *bee) delFollower(bid uint64, hid uint64) error {
+	oldc := b.colony()
+	if oldc.Leader != b.beeID {
+		return fmt.Errorf("%v is not the leader", b)
+	}
+	newc := oldc.DeepCopy()
+	if !newc.DelFollower(bid) {
+		return ErrNoSuchBee
+	}
+
+	t := 10 * b.hive.config.RaftElectTimeout()
+	cfgctx, cfgcnl := context.WithTimeout(context.Background(), t)
+	defer cfgcnl()
+	if err := b.hive.node.RemoveNodeFromGroup(cfgctx, hid, oldc.ID,
+		bid); err != nil {
+
+		return err
+	}
+
+	upctx, upcnl := context.WithTimeout(context.Background(), t)
+	defer upcnl()
+	up := updateColony{
+		Term: b.term(),
+		Old:  oldc,
+		New:  newc,
+	}
+	if _, err := b.hive.proposeAmongHives(upctx, up); err != nil {
+		glog.Errorf("%v cannot update its colony: %v", b, err)
+		return err
+	}
+
 	b.setColony(newc)
+	b.evicted++
+	glog.V(2).Infof("%v removed follower %v, the quorum is %v", b, bid,
+		newc.Quorum())
+	return nil
+}
+
+// checkFollowers evicts the followers that cannot be reached from the colony,
+// and recruits new followers in their place.
+func (b *bee) checkFollowers() error {
+	c := b.colony()
+	if c.Leader != b.ID() {
+		return ErrIsNotMaster
+	}
+
+	for _, f := range c.Followers {
+		info, err := b.hive.registry.bee(f)
+		if err != nil {
+			glog.Errorf("%v cannot find follower %v: %v", b, f, err)
+			continue
+		}
+		if b.followerReachable(f, info.Hive) {
+			continue
+		}
+		glog.Warningf("%v evicts unreachable follower %v on %v", b, f, info.Hive)
+		if err := b.delFollower(f, info.Hive); err != nil {
+			return err
+		}
+	}
+	return b.maybeRecruitFollowers()
+}
+
+// followerReachable returns whether the follower on the given hive is
+// reachable, that is whether it responds to a ping. The hive of the follower
+// may be alive while the follower is not, so the follower is always pinged.
+// The failure detector only speeds up the suspicion: a follower on a suspected
+// hive is unreachable if it does not respond to one ping, and other followers
+// are unreachable if they do not respond to followerPingTries pings.
+func (b *bee) followerReachable(f uint64, hive uint64) bool {
+	tries := followerPingTries
+	if phi, ok := b.hive.detector.phi(hive, time.Now()); ok &&
+		phi >= b.hive.config.PhiThresh {
+
+		glog.V(2).Infof("%v suspects hive %v of follower %v (phi=%.2f)", b, hive,
+			f, phi)
+		tries = 1
+	}
+	return b.pingFollower(f, tries)
+}
+
+func (b *bee) pingFollower(f uint64, tries int) bool {
+	t := 2 * b.hive.config.RaftElectTimeout()
+	for i := 0; i < tries; i++ {
+		if _, err := b.sendCmdWithTimeout(f, cmdPing{}, t); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sendCmdWithTimeout sends a command to the given bee, and fails if the bee
+// does not respond in time.
+func (b *bee) sendCmdWithTimeout(to uint64, cmd interface{},
+	timeout time.Duration) (interface{}, error) {
+
+	return cmdWithTimeout(timeout, func() (interface{}, error) {
+		return b.sendFencedCmd(to, cmd)
+	})
+}
+
+// fence returns the fencing token of the commands that the bee sends to its
+// colony.
+func (b *bee) fence() fence {
+	return fence{Colony: b.colony().ID, Term: b.term()}
+}
+
+// checkFence returns a StaleTermError if f is from a term older than the term
+// of the colony known by this bee.
+func (b *bee) checkFence(f fence) error {
+	if f.IsNil() {
+		return nil
+	}
+
+	b.Lock()
+	c := b.beeColony.ID
+	t := b.txTerm
+	b.Unlock()
+	if c != f.Colony {
+		return nil
+	}
+	if bt := b.term(); t < bt {
+		t = bt
+	}
+	if f.Term < t {
+		return StaleTermError{Colony: f.Colony, Term: f.Term, Current: t}
+	}
 	return nil
 }
 
+// sendFencedCmd sends a command to a bee of the colony. The command is
+// rejected if this bee is no longer the leader of the colony.
+//
+// If the command is rejected with a StaleTermError, this bee is deposed and
+// steps down.
+func (b *bee) sendFencedCmd(to uint64, data interface{}) (res interface{},
+	err error) {
+
+	f := b.fence()
+	defer func() {
+		if IsStaleTerm(err) {
+			b.stepDown(err)
+		}
+	}()
+
+	if lb, ok := b.qee.beeByID(to); ok {
+		if err = b.hive.registry.checkFence(f); err != nil {
+			return nil, err
+		}
+		ch := make(chan cmdResult)
+		cc := newCmdAndChannel(data, b.hive.ID(), b.app.Name(), to, ch)
+		cc.cmd.Fence = f
+		lb.enqueCmd(cc)
+		return (<-ch).get()
+	}
+
+	info, err := b.hive.registry.bee(to)
+	if err != nil {
+		return nil, err
+	}
+	return b.hive.client.sendCmd(cmd{
+		Hive:  info.Hive,
+		App:   info.App,
+		Bee:   info.ID,
+		Data:  data,
+		Fence: f,
+	})
+}
+
+// stepDown reloads the colony of a deposed leader from the registry, and
+// refreshes its role.
+func (b *bee) stepDown(err error) {
+	glog.Warningf("%v is deposed: %v", b, err)
+	info, rerr := b.hive.registry.bee(b.ID())
+	if rerr != nil {
+		glog.Errorf("%v cannot find itself in the registry: %v", b, rerr)
+		return
+	}
+	if info.Colony.Leader == b.ID() {
+		// The registry of this hive is not updated yet.
+		return
+	}
+	b.setColony(info.Colony)
+	go b.processCmd(cmdRefreshRole{})
+}
+
 func (b *bee) setState(s state.State) {
 	b.stateL1 = state.NewTransactional(s)
 }
 
+// sqlState returns the SQL state of the bee, if any.
+func (b *bee) sqlState() (*state.SQL, bool) {
+	if b.stateL1 == nil {
+		return nil, false
+	}
+	s, ok := b.stateL1.State.(*state.SQL)
+	return s, ok
+}
+
+// attachState makes the bee write its SQL state to the database. Only the
+// leader of a colony writes its state, so that the state of a colony is stored
+// once.
+func (b *bee) attachState() {
+	if s, ok := b.sqlState(); ok {
+		if err := s.Attach(); err != nil {
+			glog.Errorf("%v cannot write its state to the database: %v", b,
+				err)
+		}
+	}
+}
+
+// detachState keeps the SQL state of the bee in memory and deletes its rows
+// from the database.
+func (b *bee) detachState() {
+	if s, ok := b.sqlState(); ok {
+		if err := s.Detach(); err != nil {
+			glog.Errorf("%v cannot delete its state from the database: %v", b,
+				err)
+		}
+	}
+}
+
 func (b *bee) startDetached(h DetachedHandler) {
 	if !b.detached {
 		glog.Fatalf("%v is not detached", b)
@@ -342,13 +663,25 @@ func (b *bee) startDetached(h DetachedHandler) {
 				glog.Errorf("%v recovers from an error in Start(): %v", b, r)
 			}
 		}()
-		h.Start(b)
+		h.Start(detachedStartCtx{b})
 	}()
 	defer h.Stop(b)
 
 	b.start()
 }
 
+// detachedStartCtx is the context passed to the Start method of a detached
+// handler, which runs outside of the bee's goroutine.
+type detachedStartCtx struct {
+	*bee
+}
+
+// Update runs fn on the bee's goroutine.
+func (c detachedStartCtx) Update(fn func(tx StateTx) error) error {
+	_, err := c.processCmd(cmdUpdate{Fn: fn})
+	return err
+}
+
 func (b *bee) start() {
 	if !b.proxy && !b.isColonyNil() && b.app.persistent() {
 		if err := b.createGroup(); err != nil {
@@ -374,7 +707,47 @@ func (b *bee) start() {
 	var inT <-chan time.Time
 	var outT <-chan time.Time
 
+	var compactT <-chan time.Time
+	if t := b.hive.config.CompactTick; t > 0 && !b.proxy {
+		ticker := time.NewTicker(t)
+		defer ticker.Stop()
+		compactT = ticker.C
+	}
+
+	var redeliverT <-chan time.Time
+	if t := b.app.ackTimeout; t > 0 {
+		ticker := time.NewTicker(t)
+		defer ticker.Stop()
+		redeliverT = ticker.C
+	}
+
+	var reorderT <-chan time.Time
+	if t := b.app.fifoWait; t > 0 && !b.detached {
+		ticker := time.NewTicker(t)
+		defer ticker.Stop()
+		reorderT = ticker.C
+	}
+
+	// splits are the cell splits dequeued with the batch. See qee.split.
+	var splits []msgAndHandler
+
+	var antiEntropyT <-chan time.Time
+	if t := b.hive.config.AntiEntropyTick; t > 0 && !b.proxy &&
+		b.app.persistent() {
+
+		ticker := time.NewTicker(t)
+		defer ticker.Stop()
+		antiEntropyT = ticker.C
+	}
+
 	for b.status == beeStatusStarted {
+		if b.drainCtrl(inT == nil && outT == nil) {
+			return
+		}
+		if b.status != beeStatusStarted {
+			break
+		}
+
 		select {
 		case mh := <-dataCh:
 			batch = append(batch, mh)
@@ -387,6 +760,18 @@ func (b *bee) start() {
 					break loop
 				}
 			}
+			if w := b.app.batch.wait; w > 0 {
+				batch = b.waitForBatch(dataCh, batch, w)
+			}
+			batch, splits = takeSplits(batch, splits)
+			b.release(len(batch))
+			prioritize(batch)
+			batch = dropExpired(b.app.Name(), batch, time.Now())
+			batch = b.reorder(batch, time.Now())
+			if len(batch) == 0 {
+				splits = b.splitCells(splits)
+				break
+			}
 
 			t := uint64(len(batch))
 			if !b.inBucket.Get(t) {
@@ -395,18 +780,47 @@ func (b *bee) start() {
 				break
 			}
 
+			b.touch(time.Now())
 			b.handleMsg(batch)
+			b.maybeAckMsgs(batch)
+			b.maybeSendReceipts(batch)
 			batch = clearBatch(batch)
+			b.maybeCompact()
+			splits = b.splitCells(splits)
 
 		case <-inT:
 			if !b.inBucket.Get(uint64(len(batch))) {
 				glog.Fatalf("cannot get tokens after the wait")
 			}
 			b.handleMsg(batch)
+			b.maybeAckMsgs(batch)
+			b.maybeSendReceipts(batch)
 			batch = clearBatch(batch)
+			b.maybeCompact()
+			splits = b.splitCells(splits)
 			dataCh = b.dataCh.out()
 			inT = nil
 
+		case <-compactT:
+			b.compact(0)
+
+		case <-antiEntropyT:
+			b.antiEntropy()
+
+		case <-redeliverT:
+			b.redeliver()
+
+		case <-reorderT:
+			now := time.Now()
+			if b.proxy {
+				now = time.Time{}
+			}
+			if mhs := b.expireStreams(now); len(mhs) != 0 {
+				b.handleMsg(mhs)
+				b.maybeAckMsgs(mhs)
+				b.maybeSendReceipts(mhs)
+			}
+
 		case outM = <-outCh:
 			l := uint64(len(outM))
 			if b.outBucket.Get(l) {
@@ -426,9 +840,94 @@ func (b *bee) start() {
 			outT = nil
 
 		case c := <-b.ctrlCh:
-			b.handleCmd(c)
+			if b.handleCtrl(c, inT == nil && outT == nil) {
+				return
+			}
+		}
+	}
+}
+
+// handleCtrl handles a command of the bee, and returns whether the bee is
+// hibernated. idle is whether the bee is not waiting for rate limits.
+func (b *bee) handleCtrl(c cmdAndChannel, idle bool) (hibernated bool) {
+	if _, ok := c.cmd.Data.(cmdHibernate); ok {
+		r := b.hibernate(idle)
+		c.ch <- r
+		// The bee may be revived as soon as the queen receives r.
+		return r.Err == nil
+	}
+	b.handleCmd(c)
+	return false
+}
+
+// drainCtrl handles the pending commands of the bee, and returns whether the
+// bee is hibernated. It is called before waiting on the channels of the bee,
+// so that commands such as stop and migrate are not starved by a backlog of
+// messages.
+func (b *bee) drainCtrl(idle bool) (hibernated bool) {
+	for b.status == beeStatusStarted {
+		select {
+		case c := <-b.ctrlCh:
+			if b.handleCtrl(c, idle) {
+				return true
+			}
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// maybeCompact compacts the state of the bee if it has more garbage than the
+// compaction threshold of the hive.
+func (b *bee) maybeCompact() {
+	if t := b.hive.config.CompactThresh; t != 0 {
+		b.compact(t)
+	}
+}
+
+// compact drops the tombstones and stale transaction artifacts of the bee's
+// state, if the state has at least min bytes of garbage. The state is
+// compacted under the same locks as Apply, since the raft applier writes the
+// state concurrently.
+func (b *bee) compact(min uint) {
+	b.stateM.Lock()
+	defer b.stateM.Unlock()
+	b.Lock()
+	defer b.Unlock()
+
+	if b.stateL1 == nil {
+		return
+	}
+	if g := b.stateL1.Garbage(); g == 0 || uint(g) < min {
+		return
+	}
+
+	n := b.stateL1.Compact()
+	compactions.WithLabelValues(b.app.Name()).Inc()
+	compactedBytes.WithLabelValues(b.app.Name()).Add(float64(n))
+	glog.V(2).Infof("%v reclaimed %v bytes in compaction", b, n)
+}
+
+// waitForBatch waits at most d for the batch to fill up.
+func (b *bee) waitForBatch(dataCh <-chan msgAndHandler, batch []msgAndHandler,
+	d time.Duration) []msgAndHandler {
+
+	if uint(len(batch)) >= b.batchSize {
+		return batch
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	for uint(len(batch)) < b.batchSize {
+		select {
+		case mh := <-dataCh:
+			batch = append(batch, mh)
+		case <-t.C:
+			return batch
 		}
 	}
+	return batch
 }
 
 func clearBatch(batch []msgAndHandler) []msgAndHandler {
@@ -438,8 +937,7 @@ func clearBatch(batch []msgAndHandler) []msgAndHandler {
 	return batch[0:0]
 }
 
-func (b *bee) recoverFromError(mh msgAndHandler, err interface{},
-	stack bool) {
+func (b *bee) recoverFromError(mh msgAndHandler, err interface{}) {
 	b.AbortTx()
 
 	if d, ok := err.(time.Duration); ok {
@@ -448,9 +946,7 @@ func (b *bee) recoverFromError(mh msgAndHandler, err interface{},
 	}
 
 	glog.Errorf("error in %s for %s: %v", b.app.Name(), mh.msg.Type(), err)
-	if stack {
-		glog.Errorf("%s", debug.Stack())
-	}
+	b.app.deadLetters.add(mh, err)
 }
 
 var (
@@ -458,18 +954,37 @@ var (
 )
 
 func (b *bee) callRcv(mh msgAndHandler) (err error) {
+	if !b.beforeRcv(&mh) {
+		return nil
+	}
+
+	b.trace = mh.msg.MsgTrace
 	defer func() {
+		b.trace = 0
 		if r := recover(); r != nil {
-			b.recoverFromError(mh, r, true)
+			b.recoverFromPanic(mh, r, debug.Stack())
 		}
 		err = errRcv
 	}()
 
-	if err := mh.handler.Rcv(mh.msg, b); err != nil {
-		b.recoverFromError(mh, err, false)
+	var rerr error
+	if b.app.txTimeout.d > 0 {
+		rerr = b.rcvWithTimeout(mh.msg.Type(), func(ctx RcvContext) error {
+			return mh.handler.Rcv(mh.msg, ctx)
+		})
+	} else {
+		rerr = mh.handler.Rcv(mh.msg, b)
+	}
+	if rerr != nil {
+		b.recoverFromError(mh, rerr)
 		return errRcv
 	}
 
+	b.collect(mh.msg)
+	return nil
+}
+
+func (b *bee) collect(m *msg) {
 	// FIXME(soheil): Provenence works only when the application is transactional.
 	var msgs []*msg
 	if b.stateL2 != nil {
@@ -477,28 +992,101 @@ func (b *bee) callRcv(mh msgAndHandler) (err error) {
 	} else {
 		msgs = b.msgBufL1
 	}
-	b.hive.collector.collect(b.beeID, mh.msg, msgs)
-	return nil
+	b.hive.collector.collect(b.beeID, m, msgs)
+}
+
+// callRcvBatch calls the batch handler of mhs for all the messages at once.
+func (b *bee) callRcvBatch(mhs []msgAndHandler) {
+	b.trace = mhs[0].msg.MsgTrace
+	defer func() {
+		b.trace = 0
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			for i := range mhs {
+				b.recoverFromPanic(mhs[i], r, stack)
+			}
+		}
+	}()
+
+	h := mhs[0].handler.(BatchHandler)
+	msgs := make([]Msg, len(mhs))
+	for i := range mhs {
+		msgs[i] = mhs[i].msg
+	}
+
+	var rerr error
+	if b.app.txTimeout.d > 0 {
+		rerr = b.rcvWithTimeout(mhs[0].msg.Type(), func(ctx RcvContext) error {
+			return h.RcvBatch(msgs, ctx)
+		})
+	} else {
+		rerr = h.RcvBatch(msgs, b)
+	}
+	if rerr != nil {
+		for i := range mhs {
+			b.recoverFromError(mhs[i], rerr)
+		}
+		return
+	}
+
+	for i := range mhs {
+		b.collect(mhs[i].msg)
+	}
+}
+
+// batchEnd returns the end of the run of messages starting at i that are of
+// the same type and are handled by a batch handler.
+func batchEnd(mhs []msgAndHandler, i int) int {
+	if !isBatch(mhs[i].handler) {
+		return i + 1
+	}
+
+	t := mhs[i].msg.Type()
+	j := i + 1
+	for j < len(mhs) && mhs[j].msg.Type() == t && isBatch(mhs[j].handler) {
+		j++
+	}
+	return j
 }
 
 func (b *bee) handleMsgLeader(mhs []msgAndHandler) {
 
 	usetx := b.app.transactional()
+	if usetx && allReadOnly(mhs) {
+		b.handleMsgReadOnly(mhs)
+		return
+	}
+
 	if usetx && len(mhs) > 1 {
 		b.stateL2 = state.NewTransactional(b.stateL1)
 		b.stateL1.BeginTx()
 	}
 
-	for i := range mhs {
+	for i := 0; i < len(mhs); {
 		if usetx {
 			b.BeginTx()
 		}
 
-		mh := mhs[i]
-		if glog.V(2) {
-			glog.Infof("%v handles message %v", b, mh.msg)
+		j := batchEnd(mhs, i)
+		if isBatch(mhs[i].handler) {
+			b.handleBatch(mhs[i:j], usetx)
+		} else {
+			mh := mhs[i]
+			if glog.V(2) {
+				glog.Infof("%v handles message %v", b, mh.msg)
+			}
+			if usetx && b.isDuplicate(mh.msg) {
+				glog.V(2).Infof("%v drops duplicate message %v", b, mh.msg)
+			} else {
+				if usetx {
+					b.recordOrder(mh.msg)
+				}
+				b.readOnly = isReadOnly(mh.handler)
+				b.callRcv(mh)
+				b.readOnly = false
+			}
 		}
-		b.callRcv(mh)
+		i = j
 
 		if usetx {
 			var err error
@@ -529,6 +1117,53 @@ func (b *bee) handleMsgLeader(mhs []msgAndHandler) {
 	}
 }
 
+// handleBatch handles the messages of a batch handler in one call.
+func (b *bee) handleBatch(mhs []msgAndHandler, usetx bool) {
+	batch := make([]msgAndHandler, 0, len(mhs))
+	for _, mh := range mhs {
+		if usetx && b.isDuplicate(mh.msg) {
+			glog.V(2).Infof("%v drops duplicate message %v", b, mh.msg)
+			continue
+		}
+		if !b.beforeRcv(&mh) {
+			continue
+		}
+		if usetx {
+			b.recordOrder(mh.msg)
+		}
+		batch = append(batch, mh)
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	glog.V(2).Infof("%v handles a batch of %v messages of %v", b, len(batch),
+		batch[0].msg.Type())
+	b.callRcvBatch(batch)
+}
+
+func allReadOnly(mhs []msgAndHandler) bool {
+	for i := range mhs {
+		if !isReadOnly(mhs[i].handler) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleMsgReadOnly handles messages of read-only handlers without any
+// transaction. Messages emitted by the handlers are not buffered.
+func (b *bee) handleMsgReadOnly(mhs []msgAndHandler) {
+	b.readOnly = true
+	for i := range mhs {
+		if glog.V(2) {
+			glog.Infof("%v handles read-only message %v", b, mhs[i].msg)
+		}
+		b.callRcv(mhs[i])
+	}
+	b.readOnly = false
+}
+
 func (b *bee) group() uint64 {
 	b.Lock()
 	g := b.beeColony.ID
@@ -540,9 +1175,23 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 	glog.V(2).Infof("%v handles command %v", b, cc.cmd)
 	var err error
 	var data interface{}
+	if err = b.checkFence(cc.cmd.Fence); err != nil {
+		glog.Warningf("%v rejects %v: %v", b, cc.cmd, err)
+		if cc.ch != nil {
+			cc.ch <- cmdResult{Err: err}
+		}
+		return
+	}
+
 	switch cmd := cc.cmd.Data.(type) {
 	case cmdStop:
 		b.status = beeStatusStopped
+		b.hive.timers.cancel(b.ID())
+		b.detachState()
+		if b.asyncCh != nil {
+			close(b.asyncCh)
+			b.asyncCh = nil
+		}
 		b.disableEmit()
 		glog.V(2).Infof("%v stopped", b)
 
@@ -550,11 +1199,51 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 		b.status = beeStatusStarted
 		glog.V(2).Infof("%v started", b)
 
+	case cmdAckMsgs:
+		b.handleAck(cmd.Seqs)
+
 	case cmdSync:
 		err = b.raftBarrier()
 
 	case cmdRestoreState:
-		err = b.stateL1.Restore(cmd.State)
+		if err = b.stateL1.Restore(cmd.State); err == nil && b.isLeader() {
+			b.scheduleTimers()
+		}
+
+	case cmdSaveState:
+		data, err = b.stateL1.Save()
+
+	case cmdUpdate:
+		err = b.Update(cmd.Fn)
+
+	case cmdPing:
+
+	case cmdCheckFollowers:
+		err = b.checkFollowers()
+
+	case cmdChainTx:
+		// The result is sent once the rest of the chain applies the transaction.
+		b.applyChainTx(cmd.Tx, cmd.Chain, cc.ch)
+		return
+
+	case cmdStateDigest:
+		data = b.stateDigest(b.colony().Leader)
+
+	case cmdSaveDict:
+		data, err = b.saveDict(cmd.Dict)
+
+	case cmdRepairDict:
+		err = b.repairDict(cmd.Dict, cmd.State)
+
+	case cmdLogInfo:
+		if !b.app.persistent() {
+			err = fmt.Errorf("%v is not replicated", b)
+			break
+		}
+		ctx, cnl := context.WithTimeout(context.Background(),
+			b.hive.config.RaftElectTimeout())
+		data, err = b.hive.node.LogInfo(ctx, b.group())
+		cnl()
 
 	case cmdCampaign:
 		ctx, cnl := context.WithTimeout(context.Background(),
@@ -563,7 +1252,30 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 		cnl()
 
 	case cmdHandoff:
-		err = b.handoff(cmd.To)
+		to := cmd.To
+		if to == Nil {
+			if to, err = b.handoffTarget(); err != nil {
+				break
+			}
+		}
+		if !b.app.persistent() && b.handoffInBackground(to, cc.ch) {
+			// The result is sent when the handoff is completed.
+			return
+		}
+		if err = b.handoff(to); err == nil {
+			data = to
+		}
+
+	case cmdCompleteHandoff:
+		err = b.completeHandoff(cmd.To, cmd.Err)
+
+	case cmdApplyOps:
+		if err = b.stateL1.Apply(cmd.Ops); err == nil && b.isLeader() {
+			b.scheduleTimers()
+		}
+
+	case cmdCommitPrepared:
+		err = b.commitPrepared(cmd.ID)
 
 	case cmdJoinColony:
 		if !cmd.Colony.Contains(b.ID()) {
@@ -591,14 +1303,19 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 
 	case cmdRefreshRole:
 		c := b.colony()
-		if c.Leader == b.ID() {
+		if c.IsNil() {
+			b.becomeZombie()
+		} else if c.Leader == b.ID() {
 			b.becomeLeader()
 		} else {
 			b.becomeFollower()
 		}
 
 	case cmdAddFollower:
-		err = b.addFollower(cmd.Bee, cmd.Hive)
+		err = b.addFollower(cmd.Bee, cmd.Hive, false)
+
+	case cmdDelFollower:
+		err = b.delFollower(cmd.Bee, cmd.Hive)
 
 	default:
 		err = fmt.Errorf("unknown bee command %#v", cmd)
@@ -617,7 +1334,9 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 }
 
 func (b *bee) becomeLeader() {
+	b.attachState()
 	b.handleMsg, b.handleCmd = b.leaderHandlers()
+	b.scheduleTimers()
 }
 
 func (b *bee) leaderHandlers() (func(mhs []msgAndHandler),
@@ -635,6 +1354,7 @@ func (b *bee) dropMsg(mhs []msgAndHandler) {
 }
 
 func (b *bee) becomeFollower() {
+	b.detachState()
 	b.handleMsg, b.handleCmd = b.followerHandlers()
 }
 
@@ -652,9 +1372,81 @@ func (b *bee) followerHandlers() (func(mhs []msgAndHandler),
 	}
 
 	mfn, _ := b.proxyHandlers(c.Leader)
+	if b.app.readRepl.enabled {
+		return func(mhs []msgAndHandler) {
+			b.handleMsgReplica(mhs, mfn)
+		}, b.handleCmdLocal
+	}
 	return mfn, b.handleCmdLocal
 }
 
+// handleMsgReplica handles the messages of read-only handlers on a follower,
+// and forwards the rest to the leader using proxy.
+func (b *bee) handleMsgReplica(mhs []msgAndHandler,
+	proxy func(mhs []msgAndHandler)) {
+
+	var ro, fwd []msgAndHandler
+	for i := range mhs {
+		if isReadOnly(mhs[i].handler) {
+			ro = append(ro, mhs[i])
+		} else {
+			fwd = append(fwd, mhs[i])
+		}
+	}
+
+	if len(fwd) != 0 {
+		proxy(fwd)
+	}
+
+	if len(ro) == 0 {
+		return
+	}
+
+	if time.Since(b.replicaSync) > b.app.readRepl.staleness {
+		if err := b.syncReplica(); err != nil {
+			glog.Errorf("%v cannot sync with its leader: %v", b, err)
+			proxy(ro)
+			return
+		}
+		b.replicaSync = time.Now()
+	}
+
+	b.stateM.RLock()
+	b.handleMsgReadOnly(ro)
+	b.stateM.RUnlock()
+}
+
+// syncReplica waits until the follower applies the transactions committed by
+// the leader of its colony so far. The commit index of the leader is its read
+// index: once the follower applies the log up to that index, it can serve the
+// reads that have started before the sync.
+func (b *bee) syncReplica() error {
+	t := b.hive.config.RaftElectTimeout()
+	res, err := b.sendCmdWithTimeout(b.colony().Leader, cmdLogInfo{}, t)
+	if err != nil {
+		return err
+	}
+	idx := res.(raft.LogInfo).Commit
+
+	deadline := time.Now().Add(t)
+	for {
+		ctx, cnl := context.WithTimeout(context.Background(), t)
+		info, err := b.hive.node.LogInfo(ctx, b.group())
+		cnl()
+		if err != nil {
+			return err
+		}
+		if info.Applied >= idx {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%v has applied up to %v instead of %v", b,
+				info.Applied, idx)
+		}
+		time.Sleep(b.hive.config.RaftTick)
+	}
+}
+
 func (b *bee) becomeProxy() {
 	b.proxy = true
 	b.handleMsg, b.handleCmd = b.proxyHandlers(b.ID())
@@ -669,6 +1461,16 @@ func (b *bee) proxyHandlers(to uint64) (func(mhs []msgAndHandler),
 	}
 
 	mfn := func(mhs []msgAndHandler) {
+		// Messages are tracked before sending, so that they are redelivered if
+		// they cannot be sent.
+		msgs := make([]msg, 0, len(mhs))
+		for i := range mhs {
+			msg := *(mhs[i].msg)
+			msg.MsgTo = to
+			b.trackAck(&msg)
+			msgs = append(msgs, msg)
+		}
+
 		if !b.prxClient.backoff.Equal(time.Time{}) &&
 			time.Now().Before(b.prxClient.backoff) {
 
@@ -676,8 +1478,15 @@ func (b *bee) proxyHandlers(to uint64) (func(mhs []msgAndHandler),
 			return
 		}
 
+		// The messages are redelivered once the circuit to the hive is closed.
+		if err := b.hive.client.allow(bi.Hive); err != nil {
+			glog.V(2).Infof("%v cannot send message: %v", b, err)
+			return
+		}
+
 		if b.prxClient.client == nil {
 			c, err := b.hive.client.beeClient(to)
+			b.hive.client.done(bi.Hive, err)
 			if err != nil {
 				if berr, ok := err.(*rpcBackoffError); ok {
 					b.prxClient = clientBackoff{backoff: berr.Until}
@@ -688,22 +1497,35 @@ func (b *bee) proxyHandlers(to uint64) (func(mhs []msgAndHandler),
 			b.prxClient = clientBackoff{client: c}
 		}
 
-		msgs := make([]msg, 0, len(mhs))
-		for i := range mhs {
-			msg := *(mhs[i].msg)
-			msg.MsgTo = to
-			msgs = append(msgs, msg)
+		if mhs, msgs = b.toRemoteSchemas(mhs, msgs); len(msgs) == 0 {
+			return
+		}
+		if mhs, msgs = b.encryptMsgs(mhs, msgs); len(msgs) == 0 {
+			return
 		}
 
 		for {
-			if err := b.prxClient.client.sendMsg(msgs); err == nil {
+			err := b.prxClient.client.sendMsg(msgs)
+			b.hive.client.done(bi.Hive, err)
+			if err == nil {
 				return
 			}
 
-			// Maybe a second try, if the previous connection is closed.
-			if b.prxClient.client, err = b.hive.client.resetBeeClient(to,
-				b.prxClient.client); err != nil {
+			if d, ok := pushedBack(err); ok {
+				b.retryPushedBack(mhs, msgs, d)
+				return
+			}
+
+			if err := b.hive.client.allow(bi.Hive); err != nil {
+				glog.Errorf("%v cannot send message: %v", b, err)
+				return
+			}
 
+			// Maybe a second try, if the previous connection is closed.
+			b.prxClient.client, err = b.hive.client.resetBeeClient(to,
+				b.prxClient.client)
+			if err != nil {
+				b.hive.client.done(bi.Hive, err)
 				glog.Errorf("%v cannot send message: %v", b, err)
 				return
 			}
@@ -712,7 +1534,7 @@ func (b *bee) proxyHandlers(to uint64) (func(mhs []msgAndHandler),
 
 	cfn := func(cc cmdAndChannel) {
 		switch cc.cmd.Data.(type) {
-		case cmdStop, cmdStart:
+		case cmdStop, cmdStart, cmdAckMsgs:
 			b.handleCmdLocal(cc)
 		default:
 			cc.cmd.Hive = bi.Hive
@@ -746,11 +1568,17 @@ func (b *bee) detachedHandlers(h DetachedHandler) (func(mhs []msgAndHandler),
 
 func (b *bee) enqueMsg(mh msgAndHandler) {
 	glog.V(3).Infof("%v enqueues message %v", b, mh.msg)
+	if !b.admit(mh) {
+		return
+	}
 	b.dataCh.in() <- mh
 }
 
 func (b *bee) enqueCmd(cc cmdAndChannel) {
 	glog.V(3).Infof("%v enqueues a command %v", b, cc)
+	if !b.proxy && b.handleTxCmd(cc) {
+		return
+	}
 	b.ctrlCh <- cc
 }
 
@@ -779,8 +1607,8 @@ func (b *bee) addMappedCells(cells MappedCells) {
 		b.cells = make(map[CellKey]bool)
 	}
 
+	glog.V(2).Infof("Adding cells %v to %v", cells, b)
 	for _, c := range cells {
-		glog.V(2).Infof("Adding cell %v to %v", c, b)
 		b.cells[c] = true
 	}
 }
@@ -821,6 +1649,9 @@ func (b *bee) Hive() Hive {
 
 func (b *bee) Dict(n string) state.Dict {
 	dicts, _ := b.currentState()
+	if b.readOnly {
+		return state.ReadOnly(dicts).Dict(n)
+	}
 	return dicts.Dict(n)
 }
 
@@ -863,6 +1694,10 @@ func (b *bee) throttle(msgs []*msg) {
 }
 
 func (b *bee) bufferOrEmit(m *msg) {
+	if m.MsgTrace == 0 {
+		m.MsgTrace = b.trace
+	}
+
 	dicts, msgs := b.currentState()
 	if dicts.TxStatus() != state.TxOpen {
 		b.throttle([]*msg{m})
@@ -912,6 +1747,13 @@ func (b *bee) BeeLocal() interface{} {
 	return b.local
 }
 
+func (b *bee) LocalState() state.Dict {
+	if b.localState == nil {
+		b.localState = state.NewInMem().Dict(localStateDict)
+	}
+	return b.localState
+}
+
 func (b *bee) Sync(ctx context.Context, req interface{}) (res interface{},
 	err error) {
 
@@ -947,7 +1789,7 @@ func (b *bee) BeginTx() error {
 	return nil
 }
 
-func (b *bee) commitTxBothLayers() (err error) {
+func (b *bee) commitTxBothLayers() (ops []state.Op, err error) {
 	hasL2 := b.stateL2 != nil
 	if hasL2 {
 		if err = b.stateL2.CommitTx(); err != nil {
@@ -955,7 +1797,14 @@ func (b *bee) commitTxBothLayers() (err error) {
 		}
 	}
 
+	if err = b.preCommit(b.stateL1.TxOps()); err != nil {
+		goto reset
+	}
+
+	ops = b.stateL1.TxOps()
+	b.msgBufL1 = append(b.msgBufL1, b.dictChanges(ops)...)
 	if err = b.stateL1.CommitTx(); err != nil {
+		ops = nil
 		goto reset
 	}
 
@@ -963,6 +1812,7 @@ func (b *bee) commitTxBothLayers() (err error) {
 	if hasL2 {
 		b.throttle(b.msgBufL2)
 	}
+	b.postCommit(ops)
 
 reset:
 	if hasL2 {
@@ -991,6 +1841,7 @@ func (b *bee) commitTxL2() (err error) {
 	}
 	if err = b.stateL2.CommitTx(); err == nil {
 		b.msgBufL1 = append(b.msgBufL1, b.msgBufL2...)
+		b.promoteDistTxs()
 	}
 	b.resetTx(b.stateL2, &b.msgBufL2)
 	return
@@ -1031,6 +1882,13 @@ func (b *bee) replicate() error {
 
 	b.Unlock()
 
+	if err := b.preCommit(stx.Ops); err != nil {
+		b.AbortTx()
+		return err
+	}
+	stx = b.stateL1.Tx()
+	b.msgBufL1 = append(b.msgBufL1, b.dictChanges(stx.Ops)...)
+
 	if err := b.maybeRecruitFollowers(); err != nil {
 		return err
 	}
@@ -1044,18 +1902,91 @@ func (b *bee) replicate() error {
 	ctx, cnl := context.WithTimeout(context.Background(),
 		10*b.hive.config.RaftElectTimeout())
 	defer cnl()
+	b.commitSeq++
 	commit := commitTx{
-		Tx:   tx,
-		Term: b.term(),
-	}
-	if _, err := b.hive.node.Propose(ctx, b.group(), commit); err != nil {
-		glog.Errorf("%v cannot replicate the transaction: %v", b, err)
+		Tx:     tx,
+		Term:   b.term(),
+		Origin: b.ID(),
+		Seq:    b.commitSeq,
+	}
+	if b.app.replMode == ReplicateChain {
+		if err := b.replicateChain(commit); err != nil {
+			glog.Errorf("%v cannot replicate the transaction on its chain: %v", b,
+				err)
+			return err
+		}
+	} else if _, err := b.hive.node.Propose(ctx, b.group(), commit); err != nil {
+		glog.Errorf("%v cannot replicate the transaction on a quorum of %v: %v",
+			b, b.colony().Quorum(), err)
 		return err
 	}
 	glog.V(2).Infof("%v successfully replicates transaction", b)
+	ackColonyTx(b, b.colony(), 0)
+	b.postCommit(stx.Ops)
+	return nil
+}
+
+// replicateAsync commits the transaction locally, and replicates it in the
+// background.
+func (b *bee) replicateAsync() error {
+	ops, err := b.commitTxBothLayers()
+	if err != nil || len(ops) == 0 {
+		return err
+	}
+
+	if err := b.maybeRecruitFollowers(); err != nil {
+		glog.Errorf("%v cannot recruit followers: %v", b, err)
+	}
+
+	b.commitSeq++
+	commit := commitTx{
+		Tx:     tx{Tx: state.Tx{Ops: ops, Status: state.TxOpen}},
+		Term:   b.term(),
+		Origin: b.ID(),
+		Seq:    b.commitSeq,
+	}
+	// The transaction is already applied on this bee.
+	b.Lock()
+	b.markApplied(commit.Term, commit.Origin, commit.Seq)
+	b.Unlock()
+
+	if b.asyncCh == nil {
+		b.asyncCh = make(chan commitTx, asyncReplicationBuf)
+		go b.replicateInBackground(b.asyncCh)
+	}
+	b.asyncCh <- commit
+	colonyReplLag.WithLabelValues(colonyLabels(b, b.colony())...).
+		Set(float64(len(b.asyncCh)))
 	return nil
 }
 
+// replicateInBackground replicates the transactions of ch in order.
+func (b *bee) replicateInBackground(ch <-chan commitTx) {
+	for commit := range ch {
+		_, err := b.hive.node.ProposeRetry(b.group(), commit,
+			10*b.hive.config.RaftElectTimeout(), -1)
+		if err != nil {
+			glog.Errorf("%v cannot replicate transaction %v: %v", b, commit.Seq,
+				err)
+			continue
+		}
+		ackColonyTx(b, b.colony(), len(ch))
+	}
+}
+
+// markApplied marks the transaction of origin with the given sequence as
+// applied in term.
+func (b *bee) markApplied(term, origin, seq uint64) {
+	if b.txTerm < term {
+		b.txTerm = term
+		b.txApplied = nil
+	}
+	if b.txApplied == nil {
+		b.txApplied = make(map[uint64]uint64)
+	}
+	b.txApplied[origin] = seq
+}
+
 func (b *bee) maybeRecruitFollowers() error {
 	if b.detached {
 		return nil
@@ -1087,13 +2018,14 @@ func (b *bee) doRecruitFollowers() (recruited int) {
 	for _, f := range c.Followers {
 		fb, err := b.hive.registry.bee(f)
 		if err != nil {
-			glog.Fatalf("%v cannot find the hive of follower %v: %v", b, f, err)
+			glog.Errorf("%v cannot find the hive of follower %v: %v", b, f, err)
+			continue
 		}
 		blacklist = append(blacklist, fb.Hive)
 	}
 
 	for r != 1 {
-		hives := b.hive.replStrategy.selectHives(blacklist, r-1)
+		hives := b.hive.replStrategy.selectHives(b.app.placeRules, blacklist, r-1)
 		if len(hives) == 0 {
 			glog.Warningf("can only find %v hives to create followers for %v",
 				len(c.Followers), b)
@@ -1109,7 +2041,11 @@ func (b *bee) doRecruitFollowers() (recruited int) {
 
 		for i := 0; i < tries; i++ {
 			blacklist = append(blacklist, hives[i])
+			rerepl := i < b.evicted
 			go func(i int) {
+				if rerepl {
+					b.hive.replLimiter.wait(b.app.replPrio)
+				}
 				glog.V(2).Infof("trying to create a new follower for %v on hive %v", b,
 					hives[0])
 				cmd := cmd{
@@ -1117,7 +2053,8 @@ func (b *bee) doRecruitFollowers() (recruited int) {
 					App:  b.app.Name(),
 					Data: cmdCreateBee{},
 				}
-				res, err := b.hive.client.sendCmd(cmd)
+				res, err := b.hive.client.sendCmdWithTimeout(cmd,
+					10*b.hive.config.RaftElectTimeout())
 				if err != nil {
 					glog.Errorf("%v cannot create a new bee on %v: %v", b, hives[0], err)
 					fch <- BeeInfo{}
@@ -1136,12 +2073,17 @@ func (b *bee) doRecruitFollowers() (recruited int) {
 				continue
 			}
 
-			if err := b.addFollower(finf.ID, finf.Hive); err != nil {
+			if err := b.addFollower(finf.ID, finf.Hive,
+				b.needsWitness()); err != nil {
+
 				glog.Errorf("%v cannot add %v as a follower: %v", b, finf.ID, err)
 				continue
 			}
 			recruited++
 			r--
+			if b.evicted > 0 {
+				b.evicted--
+			}
 		}
 	}
 
@@ -1149,6 +2091,15 @@ func (b *bee) doRecruitFollowers() (recruited int) {
 	return recruited
 }
 
+// needsWitness returns whether the next follower recruited for the colony
+// should be a witness. Full followers are recruited first.
+func (b *bee) needsWitness() bool {
+	c := b.colony()
+	full := len(c.Followers) - len(c.Witnesses)
+	return len(c.Witnesses) < b.app.witnesses &&
+		full >= b.app.replFactor-1-b.app.witnesses
+}
+
 func (b *bee) handoffNonPersistent(to uint64) error {
 	s, err := b.stateL1.Save()
 	if err != nil {
@@ -1159,6 +2110,56 @@ func (b *bee) handoffNonPersistent(to uint64) error {
 		return err
 	}
 
+	return b.cutover(to)
+}
+
+// handoffInBackground takes a copy-on-write snapshot of the bee's state and
+// streams it to the destination bee while this bee keeps processing messages.
+// Once the snapshot is restored, cmdCompleteHandoff is enqueued on the bee to
+// ship the remaining changes and to cut over. It returns false if the state
+// does not support snapshots.
+func (b *bee) handoffInBackground(to uint64, ch chan cmdResult) bool {
+	ss, ok := b.stateL1.State.(state.Snapshotter)
+	if !ok {
+		return false
+	}
+
+	snap := ss.Snapshot()
+	glog.V(2).Infof("%v streams its state snapshot to %v", b, to)
+	go func() {
+		s, err := snap.Save()
+		if err == nil {
+			_, err = b.qee.sendCmdToBee(to, cmdRestoreState{State: s})
+		}
+		done := cmdCompleteHandoff{To: to, Err: bhgob.NewError(err)}
+		b.enqueCmd(newCmdAndChannel(done, b.hive.ID(), b.app.Name(), b.ID(), ch))
+	}()
+	return true
+}
+
+// completeHandoff sends the changes made since the snapshot to the destination
+// bee and cuts over. This is the only phase of a handoff in which the bee stops
+// processing messages.
+func (b *bee) completeHandoff(to uint64, serr bhgob.Error) error {
+	ops := b.stateL1.State.(state.Snapshotter).Changes()
+	if !serr.IsNil() {
+		return serr
+	}
+
+	glog.V(2).Infof("%v cuts over to %v with %v pending changes", b, to,
+		len(ops))
+	if len(ops) != 0 {
+		if _, err := b.qee.sendCmdToBee(to, cmdApplyOps{Ops: ops}); err != nil {
+			return err
+		}
+	}
+
+	return b.cutover(to)
+}
+
+// cutover transfers the leadership of the colony to the given bee and turns
+// this bee into a proxy.
+func (b *bee) cutover(to uint64) error {
 	oldc := b.colony()
 	newc := oldc.DeepCopy()
 	newc.Leader = to
@@ -1174,7 +2175,12 @@ func (b *bee) handoffNonPersistent(to uint64) error {
 		return err
 	}
 
-	b.becomeProxy()
+	// Messages that are already routed to this bee are relayed to the new
+	// leader.
+	b.setColony(newc)
+	b.detachState()
+	b.proxy = true
+	b.handleMsg, b.handleCmd = b.proxyHandlers(to)
 	return nil
 }
 
@@ -1188,14 +2194,14 @@ func (b *bee) handoff(to uint64) error {
 		return fmt.Errorf("%v is not a follower of %v", to, b)
 	}
 
-	if _, err := b.qee.sendCmdToBee(to, cmdSync{}); err != nil {
+	if _, err := b.sendFencedCmd(to, cmdSync{}); err != nil {
 		return err
 	}
 
 	ch := make(chan error)
 	go func() {
 		// TODO(soheil): use context with deadline here.
-		_, err := b.qee.sendCmdToBee(to, cmdCampaign{})
+		_, err := b.sendFencedCmd(to, cmdCampaign{})
 		ch <- err
 	}()
 
@@ -1212,6 +2218,88 @@ func (b *bee) handoff(to uint64) error {
 	return <-ch
 }
 
+// handoffTarget returns the follower that is the most up-to-date with the
+// leader, which is the best candidate to take over the colony.
+func (b *bee) handoffTarget() (uint64, error) {
+	c := b.colony()
+	if c.Leader != b.ID() {
+		return Nil, ErrIsNotMaster
+	}
+
+	ctx, cnl := context.WithTimeout(context.Background(),
+		b.hive.config.RaftElectTimeout())
+	defer cnl()
+	l, err := b.hive.node.LogInfo(ctx, b.group())
+	if err != nil {
+		return Nil, err
+	}
+
+	to, _ := b.mostUpToDate(c.Followers, l)
+	if to == Nil {
+		return Nil, fmt.Errorf("%v has no follower to hand off to", b)
+	}
+	return to, nil
+}
+
+// mostUpToDate returns the bee in bees, other than witnesses, that has matched
+// the most of the raft log of the leader, along with its matched index.
+func (b *bee) mostUpToDate(bees []uint64, l raft.LogInfo) (to uint64,
+	matched uint64) {
+
+	c := b.colony()
+	to = Nil
+	for _, f := range bees {
+		if f == b.ID() || c.IsWitness(f) {
+			continue
+		}
+		info, err := b.hive.registry.bee(f)
+		if err != nil {
+			continue
+		}
+		if m := l.Matched[info.Hive]; to == Nil || matched < m {
+			to, matched = f, m
+		}
+	}
+	return
+}
+
+// handoffWitness is called when the witness is elected as the raft leader of
+// its colony. It waits until the most up-to-date bee of the colony has
+// replicated the raft log of the witness, and makes that bee campaign. The
+// witness votes for the bee, since their logs are equally up-to-date.
+func (b *bee) handoffWitness() {
+	c := b.colony()
+	t := b.hive.config.RaftElectTimeout()
+	deadline := time.Now().Add(witnessHandoffTimeout * t)
+	for time.Now().Before(deadline) {
+		ctx, cnl := context.WithTimeout(context.Background(), t)
+		l, err := b.hive.node.LogInfo(ctx, c.ID)
+		cnl()
+		if err != nil {
+			glog.Errorf("%v cannot get its raft log: %v", b, err)
+			return
+		}
+		if l.Leader != b.hive.ID() {
+			return
+		}
+
+		to, matched := b.mostUpToDate(append([]uint64{c.Leader}, c.Followers...),
+			l)
+		if to != Nil && matched >= l.Last {
+			glog.V(2).Infof("%v hands off the leadership of its colony to %v", b,
+				to)
+			if _, err := b.sendCmdWithTimeout(to, cmdCampaign{}, t); err != nil {
+				glog.Errorf("%v cannot hand off to %v: %v", b, to, err)
+			}
+			// The bee is given an election timeout to win the election.
+			time.Sleep(t)
+			continue
+		}
+		time.Sleep(b.hive.config.RaftTick)
+	}
+	glog.Errorf("%v cannot hand off the leadership of its colony", b)
+}
+
 func (b *bee) raftBarrier() error {
 	_, err := b.hive.node.ProposeRetry(b.group(), noOp{},
 		10*b.hive.config.RaftElectTimeout(), -1)
@@ -1230,11 +2318,26 @@ func (b *bee) currentState() (dicts *state.Transactional, msgs *[]*msg) {
 }
 
 func (b *bee) CommitTx() error {
+	err := b.commitTx()
+	if err == nil {
+		b.commitDistTxs()
+	} else {
+		b.abortDistTxs(false)
+	}
+	return err
+}
+
+func (b *bee) commitTx() error {
 	// No need to replicate and/or persist the transaction.
-	if !b.app.persistent() || b.detached {
+	if !b.app.persistent() || b.detached || b.app.replMode == ReplicateNone {
 		glog.V(2).Infof("%v commits in memory transaction", b)
-		b.commitTxBothLayers()
-		return nil
+		_, err := b.commitTxBothLayers()
+		return err
+	}
+
+	if b.app.replMode == ReplicateAsync {
+		glog.V(2).Infof("%v commits asynchronously replicated transaction", b)
+		return b.replicateAsync()
 	}
 
 	glog.V(2).Infof("%v commits persistent transaction", b)
@@ -1248,11 +2351,82 @@ func (b *bee) AbortTx() error {
 	}
 
 	glog.V(2).Infof("%v aborts tx", b)
+	b.abortDistTxs(dicts == b.stateL2)
 	err := dicts.AbortTx()
 	b.resetTx(dicts, msgs)
 	return err
 }
 
+func (b *bee) Savepoint() (Savepoint, error) {
+	dicts, msgs := b.currentState()
+	ssp, err := dicts.Savepoint()
+	if err != nil {
+		return Savepoint{}, err
+	}
+	return Savepoint{state: ssp, msgs: len(*msgs)}, nil
+}
+
+func (b *bee) RollbackTo(sp Savepoint) error {
+	dicts, msgs := b.currentState()
+	if err := dicts.RollbackTo(sp.state); err != nil {
+		return err
+	}
+
+	glog.V(2).Infof("%v rolls back to savepoint", b)
+	for i := sp.msgs; i < len(*msgs); i++ {
+		(*msgs)[i] = nil
+	}
+	*msgs = (*msgs)[:sp.msgs]
+	return nil
+}
+
+// Update runs fn in a transaction. If the handler has an open transaction,
+// fn's changes are committed along with it. Otherwise, they are committed, and
+// replicated, in a transaction of their own. Update must be called on the bee's
+// goroutine.
+func (b *bee) Update(fn func(tx StateTx) error) error {
+	dicts, _ := b.currentState()
+	if dicts.TxStatus() == state.TxOpen {
+		return state.Update(dicts, func(tx state.State) error {
+			return fn(tx)
+		})
+	}
+
+	if err := b.BeginTx(); err != nil {
+		return err
+	}
+	if err := fn(dicts); err != nil {
+		b.AbortTx()
+		return err
+	}
+	return b.CommitTx()
+}
+
+func (b *bee) BeeState(id uint64) (state.State, error) {
+	if id == b.ID() {
+		return nil, fmt.Errorf("%v cannot request its own state", b)
+	}
+
+	info, err := b.hive.registry.bee(id)
+	if err != nil {
+		return nil, err
+	}
+	if info.App != b.app.Name() {
+		return nil, fmt.Errorf("bee %v is not in app %v", id, b.app.Name())
+	}
+
+	res, err := b.qee.sendCmdToBee(id, cmdSaveState{})
+	if err != nil {
+		return nil, err
+	}
+
+	s := state.NewInMem()
+	if err := s.Restore(res.([]byte)); err != nil {
+		return nil, err
+	}
+	return state.ReadOnly(s), nil
+}
+
 func (b *bee) Snooze(d time.Duration) {
 	panic(d)
 }
@@ -1262,10 +2436,18 @@ func (b *bee) Save() ([]byte, error) {
 }
 
 func (b *bee) Restore(buf []byte) error {
+	b.stateM.Lock()
+	defer b.stateM.Unlock()
+	if b.colony().IsWitness(b.ID()) {
+		glog.V(2).Infof("%v is a witness and ignores the snapshot", b)
+		return nil
+	}
 	return b.stateL1.Restore(buf)
 }
 
 func (b *bee) Apply(req interface{}) (interface{}, error) {
+	b.stateM.Lock()
+	defer b.stateM.Unlock()
 	b.Lock()
 	defer b.Unlock()
 
@@ -1273,10 +2455,16 @@ func (b *bee) Apply(req interface{}) (interface{}, error) {
 	case commitTx:
 		if b.txTerm < r.Term {
 			b.txTerm = r.Term
+			b.txApplied = nil
 		} else if r.Term < b.txTerm {
 			return nil, ErrOldTx
 		}
 
+		if r.Seq != 0 && r.Seq <= b.txApplied[r.Origin] {
+			glog.V(2).Infof("%v ignores duplicate %v", b, r)
+			return nil, nil
+		}
+
 		glog.V(2).Infof("%v commits %v", b, r)
 		leader := b.isLeader()
 
@@ -1292,8 +2480,14 @@ func (b *bee) Apply(req interface{}) (interface{}, error) {
 			b.resetTx(b.stateL1, &b.msgBufL1)
 		}
 
-		if err := b.stateL1.Apply(r.Tx.Ops); err != nil {
-			return nil, err
+		// Witnesses keep only the metadata of transactions.
+		if !b.isWitness() {
+			if err := b.stateL1.Apply(r.Tx.Ops); err != nil {
+				return nil, err
+			}
+		}
+		if r.Seq != 0 {
+			b.markApplied(r.Term, r.Origin, r.Seq)
 		}
 
 		if leader && b.emitInRaft {
@@ -1334,8 +2528,11 @@ func (b *bee) ApplyConfChange(cc raftpb.ConfChange, gn raft.GroupNode) error {
 			return ErrNoSuchBee
 		}
 		if bid == b.beeID {
-			// TODO(soheil): should we stop the bee here?
-			glog.Fatalf("bee is alive but removed from raft")
+			glog.Warningf("%v is removed from its colony", b)
+			b.beeColony = Colony{}
+			go b.enqueCmd(newCmdAndChannel(cmdRefreshRole{}, b.hive.ID(),
+				b.app.Name(), b.beeID, nil))
+			return nil
 		}
 		if col.Leader == bid {
 			// TODO(soheil): should we launch a goroutine to campaign here?
@@ -1350,9 +2547,14 @@ func (b *bee) ApplyConfChange(cc raftpb.ConfChange, gn raft.GroupNode) error {
 
 // commitTx is a bee raft command that is applied when a transaction is
 // commited.
+//
+// Origin and Seq identify the transaction in its term. A retransmitted
+// commitTx is applied only once.
 type commitTx struct {
-	Tx   tx
-	Term uint64
+	Tx     tx
+	Term   uint64
+	Origin uint64 // The bee that committed the transaction.
+	Seq    uint64 // The sequence of the transaction on Origin.
 }
 
 func init() {
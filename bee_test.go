@@ -1,12 +1,15 @@
 package beehive
 
 import (
+	"database/sql"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"testing"
 	"time"
 
 	"github.com/kandoo/beehive/bucket"
+	bhgob "github.com/kandoo/beehive/gob"
 	"github.com/kandoo/beehive/raft"
 	"github.com/kandoo/beehive/randtime"
 	"github.com/kandoo/beehive/state"
@@ -192,6 +195,176 @@ func TestBeeTxTerm(t *testing.T) {
 	}
 }
 
+func TestBeeCheckFence(t *testing.T) {
+	b := &bee{beeColony: Colony{ID: 1, Leader: 2}, txTerm: 2}
+	b.setTerm(3)
+
+	if err := b.checkFence(fence{Colony: 1, Term: 3}); err != nil {
+		t.Errorf("command of the current leader is rejected: %v", err)
+	}
+	if err := b.checkFence(fence{Colony: 4, Term: 1}); err != nil {
+		t.Errorf("command of another colony is rejected: %v", err)
+	}
+
+	err := b.checkFence(fence{Colony: 1, Term: 2})
+	if !IsStaleTerm(err) {
+		t.Fatalf("command of a deposed leader is accepted: %v", err)
+	}
+
+	// The error is sent as is to remote hives.
+	var res cmdResult
+	buf, gerr := bhgob.Encode(cmdResult{Err: err})
+	if gerr != nil {
+		t.Fatal(gerr)
+	}
+	if gerr := bhgob.Decode(&res, buf); gerr != nil {
+		t.Fatal(gerr)
+	}
+	if res.Err != err {
+		t.Errorf("invalid decoded error: actual=%#v want=%#v", res.Err, err)
+	}
+}
+
+func TestBeeTxDedup(t *testing.T) {
+	h := newHiveForTest()
+
+	ch := make(chan uint64)
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	rcvf := func(msg Msg, ctx RcvContext) error {
+		ch <- ctx.ID()
+		return nil
+	}
+
+	a := h.NewApp("BeeTxDedupTest", Persistent(1))
+	a.HandleFunc("", mapf, rcvf)
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit("")
+	b := a.(*app).qee.bees[<-ch]
+
+	put := func(v int) commitTx {
+		return commitTx{
+			Tx: tx{
+				Tx: state.Tx{
+					Ops: []state.Op{{T: state.Put, D: "D", K: "k", V: v}},
+				},
+			},
+			Term:   b.term(),
+			Origin: 1,
+			Seq:    1,
+		}
+	}
+
+	tick := h.Config().RaftTick
+	g := b.group()
+	for i := 0; i < 2; i++ {
+		if _, err := b.hive.node.ProposeRetry(g, put(i), tick, -1); err != nil {
+			t.Errorf("did not expect an error in commit: %v", err)
+		}
+	}
+
+	b.Lock()
+	v, err := b.stateL1.Dict("D").Get("k")
+	b.Unlock()
+	if err != nil || v != 0 {
+		t.Errorf("duplicate transaction is applied: %v", v)
+	}
+}
+
+func TestBeeLogInfo(t *testing.T) {
+	h := newHiveForTest()
+
+	ch := make(chan uint64)
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	rcvf := func(msg Msg, ctx RcvContext) error {
+		ch <- ctx.ID()
+		return ctx.Dict("D").Put("0", true)
+	}
+
+	a := h.NewApp("BeeLogInfoTest", Persistent(1))
+	a.HandleFunc("", mapf, rcvf)
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit("")
+	id := <-ch
+
+	res, err := a.(*app).qee.sendCmdToBee(id, cmdLogInfo{})
+	if err != nil {
+		t.Fatalf("cannot get the log info: %v", err)
+	}
+	info := res.(raft.LogInfo)
+	if info.Commit == 0 || info.Last < info.Commit {
+		t.Errorf("invalid log indices: commit=%v last=%v", info.Commit,
+			info.Last)
+	}
+	if info.Entries == 0 || info.Size == 0 {
+		t.Errorf("invalid log size: entries=%v size=%v", info.Entries, info.Size)
+	}
+	if info.Leader != h.ID() {
+		t.Errorf("invalid leader: actual=%v want=%v", info.Leader, h.ID())
+	}
+}
+
+func TestBeeUpdateReplicates(t *testing.T) {
+	h := newHiveForTest()
+
+	ch := make(chan uint64)
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	rcvf := func(msg Msg, ctx RcvContext) error {
+		ch <- ctx.ID()
+		return nil
+	}
+
+	a := h.NewApp("BeeUpdateReplicatesTest", Persistent(1))
+	a.HandleFunc("", mapf, rcvf)
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit("")
+	id := <-ch
+
+	res, err := a.(*app).qee.sendCmdToBee(id, cmdLogInfo{})
+	if err != nil {
+		t.Fatalf("cannot get the log info: %v", err)
+	}
+	before := res.(raft.LogInfo).Commit
+
+	update := cmdUpdate{Fn: func(tx StateTx) error {
+		return tx.Dict("D").Put("0", true)
+	}}
+	if _, err = a.(*app).qee.sendCmdToBee(id, update); err != nil {
+		t.Fatalf("cannot update the state: %v", err)
+	}
+
+	res, err = a.(*app).qee.sendCmdToBee(id, cmdLogInfo{})
+	if err != nil {
+		t.Fatalf("cannot get the log info: %v", err)
+	}
+	if after := res.(raft.LogInfo).Commit; after <= before {
+		t.Errorf("update is not replicated: actual=%v want>%v", after, before)
+	}
+
+	var v interface{}
+	get := cmdUpdate{Fn: func(tx StateTx) (err error) {
+		v, err = tx.Dict("D").Get("0")
+		return err
+	}}
+	if _, err = a.(*app).qee.sendCmdToBee(id, get); err != nil || v != true {
+		t.Errorf("invalid value: actual=%v want=true (err=%v)", v, err)
+	}
+}
+
 type benchBeeHandler struct {
 	data []byte
 }
@@ -274,3 +447,126 @@ func BenchmarkBeePersistence(b *testing.B) {
 	time.Sleep(1 * time.Second)
 	hive.node.Stop()
 }
+
+func TestBeeTrace(t *testing.T) {
+	type tracePing int
+	type tracePong int
+
+	ch := make(chan [2]uint64, 2)
+	pingf := func(msg Msg, ctx RcvContext) error {
+		p := msg.Data().(tracePing)
+		if err := ctx.Dict("t").Put(fmt.Sprint(p), msg.Trace()); err != nil {
+			return err
+		}
+		ctx.Emit(tracePong(p))
+		return nil
+	}
+	pongf := func(msg Msg, ctx RcvContext) error {
+		v, err := ctx.Dict("t").Get(fmt.Sprint(msg.Data().(tracePong)))
+		if err != nil {
+			return err
+		}
+		ch <- [2]uint64{v.(uint64), msg.Trace()}
+		return nil
+	}
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		return ctx.LocalMappedCells()
+	}
+
+	h := newHiveForTest()
+	app := h.NewApp("trace")
+	app.HandleFunc(tracePing(0), mapf, pingf)
+	app.HandleFunc(tracePong(0), mapf, pongf)
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(tracePing(0))
+	h.Emit(tracePing(1))
+	var traces []uint64
+	for i := 0; i < 2; i++ {
+		tr := <-ch
+		if tr[0] == 0 || tr[0] != tr[1] {
+			t.Errorf("trace is not propagated: ping=%x pong=%x", tr[0], tr[1])
+		}
+		traces = append(traces, tr[1])
+	}
+	if traces[0] == traces[1] {
+		t.Errorf("messages have the same trace: %x", traces[0])
+	}
+}
+
+func TestBeeCtrlPriority(t *testing.T) {
+	h := newHiveForTest(BatchSize(1))
+	started := make(chan uint64)
+	release := make(chan struct{})
+	a := h.NewApp("ctrlprio")
+	a.HandleFunc(int(0), func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(msg Msg, ctx RcvContext) error {
+		started <- ctx.ID()
+		<-release
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+	defer func() {
+		close(release)
+		go func() {
+			for range started {
+			}
+		}()
+	}()
+
+	for i := 0; i < 10; i++ {
+		h.Emit(i)
+	}
+	b, _ := a.(*app).qee.beeByID(<-started)
+	for len(b.dataCh.out()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	res := make(chan error, 1)
+	go func() {
+		_, err := b.processCmd(cmdPing{})
+		res <- err
+	}()
+	// Wait until the command is queued behind the backlog.
+	for len(b.ctrlCh) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	release <- struct{}{}
+
+	// The bee blocks on the next message, so the command must be handled
+	// before it.
+	<-started
+	select {
+	case err := <-res:
+		if err != nil {
+			t.Errorf("cannot ping the bee: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("the backlog is handled before the command")
+	}
+}
+
+func TestBeeCommitTxError(t *testing.T) {
+	db, err := sql.Open("beehive-nosql", "")
+	if err != nil {
+		t.Fatalf("cannot open the database: %v", err)
+	}
+
+	b := &bee{
+		beeID: 1,
+		app:   &app{name: "sql", flags: appFlagTransactional},
+	}
+	b.setState(state.NewSQL(db, state.MySQL, "t", 1))
+	if err := b.BeginTx(); err != nil {
+		t.Fatalf("cannot begin the transaction: %v", err)
+	}
+	b.Dict("D").Put("k", 1)
+	if err := b.CommitTx(); err == nil {
+		t.Error("no error when the state cannot be written")
+	}
+}
@@ -0,0 +1,129 @@
+package beehive
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// The states of a circuit breaker. The values are exported in the
+// beehive_rpc_breaker_state metric.
+const (
+	breakerClosed   = 0
+	breakerOpen     = 1
+	breakerHalfOpen = 2
+)
+
+// rpcBreakerError is returned for the calls rejected by an open circuit
+// breaker.
+type rpcBreakerError struct {
+	Hive  uint64
+	Until time.Time
+}
+
+func (e *rpcBreakerError) Error() string {
+	return fmt.Sprintf("rpc-client: circuit to hive %v is open until %v", e.Hive,
+		e.Until)
+}
+
+func isBreakerError(err error) bool {
+	_, ok := err.(*rpcBreakerError)
+	return ok
+}
+
+// circuitBreaker fails the calls to a peer hive fast, after the peer fails
+// HiveConfig.BreakerThresh consecutive calls. Once HiveConfig.BreakerTimeout
+// passes, the breaker lets one call through to probe the peer: the breaker is
+// closed if the probe succeeds, and is opened again otherwise.
+type circuitBreaker struct {
+	sync.Mutex
+	hive  uint64
+	state int
+	fails uint
+	// until is when an open breaker lets a probe through, or when the probe of
+	// a half-open breaker is considered lost.
+	until time.Time
+}
+
+func (b *circuitBreaker) setState(state int) {
+	if b.state == state {
+		return
+	}
+	glog.V(2).Infof("circuit breaker of hive %v: %v -> %v", b.hive, b.state,
+		state)
+	b.state = state
+	breakerState.WithLabelValues(strconv.FormatUint(b.hive, 10)).Set(
+		float64(state))
+}
+
+// allow returns an error if the call should fail fast.
+func (b *circuitBreaker) allow(timeout time.Duration) error {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	switch {
+	case b.state == breakerClosed:
+		return nil
+	case now.Before(b.until):
+		breakerRejects.WithLabelValues(strconv.FormatUint(b.hive, 10)).Inc()
+		return &rpcBreakerError{Hive: b.hive, Until: b.until}
+	}
+
+	b.setState(breakerHalfOpen)
+	b.until = now.Add(timeout)
+	return nil
+}
+
+// done records the result of a call allowed by the breaker.
+func (b *circuitBreaker) done(failed bool, thresh uint, timeout time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	if !failed {
+		b.fails = 0
+		b.setState(breakerClosed)
+		return
+	}
+
+	b.fails++
+	if b.state == breakerHalfOpen || b.fails >= thresh {
+		b.setState(breakerOpen)
+		b.until = time.Now().Add(timeout)
+	}
+}
+
+func (p *rpcClientPool) breaker(hive uint64) *circuitBreaker {
+	p.Lock()
+	defer p.Unlock()
+
+	b, ok := p.breakers[hive]
+	if !ok {
+		b = &circuitBreaker{hive: hive}
+		p.breakers[hive] = b
+	}
+	return b
+}
+
+// allow returns an error if the calls to the hive should fail fast.
+func (p *rpcClientPool) allow(hive uint64) error {
+	if p.hive.config.BreakerThresh == 0 {
+		return nil
+	}
+	return p.breaker(hive).allow(p.hive.config.BreakerTimeout)
+}
+
+// done records the result of a call to the hive. Only the errors of broken
+// or failed connections count as failures, since other errors are returned
+// by a live peer. Backoff errors are not calls, and are ignored.
+func (p *rpcClientPool) done(hive uint64, err error) {
+	cfg := p.hive.config
+	if cfg.BreakerThresh == 0 || isBackoffError(err) || isBreakerError(err) {
+		return
+	}
+	p.breaker(hive).done(err != nil && p.shouldRetry(err), cfg.BreakerThresh,
+		cfg.BreakerTimeout)
+}
@@ -0,0 +1,70 @@
+package beehive
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{hive: 1}
+	fail := func() {
+		if err := b.allow(time.Hour); err != nil {
+			t.Fatalf("call is not allowed: %v", err)
+		}
+		b.done(true, 2, time.Hour)
+	}
+
+	fail()
+	if b.state != breakerClosed {
+		t.Fatalf("breaker is open after one failure: %v", b.state)
+	}
+	fail()
+	if b.state != breakerOpen {
+		t.Fatalf("breaker is not open after two failures: %v", b.state)
+	}
+	if err := b.allow(time.Hour); !isBreakerError(err) {
+		t.Fatalf("open breaker allows calls: %v", err)
+	}
+
+	// Probe the peer.
+	b.until = time.Now()
+	if err := b.allow(time.Hour); err != nil {
+		t.Fatalf("probe is not allowed: %v", err)
+	}
+	if err := b.allow(time.Hour); !isBreakerError(err) {
+		t.Fatalf("half-open breaker allows more than one probe: %v", err)
+	}
+	b.done(true, 2, time.Hour)
+	if b.state != breakerOpen {
+		t.Fatalf("breaker is not open after a failed probe: %v", b.state)
+	}
+
+	b.until = time.Now()
+	b.allow(time.Hour)
+	b.done(false, 2, time.Hour)
+	if b.state != breakerClosed || b.fails != 0 {
+		t.Errorf("breaker is not closed after a probe: %v", b.state)
+	}
+}
+
+func TestBreakerFailures(t *testing.T) {
+	p := newRPCClientPool(&hive{config: HiveConfig{BreakerThresh: 1,
+		BreakerTimeout: time.Hour}})
+
+	// Errors returned by live peers do not open the circuit.
+	p.done(2, errors.New("remote error"))
+	p.done(2, &rpcBackoffError{})
+	if err := p.allow(2); err != nil {
+		t.Fatalf("circuit is open: %v", err)
+	}
+
+	p.done(2, &net.OpError{Op: "dial", Err: errors.New("refused")})
+	if err := p.allow(2); !isBreakerError(err) {
+		t.Errorf("circuit is not open: %v", err)
+	}
+	if _, err := p.sendCmd(cmd{Hive: 2, Data: cmdPing{}}); !isBreakerError(err) {
+		t.Errorf("command does not fail fast: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package beehive
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// bcastAllDict is the dictionary of the mapped cells returned by BroadcastAll.
+const bcastAllDict = "__bcast_all__"
+
+// BroadcastAll returns the mapped cells that deliver a message to all the bees
+// of the application on every hive, as if the map function returned an empty
+// set (i.e., a local broadcast) on each hive. Similar to a local broadcast,
+// only the existing bees of the application receive the message. Failures in
+// delivering the message to other hives are logged.
+func BroadcastAll() MappedCells {
+	return MappedCells{{Dict: bcastAllDict}}
+}
+
+// IsBroadcastAll returns whether the mapped cells are returned by
+// BroadcastAll.
+func (mc MappedCells) IsBroadcastAll() bool {
+	return len(mc) == 1 && mc[0].Dict == bcastAllDict
+}
+
+// handleBcastAll broadcasts the message to the local bees, and to the bees of
+// the application on other hives in the background.
+func (q *qee) handleBcastAll(mh msgAndHandler) {
+	q.handleLocalBcast(mh)
+	go func() {
+		for id, err := range q.hive.remoteBcast(mh.msg, q.app.Name()) {
+			if err != nil {
+				glog.Errorf("%v cannot broadcast %v to hive %v: %v", q, mh.msg, id,
+					err)
+			}
+		}
+	}()
+}
+
+// localBcast delivers the message to the local bees of the application. If
+// app is empty, the message is delivered to the local bees of all the
+// applications that handle the message.
+func (h *hive) localBcast(m *msg, app string) error {
+	if app == "" {
+		for _, qh := range h.qees[m.Type()] {
+			qh.q.handleLocalBcast(msgAndHandler{msg: m, handler: qh.h})
+		}
+		return nil
+	}
+
+	a, ok := h.app(app)
+	if !ok {
+		return fmt.Errorf("%v has no app %v", h, app)
+	}
+	ah := a.handler(m.Type())
+	if ah == nil {
+		return fmt.Errorf("%v has no handler for %v", a, m.Type())
+	}
+	a.qee.handleLocalBcast(msgAndHandler{msg: m, handler: ah})
+	return nil
+}
+
+// remoteBcast delivers the message to the local bees of the application on
+// all the other hives, and returns the delivery error of each hive.
+func (h *hive) remoteBcast(m *msg, app string) map[uint64]error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	res := make(map[uint64]error)
+	for _, hi := range h.registry.hives() {
+		if hi.ID == h.ID() {
+			continue
+		}
+
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			_, err := h.client.sendCmd(cmd{
+				Hive: id,
+				App:  app,
+				Data: cmdLocalBcast{Msg: *m},
+			})
+			mu.Lock()
+			res[id] = err
+			mu.Unlock()
+		}(hi.ID)
+	}
+	wg.Wait()
+	return res
+}
+
+// broadcastToHives delivers the message to the local bees of the application
+// on every hive, and returns the delivery error of each hive.
+func (h *hive) broadcastToHives(m *msg, app string) map[uint64]error {
+	res := h.remoteBcast(m, app)
+	res[h.ID()] = h.localBcast(m, app)
+	return res
+}
+
+func (b *bee) BroadcastToHives(msgData interface{}) map[uint64]error {
+	return b.hive.broadcastToHives(b.newBcastMsg(msgData), "")
+}
+
+// newBcastMsg returns the message of BroadcastToHives, in the trace of the
+// current message.
+func (b *bee) newBcastMsg(msgData interface{}) *msg {
+	m := newMsgFromData(msgData, b.ID(), 0)
+	m.MsgTrace = b.trace
+	if m.MsgTrace == 0 {
+		m.MsgTrace = newTraceID()
+	}
+	return m
+}
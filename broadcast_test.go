@@ -0,0 +1,138 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type bcastTestMsg struct{}
+type bcastTestTrigger struct{}
+type bcastTestWarmup struct{}
+
+// handleBcastWarmup creates a bee for a on the hive that receives the
+// returned message, since broadcasts are only delivered to existing bees.
+func handleBcastWarmup(a App, ch chan<- uint64) {
+	a.HandleFunc(bcastTestWarmup{}, func(msg Msg, ctx MapContext) MappedCells {
+		return ctx.LocalMappedCells()
+	}, func(msg Msg, ctx RcvContext) error {
+		ch <- ctx.Hive().ID()
+		return nil
+	})
+}
+
+func warmupBcast(t *testing.T, ch <-chan uint64, hives ...Hive) {
+	for _, h := range hives {
+		h.Emit(bcastTestWarmup{})
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no bee is created on %v", h)
+		}
+	}
+}
+
+func TestBroadcastAll(t *testing.T) {
+	ch := make(chan uint64, 10)
+	warm := make(chan uint64, 1)
+	register := func(h Hive) {
+		a := h.NewApp("bcastall")
+		handleBcastWarmup(a, warm)
+		a.HandleFunc(bcastTestMsg{}, func(msg Msg, ctx MapContext) MappedCells {
+			return BroadcastAll()
+		}, func(msg Msg, ctx RcvContext) error {
+			ch <- ctx.Hive().ID()
+			return nil
+		})
+	}
+
+	h1 := newHiveForTest()
+	register(h1)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	register(h2)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	warmupBcast(t, warm, h1, h2)
+	h1.Emit(bcastTestMsg{})
+	hives := make(map[uint64]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-ch:
+			hives[id] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message is not broadcast to all hives: %v", hives)
+		}
+	}
+	if !hives[h1.ID()] || !hives[h2.ID()] {
+		t.Errorf("invalid hives: %v", hives)
+	}
+}
+
+func TestBroadcastToHives(t *testing.T) {
+	ch := make(chan uint64, 10)
+	res := make(chan map[uint64]error, 1)
+	warm := make(chan uint64, 1)
+	register := func(h Hive) {
+		a := h.NewApp("bcasthives")
+		handleBcastWarmup(a, warm)
+		a.HandleFunc(bcastTestTrigger{}, func(msg Msg, ctx MapContext) MappedCells {
+			return ctx.LocalMappedCells()
+		}, func(msg Msg, ctx RcvContext) error {
+			res <- ctx.BroadcastToHives(bcastTestMsg{})
+			return nil
+		})
+		// The map function is not called for messages broadcast to hives.
+		a.HandleFunc(bcastTestMsg{}, func(msg Msg, ctx MapContext) MappedCells {
+			return nil
+		}, func(msg Msg, ctx RcvContext) error {
+			ch <- ctx.Hive().ID()
+			return nil
+		})
+	}
+
+	h1 := newHiveForTest()
+	register(h1)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	register(h2)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	warmupBcast(t, warm, h1, h2)
+	h2.Emit(bcastTestTrigger{})
+	var status map[uint64]error
+	select {
+	case status = <-res:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not broadcast to hives")
+	}
+	if len(status) != 2 {
+		t.Fatalf("invalid delivery status: %v", status)
+	}
+	for id, err := range status {
+		if err != nil {
+			t.Errorf("cannot deliver to %v: %v", id, err)
+		}
+	}
+	hives := make(map[uint64]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-ch:
+			hives[id] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message is not delivered to all hives: %v", hives)
+		}
+	}
+	if !hives[h1.ID()] || !hives[h2.ID()] {
+		t.Errorf("invalid hives: %v", hives)
+	}
+}
@@ -58,6 +58,22 @@ func New(rate Rate, max uint64) (bucket *Bucket) {
 	return bucket
 }
 
+// NewFull is the same as New, but the returned bucket starts with its maximum
+// tokens, or with the tokens generated in one second if max is 0.
+func NewFull(rate Rate, max uint64) (bucket *Bucket) {
+	bucket = New(rate, max)
+	if bucket.Unlimited() {
+		return
+	}
+
+	if max == 0 {
+		bucket.tokens = uint64(rate)
+	} else {
+		bucket.tokens = max
+	}
+	return
+}
+
 func gcd(a, b uint64) uint64 {
 	if a < b {
 		return gcd(b, a)
@@ -58,6 +58,21 @@ func TestMax(t *testing.T) {
 	}
 }
 
+func TestNewFull(t *testing.T) {
+	b := NewFull(1*TPS, 5)
+	if !b.Get(5) {
+		t.Errorf("bucket is not full")
+	}
+	if b.Has(1) {
+		t.Errorf("bucket has more than max tokens")
+	}
+
+	b = NewFull(10*TPS, 0)
+	if !b.Get(10) || b.Has(1) {
+		t.Errorf("bucket does not have the tokens of one second")
+	}
+}
+
 func TestWhenGetHas(t *testing.T) {
 	cases := []struct {
 		rate    Rate
@@ -66,36 +66,59 @@ func newCellStore() cellStore {
 }
 
 func (s *cellStore) assign(app string, k CellKey, c Colony) {
-	s.assignCellBees(app, k, c)
-	s.assignBeeCells(app, k, c)
+	s.assignCells(app, MappedCells{k}, c)
 }
 
-func (s *cellStore) assignCellBees(app string, k CellKey, c Colony) {
-	dicts, ok := s.CellBees[app]
+// assignCells assigns the cells of app to colony c. The dictionaries of the
+// application and of the leader are looked up once for all the cells.
+func (s *cellStore) assignCells(app string, cells MappedCells, c Colony) {
+	if len(cells) == 0 {
+		return
+	}
+
+	cdicts, ok := s.CellBees[app]
 	if !ok {
-		dicts = make(map[string]map[string]Colony)
-		s.CellBees[app] = dicts
+		cdicts = make(map[string]map[string]Colony)
+		s.CellBees[app] = cdicts
 	}
-	keys, ok := dicts[k.Dict]
+	bdicts, ok := s.BeeCells[c.Leader]
 	if !ok {
-		keys = make(map[string]Colony)
-		dicts[k.Dict] = keys
+		bdicts = make(map[string]map[string]struct{})
+		s.BeeCells[c.Leader] = bdicts
+	}
+
+	for _, k := range cells {
+		ckeys, ok := cdicts[k.Dict]
+		if !ok {
+			ckeys = make(map[string]Colony)
+			cdicts[k.Dict] = ckeys
+		}
+		if prev, ok := ckeys[k.Key]; ok && prev.Leader != c.Leader {
+			s.unassignBeeCells(k, prev.Leader)
+		}
+		ckeys[k.Key] = c
+
+		bkeys, ok := bdicts[k.Dict]
+		if !ok {
+			bkeys = make(map[string]struct{})
+			bdicts[k.Dict] = bkeys
+		}
+		bkeys[k.Key] = struct{}{}
 	}
-	keys[k.Key] = c
 }
 
-func (s *cellStore) assignBeeCells(app string, k CellKey, c Colony) {
-	dicts, ok := s.BeeCells[c.Leader]
+func (s *cellStore) unassignBeeCells(k CellKey, bee uint64) {
+	dicts, ok := s.BeeCells[bee]
 	if !ok {
-		dicts = make(map[string]map[string]struct{})
-		s.BeeCells[c.Leader] = dicts
+		return
 	}
-	keys, ok := dicts[k.Dict]
-	if !ok {
-		keys = make(map[string]struct{})
-		dicts[k.Dict] = keys
+	delete(dicts[k.Dict], k.Key)
+	if len(dicts[k.Dict]) == 0 {
+		delete(dicts, k.Dict)
+	}
+	if len(dicts) == 0 {
+		delete(s.BeeCells, bee)
 	}
-	keys[k.Key] = struct{}{}
 }
 
 func (s *cellStore) colony(app string, cell CellKey) (c Colony, ok bool) {
@@ -125,6 +148,19 @@ func (s *cellStore) cells(bee uint64) MappedCells {
 	return c
 }
 
+// release unlocks the cells of the colony led by leader, and returns the
+// released cells.
+func (s *cellStore) release(app string, leader uint64) MappedCells {
+	cells := s.cells(leader)
+	delete(s.BeeCells, leader)
+	if dicts, ok := s.CellBees[app]; ok {
+		for _, k := range cells {
+			delete(dicts[k.Dict], k.Key)
+		}
+	}
+	return cells
+}
+
 func (s *cellStore) updateColony(app string, oldc Colony, newc Colony,
 	term uint64) error {
 
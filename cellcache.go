@@ -0,0 +1,227 @@
+package beehive
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// cellCacheShards is the number of shards of the cell cache.
+const cellCacheShards = 64
+
+// cellCache is a per-hive read cache of the bees that own the mapped cells.
+// It is populated from the local replica of the registry, and is invalidated
+// by watching the registry. As such, looking up the owner of cells does not
+// contend with the registry updates on the message path.
+//
+// The cells are sharded by their hash, so that the queens of different
+// applications, and the lookups of different cells, do not contend on a single
+// lock.
+type cellCache struct {
+	// gen is incremented on every invalidation, to detect the entries read
+	// from the registry while it was being changed. It is incremented before
+	// the shards are invalidated.
+	gen    uint64
+	shards [cellCacheShards]cellCacheShard
+}
+
+type cellCacheShard struct {
+	sync.RWMutex
+	cells map[string]map[CellKey]BeeInfo
+}
+
+func newCellCache() *cellCache {
+	c := &cellCache{}
+	for i := range c.shards {
+		c.shards[i].cells = make(map[string]map[CellKey]BeeInfo)
+	}
+	return c
+}
+
+// shard returns the shard of the cell of app.
+func (c *cellCache) shard(app string, k CellKey) *cellCacheShard {
+	return &c.shards[shardIndex(app, k)]
+}
+
+// shardIndex returns the index of the shard of the cell of app.
+func shardIndex(app string, k CellKey) int {
+	// FNV-1a, inlined to avoid allocating a hash.Hash on every lookup.
+	h := uint32(2166136261)
+	for _, s := range [...]string{app, k.Dict, k.Key} {
+		for i := 0; i < len(s); i++ {
+			h ^= uint32(s[i])
+			h *= 16777619
+		}
+		h *= 16777619
+	}
+	return int(h % cellCacheShards)
+}
+
+// byShard groups the cells of app by the index of their shards, so that the
+// cells of a mapset are looked up, filled, and deleted with one lock per shard
+// instead of one lock per cell.
+func byShard(app string,
+	cells MappedCells) (groups [cellCacheShards]MappedCells) {
+
+	idx := make([]uint8, len(cells))
+	var n [cellCacheShards]int
+	for i, k := range cells {
+		s := shardIndex(app, k)
+		idx[i] = uint8(s)
+		n[s]++
+	}
+	sorted := make(MappedCells, len(cells))
+	off := 0
+	for s := range groups {
+		groups[s] = sorted[off : off : off+n[s]]
+		off += n[s]
+	}
+	for i, k := range cells {
+		groups[idx[i]] = append(groups[idx[i]], k)
+	}
+	return groups
+}
+
+// beeForCells returns the bee that owns all the cells of app. It returns
+// false if some of the cells are not cached, or are owned by different bees.
+func (c *cellCache) beeForCells(app string, cells MappedCells) (info BeeInfo,
+	ok bool) {
+
+	switch len(cells) {
+	case 0:
+		return BeeInfo{}, false
+	case 1:
+		return c.shard(app, cells[0]).beeForCells(app, cells, BeeInfo{})
+	}
+
+	for i, sc := range byShard(app, cells) {
+		if len(sc) == 0 {
+			continue
+		}
+		if info, ok = c.shards[i].beeForCells(app, sc, info); !ok {
+			return BeeInfo{}, false
+		}
+	}
+	return info, true
+}
+
+// beeForCells returns the bee that owns all the cells of app in the shard. If
+// info is set, the cells must also be owned by info.
+func (s *cellCacheShard) beeForCells(app string, cells MappedCells,
+	info BeeInfo) (BeeInfo, bool) {
+
+	s.RLock()
+	keys := s.cells[app]
+	for _, k := range cells {
+		i, cached := keys[k]
+		if !cached || (info.ID != 0 && info.ID != i.ID) {
+			s.RUnlock()
+			return BeeInfo{}, false
+		}
+		info = i
+	}
+	s.RUnlock()
+	return info, true
+}
+
+// generation returns the current generation of the cache. It must be read
+// before reading the registry to fill the cache.
+func (c *cellCache) generation() uint64 {
+	return atomic.LoadUint64(&c.gen)
+}
+
+// fill caches info as the owner of the cells, if the cache has not been
+// invalidated since gen.
+func (c *cellCache) fill(gen uint64, app string, cells MappedCells,
+	info BeeInfo) {
+
+	if len(cells) == 1 {
+		c.fillShard(c.shard(app, cells[0]), gen, app, cells, info)
+		return
+	}
+
+	for i, sc := range byShard(app, cells) {
+		if len(sc) != 0 && !c.fillShard(&c.shards[i], gen, app, sc, info) {
+			return
+		}
+	}
+}
+
+// fillShard caches info as the owner of the cells in shard s. It returns false
+// if the cache has been invalidated since gen.
+func (c *cellCache) fillShard(s *cellCacheShard, gen uint64, app string,
+	cells MappedCells, info BeeInfo) bool {
+
+	s.Lock()
+	defer s.Unlock()
+	// An invalidation that has not yet reached this shard invalidates the
+	// cells filled before, so it is safe to stop here.
+	if gen != c.generation() {
+		return false
+	}
+	keys, ok := s.cells[app]
+	if !ok {
+		keys = make(map[CellKey]BeeInfo, len(cells))
+		s.cells[app] = keys
+	}
+	for _, k := range cells {
+		keys[k] = info
+	}
+	return true
+}
+
+// invalidate drops the entries that are affected by the registry event.
+func (c *cellCache) invalidate(ev RegistryEvent) {
+	atomic.AddUint64(&c.gen, 1)
+	switch ev := ev.(type) {
+	case CellsLocked:
+		// Only the cells that were not locked are locked, and those cannot be
+		// cached.
+	case CellsTransferred:
+		c.delCells(ev.App, ev.Cells)
+	case CellsReleased:
+		c.delCells(ev.App, ev.Cells)
+	case ColonyUpdated:
+		c.delIf(func(i BeeInfo) bool { return i.Colony.ID == ev.Old.ID })
+	case BeeMoved:
+		c.delIf(func(i BeeInfo) bool { return i.ID == ev.ID })
+	case BeeDeleted:
+		c.delIf(func(i BeeInfo) bool { return i.ID == ev.ID })
+	default:
+		for i := range c.shards {
+			s := &c.shards[i]
+			s.Lock()
+			s.cells = make(map[string]map[CellKey]BeeInfo)
+			s.Unlock()
+		}
+	}
+}
+
+func (c *cellCache) delIf(f func(i BeeInfo) bool) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		for _, keys := range s.cells {
+			for k, i := range keys {
+				if f(i) {
+					delete(keys, k)
+				}
+			}
+		}
+		s.Unlock()
+	}
+}
+
+func (c *cellCache) delCells(app string, cells MappedCells) {
+	for i, sc := range byShard(app, cells) {
+		if len(sc) == 0 {
+			continue
+		}
+		s := &c.shards[i]
+		s.Lock()
+		keys := s.cells[app]
+		for _, k := range sc {
+			delete(keys, k)
+		}
+		s.Unlock()
+	}
+}
@@ -0,0 +1,131 @@
+package beehive
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCellCacheInvalidation(t *testing.T) {
+	c := newCellCache()
+	a := MappedCells{{Dict: "D", Key: "a"}}
+	b := MappedCells{{Dict: "D", Key: "b"}}
+	c.fill(c.generation(), "app", a, BeeInfo{ID: 1, Colony: Colony{ID: 1}})
+	c.fill(c.generation(), "app", b, BeeInfo{ID: 2, Colony: Colony{ID: 2}})
+
+	if _, ok := c.beeForCells("app", append(a, b...)); ok {
+		t.Error("cells of different bees are returned")
+	}
+	if i, ok := c.beeForCells("app", a); !ok || i.ID != 1 {
+		t.Errorf("invalid cached bee: actual=%v want=1", i.ID)
+	}
+
+	c.invalidate(ColonyUpdated{App: "app", Old: Colony{ID: 1}})
+	if _, ok := c.beeForCells("app", a); ok {
+		t.Error("cells of an updated colony are cached")
+	}
+	if _, ok := c.beeForCells("app", b); !ok {
+		t.Error("cells of other colonies are invalidated")
+	}
+
+	c.invalidate(BeeMoved{ID: 2, From: 1, To: 2})
+	if _, ok := c.beeForCells("app", b); ok {
+		t.Error("cells of a moved bee are cached")
+	}
+
+	gen := c.generation()
+	c.invalidate(RegistryRestored{})
+	c.fill(gen, "app", a, BeeInfo{ID: 1})
+	if _, ok := c.beeForCells("app", a); ok {
+		t.Error("cache is filled with a stale entry")
+	}
+}
+
+func TestCellCacheWideMapset(t *testing.T) {
+	c := newCellCache()
+	var cells MappedCells
+	for i := 0; i < 1000; i++ {
+		cells = append(cells, CellKey{Dict: "D", Key: strconv.Itoa(i)})
+	}
+	c.fill(c.generation(), "app", cells, BeeInfo{ID: 1})
+	if i, ok := c.beeForCells("app", cells); !ok || i.ID != 1 {
+		t.Errorf("invalid cached bee: actual=%v want=1", i.ID)
+	}
+
+	c.fill(c.generation(), "app", cells[500:501], BeeInfo{ID: 2})
+	if _, ok := c.beeForCells("app", cells); ok {
+		t.Error("cells of different bees are returned")
+	}
+
+	c.invalidate(CellsReleased{App: "app", Cells: cells[:10]})
+	if _, ok := c.beeForCells("app", cells[:10]); ok {
+		t.Error("released cells are cached")
+	}
+	if i, ok := c.beeForCells("app", cells[10:500]); !ok || i.ID != 1 {
+		t.Errorf("invalid cached bee: actual=%v want=1", i.ID)
+	}
+}
+
+// BenchmarkCellCacheWideMapset measures looking up a mapset of 1000 cells.
+func BenchmarkCellCacheWideMapset(b *testing.B) {
+	c := newCellCache()
+	var cells MappedCells
+	for i := 0; i < 1000; i++ {
+		cells = append(cells, CellKey{Dict: "D", Key: strconv.Itoa(i)})
+	}
+	c.fill(c.generation(), "app", cells, BeeInfo{ID: 1})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := c.beeForCells("app", cells); !ok {
+			b.Fatal("cells are not cached")
+		}
+	}
+}
+
+// benchCellCache returns a cell cache with n cells of n/10 bees.
+func benchCellCache(n int) (*cellCache, []MappedCells) {
+	c := newCellCache()
+	cells := make([]MappedCells, n)
+	for i := range cells {
+		cells[i] = MappedCells{{Dict: "D", Key: strconv.Itoa(i)}}
+		id := uint64(i/10 + 1)
+		c.fill(c.generation(), "app", cells[i],
+			BeeInfo{ID: id, Colony: Colony{ID: id}})
+	}
+	return c, cells
+}
+
+// BenchmarkCellCacheLookup measures the throughput of routing broadcast
+// messages through the cache. Run with -cpu to see how it scales with cores.
+func BenchmarkCellCacheLookup(b *testing.B) {
+	c, cells := benchCellCache(200000)
+	var next uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint64(&next, 7919))
+		for pb.Next() {
+			i = (i + 1) % len(cells)
+			if _, ok := c.beeForCells("app", cells[i]); !ok {
+				b.Fatalf("cells %v are not cached", cells[i])
+			}
+		}
+	})
+}
+
+// BenchmarkCellCacheLookupWithFills measures the throughput of the cache when
+// one in every 16 lookups also fills the cache.
+func BenchmarkCellCacheLookupWithFills(b *testing.B) {
+	c, cells := benchCellCache(200000)
+	var next uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint64(&next, 7919))
+		for pb.Next() {
+			i = (i + 1) % len(cells)
+			info, _ := c.beeForCells("app", cells[i])
+			if i%16 == 0 {
+				c.fill(c.generation(), "app", cells[i], info)
+			}
+		}
+	})
+}
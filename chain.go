@@ -0,0 +1,132 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	bhgob "github.com/kandoo/beehive/gob"
+)
+
+// chainTxResult is the result of applying a transaction on a chain of
+// followers.
+type chainTxResult struct {
+	Applied int         // The number of followers that applied the transaction.
+	Failed  []uint64    // The followers spliced out of the chain.
+	Err     bhgob.Error // The error of applying the transaction.
+}
+
+// ErrNoChainReplica is returned when none of the followers in the chain of a
+// colony applies a transaction.
+var ErrNoChainReplica = errors.New("beehive: no follower applied the " +
+	"transaction")
+
+// replicateChain sends the transaction down the chain of followers, and
+// applies it on the leader once the last follower has applied it. Failed
+// followers are removed from the colony. The transaction fails if no follower
+// applies it.
+func (b *bee) replicateChain(commit commitTx) error {
+	c := b.colony()
+	res := b.forwardChain(commit, c.Followers)
+	for _, f := range res.Failed {
+		info, err := b.hive.registry.bee(f)
+		if err != nil {
+			return err
+		}
+		glog.Warningf("%v removes failed follower %v from its chain", b, f)
+		if err := b.delFollower(f, info.Hive); err != nil {
+			return err
+		}
+	}
+	if !res.Err.IsNil() {
+		return res.Err
+	}
+	if len(c.Followers) != 0 && res.Applied == 0 {
+		return ErrNoChainReplica
+	}
+
+	_, err := b.Apply(commit)
+	return err
+}
+
+// forwardChain sends the transaction to the first follower of chain that is
+// reachable, and returns the followers that failed in the rest of the chain.
+//
+// A follower that does not respond in time is considered failed. The timeout
+// of each hop covers the followers after it, so that the failures down the
+// chain are detected before the upstream followers time out.
+func (b *bee) forwardChain(commit commitTx, chain []uint64) (
+	res chainTxResult) {
+
+	hop := 2 * b.hive.config.RaftElectTimeout()
+	for i, f := range chain {
+		r, err := b.sendCmdWithTimeout(f, cmdChainTx{Tx: commit, Chain: chain[i+1:]},
+			time.Duration(len(chain)-i)*hop)
+		if err != nil {
+			glog.Errorf("%v splices %v out of the chain: %v", b, f, err)
+			res.Failed = append(res.Failed, f)
+			continue
+		}
+		fres := r.(chainTxResult)
+		res.Applied = fres.Applied
+		res.Failed = append(res.Failed, fres.Failed...)
+		res.Err = fres.Err
+		return res
+	}
+	return res
+}
+
+// applyChainTx applies a transaction on a follower, and forwards it to the
+// rest of the chain in the background, so that the follower keeps handling
+// its commands. The result is sent on ch once the rest of the chain applies
+// the transaction.
+func (b *bee) applyChainTx(commit commitTx, chain []uint64,
+	ch chan cmdResult) {
+
+	reply := func(res chainTxResult) {
+		if ch != nil {
+			ch <- cmdResult{Data: res}
+		}
+	}
+
+	if b.colony().Leader == b.ID() {
+		reply(chainTxResult{
+			Err: bhgob.Errorf("%v is the leader of its colony", b),
+		})
+		return
+	}
+
+	b.Lock()
+	applied := commit.Term == b.txTerm && commit.Seq != 0 &&
+		commit.Seq <= b.txApplied[commit.Origin]
+	b.Unlock()
+	if applied {
+		// The transaction is retried, and may be missing down the chain.
+		glog.V(2).Infof("%v has already applied %v", b, commit)
+	} else if _, err := b.Apply(commit); err != nil {
+		reply(chainTxResult{Err: bhgob.NewError(err)})
+		return
+	}
+
+	go func() {
+		res := b.forwardChain(commit, chain)
+		res.Applied++
+		reply(res)
+	}()
+}
+
+// sendState sends the committed state of the bee to the given bee.
+func (b *bee) sendState(to uint64) error {
+	s, err := b.stateL1.State.Save()
+	if err != nil {
+		return fmt.Errorf("%v cannot save its state: %v", b, err)
+	}
+	_, err = b.sendFencedCmd(to, cmdRestoreState{State: s})
+	return err
+}
+
+func init() {
+	gob.Register(chainTxResult{})
+}
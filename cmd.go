@@ -4,6 +4,7 @@ import (
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"time"
 )
 
 // Cmd represents a control command.
@@ -12,10 +13,25 @@ import (
 // If App is not "" and To is 0, the command should be handed to the qee.
 // Otherwise it is for a bee of that app.
 type cmd struct {
-	Hive uint64
-	App  string
-	Bee  uint64
-	Data interface{}
+	Hive  uint64
+	App   string
+	Bee   uint64
+	Data  interface{}
+	Fence fence
+}
+
+// fence is a fencing token. Commands sent by the leader of a colony carry the
+// term in which the leader was elected. The registry records the term of the
+// latest leader of each colony, and a command with an older term is sent by a
+// deposed leader, for example one that is just reconnected after a partition.
+type fence struct {
+	Colony uint64
+	Term   uint64
+}
+
+// IsNil returns whether the command is not fenced.
+func (f fence) IsNil() bool {
+	return f.Colony == Nil
 }
 
 func (c cmd) String() string {
@@ -26,6 +42,28 @@ func (c cmd) String() string {
 // supported by the receiver of the command.
 var ErrInvalidCmd = errors.New("invalid command")
 
+// StaleTermError is returned when a command is sent by a deposed leader of a
+// colony, i.e., the command is fenced with a term older than the term of the
+// colony known by the receiver. The sender should step down, and the error
+// can be detected using IsStaleTerm even when the command is sent to a remote
+// hive.
+type StaleTermError struct {
+	Colony  uint64 // The colony.
+	Term    uint64 // The term of the sender.
+	Current uint64 // The term known by the receiver.
+}
+
+func (e StaleTermError) Error() string {
+	return fmt.Sprintf("stale term %v for colony %v (current term %v)", e.Term,
+		e.Colony, e.Current)
+}
+
+// IsStaleTerm returns whether err is a StaleTermError.
+func IsStaleTerm(err error) bool {
+	_, ok := err.(StaleTermError)
+	return ok
+}
+
 type cmdAndChannel struct {
 	cmd cmd
 	ch  chan cmdResult
@@ -40,6 +78,58 @@ func (r cmdResult) get() (interface{}, error) {
 	return r.Data, r.Err
 }
 
+// cmdWithTimeout calls send, and returns an error if send does not return in
+// timeout. This is used for commands sent to hives that may be unreachable.
+func cmdWithTimeout(timeout time.Duration,
+	send func() (interface{}, error)) (interface{}, error) {
+
+	ch := make(chan cmdResult, 1)
+	go func() {
+		res, err := send()
+		ch <- cmdResult{Data: res, Err: err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.get()
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("no response in %v", timeout)
+	}
+}
+
+// isIdempotent returns whether processing the command more than once has the
+// same effect as processing it once. Only idempotent commands are retried
+// when their result is lost.
+func isIdempotent(data interface{}) bool {
+	switch data.(type) {
+	case cmdCellOwner, cmdColonyCells, cmdFindBee, cmdLiveHives, cmdLogInfo,
+		cmdPing, cmdRestoreState, cmdSaveDict, cmdSaveState, cmdStateDigest,
+		cmdSync, cmdWhereIs:
+		return true
+	}
+	return false
+}
+
+// allIdempotent returns whether all the commands are idempotent.
+func allIdempotent(cmds []cmd) bool {
+	for _, c := range cmds {
+		if !isIdempotent(c.Data) {
+			return false
+		}
+	}
+	return true
+}
+
+// isStateTransfer returns whether the command carries the state of a bee,
+// e.g., when the bee is migrated or a new follower is recruited.
+func isStateTransfer(data interface{}) bool {
+	switch data.(type) {
+	case cmdApplyOps, cmdRestoreState:
+		return true
+	}
+	return false
+}
+
 func newCmdAndChannel(d interface{}, h uint64, a string, b uint64,
 	ch chan cmdResult) cmdAndChannel {
 
@@ -56,4 +146,5 @@ func newCmdAndChannel(d interface{}, h uint64, a string, b uint64,
 
 func init() {
 	gob.Register(cmd{})
+	gob.Register(StaleTermError{})
 }
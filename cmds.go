@@ -1,54 +1,134 @@
 package beehive
 
-import "encoding/gob"
+import (
+	"encoding/gob"
 
+	bhgob "github.com/kandoo/beehive/gob"
+	"github.com/kandoo/beehive/state"
+)
+
+type cmdAbortPrepared struct{ ID string }
+type cmdAckMsgs struct{ Seqs []uint64 }
 type cmdAddFollower struct {
 	Hive uint64
 	Bee  uint64
 }
 type cmdAddHive struct{ Hive HiveInfo }
+type cmdApplyOps struct{ Ops []state.Op }
 type cmdCampaign struct{}
+type cmdChainTx struct {
+	Tx    commitTx
+	Chain []uint64
+}
+type cmdCellOwner struct {
+	App  string
+	Cell CellKey
+}
+type cmdCheckFollowers struct{}
+type cmdCompleteHandoff struct {
+	To  uint64
+	Err bhgob.Error
+}
+type cmdColonyCells struct{ Bee uint64 }
+type cmdCommitPrepared struct{ ID string }
 type cmdCreateBee struct{}
+type cmdDelFollower struct {
+	Hive uint64
+	Bee  uint64
+}
 type cmdFindBee struct{ ID uint64 }
 type cmdHandoff struct{ To uint64 }
+type cmdHibernate struct{}
 type cmdRestoreState struct{ State []byte }
 type cmdJoinColony struct{ Colony Colony }
 type cmdAddMappedCells struct{ Cells MappedCells }
 type cmdRefreshRole struct{}
 type cmdLiveHives struct{}
+type cmdLocalBcast struct{ Msg msg }
+type cmdLogInfo struct{}
 type cmdMigrate struct {
 	Bee uint64
 	To  uint64
 }
+type cmdMoveCells struct {
+	From  uint64
+	To    uint64
+	Cells MappedCells
+}
 type cmdNewHiveID struct{}
 type cmdPing struct{}
+type cmdPrepareTx struct {
+	ID  string
+	Ops []state.Op
+}
+type cmdRepairDict struct {
+	Dict  string
+	State []byte
+}
+type cmdSaveDict struct{ Dict string }
+type cmdSaveState struct{}
+type cmdSplit struct {
+	Bee   uint64
+	Cells []MappedCells
+}
+type cmdReceipt struct {
+	ID  uint64
+	App string
+}
 type cmdReloadBee struct {
 	ID     uint64
 	Colony Colony
 }
 type cmdStart struct{}
+type cmdStateDigest struct{}
 type cmdStartDetached struct{ Handler DetachedHandler }
 type cmdStop struct{}
 type cmdSync struct{}
 
+// cmdUpdate is a local command that runs Fn in a transaction on a bee.
+type cmdUpdate struct{ Fn func(tx StateTx) error }
+type cmdWhereIs struct{ Msg msg }
+
 func init() {
+	gob.Register(cmdAbortPrepared{})
+	gob.Register(cmdAckMsgs{})
 	gob.Register(cmdAddFollower{})
 	gob.Register(cmdAddHive{})
 	gob.Register(cmdAddMappedCells{})
+	gob.Register(cmdApplyOps{})
 	gob.Register(cmdCampaign{})
+	gob.Register(cmdChainTx{})
+	gob.Register(cmdCellOwner{})
+	gob.Register(cmdCheckFollowers{})
+	gob.Register(cmdColonyCells{})
+	gob.Register(cmdCommitPrepared{})
+	gob.Register(cmdCompleteHandoff{})
 	gob.Register(cmdCreateBee{})
+	gob.Register(cmdDelFollower{})
 	gob.Register(cmdFindBee{})
 	gob.Register(cmdHandoff{})
+	gob.Register(cmdHibernate{})
 	gob.Register(cmdJoinColony{})
 	gob.Register(cmdLiveHives{})
+	gob.Register(cmdLocalBcast{})
+	gob.Register(cmdLogInfo{})
 	gob.Register(cmdMigrate{})
+	gob.Register(cmdMoveCells{})
 	gob.Register(cmdNewHiveID{})
 	gob.Register(cmdPing{})
+	gob.Register(cmdPrepareTx{})
+	gob.Register(cmdReceipt{})
 	gob.Register(cmdRefreshRole{})
 	gob.Register(cmdReloadBee{})
+	gob.Register(cmdRepairDict{})
 	gob.Register(cmdRestoreState{})
+	gob.Register(cmdSaveDict{})
+	gob.Register(cmdSaveState{})
+	gob.Register(cmdSplit{})
 	gob.Register(cmdStartDetached{})
 	gob.Register(cmdStart{})
+	gob.Register(cmdStateDigest{})
 	gob.Register(cmdStop{})
 	gob.Register(cmdSync{})
+	gob.Register(cmdWhereIs{})
 }
@@ -15,9 +15,15 @@ type Colony struct {
 	ID        uint64   `json:"id"`
 	Leader    uint64   `json:"leader"`
 	Followers []uint64 `json:"followers"`
+	// Witnesses are the followers that store only the metadata of transactions.
+	Witnesses []uint64 `json:"witnesses,omitempty"`
 }
 
 func (c Colony) String() string {
+	if len(c.Witnesses) != 0 {
+		return fmt.Sprintf("colony(id=%v, leader=%v, followers=%+v, witnesses=%+v)",
+			c.ID, c.Leader, c.Followers, c.Witnesses)
+	}
 	return fmt.Sprintf("colony(id=%v, leader=%v, followers=%+v)", c.ID, c.Leader,
 		c.Followers)
 }
@@ -42,6 +48,16 @@ func (c Colony) IsFollower(id uint64) bool {
 	return false
 }
 
+// IsWitness returns whether id is a witness in this colony.
+func (c Colony) IsWitness(id uint64) bool {
+	for _, w := range c.Witnesses {
+		if w == id {
+			return true
+		}
+	}
+	return false
+}
+
 // Contains returns whether id is the leader or a follower in this colony.
 func (c Colony) Contains(id uint64) bool {
 	return c.IsLeader(id) || c.IsFollower(id)
@@ -66,9 +82,27 @@ func (c *Colony) AddFollower(id uint64) bool {
 	return true
 }
 
+// AddWitness adds a witness to the colony. Returns false if id is already a
+// follower.
+func (c *Colony) AddWitness(id uint64) bool {
+	if !c.AddFollower(id) {
+		return false
+	}
+
+	c.Witnesses = append(c.Witnesses, id)
+	return true
+}
+
 // DelFollower deletes id from the followers of this colony. Returns false if
 // id is not already a follower.
 func (c *Colony) DelFollower(id uint64) bool {
+	for i, w := range c.Witnesses {
+		if w == id {
+			c.Witnesses = append(c.Witnesses[:i], c.Witnesses[i+1:]...)
+			break
+		}
+	}
+
 	for i, s := range c.Followers {
 		if s == id {
 			c.Followers = append(c.Followers[:i], c.Followers[i+1:]...)
@@ -79,11 +113,23 @@ func (c *Colony) DelFollower(id uint64) bool {
 	return false
 }
 
+// Quorum returns the number of bees in the colony, including the leader, that
+// must have a transaction for it to be committed. This is the majority of the
+// colony.
+func (c Colony) Quorum() int {
+	return (len(c.Followers)+1)/2 + 1
+}
+
 // DeepCopy creates a cloned copy of the colony.
 func (c Colony) DeepCopy() Colony {
 	f := make([]uint64, len(c.Followers))
 	copy(f, c.Followers)
 	c.Followers = f
+	if len(c.Witnesses) != 0 {
+		w := make([]uint64, len(c.Witnesses))
+		copy(w, c.Witnesses)
+		c.Witnesses = w
+	}
 	return c
 }
 
@@ -97,7 +143,9 @@ func (c Colony) Equals(thatC Colony) bool {
 		return false
 	}
 
-	if len(c.Followers) != len(thatC.Followers) {
+	if len(c.Followers) != len(thatC.Followers) ||
+		len(c.Witnesses) != len(thatC.Witnesses) {
+
 		return false
 	}
 
@@ -116,6 +164,12 @@ func (c Colony) Equals(thatC Colony) bool {
 		}
 	}
 
+	for _, w := range thatC.Witnesses {
+		if !c.IsWitness(w) {
+			return false
+		}
+	}
+
 	return true
 }
 
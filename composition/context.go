@@ -14,6 +14,38 @@ func (c composedRcvContext) Dict(name string) state.Dict {
 	return c.RcvContext.Dict(c.prefix + name)
 }
 
+func (c composedRcvContext) Update(fn func(tx bh.StateTx) error) error {
+	return c.RcvContext.Update(func(tx bh.StateTx) error {
+		return fn(composedStateTx{StateTx: tx, prefix: c.prefix})
+	})
+}
+
+func (c composedRcvContext) BeeState(id uint64) (state.State, error) {
+	s, err := c.RcvContext.BeeState(id)
+	if err != nil {
+		return nil, err
+	}
+	return composedState{State: s, prefix: c.prefix}, nil
+}
+
+type composedState struct {
+	state.State
+	prefix string
+}
+
+func (s composedState) Dict(name string) state.Dict {
+	return s.State.Dict(s.prefix + name)
+}
+
+type composedStateTx struct {
+	bh.StateTx
+	prefix string
+}
+
+func (t composedStateTx) Dict(name string) state.Dict {
+	return t.StateTx.Dict(t.prefix + name)
+}
+
 type composedMapContext struct {
 	bh.MapContext
 	prefix string
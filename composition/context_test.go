@@ -11,12 +11,14 @@ import (
 func newMockContext() *mockContext {
 	ctx := &mockContext{
 		Transactional: state.NewTransactional(state.NewInMem()),
+		local:         state.NewInMem().Dict("local"),
 	}
 	return ctx
 }
 
 type mockContext struct {
 	*state.Transactional
+	local     state.Dict
 	txAborted bool
 }
 
@@ -46,6 +48,15 @@ func (c mockContext) SendToCell(msgData interface{}, to string,
 func (c mockContext) Reply(msg bh.Msg, replyData interface{}) error {
 	return nil
 }
+func (c mockContext) EmitAfter(d time.Duration, msgData interface{}) {
+}
+func (c mockContext) Multicast(msgData interface{},
+	to ...uint64) map[uint64]error {
+	return nil
+}
+func (c mockContext) BroadcastToHives(msgData interface{}) map[uint64]error {
+	return nil
+}
 
 func (c mockContext) StartDetached(h bh.DetachedHandler) uint64 { return 0 }
 func (c mockContext) StartDetachedFunc(start bh.StartFunc, stop bh.StopFunc,
@@ -56,6 +67,7 @@ func (c mockContext) LockCells(keys []bh.CellKey) error { return nil }
 func (c mockContext) Snooze(d time.Duration)            {}
 func (c mockContext) BeeLocal() interface{}             { return nil }
 func (c mockContext) SetBeeLocal(d interface{})         {}
+func (c mockContext) LocalState() state.Dict            { return c.local }
 
 func (c mockContext) CommitTx() error {
 	c.txAborted = false
@@ -67,6 +79,28 @@ func (c mockContext) AbortTx() error {
 	return c.Transactional.AbortTx()
 }
 
+func (c mockContext) Update(fn func(tx bh.StateTx) error) error {
+	return state.Update(c.Transactional, func(tx state.State) error {
+		return fn(tx)
+	})
+}
+
+func (c mockContext) BeeState(id uint64) (state.State, error) {
+	return state.ReadOnly(c.Transactional), nil
+}
+
+func (c mockContext) Savepoint() (bh.Savepoint, error) {
+	return bh.Savepoint{}, nil
+}
+
+func (c mockContext) RollbackTo(sp bh.Savepoint) error {
+	return nil
+}
+
+func (c mockContext) CommitWith(writes []bh.CellWrite) error {
+	return nil
+}
+
 func (c mockContext) DeferReply(msg bh.Msg) bh.Repliable {
 	return bh.Repliable{}
 }
@@ -0,0 +1,161 @@
+package beehive
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/raft"
+)
+
+// The codecs of the payloads sent between hives. The first byte of each
+// payload is its codec.
+const (
+	codecNone       byte = 0
+	codecFlate      byte = 1
+	codecProto      byte = 2
+	codecProtoFlate byte = 3
+)
+
+// codecNames are the names of the codecs exchanged in negotiations.
+var codecNames = map[byte]string{
+	codecFlate: "flate",
+	codecProto: "proto",
+}
+
+// raftFlate is advertised among the codecs of hives that accept compressed
+// raft batches.
+const raftFlate = "raft-flate"
+
+// flateCodecs are the compressed codecs of the codecs.
+var flateCodecs = map[byte]byte{
+	codecNone:  codecFlate,
+	codecProto: codecProtoFlate,
+}
+
+// encodePayload gob-encodes v, and compresses it if it is larger than thresh.
+func encodePayload(v interface{}, thresh uint) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(codecNone)
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return compressPayload(buf.Bytes(), thresh)
+}
+
+// compressPayload compresses the raw payload if it is larger than thresh.
+func compressPayload(raw []byte, thresh uint) ([]byte, error) {
+	if thresh == 0 || uint(len(raw)-1) <= thresh {
+		return raw, nil
+	}
+
+	var cbuf bytes.Buffer
+	cbuf.WriteByte(flateCodecs[raw[0]])
+	w, err := flate.NewWriter(&cbuf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(raw[1:]); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	compressedBytes.WithLabelValues("raw").Add(float64(len(raw) - 1))
+	compressedBytes.WithLabelValues("compressed").Add(float64(cbuf.Len() - 1))
+	return cbuf.Bytes(), nil
+}
+
+// decodePayload decompresses the payload, if compressed, and decodes it into
+// v.
+func decodePayload(p []byte, v interface{}) error {
+	if len(p) == 0 {
+		return errors.New("rpc: empty payload")
+	}
+
+	var r io.Reader = bytes.NewReader(p[1:])
+	switch p[0] {
+	case codecNone, codecProto:
+	case codecFlate, codecProtoFlate:
+		fr := flate.NewReader(r)
+		defer fr.Close()
+		r = fr
+	default:
+		return fmt.Errorf("rpc: unsupported codec %v", p[0])
+	}
+	if p[0] == codecProto || p[0] == codecProtoFlate {
+		return decodeProtoPayload(r, v)
+	}
+	return gob.NewDecoder(r).Decode(v)
+}
+
+// negotiate enables compression on the client if the remote hive supports
+// it. Hives that do not support compression are sent plain payloads.
+func (c *rpcClient) negotiate(thresh uint) {
+	if thresh == 0 {
+		return
+	}
+
+	var codecs []string
+	if err := c.cmd.Call("rpcServer.Codecs", struct{}{}, &codecs); err != nil {
+		glog.V(2).Infof("%v does not support compression: %v", c, err)
+		return
+	}
+	for _, codec := range codecs {
+		switch codec {
+		case codecNames[codecFlate]:
+			c.compress = thresh
+		case raftFlate:
+			c.raftFlate = true
+		}
+	}
+	if c.compress == 0 {
+		c.raftFlate = false
+	}
+}
+
+// Codecs returns the codecs supported by the server.
+func (s *rpcServer) Codecs(dummy struct{}, codecs *[]string) error {
+	*codecs = []string{codecNames[codecFlate], codecNames[codecProto],
+		raftFlate}
+	return nil
+}
+
+// EnqueMsgPayload is the same as EnqueMsg for a payload of messages.
+func (s *rpcServer) EnqueMsgPayload(p []byte, dummy *struct{}) error {
+	var msgs []msg
+	if err := decodePayload(p, &msgs); err != nil {
+		return err
+	}
+	return s.EnqueMsg(msgs, dummy)
+}
+
+// ProcessRaftPayload is the same as ProcessRaft for a payload of a raft batch.
+func (s *rpcServer) ProcessRaftPayload(p []byte, dummy *bool) error {
+	var batch raft.Batch
+	if err := decodePayload(p, &batch); err != nil {
+		return err
+	}
+	return s.ProcessRaft(batch, dummy)
+}
+
+// ProcessCmdPayload is the same as ProcessCmd for a payload of commands. The
+// results are returned as a payload, compressed using the threshold of this
+// hive.
+func (s *rpcServer) ProcessCmdPayload(p []byte, res *[]byte) error {
+	var cmds []cmd
+	if err := decodePayload(p, &cmds); err != nil {
+		return err
+	}
+	var r []cmdResult
+	if err := s.ProcessCmd(cmds, &r); err != nil {
+		return err
+	}
+	var err error
+	*res, err = encodePayload(r, s.h.config.CompressThresh)
+	return err
+}
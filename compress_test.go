@@ -0,0 +1,119 @@
+package beehive
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+	dto "github.com/kandoo/beehive/Godeps/_workspace/src/github.com/prometheus/client_model/go"
+	"github.com/kandoo/beehive/raft"
+)
+
+func TestPayload(t *testing.T) {
+	msgs := []msg{{MsgData: strings.Repeat("a", 1024), MsgTo: 1}}
+	for _, thresh := range []uint{0, 1 << 20, 1} {
+		p, err := encodePayload(msgs, thresh)
+		if err != nil {
+			t.Fatalf("cannot encode the payload: %v", err)
+		}
+		want := codecNone
+		if thresh == 1 {
+			want = codecFlate
+		}
+		if p[0] != want {
+			t.Errorf("invalid codec for threshold %v: actual=%v want=%v", thresh,
+				p[0], want)
+		}
+
+		var res []msg
+		if err := decodePayload(p, &res); err != nil {
+			t.Fatalf("cannot decode the payload: %v", err)
+		}
+		if len(res) != 1 || res[0].MsgData != msgs[0].MsgData {
+			t.Errorf("invalid decoded payload: %v", res)
+		}
+	}
+
+	if err := decodePayload([]byte{42}, &[]msg{}); err == nil {
+		t.Error("payload of an unknown codec is decoded")
+	}
+}
+
+func TestCompressedDelivery(t *testing.T) {
+	ch := make(chan string)
+	register := func(h Hive) {
+		a := h.NewApp("compressed")
+		a.HandleFunc("", func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(msg Msg, ctx RcvContext) error {
+			ch <- msg.Data().(string)
+			return nil
+		})
+	}
+
+	h1 := newHiveForTest(CompressThresh(64))
+	register(h1)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(CompressThresh(64), PeerAddrs(h1.Config().Addr))
+	register(h2)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	h1.Emit("a")
+	<-ch
+
+	compressed := func() float64 {
+		var m dto.Metric
+		compressedBytes.WithLabelValues("raw").Write(&m)
+		return m.GetCounter().GetValue()
+	}
+	before := compressed()
+
+	// The message is sent by the proxy on h2 in a compressed payload.
+	data := strings.Repeat("b", 1024)
+	h2.Emit(data)
+	if d := <-ch; d != data {
+		t.Errorf("invalid message: actual=%v want=%v", d, data)
+	}
+	if compressed() == before {
+		t.Error("the message is not compressed")
+	}
+	c, err := h2.(*hive).client.hiveClient(h1.ID())
+	if err != nil {
+		t.Fatalf("cannot find the client of %v: %v", h1, err)
+	}
+	if c.compress != 64 || !c.raftFlate {
+		t.Errorf("compression is not negotiated: %v, %v", c.compress, c.raftFlate)
+	}
+}
+
+func TestRaftPayload(t *testing.T) {
+	entry := raftpb.Entry{Data: []byte(strings.Repeat("tx", 1024))}
+	batch := &raft.Batch{
+		From: 1,
+		To:   2,
+		Messages: map[uint64][]raftpb.Message{
+			3: {{Type: raftpb.MsgApp, Entries: []raftpb.Entry{entry}}},
+		},
+	}
+	p, err := encodePayload(batch, 64)
+	if err != nil {
+		t.Fatalf("cannot encode the batch: %v", err)
+	}
+	if p[0] != codecFlate {
+		t.Errorf("the batch is not compressed: %v", p[0])
+	}
+
+	var res raft.Batch
+	if err := decodePayload(p, &res); err != nil {
+		t.Fatalf("cannot decode the batch: %v", err)
+	}
+	if !reflect.DeepEqual(&res, batch) {
+		t.Errorf("invalid batch: actual=%+v want=%+v", res, *batch)
+	}
+}
@@ -0,0 +1,136 @@
+package beehive
+
+import (
+	"errors"
+
+	"github.com/kandoo/beehive/state"
+)
+
+// ErrMapState is returned when the map function of an application with
+// ConcurrentMap uses the dictionaries of its context.
+var ErrMapState = errors.New("beehive: concurrent map functions have no state")
+
+// mapJob is a message in the map pipeline.
+type mapJob struct {
+	seq   uint64
+	mh    msgAndHandler
+	cells MappedCells
+}
+
+// mapPipeline invokes the map functions of a queen on up to workers messages
+// concurrently, and hands the messages off to their bees in the order they
+// are received. As such, a slow map function delays the messages received
+// after its message, but not the map functions of those messages or the
+// commands of the queen. Except for invoking map functions, the pipeline is
+// used only in the queen's goroutine.
+type mapPipeline struct {
+	workers int
+	running int
+	// next is the sequence of the next message pushed to the pipeline, and
+	// handed is the sequence of the next message to hand off.
+	next   uint64
+	handed uint64
+	// queue has the messages waiting for a worker.
+	queue []mapJob
+	// done has the messages that are mapped but not handed off yet.
+	done map[uint64]mapJob
+	res  chan mapJob
+}
+
+// startMapPipeline starts the map pipeline of the queen, if the application
+// has concurrent map functions. It returns the channel of the mapped
+// messages, which is nil otherwise.
+func (q *qee) startMapPipeline() <-chan mapJob {
+	if q.app.mapWorkers <= 1 {
+		return nil
+	}
+	q.maps = &mapPipeline{
+		workers: q.app.mapWorkers,
+		done:    make(map[uint64]mapJob),
+		res:     make(chan mapJob, q.app.mapWorkers),
+	}
+	return q.maps.res
+}
+
+// push adds mhs to the pipeline.
+func (p *mapPipeline) push(q *qee, mhs []msgAndHandler) {
+	for _, mh := range mhs {
+		j := mapJob{seq: p.next, mh: mh}
+		p.next++
+		if q.shouldMap(&j.mh) {
+			p.queue = append(p.queue, j)
+			continue
+		}
+		p.done[j.seq] = j
+	}
+	p.dispatch(q)
+	p.handOff(q)
+}
+
+// dispatch invokes the map functions of the queued messages on the idle
+// workers.
+func (p *mapPipeline) dispatch(q *qee) {
+	for p.running < p.workers && len(p.queue) != 0 {
+		j := p.queue[0]
+		p.queue[0] = mapJob{}
+		p.queue = p.queue[1:]
+		p.running++
+		go func(j mapJob) {
+			j.cells = q.invokeMap(j.mh, concurrentMapCtx{q})
+			p.res <- j
+		}(j)
+	}
+}
+
+// handOff routes the mapped messages that are received before all the
+// messages that are not mapped yet.
+func (p *mapPipeline) handOff(q *qee) {
+	var mhs []msgAndHandler
+	var mapped []MappedCells
+	for {
+		j, ok := p.done[p.handed]
+		if !ok {
+			break
+		}
+		delete(p.done, p.handed)
+		p.handed++
+		mhs = append(mhs, j.mh)
+		mapped = append(mapped, j.cells)
+	}
+	if len(mhs) != 0 {
+		q.routeMsgs(mhs, mapped)
+	}
+}
+
+// mapped is called in the queen's goroutine when the map function of j
+// returns.
+func (q *qee) mapped(j mapJob) {
+	p := q.maps
+	p.running--
+	p.done[j.seq] = j
+	p.dispatch(q)
+	p.handOff(q)
+}
+
+// concurrentMapCtx is the context of concurrent map functions, which cannot
+// access the state of the queen.
+type concurrentMapCtx struct {
+	*qee
+}
+
+func (c concurrentMapCtx) Dict(name string) state.Dict {
+	return noStateDict(name)
+}
+
+// noStateDict is a dictionary whose operations fail with ErrMapState.
+type noStateDict string
+
+func (d noStateDict) Name() string { return string(d) }
+
+func (d noStateDict) Get(k string) (interface{}, error) {
+	return nil, ErrMapState
+}
+
+func (d noStateDict) Put(k string, v interface{}) error { return ErrMapState }
+func (d noStateDict) Del(k string) error                { return ErrMapState }
+func (d noStateDict) ForEach(f state.IterFn)            {}
@@ -69,17 +69,34 @@ type RcvContext interface {
 
 	// Emit emits a message.
 	Emit(msgData interface{})
+	// EmitAfter emits a message after at least duration d. The delayed message
+	// is stored in the state of the bee, and is emitted even if the bee is
+	// migrated in the meantime. If called in a transaction, the message is
+	// emitted only if the transaction is committed.
+	EmitAfter(d time.Duration, msgData interface{})
 	// SendToCell sends a message to the bee of the give app that owns the
 	// given cell.
 	SendToCell(msgData interface{}, app string, cell CellKey)
 	// SendToBee sends a message to the given bee.
 	SendToBee(msgData interface{}, to uint64)
+	// Multicast sends a message to each of the given bees, and returns the
+	// error of the bees that the message cannot be sent to, e.g., because they
+	// do not exist or their application does not handle the message. The
+	// message is sent to the rest of the bees. Similar to SendToBee, the
+	// message is buffered if the handler is in a transaction.
+	Multicast(msgData interface{}, to ...uint64) map[uint64]error
 	// Reply replies to a message: Sends a message from the current bee to the
 	// bee that emitted msg.
 	Reply(msg Msg, replyData interface{}) error
 	// DeferReply returns a Repliable that can be used to reply to a
 	// message (either a sync or a async message) later.
 	DeferReply(msg Msg) Repliable
+	// BroadcastToHives delivers a message to all the existing bees of the
+	// applications that handle the message on every hive, bypassing their map
+	// functions. It blocks until the message is delivered to the hives, and returns the
+	// delivery error of each hive. Note that the message is sent immediately,
+	// even if the handler is in a transaction.
+	BroadcastToHives(msgData interface{}) map[uint64]error
 
 	// StartDetached spawns a detached handler.
 	StartDetached(h DetachedHandler) uint64
@@ -99,6 +116,11 @@ type RcvContext interface {
 	BeeLocal() interface{}
 	// SetBeeLocal sets a data in the bee-local storage.
 	SetBeeLocal(d interface{})
+	// LocalState returns the bee-local scratch dictionary. Similar to BeeLocal,
+	// it is just visible to the current bee and is not part of the state: it is
+	// not transactional, and is neither replicated nor migrated with the bee.
+	// It is suitable for caches that can be rebuilt from the state.
+	LocalState() state.Dict
 
 	// Starts a transaction in this context. Transactions span multiple
 	// dictionaries and buffer all messages. When a transaction commits all the
@@ -113,6 +135,54 @@ type RcvContext interface {
 	CommitTx() error
 	// Aborts the transaction.
 	AbortTx() error
+	// Savepoint returns a savepoint in the current transaction, which can be
+	// used for a partial rollback.
+	Savepoint() (Savepoint, error)
+	// RollbackTo discards the changes in the state and the messages buffered
+	// after the savepoint, and keeps the current transaction open.
+	RollbackTo(sp Savepoint) error
+	// CommitWith atomically commits writes on cells owned by other bees, possibly
+	// of other applications, with the current transaction using two-phase
+	// commit. The writes on the cells of the current bee are added to the
+	// current transaction. CommitWith returns an error if any of the owners
+	// cannot prepare its writes in time, in which case no remote write is
+	// applied and the current transaction should be aborted (e.g., by returning
+	// the error). Otherwise, the remote writes are applied once the current
+	// transaction is committed, and discarded if it is aborted.
+	//
+	// Note that prepared cells are only protected against other distributed
+	// transactions, not against the handlers of their owners. The owners abort
+	// the transactions that are not committed in a minute.
+	CommitWith(writes []CellWrite) error
+
+	// Update atomically applies the changes fn makes in the dictionaries of
+	// this context: either all the changes are applied or, if fn returns an
+	// error, none of them. Unlike BeginTx and CommitTx, Update can be used
+	// inside and outside the transaction of the current message, and is safe to
+	// call from the Start method of detached handlers.
+	Update(fn func(tx StateTx) error) error
+
+	// BeeState returns a read-only snapshot of the state of the given bee of
+	// this application. The snapshot is taken between two transactions of that
+	// bee and is consistent. BeeState blocks until the snapshot is received, and
+	// is mainly used by detached handlers to expose stats or serve queries.
+	BeeState(id uint64) (state.State, error)
+}
+
+// Savepoint is a point in the transaction of a bee that the transaction can be
+// rolled back to. Savepoints are created using RcvContext.Savepoint().
+type Savepoint struct {
+	state state.Savepoint
+	msgs  int
+}
+
+// localStateDict is the name of the dictionary returned by LocalState.
+const localStateDict = "__local__"
+
+// StateTx is the view of the state of a bee in an atomic update.
+type StateTx interface {
+	// Dict returns the dictionary with the given name.
+	Dict(name string) state.Dict
 }
 
 func init() {
@@ -0,0 +1,120 @@
+package beehive
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// defaultDeadLetters is the default number of dead letters kept for each
+// application on each hive.
+const defaultDeadLetters = 1024
+
+// ErrNoSuchDeadLetter is returned when reprocessing a dead letter that does
+// not exist.
+var ErrNoSuchDeadLetter = errors.New("beehive: no such dead letter")
+
+// DeadLetter is a message that is dropped because the application has failed
+// to map or to handle it.
+type DeadLetter struct {
+	ID       uint64    // ID of the dead letter, unique on the hive.
+	Msg      Msg       // The original message.
+	Err      string    // The last error.
+	Attempts int       // Number of times the message has failed.
+	Time     time.Time // When the message has last failed.
+	Stack    string    // The stack of the handler, if it has panicked.
+}
+
+// deadLetterQueue keeps the latest dead letters of an application. When it is
+// full, the oldest dead letters are discarded.
+type deadLetterQueue struct {
+	sync.Mutex
+	max     int
+	lastID  uint64
+	letters []deadLetter
+}
+
+type deadLetter struct {
+	DeadLetter
+	mh msgAndHandler
+}
+
+func newDeadLetterQueue(max int) *deadLetterQueue {
+	return &deadLetterQueue{max: max}
+}
+
+func (q *deadLetterQueue) add(mh msgAndHandler, err interface{}) {
+	q.addWithStack(mh, err, nil)
+}
+
+// addWithStack adds a dead letter for a message whose handler has panicked
+// with the given stack.
+func (q *deadLetterQueue) addWithStack(mh msgAndHandler, err interface{},
+	stack []byte) {
+
+	if q == nil || q.max <= 0 || mh.msg == nil {
+		return
+	}
+
+	mh.attempts++
+	q.Lock()
+	defer q.Unlock()
+	q.lastID++
+	if len(q.letters) == q.max {
+		glog.V(2).Infof("discards dead letter %v", q.letters[0].ID)
+		copy(q.letters, q.letters[1:])
+		q.letters = q.letters[:q.max-1]
+	}
+	q.letters = append(q.letters, deadLetter{
+		DeadLetter: DeadLetter{
+			ID:       q.lastID,
+			Msg:      mh.msg,
+			Err:      fmt.Sprint(err),
+			Attempts: mh.attempts,
+			Time:     time.Now(),
+			Stack:    string(stack),
+		},
+		mh: mh,
+	})
+}
+
+func (q *deadLetterQueue) list() []DeadLetter {
+	q.Lock()
+	defer q.Unlock()
+	l := make([]DeadLetter, 0, len(q.letters))
+	for _, d := range q.letters {
+		l = append(l, d.DeadLetter)
+	}
+	return l
+}
+
+// remove removes the dead letter with the given ID from the queue.
+func (q *deadLetterQueue) remove(id uint64) (msgAndHandler, error) {
+	q.Lock()
+	defer q.Unlock()
+	for i, d := range q.letters {
+		if d.ID == id {
+			q.letters = append(q.letters[:i], q.letters[i+1:]...)
+			return d.mh, nil
+		}
+	}
+	return msgAndHandler{}, ErrNoSuchDeadLetter
+}
+
+func (a *app) DeadLetters() []DeadLetter {
+	return a.deadLetters.list()
+}
+
+func (a *app) Reprocess(id uint64) error {
+	mh, err := a.deadLetters.remove(id)
+	if err != nil {
+		return err
+	}
+	// The message is routed again, since the bee that owned its cells may have
+	// changed.
+	a.qee.enqueMsg(mh)
+	return nil
+}
@@ -0,0 +1,55 @@
+package beehive
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterReprocess(t *testing.T) {
+	h := newHiveForTest()
+	ch := make(chan int, 3)
+	a := h.NewApp("deadletter")
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	rf := func(msg Msg, ctx RcvContext) error {
+		ch <- msg.Data().(int)
+		return errors.New("failure")
+	}
+	a.HandleFunc(0, mf, rf)
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(1)
+	<-ch
+	waitForDeadLetters := func(n int) []DeadLetter {
+		for i := 0; i < 100; i++ {
+			if l := a.DeadLetters(); len(l) == n {
+				return l
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("no dead letter")
+		return nil
+	}
+
+	l := waitForDeadLetters(1)
+	if l[0].Attempts != 1 || l[0].Msg.Data() != 1 || l[0].Err != "failure" {
+		t.Errorf("invalid dead letter: %#v", l[0])
+	}
+
+	if err := a.Reprocess(l[0].ID); err != nil {
+		t.Fatalf("cannot reprocess the dead letter: %v", err)
+	}
+	<-ch
+	l = waitForDeadLetters(1)
+	if l[0].Attempts != 2 {
+		t.Errorf("invalid attempts: actual=%v want=2", l[0].Attempts)
+	}
+
+	if err := a.Reprocess(l[0].ID + 1); err != ErrNoSuchDeadLetter {
+		t.Errorf("reprocessed a non-existing dead letter: %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// timersDict is the dictionary that keeps the delayed messages of a bee. Since
+// it is part of the state of the bee, delayed messages are replicated and
+// migrated with the bee.
+const timersDict = "__timers__"
+
+// delayedMsg is a message emitted by EmitAfter that is not fired yet.
+type delayedMsg struct {
+	At    time.Time
+	Data  interface{}
+	Trace uint64
+}
+
+// timerFired is sent to a bee by the hive when the timer of one of its delayed
+// messages fires.
+type timerFired struct {
+	Key string
+}
+
+// timerHandler emits the delayed message of a fired timer. Timers may fire more
+// than once, for example when the bee is migrated, and the delayed message is
+// removed from the state once emitted.
+type timerHandler struct{}
+
+func (h timerHandler) Rcv(msg Msg, ctx RcvContext) error {
+	k := msg.Data().(timerFired).Key
+	d := ctx.Dict(timersDict)
+	v, err := d.Get(k)
+	if err != nil {
+		glog.V(2).Infof("%v ignores timer %v: %v", ctx, k, err)
+		return nil
+	}
+	if err := d.Del(k); err != nil {
+		return err
+	}
+	ctx.Emit(v.(delayedMsg).Data)
+	return nil
+}
+
+func (h timerHandler) Map(msg Msg, ctx MapContext) MappedCells {
+	return nil
+}
+
+// timerQueue keeps the timers of the delayed messages of the bees in a hive.
+type timerQueue struct {
+	sync.Mutex
+	hive   *hive
+	timers map[uint64]map[string]*time.Timer
+}
+
+func newTimerQueue(h *hive) *timerQueue {
+	return &timerQueue{
+		hive:   h,
+		timers: make(map[uint64]map[string]*time.Timer),
+	}
+}
+
+// add schedules the delayed message of bee stored in key to fire at the given
+// time. If the message is already scheduled, its timer is reset.
+func (q *timerQueue) add(bee uint64, key string, dm delayedMsg) {
+	q.Lock()
+	defer q.Unlock()
+
+	bt, ok := q.timers[bee]
+	if !ok {
+		bt = make(map[string]*time.Timer)
+		q.timers[bee] = bt
+	}
+	if t, ok := bt[key]; ok {
+		t.Stop()
+	}
+	bt[key] = time.AfterFunc(dm.At.Sub(time.Now()), func() {
+		q.fire(bee, key, dm.Trace)
+	})
+}
+
+func (q *timerQueue) fire(bee uint64, key string, trace uint64) {
+	q.Lock()
+	bt := q.timers[bee]
+	if _, ok := bt[key]; !ok {
+		q.Unlock()
+		return
+	}
+	delete(bt, key)
+	if len(bt) == 0 {
+		delete(q.timers, bee)
+	}
+	q.Unlock()
+
+	q.hive.enqueMsg(&msg{
+		MsgData:  timerFired{Key: key},
+		MsgTo:    bee,
+		MsgTrace: trace,
+	})
+}
+
+// cancel stops the timers of bee.
+func (q *timerQueue) cancel(bee uint64) {
+	q.Lock()
+	defer q.Unlock()
+
+	for _, t := range q.timers[bee] {
+		t.Stop()
+	}
+	delete(q.timers, bee)
+}
+
+// has returns whether bee has a timer.
+func (q *timerQueue) has(bee uint64) bool {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.timers[bee]) != 0
+}
+
+// stop stops all the timers.
+func (q *timerQueue) stop() {
+	q.Lock()
+	defer q.Unlock()
+
+	for _, bt := range q.timers {
+		for _, t := range bt {
+			t.Stop()
+		}
+	}
+	q.timers = make(map[uint64]map[string]*time.Timer)
+}
+
+// len returns the number of pending timers.
+func (q *timerQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	n := 0
+	for _, bt := range q.timers {
+		n += len(bt)
+	}
+	return n
+}
+
+func (b *bee) EmitAfter(d time.Duration, msgData interface{}) {
+	if b.detached {
+		// Detached bees have no state, and their timers are not persisted.
+		time.AfterFunc(d, func() { b.Emit(msgData) })
+		return
+	}
+
+	trace := b.trace
+	if trace == 0 {
+		trace = newTraceID()
+	}
+	k := fmt.Sprintf("%016x", newTraceID())
+	dm := delayedMsg{At: time.Now().Add(d), Data: msgData, Trace: trace}
+	if err := b.Dict(timersDict).Put(k, dm); err != nil {
+		glog.Errorf("%v cannot store delayed message %v: %v", b, msgData, err)
+		return
+	}
+	b.hive.timers.add(b.ID(), k, dm)
+}
+
+// scheduleTimers registers the timers of the delayed messages in the state of
+// the bee. It is called when the bee becomes the leader of its colony, or when
+// its state is restored, so that delayed messages survive migrations and
+// failures.
+func (b *bee) scheduleTimers() {
+	if b.detached || b.proxy {
+		return
+	}
+
+	dicts, _ := b.currentState()
+	dicts.Dict(timersDict).ForEach(func(k string, v interface{}) bool {
+		b.hive.timers.add(b.ID(), k, v.(delayedMsg))
+		return true
+	})
+}
+
+func init() {
+	gob.Register(delayedMsg{})
+	gob.Register(timerFired{})
+}
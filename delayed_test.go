@@ -0,0 +1,78 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/state"
+)
+
+type delayedTestStart struct{}
+type delayedTestFired struct{}
+
+func TestEmitAfter(t *testing.T) {
+	d := 100 * time.Millisecond
+	ch := make(chan time.Time, 2)
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+
+	h := newHiveForTest()
+	app := h.NewApp("delayed")
+	app.HandleFunc(delayedTestStart{}, mapf, func(msg Msg, ctx RcvContext) error {
+		ctx.EmitAfter(d, delayedTestFired{})
+		return nil
+	})
+	app.HandleFunc(delayedTestFired{}, mapf, func(msg Msg, ctx RcvContext) error {
+		n := 0
+		ctx.Dict(timersDict).ForEach(func(k string, v interface{}) bool {
+			n++
+			return true
+		})
+		if n != 0 {
+			t.Errorf("delayed message is not removed from the state")
+		}
+		ch <- time.Now()
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	start := time.Now()
+	h.Emit(delayedTestStart{})
+	if at := <-ch; at.Sub(start) < d {
+		t.Errorf("delayed message is emitted after %v", at.Sub(start))
+	}
+	select {
+	case <-ch:
+		t.Error("delayed message is emitted twice")
+	case <-time.After(2 * d):
+	}
+}
+
+func TestScheduleTimers(t *testing.T) {
+	h := newHiveForTest().(*hive)
+	b := &bee{beeID: 1, hive: h, app: &app{name: "delayed"}}
+	b.setState(state.NewInMem())
+	dm := delayedMsg{At: time.Now().Add(time.Hour), Data: 1, Trace: 2}
+	b.Dict(timersDict).Put("a", dm)
+	b.Dict(timersDict).Put("b", dm)
+	defer h.timers.stop()
+
+	// A bee that takes over the state of another bee schedules its timers.
+	b.scheduleTimers()
+	if n := h.timers.len(); n != 2 {
+		t.Errorf("invalid number of timers: actual=%v want=2", n)
+	}
+	b.scheduleTimers()
+	if n := h.timers.len(); n != 2 {
+		t.Errorf("timers are scheduled twice: actual=%v want=2", n)
+	}
+
+	h.timers.cancel(b.ID())
+	if n := h.timers.len(); n != 0 {
+		t.Errorf("timers are not canceled: %v", n)
+	}
+}
@@ -3,6 +3,8 @@ package beehive
 import (
 	"testing"
 	"time"
+
+	"github.com/kandoo/beehive/state"
 )
 
 type testDetachedHandler struct {
@@ -59,3 +61,95 @@ func TestDetached(t *testing.T) {
 
 	h.Stop()
 }
+
+type testDetachedUpdateHandler struct {
+	ch chan int
+}
+
+func (d *testDetachedUpdateHandler) Start(ctx RcvContext) {
+	ctx.Update(func(tx StateTx) error {
+		tx.Dict("d1").Put("k", 1)
+		tx.Dict("d2").Put("k", 2)
+		return nil
+	})
+	ctx.SendToBee(testDetachedMsg(0), ctx.ID())
+}
+
+func (d *testDetachedUpdateHandler) Stop(ctx RcvContext) {}
+
+func (d *testDetachedUpdateHandler) Rcv(msg Msg, ctx RcvContext) error {
+	return ctx.Update(func(tx StateTx) error {
+		sum := 0
+		for _, n := range []string{"d1", "d2"} {
+			v, err := tx.Dict(n).Get("k")
+			if err != nil {
+				return err
+			}
+			sum += v.(int)
+		}
+		d.ch <- sum
+		return nil
+	})
+}
+
+func TestDetachedUpdate(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("TestDetachedUpdate")
+	ch := make(chan int, 1)
+	app.Detached(&testDetachedUpdateHandler{ch: ch})
+
+	go h.Start()
+	defer h.Stop()
+
+	select {
+	case sum := <-ch:
+		if sum != 3 {
+			t.Errorf("invalid sum of values: actual=%v want=3", sum)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("did not receive any message on the channel.")
+	}
+}
+
+func TestDetachedBeeState(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("TestDetachedBeeState")
+	done := make(chan uint64)
+	app.HandleFunc(AppTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			ctx.Dict("D").Put("0", 1)
+			done <- ctx.ID()
+			return nil
+		})
+
+	ids := make(chan uint64)
+	vals := make(chan interface{})
+	app.DetachedFunc(
+		func(ctx RcvContext) {
+			s, err := ctx.BeeState(<-ids)
+			if err != nil {
+				vals <- err
+				return
+			}
+			if err := s.Dict("D").Put("0", 2); err != state.ErrReadOnly {
+				vals <- err
+				return
+			}
+			v, _ := s.Dict("D").Get("0")
+			vals <- v
+		},
+		func(ctx RcvContext) {},
+		func(msg Msg, ctx RcvContext) error { return nil })
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(AppTestMsg(0))
+	ids <- <-done
+	if v := <-vals; v != 1 {
+		t.Errorf("invalid value in bee state: actual=%v want=1", v)
+	}
+}
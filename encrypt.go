@@ -0,0 +1,181 @@
+package beehive
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// PayloadCipher encrypts and decrypts the data of the messages sent between
+// hives. See Encrypt.
+//
+// ad is the additional data of the message, which is authenticated but not
+// encrypted: it binds the sealed data to the type and the destination of its
+// message, so that the sealed data cannot be replayed onto another message.
+// Decrypt must fail if ad is not the additional data used in Encrypt.
+type PayloadCipher interface {
+	Encrypt(plain, ad []byte) ([]byte, error)
+	Decrypt(sealed, ad []byte) ([]byte, error)
+}
+
+// Encrypt is an application option that encrypts the data of the messages sent
+// to the bees of the application on other hives using c. The destination hive
+// decrypts the messages, and must use the same option for the application;
+// it rejects the messages of the application that are not encrypted.
+//
+// Messages delivered on the same hive stay in plaintext, and so do the
+// messages broadcast to all hives (see BroadcastAll) and the state of bees.
+func Encrypt(c PayloadCipher) AppOption {
+	return func(a *app) {
+		a.cipher = c
+	}
+}
+
+// NewAESCipher returns a PayloadCipher that uses AES-GCM with the given key,
+// which must be 16, 24, or 32 bytes long.
+func NewAESCipher(key []byte) (PayloadCipher, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		return nil, err
+	}
+	return aesCipher{aead: aead}, nil
+}
+
+type aesCipher struct {
+	aead cipher.AEAD
+}
+
+// Encrypt seals the plaintext using a random nonce, which is prepended to the
+// sealed data.
+func (c aesCipher) Encrypt(plain, ad []byte) ([]byte, error) {
+	n := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plain)+
+		c.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, n); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(n, n, plain, ad), nil
+}
+
+func (c aesCipher) Decrypt(sealed, ad []byte) ([]byte, error) {
+	ns := c.aead.NonceSize()
+	if len(sealed) < ns {
+		return nil, errors.New("beehive: sealed data is too short")
+	}
+	return c.aead.Open(nil, sealed[:ns], sealed[ns:], ad)
+}
+
+// sealedData is the encrypted data of a message. Type is the type of the
+// message before encryption, and is authenticated along with the destination
+// of the message.
+type sealedData struct {
+	Type string
+	Data []byte
+}
+
+// sealedAD returns the additional data of a message of type t sent to bee to.
+func sealedAD(t string, to uint64) []byte {
+	ad := make([]byte, len(t)+8)
+	copy(ad, t)
+	binary.BigEndian.PutUint64(ad[len(t):], to)
+	return ad
+}
+
+func init() {
+	gob.Register(sealedData{})
+}
+
+// sealMsg replaces the data of the message with its encryption.
+func sealMsg(c PayloadCipher, m *msg) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&m.MsgData); err != nil {
+		return err
+	}
+	t := m.Type()
+	s, err := c.Encrypt(buf.Bytes(), sealedAD(t, m.MsgTo))
+	if err != nil {
+		return err
+	}
+	m.MsgData = sealedData{Type: t, Data: s}
+	return nil
+}
+
+// openMsg replaces the encrypted data of the message with its decryption.
+func openMsg(c PayloadCipher, m *msg) error {
+	s, ok := m.MsgData.(sealedData)
+	if !ok {
+		return fmt.Errorf("beehive: %v is not encrypted", m.Type())
+	}
+	p, err := c.Decrypt(s.Data, sealedAD(s.Type, m.MsgTo))
+	if err != nil {
+		return err
+	}
+	var d interface{}
+	if err := gob.NewDecoder(bytes.NewReader(p)).Decode(&d); err != nil {
+		return err
+	}
+	if t := MsgType(d); t != s.Type {
+		return fmt.Errorf("beehive: sealed %v has data of type %v", s.Type, t)
+	}
+	m.MsgData = d
+	return nil
+}
+
+// encryptMsgs encrypts the messages of the proxy bee, if its application
+// encrypts messages. The messages that cannot be encrypted are added to the
+// dead letters of the application, and are not redelivered.
+func (b *bee) encryptMsgs(mhs []msgAndHandler,
+	msgs []msg) ([]msgAndHandler, []msg) {
+
+	if b.app.cipher == nil {
+		return mhs, msgs
+	}
+
+	res := msgs[:0]
+	kept := make([]msgAndHandler, 0, len(mhs))
+	for i := range msgs {
+		m := msgs[i]
+		if err := sealMsg(b.app.cipher, &m); err != nil {
+			glog.Errorf("%v cannot encrypt message %v: %v", b, mhs[i].msg, err)
+			if m.MsgAckBee == b.ID() {
+				b.handleAck([]uint64{m.MsgSeq})
+			}
+			b.app.deadLetters.add(mhs[i], err)
+			continue
+		}
+		res = append(res, m)
+		kept = append(kept, mhs[i])
+	}
+	return kept, res
+}
+
+// decryptMsg decrypts a message received from another hive, if the
+// application of its destination bee encrypts messages.
+func (h *hive) decryptMsg(m *msg) error {
+	if !m.IsUnicast() {
+		return nil
+	}
+	info, err := h.bee(m.MsgTo)
+	if err != nil {
+		// Without its destination, the message cannot be checked against the
+		// application.
+		return fmt.Errorf("beehive: cannot find the destination of %v: %v",
+			m.Type(), err)
+	}
+	a, ok := h.app(info.App)
+	if !ok || a.cipher == nil {
+		return nil
+	}
+	return openMsg(a.cipher, m)
+}
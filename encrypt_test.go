@@ -0,0 +1,124 @@
+package beehive
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+type encryptTestMsg string
+
+func TestAESCipher(t *testing.T) {
+	c, err := NewAESCipher(bytes.Repeat([]byte{1}, 16))
+	if err != nil {
+		t.Fatalf("cannot create the cipher: %v", err)
+	}
+
+	plain := []byte("plaintext")
+	ad := []byte("ad")
+	s, err := c.Encrypt(plain, ad)
+	if err != nil {
+		t.Fatalf("cannot encrypt: %v", err)
+	}
+	if bytes.Contains(s, plain) {
+		t.Error("sealed data contains the plaintext")
+	}
+	p, err := c.Decrypt(s, ad)
+	if err != nil || !bytes.Equal(p, plain) {
+		t.Errorf("invalid decryption: actual=%q,%v want=%q", p, err, plain)
+	}
+
+	if _, err = c.Decrypt(s, []byte("other")); err == nil {
+		t.Error("data is decrypted with another additional data")
+	}
+
+	s[len(s)-1]++
+	if _, err = c.Decrypt(s, ad); err == nil {
+		t.Error("tampered data is decrypted")
+	}
+
+	if _, err = NewAESCipher([]byte("short")); err == nil {
+		t.Error("cipher is created with an invalid key")
+	}
+}
+
+func TestSealMsg(t *testing.T) {
+	gob.Register(encryptTestMsg(""))
+	c, _ := NewAESCipher(bytes.Repeat([]byte{1}, 32))
+
+	m := msg{MsgData: encryptTestMsg("secret"), MsgTo: 1}
+	if err := sealMsg(c, &m); err != nil {
+		t.Fatalf("cannot seal the message: %v", err)
+	}
+	if _, ok := m.MsgData.(sealedData); !ok {
+		t.Fatalf("message is not sealed: %v", m.MsgData)
+	}
+	if err := openMsg(c, &m); err != nil {
+		t.Fatalf("cannot open the message: %v", err)
+	}
+	if m.MsgData != encryptTestMsg("secret") {
+		t.Errorf("invalid data: actual=%v want=secret", m.MsgData)
+	}
+
+	if err := openMsg(c, &m); err == nil {
+		t.Error("plaintext message is accepted")
+	}
+
+	// Sealed data cannot be replayed onto another destination or type.
+	sealMsg(c, &m)
+	replay := msg{MsgData: m.MsgData, MsgTo: 2}
+	if err := openMsg(c, &replay); err == nil {
+		t.Error("sealed data is replayed onto another destination")
+	}
+	s := m.MsgData.(sealedData)
+	s.Type = "other"
+	replay = msg{MsgData: s, MsgTo: 1}
+	if err := openMsg(c, &replay); err == nil {
+		t.Error("sealed data is replayed onto another type")
+	}
+}
+
+func TestEncryptedDelivery(t *testing.T) {
+	c, _ := NewAESCipher(bytes.Repeat([]byte{1}, 16))
+	ch := make(chan encryptTestMsg)
+	register := func(h Hive) {
+		a := h.NewApp("encrypted", Encrypt(c))
+		a.HandleFunc(encryptTestMsg(""), func(msg Msg,
+			ctx MapContext) MappedCells {
+
+			return MappedCells{{"E", "0"}}
+		}, func(msg Msg, ctx RcvContext) error {
+			ch <- msg.Data().(encryptTestMsg)
+			return nil
+		})
+	}
+
+	h1 := newHiveForTest()
+	register(h1)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	register(h2)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	h1.Emit(encryptTestMsg("a"))
+	<-ch
+
+	// The message is sent by the proxy on h2.
+	h2.Emit(encryptTestMsg("b"))
+	if m := <-ch; m != "b" {
+		t.Errorf("invalid message: actual=%v want=b", m)
+	}
+}
+
+func TestDecryptMsgUnknownBee(t *testing.T) {
+	h := newHiveForTest()
+	m := msg{MsgData: encryptTestMsg("plain"), MsgTo: 12345}
+	if err := h.(*hive).decryptMsg(&m); err == nil {
+		t.Error("message to an unknown bee is accepted")
+	}
+}
@@ -0,0 +1,165 @@
+package beehive
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// fragHeaderLen is the length of the header of a fragment: the ID of the
+// payload, the index of the fragment and the number of fragments.
+const fragHeaderLen = 16
+
+// fragTimeout is the duration after which a partially received payload is
+// dropped.
+const fragTimeout = 1 * time.Minute
+
+var errInvalidFrag = errors.New("rpc: invalid fragment")
+
+// fragment splits the payload into fragments of at most size bytes.
+func fragment(p []byte, size uint) [][]byte {
+	id := newTraceID()
+	n := (len(p) + int(size) - 1) / int(size)
+	frags := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		start := i * int(size)
+		end := start + int(size)
+		if end > len(p) {
+			end = len(p)
+		}
+		f := make([]byte, fragHeaderLen+end-start)
+		binary.BigEndian.PutUint64(f, id)
+		binary.BigEndian.PutUint32(f[8:], uint32(i))
+		binary.BigEndian.PutUint32(f[12:], uint32(n))
+		copy(f[fragHeaderLen:], p[start:end])
+		frags = append(frags, f)
+	}
+	return frags
+}
+
+// partialPayload is a payload whose fragments are being received.
+type partialPayload struct {
+	frags [][]byte
+	rcvd  int
+	last  time.Time
+}
+
+// reassembler reassembles the payloads from their fragments.
+type reassembler struct {
+	sync.Mutex
+	partials map[uint64]*partialPayload
+}
+
+// add adds the fragment, and returns the payload if all its fragments are
+// received.
+func (r *reassembler) add(f []byte) ([]byte, error) {
+	if len(f) < fragHeaderLen {
+		return nil, errInvalidFrag
+	}
+	id := binary.BigEndian.Uint64(f)
+	i := int(binary.BigEndian.Uint32(f[8:]))
+	n := int(binary.BigEndian.Uint32(f[12:]))
+	if i >= n {
+		return nil, errInvalidFrag
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	r.expire(now)
+
+	if r.partials == nil {
+		r.partials = make(map[uint64]*partialPayload)
+	}
+	pp, ok := r.partials[id]
+	if !ok {
+		pp = &partialPayload{frags: make([][]byte, n)}
+		r.partials[id] = pp
+	}
+	if len(pp.frags) != n {
+		return nil, errInvalidFrag
+	}
+	if pp.frags[i] == nil {
+		pp.frags[i] = f[fragHeaderLen:]
+		pp.rcvd++
+	}
+	pp.last = now
+	if pp.rcvd < n {
+		return nil, nil
+	}
+
+	delete(r.partials, id)
+	size := 0
+	for _, d := range pp.frags {
+		size += len(d)
+	}
+	p := make([]byte, 0, size)
+	for _, d := range pp.frags {
+		p = append(p, d...)
+	}
+	return p, nil
+}
+
+// expire drops the partial payloads that have not received any fragment in
+// fragTimeout.
+func (r *reassembler) expire(now time.Time) {
+	for id, pp := range r.partials {
+		if now.Sub(pp.last) > fragTimeout {
+			glog.Warningf("dropping partial payload %v with %v/%v fragments", id,
+				pp.rcvd, len(pp.frags))
+			delete(r.partials, id)
+		}
+	}
+}
+
+// negotiateFragments enables fragmentation on the client if the remote hive
+// supports it.
+func (c *rpcClient) negotiateFragments(size uint) {
+	if size == 0 {
+		return
+	}
+
+	var ok bool
+	if err := c.cmd.Call("rpcServer.Fragments", struct{}{}, &ok); err != nil {
+		glog.V(2).Infof("%v does not support fragmentation: %v", c, err)
+		return
+	}
+	if ok {
+		c.fragment = size
+	}
+}
+
+// sendFragments sends the payload of messages in fragments. Other messages
+// sent on the same connection are interleaved with the fragments.
+func (c *rpcClient) sendFragments(p []byte) error {
+	var dummy struct{}
+	frags := fragment(p, c.fragment)
+	glog.V(3).Infof("%v sends a payload of %v bytes in %v fragments", c, len(p),
+		len(frags))
+	for _, f := range frags {
+		if err := c.msg.Call("rpcServer.EnqueMsgFragment", f, &dummy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fragments returns whether the server reassembles fragmented payloads.
+func (s *rpcServer) Fragments(dummy struct{}, ok *bool) error {
+	*ok = true
+	return nil
+}
+
+// EnqueMsgFragment reassembles the payload of messages from its fragments,
+// and enqueues the messages once all the fragments are received.
+func (s *rpcServer) EnqueMsgFragment(f []byte, dummy *struct{}) error {
+	p, err := s.frags.add(f)
+	if err != nil || p == nil {
+		return err
+	}
+	return s.EnqueMsgPayload(p, dummy)
+}
@@ -0,0 +1,81 @@
+package beehive
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReassemble(t *testing.T) {
+	p := []byte(strings.Repeat("abcdefg", 10))
+	frags := fragment(p, 16)
+	if len(frags) != 5 {
+		t.Fatalf("invalid number of fragments: actual=%v want=5", len(frags))
+	}
+
+	var r reassembler
+	// Fragments can be received out of order and more than once.
+	for _, i := range []int{4, 1, 1, 0, 3} {
+		res, err := r.add(frags[i])
+		if err != nil || res != nil {
+			t.Fatalf("payload is reassembled before all fragments are received: "+
+				"res=%v err=%v", res, err)
+		}
+	}
+	res, err := r.add(frags[2])
+	if err != nil {
+		t.Fatalf("cannot reassemble the payload: %v", err)
+	}
+	if !bytes.Equal(res, p) {
+		t.Errorf("invalid reassembled payload: actual=%s want=%s", res, p)
+	}
+	if len(r.partials) != 0 {
+		t.Errorf("reassembled payload is not removed: %v", r.partials)
+	}
+
+	if _, err := r.add([]byte{1}); err == nil {
+		t.Error("invalid fragment is accepted")
+	}
+}
+
+func TestFragmentedDelivery(t *testing.T) {
+	ch := make(chan string)
+	register := func(h Hive) {
+		a := h.NewApp("fragmented")
+		a.HandleFunc("", func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(msg Msg, ctx RcvContext) error {
+			ch <- msg.Data().(string)
+			return nil
+		})
+	}
+
+	h1 := newHiveForTest(FragmentSize(64))
+	register(h1)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(FragmentSize(64), PeerAddrs(h1.Config().Addr))
+	register(h2)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	h1.Emit("a")
+	<-ch
+
+	// The message is sent by the proxy on h2 in fragments.
+	data := strings.Repeat("b", 1024)
+	h2.Emit(data)
+	if d := <-ch; d != data {
+		t.Errorf("invalid message: actual=%v want=%v", d, data)
+	}
+	c, err := h2.(*hive).client.hiveClient(h1.ID())
+	if err != nil {
+		t.Fatalf("cannot find the client of %v: %v", h1, err)
+	}
+	if c.fragment != 64 {
+		t.Errorf("fragmentation is not negotiated: %v", c.fragment)
+	}
+}
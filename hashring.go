@@ -0,0 +1,122 @@
+package beehive
+
+import (
+	"sort"
+	"strconv"
+)
+
+// DefaultRingReplicas is the default number of points of each virtual cell on
+// a HashRing.
+const DefaultRingReplicas = 64
+
+// HashRing maps arbitrary keys to a bounded number of virtual cells in a
+// dictionary using consistent hashing. Map functions can use a HashRing to
+// spread an unbounded key space evenly among a fixed number of cells, and thus
+// a fixed number of bees:
+//
+//	ring := beehive.NewHashRing("users", 128, 0)
+//	app.HandleFunc(Login{}, func(m beehive.Msg, c beehive.MapContext) beehive.MappedCells {
+//		return ring.Cells(m.Data().(Login).User)
+//	}, rcvf)
+//
+// Since the ring is consistent, growing it from n to n+1 cells moves only about
+// 1/(n+1) of the keys to a different cell. A HashRing is immutable and safe for
+// concurrent use.
+type HashRing struct {
+	dict   string
+	points []uint32
+	cells  []string // cells[i] is the cell of points[i].
+}
+
+// NewHashRing creates a ring of n virtual cells in dict. Each cell is placed on
+// the ring replicas times; the more replicas, the more even the distribution
+// of keys. If replicas is 0, DefaultRingReplicas is used.
+func NewHashRing(dict string, n, replicas int) *HashRing {
+	if n <= 0 {
+		panic("beehive: hash ring with no cells")
+	}
+	if replicas <= 0 {
+		replicas = DefaultRingReplicas
+	}
+
+	r := &HashRing{
+		dict:   dict,
+		points: make([]uint32, 0, n*replicas),
+		cells:  make([]string, 0, n*replicas),
+	}
+	byPoint := make(map[uint32]string, n*replicas)
+	for c := 0; c < n; c++ {
+		k := strconv.Itoa(c)
+		for i := 0; i < replicas; i++ {
+			p := ringHash(dict, k, strconv.Itoa(i))
+			// On collisions, the first cell wins.
+			if _, ok := byPoint[p]; !ok {
+				byPoint[p] = k
+			}
+		}
+	}
+	for p := range byPoint {
+		r.points = append(r.points, p)
+	}
+	sort.Sort(uint32Slice(r.points))
+	for _, p := range r.points {
+		r.cells = append(r.cells, byPoint[p])
+	}
+	return r
+}
+
+// Dict returns the dictionary of the cells of the ring.
+func (r *HashRing) Dict() string {
+	return r.dict
+}
+
+// Cell returns the virtual cell of key.
+func (r *HashRing) Cell(key string) CellKey {
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return CellKey{Dict: r.dict, Key: r.cells[i]}
+}
+
+// Cells returns the virtual cells of keys, without duplicates. The result can
+// be returned from a map function as is.
+func (r *HashRing) Cells(keys ...string) MappedCells {
+	cells := make(MappedCells, 0, len(keys))
+	seen := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		c := r.Cell(k)
+		if _, ok := seen[c.Key]; ok {
+			continue
+		}
+		seen[c.Key] = struct{}{}
+		cells = append(cells, c)
+	}
+	return cells
+}
+
+// ringHash returns the FNV-1a hash of strs, finalized with the murmur3 mixer
+// so that similar strings land far apart on the ring.
+func ringHash(strs ...string) uint32 {
+	h := uint32(2166136261)
+	for _, s := range strs {
+		for i := 0; i < len(s); i++ {
+			h ^= uint32(s[i])
+			h *= 16777619
+		}
+		h *= 16777619
+	}
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
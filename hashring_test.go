@@ -0,0 +1,60 @@
+package beehive
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHashRingDistribution(t *testing.T) {
+	const cells = 16
+	const keys = 16000
+	r := NewHashRing("D", cells, 0)
+	cnt := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		c := r.Cell(strconv.Itoa(i))
+		if c.Dict != "D" {
+			t.Fatalf("invalid dict: actual=%v want=D", c.Dict)
+		}
+		cnt[c.Key]++
+	}
+	if len(cnt) != cells {
+		t.Fatalf("invalid number of cells: actual=%v want=%v", len(cnt), cells)
+	}
+	for k, n := range cnt {
+		if n < keys/cells/2 || n > keys/cells*2 {
+			t.Errorf("uneven cell %v: actual=%v want~%v", k, n, keys/cells)
+		}
+	}
+}
+
+func TestHashRingGrow(t *testing.T) {
+	const keys = 10000
+	r1 := NewHashRing("D", 10, 0)
+	r2 := NewHashRing("D", 11, 0)
+	moved := 0
+	for i := 0; i < keys; i++ {
+		k := strconv.Itoa(i)
+		c1, c2 := r1.Cell(k), r2.Cell(k)
+		if c1 == c2 {
+			continue
+		}
+		if c2.Key != "10" {
+			t.Fatalf("key %v moved between old cells: %v -> %v", k, c1, c2)
+		}
+		moved++
+	}
+	if moved > keys/11*2 {
+		t.Errorf("too many moved keys: actual=%v want~%v", moved, keys/11)
+	}
+}
+
+func TestHashRingCells(t *testing.T) {
+	r := NewHashRing("D", 4, 0)
+	cells := r.Cells("a", "a", "b")
+	if len(cells) == 0 || len(cells) > 2 {
+		t.Fatalf("invalid cells: %v", cells)
+	}
+	if cells[0] != r.Cell("a") {
+		t.Errorf("invalid cell: actual=%v want=%v", cells[0], r.Cell("a"))
+	}
+}
@@ -0,0 +1,182 @@
+package beehive
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// Hibernate is an application option that hibernates the bees of the
+// application that have not received a message for idle: the state of a
+// hibernated bee is saved, and its goroutine is stopped. The bee is
+// transparently revived, on the same hive and with the same ID, when a message
+// or a command is routed to it.
+//
+// Only the leaders of non-persistent applications are hibernated, and only if
+// they have no pending messages, timers, acks, or ordered streams, and do not
+// use BeeLocal or LocalState. Hibernated bees do not receive local broadcasts.
+func Hibernate(idle time.Duration) AppOption {
+	return func(a *app) {
+		a.hibernate = idle
+	}
+}
+
+// errBeeBusy is returned by a bee that cannot be hibernated.
+var errBeeBusy = errors.New("beehive: bee is busy")
+
+// hibernatedBee is a bee whose goroutine is stopped. The bee keeps its
+// channels, so that the messages and commands enqueued by those who looked
+// the bee up before its hibernation are handled once it is revived.
+type hibernatedBee struct {
+	bee  *bee
+	once sync.Once
+	// done is closed once the bee is either hibernated, or has refused to
+	// hibernate.
+	done chan struct{}
+	// state is the saved state of the hibernated bee.
+	state []byte
+	// busy is whether the bee has refused to hibernate.
+	busy bool
+}
+
+// touch marks the bee as active.
+func (b *bee) touch(now time.Time) {
+	atomic.StoreInt64(&b.active, now.UnixNano())
+}
+
+// idle returns how long the bee has not received a message.
+func (b *bee) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&b.active)))
+}
+
+// hibernatable returns whether the bee can be hibernated. It must be called in
+// the bee's goroutine.
+func (b *bee) hibernatable() bool {
+	return !b.proxy && !b.detached && !b.app.persistent() && b.isLeader() &&
+		len(b.colony().Followers) == 0 && b.app.ackTimeout == 0 &&
+		len(b.unacked) == 0 && len(b.streams) == 0 && !b.hasPrepared() &&
+		len(b.msgBufL1) == 0 && b.local == nil && b.localState == nil &&
+		!b.hive.timers.has(b.ID()) && len(b.dataCh.out()) == 0 &&
+		len(b.ctrlCh) == 0
+}
+
+// hibernate saves the state of the bee and stops it, if it is idle. It
+// returns the saved state.
+func (b *bee) hibernate(idle bool) cmdResult {
+	var s []byte
+	var err error
+	switch {
+	case !idle || !b.hibernatable():
+		err = errBeeBusy
+	case b.app.sql.db != nil:
+		// SQL state is already persisted.
+	default:
+		s, err = b.stateL1.Save()
+	}
+	if err == nil {
+		b.status = beeStatusStopped
+		b.stateL1 = nil
+		b.streams = nil
+		b.unacked = nil
+		b.txApplied = nil
+		glog.V(2).Infof("%v hibernated", b)
+	}
+	return cmdResult{Data: s, Err: err}
+}
+
+// hibernateIdle hibernates the local bees that have been idle for longer than
+// the hibernation timeout of the application.
+func (q *qee) hibernateIdle(now time.Time) {
+	var idle []*bee
+	q.RLock()
+	for _, b := range q.bees {
+		if !b.proxy && !b.detached && b.idle(now) >= q.app.hibernate {
+			idle = append(idle, b)
+		}
+	}
+	q.RUnlock()
+
+	for _, b := range idle {
+		q.hibernateBee(b, now)
+	}
+}
+
+func (q *qee) hibernateBee(b *bee, now time.Time) {
+	h := &hibernatedBee{bee: b, done: make(chan struct{})}
+	q.Lock()
+	if _, migrating := q.migrating[b.ID()]; migrating || q.bees[b.ID()] != b {
+		q.Unlock()
+		return
+	}
+	delete(q.bees, b.ID())
+	q.hibernated[b.ID()] = h
+	q.Unlock()
+
+	ch := make(chan cmdResult)
+	b.ctrlCh <- newCmdAndChannel(cmdHibernate{}, q.hive.ID(), q.app.Name(),
+		b.ID(), ch)
+	res, err := (<-ch).get()
+	if err != nil {
+		if err != errBeeBusy {
+			glog.Errorf("%v cannot hibernate %v: %v", q, b, err)
+		}
+		// Do not retry before the bee is idle for another period.
+		b.touch(now)
+		h.busy = true
+		close(h.done)
+		q.revive(h)
+		return
+	}
+
+	h.state, _ = res.([]byte)
+	close(h.done)
+	hibernations.WithLabelValues(q.app.Name()).Inc()
+
+	// Revive the bee if something is enqueued while it was hibernating.
+	if len(b.dataCh.out()) != 0 || len(b.ctrlCh) != 0 {
+		q.revive(h)
+	}
+}
+
+// revive revives the hibernated bee, and returns it. Concurrent calls wait
+// for the bee to be revived once.
+func (q *qee) revive(h *hibernatedBee) *bee {
+	h.once.Do(func() {
+		<-h.done
+		b := h.bee
+		if !h.busy {
+			b.setState(q.app.newBeeState(b.ID()))
+			if h.state != nil {
+				if err := b.stateL1.Restore(h.state); err != nil {
+					glog.Fatalf("%v cannot restore the state of %v: %v", q, b, err)
+				}
+				h.state = nil
+			}
+			b.becomeLeader()
+			b.touch(time.Now())
+			go b.start()
+			revivals.WithLabelValues(q.app.Name()).Inc()
+			glog.V(2).Infof("%v revived %v", q, b)
+		}
+
+		q.Lock()
+		q.bees[b.ID()] = b
+		delete(q.hibernated, b.ID())
+		q.Unlock()
+	})
+	return h.bee
+}
+
+// hibernateTick returns the channel that fires when the queen should look for
+// idle bees, and a function that stops it. The channel is nil if the
+// application does not hibernate its bees.
+func (q *qee) hibernateTick() (<-chan time.Time, func()) {
+	if q.app.hibernate <= 0 || q.app.persistent() {
+		return nil, func() {}
+	}
+	t := time.NewTicker(q.app.hibernate / 2)
+	return t.C, t.Stop
+}
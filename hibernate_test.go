@@ -0,0 +1,67 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type hibernateTestMsg string
+
+func TestHibernate(t *testing.T) {
+	type rcv struct {
+		bee uint64
+		cnt int
+	}
+	ch := make(chan rcv)
+	h := newHiveForTest()
+	a := h.NewApp("hibernate", Hibernate(100*time.Millisecond))
+	a.HandleFunc(hibernateTestMsg(""), func(msg Msg,
+		ctx MapContext) MappedCells {
+
+		return MappedCells{{"H", string(msg.Data().(hibernateTestMsg))}}
+	}, func(msg Msg, ctx RcvContext) error {
+		d := ctx.Dict("H")
+		k := string(msg.Data().(hibernateTestMsg))
+		cnt := 0
+		if v, err := d.Get(k); err == nil {
+			cnt = v.(int)
+		}
+		cnt++
+		d.Put(k, cnt)
+		ch <- rcv{bee: ctx.ID(), cnt: cnt}
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(hibernateTestMsg("k"))
+	first := <-ch
+
+	q := h.(*hive).apps["hibernate"].qee
+	hibernated := func() bool {
+		q.RLock()
+		defer q.RUnlock()
+		_, ok := q.hibernated[first.bee]
+		return ok
+	}
+	for i := 0; !hibernated(); i++ {
+		if i == 100 {
+			t.Fatal("idle bee is not hibernated")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	h.Emit(hibernateTestMsg("k"))
+	r := <-ch
+	if r.bee != first.bee {
+		t.Errorf("message is handled by another bee: actual=%v want=%v", r.bee,
+			first.bee)
+	}
+	if r.cnt != 2 {
+		t.Errorf("invalid state after revival: actual=%v want=2", r.cnt)
+	}
+	if hibernated() {
+		t.Error("bee is hibernated after revival")
+	}
+}
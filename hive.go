@@ -1,6 +1,7 @@
 package beehive
 
 import (
+	"crypto/tls"
 	"encoding/gob"
 	"errors"
 	"flag"
@@ -22,6 +23,7 @@ import (
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/soheilhy/args"
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/soheilhy/cmux"
 	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/kandoo/beehive/bucket"
 	"github.com/kandoo/beehive/raft"
 	"github.com/kandoo/beehive/randtime"
 )
@@ -50,6 +52,14 @@ type Hive interface {
 
 	// Emits a message containing msgData from this hive.
 	Emit(msgData interface{})
+	// EmitWithReceipt emits a message containing msgData from this hive, and
+	// returns a future that is resolved when the message is handled, and the
+	// transaction of its handler is committed, by all the applications that
+	// handle the message. For a local broadcast, the first bee that handles
+	// the message resolves the receipt of its application. The future is
+	// resolved with an error if ctx is done before; for example, when the
+	// message is dropped.
+	EmitWithReceipt(ctx context.Context, msgData interface{}) *Future
 	// Sends a message to a specific bee that owns a specific dictionary key.
 	SendToCellKey(msgData interface{}, to string, dk CellKey)
 	// Sends a message to a sepcific bee.
@@ -59,6 +69,23 @@ type Hive interface {
 	// Sync processes a synchrounous message (req) and blocks until the response
 	// is recieved.
 	Sync(ctx context.Context, req interface{}) (res interface{}, err error)
+	// SyncAsync processes a synchrounous message (req) without blocking. The
+	// returned future is resolved when the response is received, or when ctx
+	// is done.
+	SyncAsync(ctx context.Context, req interface{}) *Future
+
+	// WhereIs returns where the application routes a message containing
+	// msgData, by invoking its map function and looking up the owner of the
+	// mapped cells. The message is not routed and interceptors are not
+	// invoked. Note that the map function must not have side effects.
+	WhereIs(app string, msgData interface{}) (Route, error)
+
+	// InterceptMap adds a map interceptor for the messages of all the
+	// applications on this hive. It must be called before the hive starts.
+	InterceptMap(f MapInterceptor)
+	// InterceptRcv adds a receive interceptor for the messages of all the
+	// applications on this hive. It must be called before the hive starts.
+	InterceptRcv(f RcvInterceptor)
 
 	// Registers a message for encoding/decoding. This method should be called
 	// only on messages that have no active handler. Such messages are almost
@@ -88,8 +115,48 @@ type HiveConfig struct {
 	RaftElectTicks int           // number of raft ticks that fires election.
 	RaftInFlights  int           // maximum number of inflights to a node.
 	RaftMaxMsgSize uint64        // maximum size of an append message.
+	RaftSnapCount  uint64        // number of entries between raft snapshots.
+	RaftCatchUp    uint64        // in-memory entries kept for slow followers.
 
 	ConnTimeout time.Duration // timeout for connections between hives.
+	KeepAlive   time.Duration // TCP keep-alive period. 0 disables.
+	IdleTimeout time.Duration // connections idle this long are closed.
+	MaxConnAge  time.Duration // connections this old are replaced.
+	CmdTimeout  time.Duration // default timeout of commands to other hives.
+	CmdRetries  uint          // retries of commands on broken connections.
+
+	BreakerThresh  uint          // failed calls that open a peer's circuit.
+	BreakerTimeout time.Duration // how long a peer's circuit stays open.
+
+	CompactTick   time.Duration // how often bees compact their state.
+	CompactThresh uint          // number of deleted keys that triggers compaction.
+
+	AntiEntropyTick time.Duration // how often colonies compare their states.
+
+	RebalanceFrac float64 // fraction of local bees migrated to joining hives.
+
+	ReReplRate uint // followers recruited per second to replace failed ones.
+
+	PhiThresh float64 // the suspicion level at which peers are suspected.
+
+	CellLease time.Duration // the lease of the hive on its cells. 0 disables.
+
+	CompressThresh uint // payloads compressed for other hives. 0 disables.
+	FragmentSize   uint // max size of message payloads. 0 disables.
+
+	MsgEncoding string // encoding of the messages sent to other hives.
+
+	RPCOverHTTP bool   // whether RPC connections are tunneled in HTTP.
+	HTTPProxy   string // HTTP proxy used to connect to other hives.
+
+	CtrlRate uint // egress bytes/s of control traffic per peer. 0 disables.
+	DataRate uint // egress bytes/s of data traffic per peer. 0 disables.
+
+	TLSCert string // certificate file of the hive. Empty disables TLS.
+	TLSKey  string // private key file of the hive.
+	TLSCA   string // CA certificate file of the hives. Empty uses the system's.
+
+	Labels []string // labels of the hive used in placement constraints.
 }
 
 // RaftElectTimeout returns the raft election timeout as
@@ -197,6 +264,12 @@ var raftFsyncTick = args.NewDuration(args.Flag("raftfsync", 1*time.Second,
 
 // RaftFsyncTick represents when the hive should call fsync on written entires.
 // 0 means immidiately after each write.
+//
+// Transactions of persistent applications are appended to the on-disk raft
+// WAL of their colony before they are applied, and are replayed when the hive
+// restarts. As such, RaftFsyncTick is the fsync policy of the transaction log:
+// with a non-zero tick, a simultaneous crash of all the replicas can lose the
+// transactions committed in the last tick.
 func RaftFsyncTick(t time.Duration) HiveOption {
 	return HiveOption(raftFsyncTick(t))
 }
@@ -228,6 +301,27 @@ func RaftMaxMsgSize(s uint64) HiveOption {
 	return HiveOption(raftMaxMsgSize(s))
 }
 
+var raftSnapCount = args.NewUint64(args.Flag("raftsnapcount", uint64(1024),
+	"number of raft entries after which the hive takes a snapshot"))
+
+// RaftSnapCount represents the number of raft entries applied between two
+// snapshots of a raft group.
+func RaftSnapCount(c uint64) HiveOption {
+	return HiveOption(raftSnapCount(c))
+}
+
+var raftCatchUp = args.NewUint64(args.Flag("raftcatchup", uint64(5000),
+	"number of raft entries kept in memory for slow followers"))
+
+// RaftCatchUp represents the number of raft entries kept in memory, after a
+// snapshot, for slow followers to catch up. Together with RaftSnapCount, it
+// caps the in-memory transaction log of a bee: older transactions are only on
+// disk (in the WAL and the snapshots), and a follower that falls behind them
+// catches up using the latest snapshot.
+func RaftCatchUp(c uint64) HiveOption {
+	return HiveOption(raftCatchUp(c))
+}
+
 var connTimeout = args.NewDuration(args.Flag("conntimeout", 60*time.Second,
 	"timeout for trying to connect to other hives"))
 
@@ -236,6 +330,262 @@ func ConnTimeout(t time.Duration) HiveOption {
 	return HiveOption(connTimeout(t))
 }
 
+var keepAlive = args.NewDuration(args.Flag("keepalive", 30*time.Second,
+	"tcp keep-alive period of connections between hives. 0 disables"))
+
+// KeepAlive represents the TCP keep-alive period of the connections between
+// hives, so that connections silently dropped by a NAT or a firewall are
+// detected before a send blocks on them. 0 disables keep-alives.
+func KeepAlive(t time.Duration) HiveOption {
+	return HiveOption(keepAlive(t))
+}
+
+var idleTimeout = args.NewDuration(args.Flag("idletimeout", 10*time.Minute,
+	"connections to other hives idle this long are closed. 0 disables"))
+
+// IdleTimeout represents how long a connection to another hive can stay
+// unused before it is closed. The hive is redialed on the next send. 0 keeps
+// idle connections open.
+func IdleTimeout(t time.Duration) HiveOption {
+	return HiveOption(idleTimeout(t))
+}
+
+var maxConnAge = args.NewDuration(args.Flag("maxconnage", time.Duration(0),
+	"connections to other hives this old are replaced. 0 disables"))
+
+// MaxConnAge represents the maximum age of a connection to another hive.
+// Older connections are replaced by new ones, and are closed once their
+// in-flight calls finish. It bounds how long a hive uses a stale connection
+// whose failure is not detected. 0 means no maximum.
+func MaxConnAge(t time.Duration) HiveOption {
+	return HiveOption(maxConnAge(t))
+}
+
+var cmdTimeout = args.NewDuration(args.Flag("cmdtimeout", 60*time.Second,
+	"default timeout of commands sent to other hives. 0 disables"))
+
+// CmdTimeout represents the default timeout of the commands sent to other
+// hives. A command fails if the remote hive does not respond in time, so that
+// the sender does not hang on a half-dead peer. 0 disables the timeout.
+func CmdTimeout(t time.Duration) HiveOption {
+	return HiveOption(cmdTimeout(t))
+}
+
+var cmdRetries = args.NewUint(args.Flag("cmdretries", uint(2),
+	"number of times commands are retried when connections to hives break"))
+
+// CmdRetries represents the number of times a command to another hive is
+// retried when the hive cannot be reached. The hive redials the peer with a
+// jittered exponential backoff between retries, and returns the error to the
+// sender only when all the retries fail. If the connection breaks or the
+// command times out after it is sent, the command is retried only if it is
+// idempotent, since it may have been processed. 0 disables retries.
+func CmdRetries(n uint) HiveOption {
+	return HiveOption(cmdRetries(n))
+}
+
+var breakerThresh = args.NewUint(args.Flag("breakerthresh", uint(0),
+	"consecutive failed calls that open the circuit to a hive. 0 disables"))
+
+// BreakerThresh represents the number of consecutive calls to a peer hive
+// that should fail, before the circuit breaker of the peer opens. Bees and
+// proxies fail fast when calling a peer with an open circuit, instead of
+// waiting on a degraded peer one after another. 0, the default, disables
+// circuit breakers.
+func BreakerThresh(n uint) HiveOption {
+	return HiveOption(breakerThresh(n))
+}
+
+var breakerTimeout = args.NewDuration(args.Flag("breakertimeout",
+	5*time.Second, "how long the circuit to a failed hive stays open"))
+
+// BreakerTimeout represents how long the circuit breaker of a peer hive stays
+// open. Afterwards, one call is let through to probe the peer, and the circuit
+// is closed if the call succeeds. It has no effect unless BreakerThresh is set.
+func BreakerTimeout(t time.Duration) HiveOption {
+	return HiveOption(breakerTimeout(t))
+}
+
+var compactTick = args.NewDuration(args.Flag("compacttick", 1*time.Minute,
+	"how often bees compact their state. 0 disables periodic compaction"))
+
+// CompactTick represents how often bees reclaim the memory of deleted keys in
+// their state.
+func CompactTick(t time.Duration) HiveOption {
+	return HiveOption(compactTick(t))
+}
+
+var compactThresh = args.NewUint(args.Flag("compactthresh", uint(4096),
+	"number of deleted keys after which a bee compacts its state. 0 disables"))
+
+// CompactThresh represents the number of deleted keys in the state of a bee
+// that triggers a compaction.
+func CompactThresh(t uint) HiveOption { return HiveOption(compactThresh(t)) }
+
+var antiEntropyTick = args.NewDuration(args.Flag("antientropytick",
+	time.Duration(0), "how often colony leaders compare their state with "+
+		"their followers. 0 disables anti-entropy"))
+
+// AntiEntropyTick represents how often the leader of a colony compares its
+// state with its followers, and repairs the dictionaries that have diverged.
+// Anti-entropy is disabled by default.
+func AntiEntropyTick(t time.Duration) HiveOption {
+	return HiveOption(antiEntropyTick(t))
+}
+
+var rebalanceFrac = args.NewFloat64(args.Flag("rebalance", 0.0,
+	"fraction of local bees migrated to a new hive when it joins. 0 disables "+
+		"rebalancing"))
+
+// RebalanceFrac represents the fraction of the local bees that the hive
+// migrates to a new hive when it joins the cluster. For an even load, use
+// 1/n where n is the number of hives after the join. Bees of sticky apps are
+// never migrated.
+func RebalanceFrac(f float64) HiveOption {
+	return HiveOption(rebalanceFrac(f))
+}
+
+var reReplRate = args.NewUint(args.Flag("rereplrate", uint(0),
+	"number of followers recruited per second to replace failed followers. "+
+		"0 means unlimited"))
+
+// ReReplRate represents the number of followers that the hive recruits per
+// second to replace the failed followers of its colonies. After a correlated
+// failure, this caps the state copied to the new followers. Apps with a higher
+// ReplicationPriority are served first.
+func ReReplRate(r uint) HiveOption { return HiveOption(reReplRate(r)) }
+
+var phiThresh = args.NewFloat64(args.Flag("phithresh", 8.0,
+	"the phi suspicion level at which a peer hive is considered failed"))
+
+// PhiThresh represents the suspicion level (phi) at which the hive suspects a
+// peer. Hives track the arrival times of the raft messages of their peers, and
+// a phi of p means that the chance of a false positive is 10^-p. Followers on
+// a suspected hive are evicted if they miss a single ping. Lower values detect
+// failures faster, at the cost of more false positives.
+func PhiThresh(p float64) HiveOption { return HiveOption(phiThresh(p)) }
+
+var cellLease = args.NewDuration(args.Flag("celllease", time.Duration(0),
+	"the lease of the hive on the cells of its colonies. 0 means the cells "+
+		"are locked forever"))
+
+// CellLease represents the lease of the hive on the cells locked by its
+// colonies. The hive renews its lease every CellLease/3. If a hive fails to
+// renew its lease, the cells of the colonies led by its bees are released and
+// can be locked by other bees. The lease should be much longer than the clock
+// skew among hives.
+func CellLease(l time.Duration) HiveOption { return HiveOption(cellLease(l)) }
+
+var compressThresh = args.NewUint(args.Flag("compressthresh", uint(0),
+	"size of the messages, commands and raft batches in bytes above which "+
+		"they are compressed when sent to other hives. 0 disables"))
+
+// CompressThresh represents the size of the payloads, in bytes, above which the
+// messages, commands and raft batches sent to other hives are compressed.
+// Compression is negotiated per pair of hives, and hives that do not support it
+// are sent uncompressed payloads. It is useful for the hives connected over a
+// WAN, e.g., to replicate large transactions across data centers.
+func CompressThresh(t uint) HiveOption {
+	return HiveOption(compressThresh(t))
+}
+
+var fragmentSize = args.NewUint(args.Flag("fragsize", uint(1<<20),
+	"size of the fragments in bytes that large messages are split into when "+
+		"sent to other hives. 0 disables"))
+
+// FragmentSize represents the maximum size of the payloads of the messages
+// sent to other hives, in bytes. Larger payloads are split into fragments and
+// are reassembled by the receiving hive, so that a large message (e.g., a
+// state snapshot) does not block the messages of other bees sent on the same
+// connection. Similar to compression, fragmentation is negotiated per pair of
+// hives.
+func FragmentSize(s uint) HiveOption { return HiveOption(fragmentSize(s)) }
+
+var msgEncoding = args.NewString(args.Flag("msgencoding", EncodingGob,
+	"encoding of the messages sent to other hives: gob or proto"))
+
+// MsgEncoding represents the encoding of the messages sent to other hives,
+// which is either EncodingGob or EncodingProto. The encoding is negotiated
+// per pair of hives, and hives that do not support protobuf are sent gob, so
+// that a cluster can be upgraded one hive at a time. Commands among hives are
+// always encoded using gob.
+func MsgEncoding(e string) HiveOption { return HiveOption(msgEncoding(e)) }
+
+var rpcOverHTTP = args.NewBool(args.Flag("rpcoverhttp", false,
+	"whether to tunnel rpc connections to other hives in http"))
+
+// RPCOverHTTP represents whether the RPC connections to other hives are
+// tunneled in HTTP, using a CONNECT request to the HTTP endpoint of the
+// hives. It is useful when only HTTP(S) is allowed between sites. Hives always
+// accept tunneled connections, so only the hives behind such firewalls need
+// to set this option.
+func RPCOverHTTP(b bool) HiveOption { return HiveOption(rpcOverHTTP(b)) }
+
+var httpProxy = args.NewString(args.Flag("httpproxy", "",
+	"address of the http proxy used to connect to other hives"))
+
+// HTTPProxy represents the address of the HTTP proxy through which the hive
+// connects to other hives. The proxy must support CONNECT requests to the
+// addresses of the hives.
+func HTTPProxy(addr string) HiveOption { return HiveOption(httpProxy(addr)) }
+
+var ctrlRate = args.NewUint(args.Flag("ctrlrate", uint(0),
+	"egress bytes per second of control traffic to each hive. 0 means unlimited"))
+
+// CtrlRate represents the egress bandwidth of the control traffic to each peer
+// hive, in bytes per second. Control traffic is the commands among hives and
+// raft heartbeats. 0 means unlimited.
+func CtrlRate(r uint) HiveOption { return HiveOption(ctrlRate(r)) }
+
+var dataRate = args.NewUint(args.Flag("datarate", uint(0),
+	"egress bytes per second of data traffic to each hive. 0 means unlimited"))
+
+// DataRate represents the egress bandwidth of the data traffic to each peer
+// hive, in bytes per second. Data traffic is the messages sent to other hives,
+// raft log replication, and the state transferred when bees are migrated or
+// followers are recruited. Limiting the data traffic keeps re-replication and
+// migration from saturating the links shared with application traffic. 0
+// means unlimited.
+func DataRate(r uint) HiveOption { return HiveOption(dataRate(r)) }
+
+var tlsCert = args.NewString(args.Flag("tlscert", "",
+	"the certificate file of the hive. TLS is disabled if empty"))
+
+// TLSCert represents the certificate file of the hive. When TLSCert and TLSKey
+// are set, the hive serves RPC and HTTP over TLS, and connects to other hives
+// over TLS using the certificate as its client certificate. All the hives of
+// a cluster must use TLS if one does.
+//
+// The certificate, the key and the CA files are reloaded when they change, so
+// that the credentials can be rotated without restarting the hive. Existing
+// connections keep their credentials.
+func TLSCert(f string) HiveOption { return HiveOption(tlsCert(f)) }
+
+var tlsKey = args.NewString(args.Flag("tlskey", "",
+	"the private key file of the hive"))
+
+// TLSKey represents the private key file of the certificate of the hive.
+func TLSKey(f string) HiveOption { return HiveOption(tlsKey(f)) }
+
+var tlsCA = args.NewString(args.Flag("tlsca", "",
+	"the CA certificate file that signs the certificates of hives"))
+
+// TLSCA represents the CA certificate file that signs the certificates of the
+// hives. If set, hives verify each other's certificates using this CA, and
+// require the hives connecting to them to present a certificate signed by the
+// CA (i.e., mutual TLS). Otherwise, hives verify the certificates of the
+// hives that they connect to using the system's root CAs.
+func TLSCA(f string) HiveOption { return HiveOption(tlsCA(f)) }
+
+var labels = args.NewString(args.Flag("labels", "",
+	"labels of the hive. Seperate entries with a comma"))
+
+// Labels represents the labels of the hive (e.g., "ssd" or "zone=eu"). Apps
+// can restrict their bees to the hives with certain labels using PlaceOn.
+func Labels(l ...string) HiveOption {
+	return HiveOption(labels(strings.Join(l, ",")))
+}
+
 func hiveConfig(opts ...HiveOption) (cfg HiveConfig) {
 	cfg.Addr = addr.Get(opts)
 	if pa := paddrs.Get(opts); pa != "" {
@@ -256,7 +606,36 @@ func hiveConfig(opts ...HiveOption) (cfg HiveConfig) {
 	cfg.RaftElectTicks = raftElectTicks.Get(opts)
 	cfg.RaftInFlights = raftInFlights.Get(opts)
 	cfg.RaftMaxMsgSize = raftMaxMsgSize.Get(opts)
+	cfg.RaftSnapCount = raftSnapCount.Get(opts)
+	cfg.RaftCatchUp = raftCatchUp.Get(opts)
 	cfg.ConnTimeout = connTimeout.Get(opts)
+	cfg.KeepAlive = keepAlive.Get(opts)
+	cfg.IdleTimeout = idleTimeout.Get(opts)
+	cfg.MaxConnAge = maxConnAge.Get(opts)
+	cfg.CmdTimeout = cmdTimeout.Get(opts)
+	cfg.CmdRetries = cmdRetries.Get(opts)
+	cfg.BreakerThresh = breakerThresh.Get(opts)
+	cfg.BreakerTimeout = breakerTimeout.Get(opts)
+	cfg.CompactTick = compactTick.Get(opts)
+	cfg.CompactThresh = compactThresh.Get(opts)
+	cfg.AntiEntropyTick = antiEntropyTick.Get(opts)
+	cfg.RebalanceFrac = rebalanceFrac.Get(opts)
+	cfg.ReReplRate = reReplRate.Get(opts)
+	cfg.PhiThresh = phiThresh.Get(opts)
+	cfg.CellLease = cellLease.Get(opts)
+	cfg.CompressThresh = compressThresh.Get(opts)
+	cfg.FragmentSize = fragmentSize.Get(opts)
+	cfg.MsgEncoding = msgEncoding.Get(opts)
+	cfg.RPCOverHTTP = rpcOverHTTP.Get(opts)
+	cfg.HTTPProxy = httpProxy.Get(opts)
+	cfg.CtrlRate = ctrlRate.Get(opts)
+	cfg.DataRate = dataRate.Get(opts)
+	cfg.TLSCert = tlsCert.Get(opts)
+	cfg.TLSKey = tlsKey.Get(opts)
+	cfg.TLSCA = tlsCA.Get(opts)
+	if l := labels.Get(opts); l != "" {
+		cfg.Labels = strings.Split(l, ",")
+	}
 	return cfg
 }
 
@@ -275,23 +654,39 @@ func NewHive(opts ...HiveOption) Hive {
 	}
 
 	cfg := hiveConfig(opts...)
+	tc, err := newTLSCreds(cfg)
+	if err != nil {
+		glog.Fatalf("invalid tls configuration: %v", err)
+	}
 	os.MkdirAll(cfg.StatePath, 0700)
-	m := meta(cfg)
+	tr := newTransport(cfg, tc)
+	m := meta(cfg, tr)
 	h := &hive{
-		id:     m.Hive.ID,
-		meta:   m,
-		status: hiveStopped,
-		config: cfg,
-		dataCh: newMsgChannel(cfg.DataChBufSize),
-		ctrlCh: make(chan cmdAndChannel),
-		syncCh: make(chan syncReqAndChan, cfg.DataChBufSize),
-		apps:   make(map[string]*app, 0),
-		qees:   make(map[string][]qeeAndHandler),
+		id:        m.Hive.ID,
+		meta:      m,
+		status:    hiveStopped,
+		config:    cfg,
+		tls:       tc,
+		transport: tr,
+		dataCh:    newMsgChannel(cfg.DataChBufSize),
+		ctrlCh:    make(chan cmdAndChannel),
+		syncCh:    make(chan syncReqAndChan, cfg.DataChBufSize),
+		apps:      make(map[string]*app, 0),
+		qees:      make(map[string][]qeeAndHandler),
 	}
 
 	h.client = newRPCClientPool(h)
 	h.registry = newRegistry(h.String())
+	if cfg.RebalanceFrac > 0 {
+		h.registry.joined = func(hi HiveInfo) { go h.rebalance(hi) }
+	}
+	h.cellCache = newCellCache()
+	h.registry.watch(h.cellCache.invalidate)
+	h.timers = newTimerQueue(h)
+	h.receipts = newReceiptTable()
 	h.replStrategy = newRndReplication(h)
+	h.replLimiter = newReplLimiter(bucket.Rate(cfg.ReReplRate))
+	h.detector = newPhiDetector(cfg.RaftHBTimeout() / 2)
 	h.httpServer = newServer(h)
 
 	if h.config.Instrument {
@@ -337,15 +732,24 @@ type hive struct {
 	apps map[string]*app
 	qees map[string][]qeeAndHandler
 
+	interceptors interceptors
+
 	httpServer *httpServer
 	listener   net.Listener
+	tls        *tlsCreds // nil if TLS is disabled.
+	transport  *transport
 
-	node     *raft.MultiNode
-	registry *registry
-	ticker   *randtime.Ticker
-	client   *rpcClientPool
+	node      *raft.MultiNode
+	registry  *registry
+	cellCache *cellCache
+	timers    *timerQueue
+	receipts  *receiptTable
+	ticker    *randtime.Ticker
+	client    *rpcClientPool
 
 	replStrategy replicationStrategy
+	replLimiter  *replLimiter
+	detector     *phiDetector
 	collector    collector
 }
 
@@ -369,8 +773,13 @@ func (h *hive) RegisterMsg(msg interface{}) {
 func (h *hive) Sync(ctx context.Context, req interface{}) (res interface{},
 	err error) {
 
+	return h.SyncAsync(ctx, req).Result()
+}
+
+func (h *hive) SyncAsync(ctx context.Context, req interface{}) *Future {
 	id := uint64(rand.Int63())
 	ch := make(chan syncRes, 1)
+	f := newFuture()
 
 	// We should run this in parallel in case we are blocked on h.syncCh.
 	go func() {
@@ -384,16 +793,20 @@ func (h *hive) Sync(ctx context.Context, req interface{}) (res interface{},
 		}
 	}()
 
-	select {
-	case r := <-ch:
-		if r.Err != nil {
-			return nil, errors.New(r.Err.Error())
-		}
-		return r.Data, nil
+	go func() {
+		select {
+		case r := <-ch:
+			if r.Err != nil {
+				f.resolve(nil, errors.New(r.Err.Error()))
+				return
+			}
+			f.resolve(r.Data, nil)
 
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	}
+		case <-ctx.Done():
+			f.resolve(nil, ctx.Err())
+		}
+	}()
+	return f
 }
 func (h *hive) app(name string) (*app, bool) {
 	a, ok := h.apps[name]
@@ -454,6 +867,7 @@ func (h *hive) handleCmd(cc cmdAndChannel) {
 		// TODO(soheil): This has a race with Stop(). Use atomics here.
 		h.status = hiveStopped
 		h.stopListener()
+		h.timers.stop()
 		h.stopQees()
 		h.node.Stop()
 		cc.ch <- cmdResult{}
@@ -466,7 +880,7 @@ func (h *hive) handleCmd(cc cmdAndChannel) {
 		cc.ch <- cmdResult{Err: err}
 
 	case cmdNewHiveID:
-		r, err := h.node.ProposeRetry(hiveGroup, newHiveID{},
+		r, err := h.proposeRetryAmongHives(newHiveID{},
 			h.config.RaftElectTimeout(), 10)
 		cc.ch <- cmdResult{
 			Data: r,
@@ -475,7 +889,7 @@ func (h *hive) handleCmd(cc cmdAndChannel) {
 
 	case cmdAddHive:
 		err := h.node.AddNodeToGroup(context.TODO(), d.Hive.ID, hiveGroup,
-			d.Hive.Addr)
+			d.Hive)
 		cc.ch <- cmdResult{
 			Err: err,
 		}
@@ -485,6 +899,29 @@ func (h *hive) handleCmd(cc cmdAndChannel) {
 			Data: h.registry.hives(),
 		}
 
+	case cmdCellOwner:
+		b, err := h.registry.cellOwner(d.App, d.Cell)
+		cc.ch <- cmdResult{
+			Data: b,
+			Err:  err,
+		}
+
+	case cmdColonyCells:
+		cells, err := h.registry.colonyCells(d.Bee)
+		cc.ch <- cmdResult{
+			Data: cells,
+			Err:  err,
+		}
+
+	case cmdLocalBcast:
+		cc.ch <- cmdResult{
+			Err: h.localBcast(&d.Msg, ""),
+		}
+
+	case cmdReceipt:
+		h.receipts.ack(d.ID, d.App)
+		cc.ch <- cmdResult{}
+
 	default:
 		cc.ch <- cmdResult{
 			Err: ErrInvalidCmd,
@@ -500,7 +937,7 @@ func (h *hive) processCmd(data interface{}) (interface{}, error) {
 
 func (h *hive) raftBarrier() error {
 	// TODO(soheil): maybe add a max retry number into the configs.
-	_, err := h.node.ProposeRetry(hiveGroup, noOp{},
+	_, err := h.proposeRetryAmongHives(noOp{},
 		10*h.config.RaftElectTimeout(), -1)
 	return err
 }
@@ -531,6 +968,23 @@ func (h *hive) bee(id uint64) (BeeInfo, error) {
 	return h.registry.bee(id)
 }
 
+// beeForCells looks up the bee that owns the cells of app in the cell cache,
+// and falls back to the registry on a miss.
+func (h *hive) beeForCells(app string, cells MappedCells) (info BeeInfo,
+	hasAll bool, err error) {
+
+	if info, ok := h.cellCache.beeForCells(app, cells); ok {
+		return info, true, nil
+	}
+
+	gen := h.cellCache.generation()
+	info, hasAll, err = h.registry.beeForCells(app, cells)
+	if err == nil && hasAll {
+		h.cellCache.fill(gen, app, cells, info)
+	}
+	return info, hasAll, err
+}
+
 func (h *hive) handleMsg(m *msg) {
 	switch {
 	case m.IsUnicast():
@@ -544,15 +998,24 @@ func (h *hive) handleMsg(m *msg) {
 			glog.Fatalf("no such application %s", i.App)
 		}
 		if i.Detached {
-			a.qee.enqueMsg(msgAndHandler{msg: m})
+			a.enqueIsolated(msgAndHandler{msg: m})
 			return
 		}
-		a.qee.enqueMsg(msgAndHandler{msg: m, handler: a.handler(m.Type())})
+		a.enqueIsolated(msgAndHandler{msg: m, handler: a.handler(m.Type())})
 	default:
 		for _, qh := range h.qees[m.Type()] {
-			qh.q.enqueMsg(msgAndHandler{m, qh.h})
+			qh.q.app.enqueIsolated(msgAndHandler{msg: m, handler: qh.h})
+		}
+	}
+}
+
+func (h *hive) initApps() error {
+	for _, a := range h.apps {
+		if err := a.init(); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
 func (h *hive) startQees() {
@@ -570,7 +1033,7 @@ func (h *hive) startRaftNode() {
 		ni := raft.GroupNode{
 			Group: hiveGroup,
 			Node:  i.ID,
-			Data:  i.Addr,
+			Data:  i,
 		}
 		peers = append(peers, ni.Peer())
 	}
@@ -591,7 +1054,8 @@ func (h *hive) startRaftNode() {
 		StateMachine:   h.registry,
 		Peers:          peers,
 		DataDir:        h.config.StatePath,
-		SnapCount:      1024,
+		SnapCount:      h.config.RaftSnapCount,
+		CatchUpEntries: h.config.RaftCatchUp,
 		FsyncTick:      h.config.RaftFsyncTick,
 		ElectionTicks:  h.config.RaftElectTicks,
 		HeartbeatTicks: h.config.RaftHBTicks,
@@ -606,11 +1070,19 @@ func (h *hive) startRaftNode() {
 func (h *hive) proposeAmongHives(ctx context.Context, req interface{}) (
 	res interface{}, err error) {
 
+	defer observeRegistryProposal(req, time.Now())
 	return h.node.Propose(ctx, hiveGroup, req)
 }
 
+func (h *hive) proposeRetryAmongHives(req interface{}, timeout time.Duration,
+	maxRetries int) (res interface{}, err error) {
+
+	defer observeRegistryProposal(req, time.Now())
+	return h.node.ProposeRetry(hiveGroup, req, timeout, maxRetries)
+}
+
 func (h *hive) delBeeFromRegistry(id uint64) error {
-	_, err := h.node.ProposeRetry(hiveGroup, delBee(id),
+	_, err := h.proposeRetryAmongHives(delBee(id),
 		h.config.RaftElectTimeout(), -1)
 	if err == ErrNoSuchBee {
 		err = nil
@@ -621,6 +1093,19 @@ func (h *hive) delBeeFromRegistry(id uint64) error {
 	return err
 }
 
+func (h *hive) renewLease() {
+	l := renewLease{
+		Hive: h.id,
+		Now:  time.Now(),
+		TTL:  h.config.CellLease,
+	}
+	if _, err := h.proposeRetryAmongHives(l, h.config.RaftElectTimeout(),
+		3); err != nil {
+
+		glog.Errorf("%v cannot renew its lease: %v", h, err)
+	}
+}
+
 func (h *hive) reloadState() {
 	for _, b := range h.registry.beesOfHive(h.id) {
 		if b.Detached || b.Colony.IsNil() {
@@ -644,6 +1129,10 @@ func (h *hive) reloadState() {
 }
 
 func (h *hive) Start() error {
+	if err := h.initApps(); err != nil {
+		glog.Errorf("%v cannot initialize applications: %v", h, err)
+		return err
+	}
 	h.status = hiveStarted
 	h.registerSignals()
 	h.startRaftNode()
@@ -659,6 +1148,21 @@ func (h *hive) Start() error {
 	h.startQees()
 	h.reloadState()
 
+	var leaseT <-chan time.Time
+	if l := h.config.CellLease; l > 0 {
+		go h.renewLease()
+		ticker := time.NewTicker(l / 3)
+		defer ticker.Stop()
+		leaseT = ticker.C
+	}
+
+	var reapT <-chan time.Time
+	if t := reapTick(h.config); t > 0 {
+		ticker := time.NewTicker(t)
+		defer ticker.Stop()
+		reapT = ticker.C
+	}
+
 	glog.V(2).Infof("%v starts message loop", h)
 	dataCh := h.dataCh.out()
 	for h.status == hiveStarted {
@@ -668,6 +1172,12 @@ func (h *hive) Start() error {
 
 		case cmd := <-h.ctrlCh:
 			h.handleCmd(cmd)
+
+		case <-leaseT:
+			go h.renewLease()
+
+		case <-reapT:
+			go h.client.reap()
 		}
 	}
 	return nil
@@ -675,8 +1185,9 @@ func (h *hive) Start() error {
 
 func (h *hive) info() HiveInfo {
 	return HiveInfo{
-		ID:   h.id,
-		Addr: h.config.Addr,
+		ID:     h.id,
+		Addr:   h.config.Addr,
+		Labels: h.config.Labels,
 	}
 }
 
@@ -700,10 +1211,12 @@ func (h *hive) waitUntilStarted() {
 
 func (h *hive) NewApp(name string, options ...AppOption) App {
 	a := &app{
-		name:     name,
-		hive:     h,
-		handlers: make(map[string]Handler),
+		name:        name,
+		hive:        h,
+		handlers:    make(map[string]Handler),
+		deadLetters: newDeadLetterQueue(defaultDeadLetters),
 	}
+	a.handlers[MsgType(timerFired{})] = timerHandler{}
 	a.initQee()
 	h.registerApp(a)
 
@@ -723,6 +1236,9 @@ func (h *hive) Emit(msgData interface{}) {
 }
 
 func (h *hive) enqueMsg(msg *msg) {
+	if msg.MsgTrace == 0 {
+		msg.MsgTrace = newTraceID()
+	}
 	h.dataCh.in() <- msgAndHandler{msg: msg}
 }
 
@@ -760,26 +1276,32 @@ func (h *hive) registerSignals() {
 }
 
 func (h *hive) listen() (err error) {
-	h.listener, err = net.Listen("tcp", h.config.Addr)
+	lc := net.ListenConfig{KeepAlive: keepAlivePeriod(h.config)}
+	h.listener, err = lc.Listen(context.Background(), "tcp", h.config.Addr)
 	if err != nil {
 		glog.Errorf("%v cannot listen: %v", h, err)
 		return err
 	}
+	if h.tls != nil {
+		h.listener = tls.NewListener(h.listener, h.tls.server())
+	}
 	glog.Infof("%v is listening", h)
 
 	m := cmux.New(h.listener)
 	hl := m.Match(cmux.HTTP1Fast())
 	rl := m.Match(cmux.Any())
 
-	go func() {
-		h.httpServer.Serve(hl)
-		glog.Infof("%v closed http listener", h)
-	}()
-
 	rs := rpc.NewServer()
 	if err := rs.RegisterName("rpcServer", newRPCServer(h)); err != nil {
 		glog.Fatalf("cannot register rpc server: %v", err)
 	}
+	// RPC connections tunneled in HTTP are hijacked by the rpc server.
+	h.httpServer.router.Handle(rpcHTTPPath, rs)
+
+	go func() {
+		h.httpServer.Serve(hl)
+		glog.Infof("%v closed http listener", h)
+	}()
 
 	go func() {
 		for {
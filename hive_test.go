@@ -148,3 +148,52 @@ func TestHiveFailure(t *testing.T) {
 	h3.Stop()
 	h2.Stop()
 }
+
+func TestHiveRebalance(t *testing.T) {
+	ch := make(chan struct{})
+	register := func(h Hive) {
+		a := h.NewApp("rebalance")
+		mf := func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", strconv.Itoa(int(msg.Data().(MyMsg)))}}
+		}
+		rf := func(msg Msg, ctx RcvContext) error {
+			ch <- struct{}{}
+			return nil
+		}
+		a.HandleFunc(MyMsg(0), mf, rf)
+	}
+
+	h1 := newHiveForTest(RebalanceFrac(0.5))
+	register(h1)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	const nbees = 4
+	for i := 0; i < nbees; i++ {
+		h1.Emit(MyMsg(i))
+		<-ch
+	}
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	register(h2)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	moved := 0
+	for i := 0; i < 100; i++ {
+		moved = 0
+		for _, b := range h1.(*hive).registry.beesOfHive(h2.ID()) {
+			if b.App == "rebalance" {
+				moved++
+			}
+		}
+		if moved == nbees/2 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("invalid number of bees migrated to the new hive: actual=%v want=%v",
+		moved, nbees/2)
+}
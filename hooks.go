@@ -0,0 +1,69 @@
+package beehive
+
+import (
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/state"
+)
+
+// PreCommitFunc is called before the transaction of a bee is committed and, for
+// persistent applications, before it is replicated. ops are the state
+// operations of the transaction. The hook runs in the transaction: it can
+// modify the state and emit messages that are committed with the transaction.
+// If the hook returns an error, the transaction is aborted.
+type PreCommitFunc func(ops []state.Op, ctx RcvContext) error
+
+// PostCommitFunc is called after the transaction of a bee is committed and,
+// for persistent applications, replicated. It is called only once per
+// transaction and only on the bee that committed the transaction (i.e., not
+// on its followers). Messages emitted in the hook are not transactional.
+type PostCommitFunc func(ops []state.Op, ctx RcvContext)
+
+// PreCommit is an application option that adds a pre-commit hook to the
+// application. Hooks are called in the order they are added. Hooks are not
+// called for empty transactions.
+func PreCommit(f PreCommitFunc) AppOption {
+	return func(a *app) {
+		a.flags |= appFlagTransactional
+		a.preCommit = append(a.preCommit, f)
+	}
+}
+
+// PostCommit is an application option that adds a post-commit hook to the
+// application. Hooks are called in the order they are added. Hooks are not
+// called for empty transactions.
+func PostCommit(f PostCommitFunc) AppOption {
+	return func(a *app) {
+		a.flags |= appFlagTransactional
+		a.postCommit = append(a.postCommit, f)
+	}
+}
+
+func (b *bee) preCommit(ops []state.Op) error {
+	if len(b.app.preCommit) == 0 || len(ops) == 0 {
+		return nil
+	}
+
+	// The hooks run in the L1 transaction, even if the L2 transaction is
+	// already committed.
+	l2 := b.stateL2
+	b.stateL2 = nil
+	defer func() { b.stateL2 = l2 }()
+
+	for _, f := range b.app.preCommit {
+		if err := f(ops, b); err != nil {
+			glog.V(2).Infof("%v pre-commit hook vetoes the transaction: %v", b, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *bee) postCommit(ops []state.Op) {
+	if len(ops) == 0 {
+		return
+	}
+
+	for _, f := range b.app.postCommit {
+		f(ops, b)
+	}
+}
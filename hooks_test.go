@@ -0,0 +1,43 @@
+package beehive
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kandoo/beehive/state"
+)
+
+func TestCommitHooks(t *testing.T) {
+	h := newHiveForTest()
+
+	committed := make(chan interface{})
+	pre := func(ops []state.Op, ctx RcvContext) error {
+		for _, op := range ops {
+			if op.V.(int) < 0 {
+				return errors.New("negative value")
+			}
+		}
+		return nil
+	}
+	post := func(ops []state.Op, ctx RcvContext) {
+		committed <- ops[0].V
+	}
+
+	app := h.NewApp("hooks", PreCommit(pre), PostCommit(post))
+	app.HandleFunc(AppTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			return ctx.Dict("D").Put("0", int(msg.Data().(AppTestMsg)))
+		})
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(AppTestMsg(-1))
+	h.Emit(AppTestMsg(1))
+	if v := <-committed; v != 1 {
+		t.Errorf("invalid committed value: actual=%v want=1", v)
+	}
+}
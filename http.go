@@ -4,16 +4,29 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/prometheus/client_golang/prometheus"
 )
 
 // state is served as json while other endpoints serve gob. The reason is that
 // state should be human readable.
 const (
-	serverV1StatePath = "/api/v1/state"
-	serverV1BeesPath  = "/api/v1/bees"
+	serverV1StatePath    = "/api/v1/state"
+	serverV1BeesPath     = "/api/v1/bees"
+	serverV1LogPath      = "/api/v1/bees/{id:[0-9]+}/log"
+	serverV1HandoffPath  = "/api/v1/bees/{id:[0-9]+}/handoff"
+	serverV1SplitPath    = "/api/v1/bees/{id:[0-9]+}/split"
+	serverV1MovePath     = "/api/v1/bees/{id:[0-9]+}/move"
+	serverV1RegistryPath = "/api/v1/registry"
+	serverV1CellsPath    = "/api/v1/apps/{app}/cells"
+	serverV1BeeCellsPath = "/api/v1/bees/{id:[0-9]+}/cells"
+	serverV1ReplayPath   = "/api/v1/apps/{app}/replay"
+	serverMetricsPath    = "/metrics"
 )
 
 func buildURL(scheme, addr, path string) string {
@@ -48,6 +61,7 @@ func newServer(h *hive) *httpServer {
 	v1.install(r)
 	w := webHandler{}
 	w.install(r)
+	r.Handle(serverMetricsPath, prometheus.Handler())
 	if h.config.Pprof {
 		p := pprofHandler{}
 		p.install(r)
@@ -69,6 +83,15 @@ type v1Handler struct {
 func (h *v1Handler) install(r *mux.Router) {
 	r.HandleFunc(serverV1StatePath, h.handleHiveState)
 	r.HandleFunc(serverV1BeesPath, h.handleBees)
+	r.HandleFunc(serverV1LogPath, h.handleBeeLog)
+	r.HandleFunc(serverV1HandoffPath, h.handleHandoff).Methods("POST")
+	r.HandleFunc(serverV1SplitPath, h.handleSplit).Methods("POST")
+	r.HandleFunc(serverV1MovePath, h.handleMoveCells).Methods("POST")
+	r.HandleFunc(serverV1RegistryPath, h.handleRegistryDump).Methods("GET")
+	r.HandleFunc(serverV1CellsPath, h.handleCellOwner)
+	r.HandleFunc(serverV1BeeCellsPath, h.handleColonyCells)
+	r.HandleFunc(serverV1ReplayPath, h.handleReplay).Methods("POST")
+	r.HandleFunc(serverV1RegistryPath, h.handleRegistryRestore).Methods("POST")
 }
 
 func (h *v1Handler) handleHiveState(w http.ResponseWriter, r *http.Request) {
@@ -98,6 +121,332 @@ func (h *v1Handler) handleBees(w http.ResponseWriter, r *http.Request) {
 	w.Write(j)
 }
 
+// handleBeeLog serves the metadata of the raft log of a bee, which can be
+// used to verify the replication progress of the bee.
+func (h *v1Handler) handleBeeLog(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, err := h.srv.hive.registry.bee(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	a, ok := h.srv.hive.app(info.App)
+	if !ok {
+		http.Error(w, "no such application", http.StatusNotFound)
+		return
+	}
+
+	l, err := a.qee.sendCmdToBee(id, cmdLogInfo{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(l)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// handleCellOwner serves the bee that owns the cell of an app, given in the
+// "dict" and "key" parameters. It is useful to debug misrouted messages.
+func (h *v1Handler) handleCellOwner(w http.ResponseWriter, r *http.Request) {
+	c := cmdCellOwner{
+		App:  mux.Vars(r)["app"],
+		Cell: CellKey{Dict: r.FormValue("dict"), Key: r.FormValue("key")},
+	}
+	info, err := h.srv.hive.processCmd(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	j, err := json.Marshal(info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// handleColonyCells serves the cells owned by the colony of a bee.
+func (h *v1Handler) handleColonyCells(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cells, err := h.srv.hive.processCmd(cmdColonyCells{Bee: id})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	j, err := json.Marshal(cells)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// ReplayResult is the result of replaying the journal of an application.
+type ReplayResult struct {
+	Replayed int `json:"replayed"` // The number of replayed messages.
+}
+
+// handleReplay replays the messages journaled for an app on this hive, from
+// the time given in the "from" parameter until the time given in the "to"
+// parameter. Times are in RFC 3339, and "to" is optional.
+func (h *v1Handler) handleReplay(w http.ResponseWriter, r *http.Request) {
+	a, ok := h.srv.hive.app(mux.Vars(r)["app"])
+	if !ok {
+		http.Error(w, "no such application", http.StatusNotFound)
+		return
+	}
+
+	var from, to time.Time
+	var err error
+	if from, err = time.Parse(time.RFC3339, r.FormValue("from")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v := r.FormValue("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	n, err := a.Replay(from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(ReplayResult{Replayed: n})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// HandoffResult is the result of handing off the leadership of a colony.
+type HandoffResult struct {
+	Leader uint64 `json:"leader"` // The new leader of the colony.
+}
+
+// handleHandoff hands off the leadership of the colony led by a bee to one of
+// its followers, given in the "to" parameter. If "to" is not set, the most
+// up-to-date follower is selected. The follower is synced with the leader
+// before it takes over the colony, so hives can be drained for maintenance
+// without failing their bees.
+func (h *v1Handler) handleHandoff(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var to uint64
+	if v := r.FormValue("to"); v != "" {
+		if to, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	info, err := h.srv.hive.registry.bee(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	a, ok := h.srv.hive.app(info.App)
+	if !ok {
+		http.Error(w, "no such application", http.StatusNotFound)
+		return
+	}
+
+	l, err := a.qee.sendCmdToBee(id, cmdHandoff{To: to})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Non-persistent bees are handed off in the background.
+	leader, ok := l.(uint64)
+	if !ok {
+		leader = to
+	}
+	j, err := json.Marshal(HandoffResult{Leader: leader})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// SplitResult is the result of splitting the cells of a bee.
+type SplitResult struct {
+	Bees []uint64 `json:"bees"` // The new bees.
+}
+
+// handleSplit splits the cells of a local bee, and their state, among the bee
+// and n-1 new local bees, where n is given in the "n" parameter and defaults
+// to 2. This spreads the load of a bee whose cells are hot across the cores of
+// the hive.
+func (h *v1Handler) handleSplit(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n := 2
+	if v := r.FormValue("n"); v != "" {
+		if n, err = strconv.Atoi(v); err != nil || n < 2 {
+			http.Error(w, "n must be at least 2", http.StatusBadRequest)
+			return
+		}
+	}
+
+	info, err := h.srv.hive.registry.bee(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	a, ok := h.srv.hive.app(info.App)
+	if !ok {
+		http.Error(w, "no such application", http.StatusNotFound)
+		return
+	}
+
+	cells, err := h.srv.hive.registry.colonyCells(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if len(cells) < n {
+		n = len(cells)
+	}
+	if n < 2 {
+		http.Error(w, "bee has too few cells to split", http.StatusBadRequest)
+		return
+	}
+	groups := make([]MappedCells, n-1)
+	for i, c := range cells {
+		if g := i % n; g != 0 {
+			groups[g-1] = append(groups[g-1], c)
+		}
+	}
+
+	res, err := a.qee.processCmd(cmdSplit{Bee: id, Cells: groups})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(SplitResult{Bees: res.([]uint64)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// handleMoveCells moves the cells in the JSON body of the request, along with
+// their state, from a local bee to the local bee given in the "to" parameter.
+// It is used to move hot cells off a bee without migrating the bee.
+func (h *v1Handler) handleMoveCells(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	to, err := strconv.ParseUint(r.FormValue("to"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var cells MappedCells
+	if err := json.NewDecoder(r.Body).Decode(&cells); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, err := h.srv.hive.registry.bee(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	a, ok := h.srv.hive.app(info.App)
+	if !ok {
+		http.Error(w, "no such application", http.StatusNotFound)
+		return
+	}
+
+	_, err = a.qee.processCmd(cmdMoveCells{From: id, To: to, Cells: cells})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleRegistryDump serves the gob-encoded dump of the whole registry,
+// including the bees, the cells, and the colonies. The dump can be saved to a
+// file, and later be restored by posting it to the same path.
+func (h *v1Handler) handleRegistryDump(w http.ResponseWriter, r *http.Request) {
+	b, err := h.srv.hive.registry.Save()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(b)
+}
+
+// handleRegistryRestore restores the registry of the cluster from a dump, so
+// that a cluster can be rebuilt after losing its registry without re-deriving
+// the ownership of cells. The restore is replicated to all hives.
+func (h *v1Handler) handleRegistryRestore(w http.ResponseWriter,
+	r *http.Request) {
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hive := h.srv.hive
+	if _, err := hive.proposeRetryAmongHives(restoreRegistry{Data: b},
+		hive.config.RaftElectTimeout(), 10); err != nil {
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
 func init() {
 	gob.Register(HiveState{})
 }
@@ -0,0 +1,120 @@
+package beehive
+
+import (
+	"fmt"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// MapInterceptor intercepts a message before it is passed to the map function
+// of its handler. It returns the data of the message, which is either
+// msg.Data() or a replacement of the same type. If the interceptor returns an
+// error, the message is dropped. Unicast messages are not mapped, and are not
+// passed to map interceptors.
+type MapInterceptor func(msg Msg, ctx MapContext) (data interface{}, err error)
+
+// RcvInterceptor intercepts a message before it is passed to the receive
+// function of its handler. Similar to MapInterceptor, it returns the data of
+// the message or an error to drop the message.
+type RcvInterceptor func(msg Msg, ctx RcvContext) (data interface{}, err error)
+
+// InterceptMap is an application option that adds a map interceptor to the
+// application. The interceptors of the hive are called before the
+// interceptors of the application, and interceptors are called in the order
+// they are added.
+func InterceptMap(f MapInterceptor) AppOption {
+	return func(a *app) {
+		a.interceptors.maps = append(a.interceptors.maps, f)
+	}
+}
+
+// InterceptRcv is an application option that adds a receive interceptor to
+// the application. Similar to InterceptMap, the interceptors of the hive are
+// called first.
+func InterceptRcv(f RcvInterceptor) AppOption {
+	return func(a *app) {
+		a.interceptors.rcvs = append(a.interceptors.rcvs, f)
+	}
+}
+
+type interceptors struct {
+	maps []MapInterceptor
+	rcvs []RcvInterceptor
+}
+
+func (h *hive) InterceptMap(f MapInterceptor) {
+	h.interceptors.maps = append(h.interceptors.maps, f)
+}
+
+func (h *hive) InterceptRcv(f RcvInterceptor) {
+	h.interceptors.rcvs = append(h.interceptors.rcvs, f)
+}
+
+// intercept calls the n interceptors in order, and returns a copy of the
+// message with the data returned by the interceptors. Messages are shared
+// among the applications and must not be modified in place.
+func intercept(m *msg, n int, f func(i int, m Msg) (interface{}, error)) (
+	res *msg, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			res = nil
+			err = fmt.Errorf("error in interceptor: %v", r)
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		d, err := f(i, m)
+		if err != nil {
+			return nil, err
+		}
+		if t := MsgType(d); t != m.Type() {
+			return nil, fmt.Errorf("interceptor changes the type of %v to %v",
+				m.Type(), t)
+		}
+		c := *m
+		c.MsgData = d
+		m = &c
+	}
+	return m, nil
+}
+
+// beforeMap calls the map interceptors of the hive and the application. It
+// returns false if the message is dropped.
+func (q *qee) beforeMap(mh *msgAndHandler) bool {
+	hi := q.hive.interceptors.maps
+	ai := q.app.interceptors.maps
+	m, err := intercept(mh.msg, len(hi)+len(ai),
+		func(i int, m Msg) (interface{}, error) {
+			if i < len(hi) {
+				return hi[i](m, q)
+			}
+			return ai[i-len(hi)](m, q)
+		})
+	if err != nil {
+		glog.V(2).Infof("%v drops intercepted message %v: %v", q, mh.msg, err)
+		return false
+	}
+	mh.msg = m
+	return true
+}
+
+// beforeRcv calls the receive interceptors of the hive and the application.
+// It returns false if the message is dropped.
+func (b *bee) beforeRcv(mh *msgAndHandler) bool {
+	hi := b.hive.interceptors.rcvs
+	ai := b.app.interceptors.rcvs
+	m, err := intercept(mh.msg, len(hi)+len(ai),
+		func(i int, m Msg) (interface{}, error) {
+			if i < len(hi) {
+				return hi[i](m, b)
+			}
+			return ai[i-len(hi)](m, b)
+		})
+	if err != nil {
+		glog.V(2).Infof("%v drops intercepted message %v: %v", b, mh.msg, err)
+		return false
+	}
+	mh.msg = m
+	return true
+}
@@ -0,0 +1,90 @@
+package beehive
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type interceptTestMsg int
+
+func TestInterceptors(t *testing.T) {
+	var calls []string
+	ch := make(chan interceptTestMsg, 10)
+
+	h := newHiveForTest()
+	h.InterceptMap(func(msg Msg, ctx MapContext) (interface{}, error) {
+		calls = append(calls, "hive map")
+		return msg.Data(), nil
+	})
+	h.InterceptRcv(func(msg Msg, ctx RcvContext) (interface{}, error) {
+		return msg.Data().(interceptTestMsg) * 10, nil
+	})
+
+	dropOdd := InterceptMap(func(msg Msg, ctx MapContext) (interface{}, error) {
+		calls = append(calls, "app map")
+		if msg.Data().(interceptTestMsg)%2 == 1 {
+			return nil, errors.New("odd")
+		}
+		return msg.Data(), nil
+	})
+	inc := InterceptRcv(func(msg Msg, ctx RcvContext) (interface{}, error) {
+		return msg.Data().(interceptTestMsg) + 1, nil
+	})
+	app := h.NewApp("intercept", dropOdd, inc)
+	app.HandleFunc(interceptTestMsg(0), func(msg Msg,
+		ctx MapContext) MappedCells {
+
+		return MappedCells{{"I", "0"}}
+	}, func(msg Msg, ctx RcvContext) error {
+		ch <- msg.Data().(interceptTestMsg)
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	for i := 1; i <= 4; i++ {
+		h.Emit(interceptTestMsg(i))
+	}
+
+	for _, want := range []interceptTestMsg{21, 41} {
+		select {
+		case d := <-ch:
+			if d != want {
+				t.Errorf("invalid intercepted message: actual=%v want=%v", d, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %v is not received", want)
+		}
+	}
+	select {
+	case d := <-ch:
+		t.Errorf("dropped message is received: %v", d)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if len(calls) != 8 {
+		t.Fatalf("invalid number of map interceptor calls: %v", calls)
+	}
+	for i := 0; i < len(calls); i += 2 {
+		if calls[i] != "hive map" || calls[i+1] != "app map" {
+			t.Errorf("invalid order of interceptors: %v", calls)
+			break
+		}
+	}
+}
+
+func TestInterceptTypeChange(t *testing.T) {
+	m := &msg{MsgData: interceptTestMsg(1)}
+	_, err := intercept(m, 1, func(i int, m Msg) (interface{}, error) {
+		return "1", nil
+	})
+	if err == nil {
+		t.Error("interceptor can change the type of a message")
+	}
+	if m.MsgData != interceptTestMsg(1) {
+		t.Errorf("interceptor modifies the message in place: %v", m.MsgData)
+	}
+}
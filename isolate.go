@@ -0,0 +1,52 @@
+package beehive
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// Isolate is an application option that delivers a deep copy of each message
+// routed to the application, so that its handlers cannot observe or race with
+// the mutations of the emitter and other applications (and vice versa). The
+// data of messages is copied by encoding it using gob, and must be registered
+// (see gob.Register).
+//
+// Without this option, messages delivered on the same hive are never
+// serialized, and all their receivers share the same message data.
+func Isolate() AppOption {
+	return func(a *app) {
+		a.isolate = true
+	}
+}
+
+// isolateMsg returns a copy of the message with a deep copy of its data.
+func isolateMsg(m *msg) (*msg, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&m.MsgData); err != nil {
+		return nil, err
+	}
+	c := *m
+	c.MsgData = nil
+	if err := gob.NewDecoder(&buf).Decode(&c.MsgData); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// enqueIsolated enqueues the message on the queen of the application, and
+// copies the message first if the application is isolated. The messages that
+// cannot be copied are added to the dead letters of the application.
+func (a *app) enqueIsolated(mh msgAndHandler) {
+	if a.isolate {
+		m, err := isolateMsg(mh.msg)
+		if err != nil {
+			glog.Errorf("%v cannot isolate message %v: %v", a, mh.msg, err)
+			a.deadLetters.add(mh, err)
+			return
+		}
+		mh.msg = m
+	}
+	a.qee.enqueMsg(mh)
+}
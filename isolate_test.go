@@ -0,0 +1,58 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"testing"
+)
+
+type isolateTestMsg struct {
+	Vals []int
+}
+
+func TestIsolate(t *testing.T) {
+	gob.Register(isolateTestMsg{})
+
+	shared := make(chan isolateTestMsg, 1)
+	isolated := make(chan isolateTestMsg, 1)
+	register := func(h Hive, name string, ch chan isolateTestMsg,
+		opts ...AppOption) {
+
+		a := h.NewApp(name, opts...)
+		a.HandleFunc(isolateTestMsg{}, func(msg Msg,
+			ctx MapContext) MappedCells {
+
+			return MappedCells{{"I", "0"}}
+		}, func(msg Msg, ctx RcvContext) error {
+			ch <- msg.Data().(isolateTestMsg)
+			return nil
+		})
+	}
+
+	h := newHiveForTest()
+	register(h, "shared", shared)
+	register(h, "isolated", isolated, Isolate())
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	m := isolateTestMsg{Vals: []int{1}}
+	h.Emit(m)
+
+	if s := <-shared; &s.Vals[0] != &m.Vals[0] {
+		t.Error("message is copied for a shared app")
+	}
+	i := <-isolated
+	if &i.Vals[0] == &m.Vals[0] {
+		t.Error("message is not copied for an isolated app")
+	}
+	if i.Vals[0] != 1 {
+		t.Errorf("invalid message: actual=%v want=[1]", i.Vals)
+	}
+}
+
+func TestIsolateMsg(t *testing.T) {
+	m := &msg{MsgData: make(chan int), MsgTo: 1}
+	if _, err := isolateMsg(m); err == nil {
+		t.Error("message with a channel is isolated")
+	}
+}
@@ -0,0 +1,233 @@
+package beehive
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// journalExt is the extension of journal segments.
+const journalExt = ".journal"
+
+// Journal is an application option that keeps a journal of the messages
+// routed to the application on each hive, in the "journal" directory of the
+// hive's state path. The journal can be replayed into the application (see
+// App.Replay), for example, to rebuild the state of the application after
+// fixing a bug in its handlers. Messages sent directly to bees are not
+// journaled.
+//
+// Journals are flushed to disk, without fsync, after each batch of messages.
+func Journal() AppOption {
+	return func(a *app) {
+		a.journal = &journal{
+			dir: filepath.Join(a.hive.config.StatePath, "journal", a.name),
+		}
+	}
+}
+
+// journalEntry is an entry of the journal.
+type journalEntry struct {
+	Time time.Time
+	Msg  msg
+}
+
+// journal is an append-only log of messages, stored in segments. Each time
+// the journal is opened, a new segment named after the current time is
+// created, and each segment is a gob stream of journal entries.
+type journal struct {
+	sync.Mutex
+
+	dir string
+	f   *os.File
+	w   *bufio.Writer
+	enc *gob.Encoder
+}
+
+func (j *journal) open() error {
+	if err := os.MkdirAll(j.dir, 0700); err != nil {
+		return err
+	}
+	n := strconv.FormatInt(time.Now().UnixNano(), 10) + journalExt
+	f, err := os.OpenFile(filepath.Join(j.dir, n),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	j.f = f
+	j.w = bufio.NewWriter(f)
+	j.enc = gob.NewEncoder(j.w)
+	return nil
+}
+
+// append journals the messages that are not already journaled, and marks
+// them as journaled.
+func (j *journal) append(mhs []msgAndHandler) error {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.f == nil {
+		if err := j.open(); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	for i := range mhs {
+		if mhs[i].journaled || mhs[i].msg.IsUnicast() {
+			continue
+		}
+		e := journalEntry{Time: now, Msg: *mhs[i].msg}
+		if err := j.enc.Encode(e); err != nil {
+			return err
+		}
+		mhs[i].journaled = true
+	}
+	return j.w.Flush()
+}
+
+func (j *journal) close() error {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.f == nil {
+		return nil
+	}
+	j.w.Flush()
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
+
+// segments returns the start time and the path of the segments of the
+// journal, sorted by their start time.
+func (j *journal) segments() ([]int64, []string, error) {
+	fis, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, nil, err
+	}
+
+	var starts []int64
+	for _, fi := range fis {
+		n := fi.Name()
+		if !strings.HasSuffix(n, journalExt) {
+			continue
+		}
+		s, err := strconv.ParseInt(strings.TrimSuffix(n, journalExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		starts = append(starts, s)
+	}
+	sort.Sort(int64Slice(starts))
+
+	paths := make([]string, len(starts))
+	for i, s := range starts {
+		paths[i] = filepath.Join(j.dir, strconv.FormatInt(s, 10)+journalExt)
+	}
+	return starts, paths, nil
+}
+
+// read calls fn for the entries journaled in [from, to), in order.
+func (j *journal) read(from, to time.Time, fn func(e journalEntry)) error {
+	j.Lock()
+	if j.w != nil {
+		j.w.Flush()
+	}
+	j.Unlock()
+
+	starts, paths, err := j.segments()
+	if err != nil {
+		return err
+	}
+
+	for i, p := range paths {
+		if !to.IsZero() && starts[i] >= to.UnixNano() {
+			break
+		}
+		// The segment ends before the next one starts.
+		if i+1 < len(starts) && starts[i+1] <= from.UnixNano() {
+			continue
+		}
+		if err := readSegment(p, from, to, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSegment(path string, from, to time.Time,
+	fn func(e journalEntry)) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	for {
+		var e journalEntry
+		switch err := dec.Decode(&e); err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			// The last entry of the segment may be partially written.
+			return nil
+		default:
+			return fmt.Errorf("cannot read journal %v: %v", path, err)
+		}
+
+		if e.Time.Before(from) || (!to.IsZero() && !e.Time.Before(to)) {
+			continue
+		}
+		fn(e)
+	}
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// journalMsgs journals the messages of the qee, if the application has a
+// journal.
+func (q *qee) journalMsgs(mhs []msgAndHandler) {
+	if q.app.journal == nil {
+		return
+	}
+	if err := q.app.journal.append(mhs); err != nil {
+		glog.Errorf("%v cannot journal messages: %v", q, err)
+	}
+}
+
+func (a *app) Replay(from, to time.Time) (n int, err error) {
+	if a.journal == nil {
+		return 0, fmt.Errorf("%v has no journal", a)
+	}
+
+	err = a.journal.read(from, to, func(e journalEntry) {
+		m := e.Msg
+		h := a.handler(m.Type())
+		if h == nil {
+			glog.Errorf("%v has no handler to replay %v", a, m)
+			return
+		}
+		a.qee.enqueMsg(msgAndHandler{msg: &m, handler: h, journaled: true})
+		n++
+	})
+	return n, err
+}
@@ -0,0 +1,66 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type journalTestMsg int
+
+func TestJournalReplay(t *testing.T) {
+	ch := make(chan journalTestMsg, 10)
+	h := newHiveForTest()
+	app := h.NewApp("journaled", Journal())
+	app.HandleFunc(journalTestMsg(0), func(msg Msg,
+		ctx MapContext) MappedCells {
+
+		return MappedCells{{"J", "0"}}
+	}, func(msg Msg, ctx RcvContext) error {
+		ch <- msg.Data().(journalTestMsg)
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	rcv := func() journalTestMsg {
+		select {
+		case m := <-ch:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("message is not received")
+		}
+		return 0
+	}
+
+	start := time.Now()
+	h.Emit(journalTestMsg(1))
+	rcv()
+	mid := time.Now()
+	h.Emit(journalTestMsg(2))
+	h.Emit(journalTestMsg(3))
+	rcv()
+	rcv()
+
+	n, err := app.Replay(mid, time.Time{})
+	if err != nil {
+		t.Fatalf("cannot replay the journal: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("invalid number of replayed messages: actual=%v want=2", n)
+	}
+	for _, want := range []journalTestMsg{2, 3} {
+		if m := rcv(); m != want {
+			t.Errorf("invalid replayed message: actual=%v want=%v", m, want)
+		}
+	}
+
+	// Replayed messages are not journaled again.
+	if n, _ = app.Replay(start, time.Time{}); n != 3 {
+		t.Errorf("invalid number of replayed messages: actual=%v want=3", n)
+	}
+	if n, _ = app.Replay(start, mid); n != 1 {
+		t.Errorf("invalid number of replayed messages: actual=%v want=1", n)
+	}
+}
@@ -0,0 +1,92 @@
+package beehive
+
+import "errors"
+
+// ErrTooManyBees is returned when the cells of a message need a new bee, but
+// the application already has its maximum number of bees on the hive.
+var ErrTooManyBees = errors.New("beehive: too many bees for the application")
+
+// MaxBees is an application option that limits the number of local bees of the
+// application on each hive to n. It protects the hive from map functions that
+// map messages to an unbounded number of cells, and thus create an unbounded
+// number of bees and goroutines.
+//
+// When the limit is reached, the cells of new messages are assigned to the
+// local bee that owns the fewest cells. If reject is true, those messages are
+// instead dropped with ErrTooManyBees. Bees created on other hives for the
+// application, such as followers, are not limited.
+func MaxBees(n int, reject bool) AppOption {
+	return func(a *app) {
+		a.maxBees.n = n
+		a.maxBees.reject = reject
+	}
+}
+
+type appMaxBees struct {
+	n      int
+	reject bool
+}
+
+// atMaxBees returns whether the application has reached its maximum number of
+// local bees, given that pending bees are about to be created.
+func (q *qee) atMaxBees(pending int) bool {
+	return q.app.maxBees.n > 0 && q.localBees()+pending >= q.app.maxBees.n
+}
+
+// localBees returns the number of the local bees of the application, including
+// hibernated bees and excluding proxies and detached bees.
+func (q *qee) localBees() (n int) {
+	q.RLock()
+	defer q.RUnlock()
+	for _, b := range q.bees {
+		if !b.proxy && !b.detached {
+			n++
+		}
+	}
+	return n + len(q.hibernated)
+}
+
+// overflowBee returns the local leader that owns the fewest cells. New cells
+// are assigned to this bee when the application has reached its maximum number
+// of local bees. Hibernated bees are revived only if there is no other leader.
+func (q *qee) overflowBee() (*bee, error) {
+	if q.app.maxBees.reject {
+		return nil, ErrTooManyBees
+	}
+
+	q.RLock()
+	bees := make([]*bee, 0, len(q.bees))
+	for _, b := range q.bees {
+		if !b.proxy && !b.detached {
+			bees = append(bees, b)
+		}
+	}
+	var hibernated []uint64
+	for id := range q.hibernated {
+		hibernated = append(hibernated, id)
+	}
+	q.RUnlock()
+
+	var min *bee
+	minc := 0
+	for _, b := range bees {
+		if !b.isLeader() {
+			continue
+		}
+		b.Lock()
+		c := len(b.cells)
+		b.Unlock()
+		if min == nil || c < minc {
+			min, minc = b, c
+		}
+	}
+	if min != nil {
+		return min, nil
+	}
+	for _, id := range hibernated {
+		if b, ok := q.beeByID(id); ok {
+			return b, nil
+		}
+	}
+	return nil, ErrTooManyBees
+}
@@ -0,0 +1,60 @@
+package beehive
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMaxBees(t *testing.T) {
+	h := newHiveForTest()
+	ch := make(chan uint64)
+	a := h.NewApp("maxbees", MaxBees(2, false))
+	a.HandleFunc(int(0), func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", strconv.Itoa(msg.Data().(int))}}
+	}, func(msg Msg, ctx RcvContext) error {
+		ch <- ctx.ID()
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	bees := make(map[uint64]bool)
+	for i := 0; i < 5; i++ {
+		h.Emit(i)
+		bees[<-ch] = true
+	}
+	if len(bees) != 2 {
+		t.Errorf("invalid number of bees: actual=%v want=2", len(bees))
+	}
+}
+
+func TestMaxBeesReject(t *testing.T) {
+	h := newHiveForTest()
+	ch := make(chan int)
+	a := h.NewApp("maxbeesrej", MaxBees(1, true))
+	a.HandleFunc(int(0), func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", strconv.Itoa(msg.Data().(int))}}
+	}, func(msg Msg, ctx RcvContext) error {
+		ch <- msg.Data().(int)
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(1)
+	<-ch
+	h.Emit(2)
+	for i := 0; i < 100; i++ {
+		if l := a.DeadLetters(); len(l) == 1 {
+			if l[0].Msg.Data() != 2 || l[0].Err != ErrTooManyBees.Error() {
+				t.Errorf("invalid dead letter: %#v", l[0])
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("message is not rejected")
+}
@@ -10,8 +10,19 @@ import (
 )
 
 type HiveInfo struct {
-	ID   uint64 `json:"id"`
-	Addr string `json:"addr"`
+	ID     uint64   `json:"id"`
+	Addr   string   `json:"addr"`
+	Labels []string `json:"labels,omitempty"`
+}
+
+// HasLabel returns whether the hive has label l.
+func (i HiveInfo) HasLabel(l string) bool {
+	for _, hl := range i.Labels {
+		if hl == l {
+			return true
+		}
+	}
+	return false
 }
 
 type hiveMeta struct {
@@ -19,7 +30,7 @@ type hiveMeta struct {
 	Peers map[uint64]HiveInfo
 }
 
-func peersInfo(addrs []string) map[uint64]HiveInfo {
+func peersInfo(addrs []string, tr *transport) map[uint64]HiveInfo {
 	if len(addrs) == 0 {
 		return nil
 	}
@@ -27,7 +38,7 @@ func peersInfo(addrs []string) map[uint64]HiveInfo {
 	ch := make(chan []HiveInfo, len(addrs))
 	for _, a := range addrs {
 		go func(a string) {
-			s, err := getHiveState(a)
+			s, err := getHiveState(a, tr)
 			if err != nil {
 				glog.Errorf("cannot communicate with %v: %v", a, err)
 				return
@@ -46,7 +57,7 @@ func peersInfo(addrs []string) map[uint64]HiveInfo {
 	return infos
 }
 
-func hiveIDFromPeers(addr string, paddrs []string) uint64 {
+func hiveIDFromPeers(info HiveInfo, paddrs []string, tr *transport) uint64 {
 	if len(paddrs) == 0 {
 		return 1
 	}
@@ -55,7 +66,7 @@ func hiveIDFromPeers(addr string, paddrs []string) uint64 {
 	for _, paddr := range paddrs {
 		glog.Infof("requesting hive ID from %v", paddr)
 		go func(paddr string) {
-			c, err := newRPCClient(paddr)
+			c, err := newRPCClient(paddr, tr)
 			if err != nil {
 				glog.Error(err)
 				return
@@ -75,8 +86,9 @@ func hiveIDFromPeers(addr string, paddrs []string) uint64 {
 			_, err = c.sendCmd(cmd{
 				Data: cmdAddHive{
 					Hive: HiveInfo{
-						ID:   id.(uint64),
-						Addr: addr,
+						ID:     id.(uint64),
+						Addr:   info.Addr,
+						Labels: info.Labels,
 					},
 				},
 			})
@@ -99,7 +111,7 @@ func hiveIDFromPeers(addr string, paddrs []string) uint64 {
 	return 1
 }
 
-func meta(cfg HiveConfig) hiveMeta {
+func meta(cfg HiveConfig, tr *transport) hiveMeta {
 	m := hiveMeta{}
 
 	var dec *gob.Decoder
@@ -108,8 +120,9 @@ func meta(cfg HiveConfig) hiveMeta {
 	if err != nil {
 		// TODO(soheil): We should also update our peer addresses when we have an
 		// existing meta.
-		m.Peers = peersInfo(cfg.PeerAddrs)
+		m.Peers = peersInfo(cfg.PeerAddrs, tr)
 		m.Hive.Addr = cfg.Addr
+		m.Hive.Labels = cfg.Labels
 		if len(cfg.PeerAddrs) == 0 {
 			// The initial ID is 1. There is no raft node up yet to allocate an ID. So
 			// we must do this when the hive starts.
@@ -117,7 +130,7 @@ func meta(cfg HiveConfig) hiveMeta {
 			goto save
 		}
 
-		m.Hive.ID = hiveIDFromPeers(cfg.Addr, cfg.PeerAddrs)
+		m.Hive.ID = hiveIDFromPeers(m.Hive, cfg.PeerAddrs, tr)
 		goto save
 	}
 
@@ -126,6 +139,7 @@ func meta(cfg HiveConfig) hiveMeta {
 		glog.Fatalf("Cannot decode meta: %v", err)
 	}
 	m.Hive.Addr = cfg.Addr
+	m.Hive.Labels = cfg.Labels
 	f.Close()
 
 save:
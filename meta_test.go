@@ -6,7 +6,7 @@ import (
 )
 
 func TestHiveIDFromPeers(t *testing.T) {
-	if id := hiveIDFromPeers("", nil); id != 1 {
+	if id := hiveIDFromPeers(HiveInfo{}, nil, nil); id != 1 {
 		t.Errorf("%v is not a valid default hive ID", id)
 	}
 }
@@ -17,12 +17,12 @@ func TestDefaultMeta(t *testing.T) {
 	}
 	os.Mkdir(cfg.StatePath, 0700)
 	defer os.RemoveAll(cfg.StatePath)
-	m := meta(cfg)
+	m := meta(cfg, nil)
 	if m.Hive.ID != 1 {
 		t.Errorf("%v is not a valid default hive ID", m.Hive.ID)
 	}
 
-	m = meta(cfg)
+	m = meta(cfg, nil)
 	if m.Hive.ID != 1 {
 		t.Errorf("%v is not a valid default hive ID", m.Hive.ID)
 	}
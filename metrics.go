@@ -0,0 +1,370 @@
+package beehive
+
+import (
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "beehive"
+
+var (
+	compactions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "state",
+			Name:      "compactions_total",
+			Help:      "Number of state compactions performed by bees.",
+		},
+		[]string{"app"},
+	)
+	compactedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "state",
+			Name:      "compacted_bytes_total",
+			Help:      "Approximate number of bytes reclaimed by state compactions.",
+		},
+		[]string{"app"},
+	)
+	antiEntropyRepairs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "colony",
+			Name:      "anti_entropy_repairs_total",
+			Help:      "Number of dictionaries resynced on followers by anti-entropy.",
+		},
+		[]string{"app"},
+	)
+	colonyReplLag = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "colony",
+			Name:      "replication_lag",
+			Help:      "Transactions committed by the leader but not acked by followers.",
+		},
+		[]string{"app", "colony"},
+	)
+	colonyFollowers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "colony",
+			Name:      "followers",
+			Help:      "Number of followers in the colony.",
+		},
+		[]string{"app", "colony"},
+	)
+	colonyReplFactor = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "colony",
+			Name:      "replication_factor",
+			Help:      "Number of bees the colony should have, including the leader.",
+		},
+		[]string{"app", "colony"},
+	)
+	colonyLastAck = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "colony",
+			Name:      "last_ack_timestamp_seconds",
+			Help:      "Unix time of the last transaction acked by the followers.",
+		},
+		[]string{"app", "colony"},
+	)
+	expiredMsgs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "msg",
+			Name:      "expired_total",
+			Help:      "Number of messages dropped because their deadline passed.",
+		},
+		[]string{"app"},
+	)
+	shedMsgs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "bee",
+			Name:      "shed_msgs_total",
+			Help:      "Number of messages shed because the queue of their bee is full.",
+		},
+		[]string{"app"},
+	)
+	rateLimitedMsgs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "queen",
+			Name:      "rate_limited_msgs_total",
+			Help:      "Number of messages dropped or pushed back by the inbound rate.",
+		},
+		[]string{"app"},
+	)
+	quarantinedMsgs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "bee",
+			Name:      "quarantined_msgs_total",
+			Help:      "Number of messages quarantined after repeated panics.",
+		},
+		[]string{"app"},
+	)
+	queenQueueLen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "queen",
+			Name:      "queue_length",
+			Help:      "Number of messages waiting to be routed by the queen.",
+		},
+		[]string{"app"},
+	)
+	queenMapTime = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "queen",
+			Name:      "map_duration_seconds",
+			Help:      "Latency of the map functions invoked by the queen.",
+			Buckets:   prometheus.ExponentialBuckets(0.000001, 4, 10),
+		},
+		[]string{"app"},
+	)
+	queenRoutedMsgs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "queen",
+			Name:      "routed_msgs_total",
+			Help:      "Number of messages routed by the queen, by kind: unicast, mapped, local_broadcast, or broadcast_all.",
+		},
+		[]string{"app", "kind"},
+	)
+	queenDroppedMsgs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "queen",
+			Name:      "nil_mapped_msgs_total",
+			Help:      "Number of messages dropped because their map function returned nil.",
+		},
+		[]string{"app"},
+	)
+	beesCreated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "queen",
+			Name:      "bees_created_total",
+			Help:      "Number of local bees created by the queen.",
+		},
+		[]string{"app"},
+	)
+	hibernations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "bee",
+			Name:      "hibernations_total",
+			Help:      "Number of idle bees hibernated.",
+		},
+		[]string{"app"},
+	)
+	revivals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "bee",
+			Name:      "revivals_total",
+			Help:      "Number of hibernated bees revived.",
+		},
+		[]string{"app"},
+	)
+	overflowMsgs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "bee",
+			Name:      "overflow_msgs_total",
+			Help:      "Number of messages queued beyond the queue limit of their bee.",
+		},
+		[]string{"app"},
+	)
+	blockedTime = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "bee",
+			Name:      "blocked_seconds",
+			Help:      "Time spent waiting for room in the queue of full bees.",
+		},
+		[]string{"app"},
+	)
+	registryRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "registry",
+			Name:      "requests_total",
+			Help:      "Number of requests applied to the local registry.",
+		},
+		[]string{"op"},
+	)
+	registryConflicts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "registry",
+			Name:      "cell_conflicts_total",
+			Help:      "Number of cell locks rejected because of conflicting owners.",
+		},
+	)
+	registryLockWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "registry",
+			Name:      "lock_wait_seconds",
+			Help:      "Time spent waiting for the registry lock to apply requests.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+		},
+	)
+	registryProposals = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "registry",
+			Name:      "proposal_duration_seconds",
+			Help:      "Latency of the requests proposed to the registry by this hive.",
+		},
+		[]string{"op"},
+	)
+	compressedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "rpc",
+			Name:      "compressed_bytes_total",
+			Help:      "Size of the payloads compressed for other hives, before and after compression.",
+		},
+		[]string{"stage"},
+	)
+	throttledTime = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "rpc",
+			Name:      "throttled_seconds_total",
+			Help:      "Time spent waiting for the egress rate limit of a traffic class.",
+		},
+		[]string{"class"},
+	)
+	breakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "rpc",
+			Name:      "breaker_state",
+			Help:      "State of the circuit breaker of a peer hive: 0 closed, 1 open, 2 half-open.",
+		},
+		[]string{"hive"},
+	)
+	breakerRejects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "rpc",
+			Name:      "breaker_rejected_total",
+			Help:      "Number of calls to a peer hive failed fast by its circuit breaker.",
+		},
+		[]string{"hive"},
+	)
+)
+
+// registryOp returns the name of a registry request used in metric labels.
+func registryOp(req interface{}) string {
+	if t := reflect.TypeOf(req); t != nil {
+		return t.Name()
+	}
+	return "nil"
+}
+
+// observeRegistryProposal records the latency of a registry proposal started
+// at start.
+func observeRegistryProposal(req interface{}, start time.Time) {
+	registryProposals.WithLabelValues(registryOp(req)).
+		Observe(time.Since(start).Seconds())
+}
+
+// queenMetrics are the routing metrics of a queen. The metrics are looked up
+// once per queen, since they are updated for every message.
+type queenMetrics struct {
+	queueLen   prometheus.Gauge
+	mapTime    prometheus.Histogram
+	unicast    prometheus.Counter
+	mapped     prometheus.Counter
+	localBcast prometheus.Counter
+	bcastAll   prometheus.Counter
+	dropped    prometheus.Counter
+	created    prometheus.Counter
+}
+
+func newQueenMetrics(app string) queenMetrics {
+	return queenMetrics{
+		queueLen:   queenQueueLen.WithLabelValues(app),
+		mapTime:    queenMapTime.WithLabelValues(app),
+		unicast:    queenRoutedMsgs.WithLabelValues(app, "unicast"),
+		mapped:     queenRoutedMsgs.WithLabelValues(app, "mapped"),
+		localBcast: queenRoutedMsgs.WithLabelValues(app, "local_broadcast"),
+		bcastAll:   queenRoutedMsgs.WithLabelValues(app, "broadcast_all"),
+		dropped:    queenDroppedMsgs.WithLabelValues(app),
+		created:    beesCreated.WithLabelValues(app),
+	}
+}
+
+// colonyLabels returns the label values of the colony metrics of b.
+func colonyLabels(b *bee, c Colony) []string {
+	return []string{b.app.Name(), strconv.FormatUint(c.ID, 10)}
+}
+
+// updateColonyMetrics updates the size of the colony led by b. The metrics of
+// the colony are removed when b is not its leader.
+func updateColonyMetrics(b *bee, c Colony) {
+	if !b.app.persistent() || b.detached {
+		return
+	}
+
+	l := colonyLabels(b, c)
+	if c.Leader != b.ID() {
+		colonyReplLag.DeleteLabelValues(l...)
+		colonyFollowers.DeleteLabelValues(l...)
+		colonyReplFactor.DeleteLabelValues(l...)
+		colonyLastAck.DeleteLabelValues(l...)
+		return
+	}
+	colonyFollowers.WithLabelValues(l...).Set(float64(len(c.Followers)))
+	colonyReplFactor.WithLabelValues(l...).Set(float64(b.app.replFactor))
+}
+
+// ackColonyTx records that the followers of the colony acked a transaction,
+// and that lag transactions are still waiting to be acked.
+func ackColonyTx(b *bee, c Colony, lag int) {
+	l := colonyLabels(b, c)
+	colonyReplLag.WithLabelValues(l...).Set(float64(lag))
+	colonyLastAck.WithLabelValues(l...).Set(float64(time.Now().Unix()))
+}
+
+func init() {
+	prometheus.MustRegister(compactions)
+	prometheus.MustRegister(compactedBytes)
+	prometheus.MustRegister(antiEntropyRepairs)
+	prometheus.MustRegister(colonyReplLag)
+	prometheus.MustRegister(colonyFollowers)
+	prometheus.MustRegister(colonyReplFactor)
+	prometheus.MustRegister(colonyLastAck)
+	prometheus.MustRegister(expiredMsgs)
+	prometheus.MustRegister(shedMsgs)
+	prometheus.MustRegister(quarantinedMsgs)
+	prometheus.MustRegister(queenQueueLen)
+	prometheus.MustRegister(queenMapTime)
+	prometheus.MustRegister(queenRoutedMsgs)
+	prometheus.MustRegister(queenDroppedMsgs)
+	prometheus.MustRegister(beesCreated)
+	prometheus.MustRegister(hibernations)
+	prometheus.MustRegister(revivals)
+	prometheus.MustRegister(rateLimitedMsgs)
+	prometheus.MustRegister(overflowMsgs)
+	prometheus.MustRegister(blockedTime)
+	prometheus.MustRegister(registryRequests)
+	prometheus.MustRegister(registryConflicts)
+	prometheus.MustRegister(registryLockWait)
+	prometheus.MustRegister(registryProposals)
+	prometheus.MustRegister(compressedBytes)
+	prometheus.MustRegister(throttledTime)
+	prometheus.MustRegister(breakerState)
+	prometheus.MustRegister(breakerRejects)
+}
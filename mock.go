@@ -40,11 +40,16 @@ func (m MockMsg) NoReply() bool {
 	return m.MsgFrom == Nil
 }
 
+func (m MockMsg) Trace() uint64 {
+	return m.MsgTrace
+}
+
 // MockRcvContext is a mock for RcvContext.
 type MockRcvContext struct {
 	CtxHive  Hive
 	CtxApp   string
 	CtxDicts *state.InMem
+	CtxLocal *state.InMem
 	CtxID    uint64
 	CtxMsgs  []Msg
 	// TODO(soheil): add message handling methods.
@@ -119,12 +124,42 @@ func (m MockRcvContext) LockCells(keys []CellKey) error {
 
 func (m MockRcvContext) Snooze(d time.Duration) {}
 
+// Multicast records the message as if it is sent to each of the bees.
+func (m *MockRcvContext) Multicast(msgData interface{},
+	to ...uint64) map[uint64]error {
+
+	for _, id := range to {
+		m.SendToBee(msgData, id)
+	}
+	return nil
+}
+
+// BroadcastToHives records the message as if it is emitted.
+func (m *MockRcvContext) BroadcastToHives(
+	msgData interface{}) map[uint64]error {
+
+	m.Emit(msgData)
+	return nil
+}
+
+// EmitAfter records the message as if it is emitted immediately.
+func (m *MockRcvContext) EmitAfter(d time.Duration, msgData interface{}) {
+	m.Emit(msgData)
+}
+
 func (m MockRcvContext) BeeLocal() interface{} {
 	return nil
 }
 
 func (m MockRcvContext) SetBeeLocal(d interface{}) {}
 
+func (m *MockRcvContext) LocalState() state.Dict {
+	if m.CtxLocal == nil {
+		m.CtxLocal = state.NewInMem()
+	}
+	return m.CtxLocal.Dict(localStateDict)
+}
+
 func (m MockRcvContext) BeginTx() error {
 	return nil
 }
@@ -137,6 +172,46 @@ func (m MockRcvContext) AbortTx() error {
 	return nil
 }
 
+func (m MockRcvContext) Savepoint() (Savepoint, error) {
+	return Savepoint{}, nil
+}
+
+func (m MockRcvContext) RollbackTo(sp Savepoint) error {
+	return nil
+}
+
+// CommitWith applies the writes on the mock's dictionaries, regardless of the
+// application.
+func (m *MockRcvContext) CommitWith(writes []CellWrite) error {
+	if m.CtxDicts == nil {
+		m.CtxDicts = state.NewInMem()
+	}
+	for _, w := range writes {
+		if err := applyOp(m.CtxDicts, w.op()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MockRcvContext) Update(fn func(tx StateTx) error) error {
+	if m.CtxDicts == nil {
+		m.CtxDicts = state.NewInMem()
+	}
+	return state.Update(m.CtxDicts, func(tx state.State) error {
+		return fn(tx)
+	})
+}
+
+// BeeState returns a read-only view of the mock's dictionaries, regardless of
+// the bee ID.
+func (m *MockRcvContext) BeeState(id uint64) (state.State, error) {
+	if m.CtxDicts == nil {
+		m.CtxDicts = state.NewInMem()
+	}
+	return state.ReadOnly(m.CtxDicts), nil
+}
+
 func (m MockRcvContext) Sync(ctx context.Context, req interface{}) (
 	res interface{}, err error) {
 
@@ -3,8 +3,14 @@ package beehive
 import (
 	"encoding/gob"
 	"fmt"
+	"math/rand"
 	"reflect"
 	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
 )
 
 // Msg is a generic interface for messages emitted in the system. Messages
@@ -25,6 +31,10 @@ type Msg interface {
 	IsBroadCast() bool
 	// IsUnicast returns whether the message is a unicast.
 	IsUnicast() bool
+
+	// Trace returns the correlation ID of this message. Messages emitted while
+	// handling a message inherit its trace, across hives.
+	Trace() uint64
 }
 
 // Typed is a message data with an explicit type.
@@ -32,10 +42,51 @@ type Typed interface {
 	Type() string
 }
 
+// Priority represents the priority of a message.
+type Priority int
+
+// Message priorities. Messages with no explicit priority are of
+// PriorityNormal.
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+const msgPrioLevels = int(PriorityHigh-PriorityLow) + 1
+
+// Prioritized is a message data with an explicit priority. When a queen or a
+// bee is backlogged, messages of higher priorities are dispatched before the
+// messages of lower priorities. Messages of the same priority are dispatched
+// in order.
+type Prioritized interface {
+	Priority() Priority
+}
+
 type msg struct {
 	MsgData interface{}
 	MsgFrom uint64
 	MsgTo   uint64
+
+	// The proxy bee that should be acked when the message is handled, and the
+	// sequence of the message in that bee. See AckedDelivery.
+	MsgSeq     uint64
+	MsgAckHive uint64
+	MsgAckBee  uint64
+
+	// MsgTrace is the correlation ID of the message.
+	MsgTrace uint64
+	// MsgSchema is the schema version of the data, when the message is sent to
+	// another hive. It is 0 if the type of the data has no registered schema.
+	MsgSchema uint
+	// The stream of the message and its sequence in the stream. See
+	// FIFODelivery.
+	MsgStream    uint64
+	MsgStreamSeq uint64
+	// The ID of the receipt of the message and the hive waiting for it. See
+	// Hive.EmitWithReceipt.
+	MsgReceipt     uint64
+	MsgReceiptHive uint64
 }
 
 func (m msg) NoReply() bool {
@@ -66,11 +117,26 @@ func (m msg) From() uint64 {
 	return m.MsgFrom
 }
 
+func (m msg) Trace() uint64 {
+	return m.MsgTrace
+}
+
 func (m msg) String() string {
 	if m.Data() == nil {
-		return fmt.Sprintf("%v -> %v\t(nil)", m.From(), m.To())
+		return fmt.Sprintf("%v -> %v\t(nil)\ttrace=%x", m.From(), m.To(),
+			m.Trace())
+	}
+	return fmt.Sprintf("%v -> %v\t%v(%#v)\ttrace=%x", m.From(), m.To(), m.Type(),
+		m.Data(), m.Trace())
+}
+
+// newTraceID returns a random, non-zero trace.
+func newTraceID() uint64 {
+	for {
+		if t := uint64(rand.Uint32())<<32 | uint64(rand.Uint32()); t != 0 {
+			return t
+		}
 	}
-	return fmt.Sprintf("%v -> %v\t%v(%#v)", m.From(), m.To(), m.Type(), m.Data())
 }
 
 // MsgType returns the message type for d.
@@ -81,6 +147,90 @@ func MsgType(d interface{}) string {
 	return reflect.TypeOf(d).String()
 }
 
+// Deadliner is a message data with a deadline. Queens and bees drop the
+// messages whose deadline has passed before they are dispatched, instead of
+// processing stale messages when they are overloaded. A zero deadline means
+// the message never expires.
+type Deadliner interface {
+	Deadline() time.Time
+}
+
+// MsgDeadline returns the deadline of the message data d, or a zero time if d
+// has no deadline.
+func MsgDeadline(d interface{}) time.Time {
+	if dl, ok := d.(Deadliner); ok {
+		return dl.Deadline()
+	}
+	return time.Time{}
+}
+
+// dropExpired removes the messages whose deadline is before now from the
+// batch, and counts them for app.
+func dropExpired(app string, batch []msgAndHandler,
+	now time.Time) []msgAndHandler {
+
+	n := 0
+	for _, mh := range batch {
+		if mh.msg != nil {
+			if d := MsgDeadline(mh.msg.MsgData); !d.IsZero() && d.Before(now) {
+				glog.V(2).Infof("%v drops expired message %v", app, mh.msg)
+				expiredMsgs.WithLabelValues(app).Inc()
+				continue
+			}
+		}
+		batch[n] = mh
+		n++
+	}
+	for i := n; i < len(batch); i++ {
+		batch[i].msg = nil
+	}
+	return batch[:n]
+}
+
+// MsgPriority returns the priority of the message data d.
+func MsgPriority(d interface{}) Priority {
+	p, ok := d.(Prioritized)
+	if !ok {
+		return PriorityNormal
+	}
+	switch pr := p.Priority(); {
+	case pr > PriorityHigh:
+		return PriorityHigh
+	case pr < PriorityLow:
+		return PriorityLow
+	default:
+		return pr
+	}
+}
+
+// prioLevel returns the index of the queue of mh in msgChannel.
+func prioLevel(mh msgAndHandler) int {
+	if mh.msg == nil {
+		return int(PriorityHigh - PriorityNormal)
+	}
+	return int(PriorityHigh - MsgPriority(mh.msg.MsgData))
+}
+
+// prioritize reorders the batch of messages in the order of their priorities.
+// Messages of the same priority keep their order.
+func prioritize(batch []msgAndHandler) {
+	mixed := false
+	for i := 1; i < len(batch) && !mixed; i++ {
+		mixed = prioLevel(batch[i]) != prioLevel(batch[0])
+	}
+	if mixed {
+		sort.Stable(byPriority(batch))
+	}
+}
+
+type byPriority []msgAndHandler
+
+func (b byPriority) Len() int      { return len(b) }
+func (b byPriority) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byPriority) Less(i, j int) bool {
+	return prioLevel(b[i]) < prioLevel(b[j])
+}
+
 func newMsgFromData(data interface{}, from uint64, to uint64) *msg {
 	return &msg{
 		MsgData: data,
@@ -92,6 +242,10 @@ func newMsgFromData(data interface{}, from uint64, to uint64) *msg {
 type msgAndHandler struct {
 	msg     *msg
 	handler Handler
+	// attempts is the number of times the message has failed.
+	attempts int
+	// journaled is whether the message is in the journal of the application.
+	journaled bool
 }
 
 type Emitter interface {
@@ -102,20 +256,28 @@ func init() {
 	gob.Register(msg{})
 }
 
+// msgChannel is an unbounded channel of messages. When its consumer falls
+// behind, the buffered messages are delivered in the order of their
+// priorities.
 type msgChannel struct {
-	chin  chan msgAndHandler
-	chout chan msgAndHandler
-	buf   []msgAndHandler
-	start int
-	end   int
+	chin   chan msgAndHandler
+	chout  chan msgAndHandler
+	queues [msgPrioLevels]msgQueue
+	// queued is the number of messages held by pipe, which is updated by pipe
+	// and read atomically by depth.
+	queued int64
 }
 
 func newMsgChannel(bufSize uint) *msgChannel {
 	q := &msgChannel{
 		chin:  make(chan msgAndHandler, bufSize),
 		chout: make(chan msgAndHandler, bufSize),
-		buf:   make([]msgAndHandler, bufSize),
 	}
+	// Prioritized messages are rare, and their queues are expanded on demand.
+	for i := range q.queues {
+		q.queues[i].buf = make([]msgAndHandler, 1)
+	}
+	q.queues[prioLevel(msgAndHandler{})].buf = make([]msgAndHandler, bufSize)
 	go q.pipe()
 	return q
 }
@@ -142,6 +304,12 @@ func (q *msgChannel) pipe() {
 			q.maybeWriteMore()
 			first, dequed = q.deque()
 		}
+
+		n := q.len()
+		if dequed {
+			n++
+		}
+		atomic.StoreInt64(&q.queued, int64(n))
 	}
 }
 
@@ -194,7 +362,7 @@ func (q *msgChannel) maybeWriteMore() {
 	}
 	for ; l > 0; l-- {
 		select {
-		case q.chout <- q.buf[q.start]:
+		case q.chout <- q.peek():
 			q.deque()
 		default:
 			return
@@ -210,15 +378,64 @@ func (q *msgChannel) out() <-chan msgAndHandler {
 	return q.chout
 }
 
+// depth returns the approximate number of messages in the channel. Unlike len,
+// it is safe to call from any goroutine.
+func (q *msgChannel) depth() int {
+	return len(q.chin) + len(q.chout) + int(atomic.LoadInt64(&q.queued))
+}
+
 func (q *msgChannel) empty() bool {
 	return q.len() == 0
 }
 
-func (q *msgChannel) full() bool {
+func (q *msgChannel) enque(mh msgAndHandler) {
+	q.queues[prioLevel(mh)].enque(mh)
+}
+
+// deque returns the oldest message of the highest priority.
+func (q *msgChannel) deque() (msgAndHandler, bool) {
+	for i := range q.queues {
+		if mh, ok := q.queues[i].deque(); ok {
+			return mh, true
+		}
+	}
+	return msgAndHandler{}, false
+}
+
+// peek returns the message that would be returned by deque.
+func (q *msgChannel) peek() msgAndHandler {
+	for i := range q.queues {
+		if !q.queues[i].empty() {
+			return q.queues[i].buf[q.queues[i].start]
+		}
+	}
+	return msgAndHandler{}
+}
+
+func (q *msgChannel) len() int {
+	l := 0
+	for i := range q.queues {
+		l += q.queues[i].len()
+	}
+	return l
+}
+
+// msgQueue is a ring buffer of messages that expands when it is full.
+type msgQueue struct {
+	buf   []msgAndHandler
+	start int
+	end   int
+}
+
+func (q *msgQueue) empty() bool {
+	return q.len() == 0
+}
+
+func (q *msgQueue) full() bool {
 	return q.len() == len(q.buf)-1
 }
 
-func (q *msgChannel) enque(mh msgAndHandler) {
+func (q *msgQueue) enque(mh msgAndHandler) {
 	if q.full() {
 		q.maybeExpand()
 	}
@@ -230,7 +447,7 @@ func (q *msgChannel) enque(mh msgAndHandler) {
 	}
 }
 
-func (q *msgChannel) deque() (msgAndHandler, bool) {
+func (q *msgQueue) deque() (msgAndHandler, bool) {
 	if q.empty() {
 		return msgAndHandler{}, false
 	}
@@ -244,7 +461,7 @@ func (q *msgChannel) deque() (msgAndHandler, bool) {
 	return mh, true
 }
 
-func (q *msgChannel) len() int {
+func (q *msgQueue) len() int {
 	l := q.end - q.start
 	if l >= 0 {
 		return l
@@ -252,11 +469,7 @@ func (q *msgChannel) len() int {
 	return len(q.buf) + l
 }
 
-func (q *msgChannel) free() int {
-	return len(q.buf) - q.len()
-}
-
-func (q *msgChannel) maybeExpand() {
+func (q *msgQueue) maybeExpand() {
 	if !q.full() {
 		return
 	}
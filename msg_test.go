@@ -3,6 +3,7 @@ package beehive
 import (
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestMsgChannelQueue(t *testing.T) {
@@ -101,3 +102,65 @@ func BenchmarkMsgChannel(b *testing.B) {
 
 	wg.Wait()
 }
+
+type prioMsg int
+
+func (m prioMsg) Priority() Priority { return Priority(m) }
+
+func TestMsgChannelPriority(t *testing.T) {
+	ch := newMsgChannel(1)
+	prios := []int{0, -1, 1, 0, 1, -1}
+	for i, p := range prios {
+		m := &msg{MsgData: prioMsg(p), MsgFrom: uint64(i)}
+		ch.enque(msgAndHandler{msg: m})
+	}
+
+	want := []uint64{2, 4, 0, 3, 1, 5}
+	for _, w := range want {
+		mh, ok := ch.deque()
+		if !ok {
+			t.Fatal("cannot deque")
+		}
+		if mh.msg.From() != w {
+			t.Errorf("invalid message: actual=%v want=%v", mh.msg.From(), w)
+		}
+	}
+}
+
+func TestPrioritize(t *testing.T) {
+	var batch []msgAndHandler
+	for i, p := range []int{0, -1, 1, 0, 1, -1} {
+		batch = append(batch,
+			msgAndHandler{msg: &msg{MsgData: prioMsg(p), MsgFrom: uint64(i)}})
+	}
+	prioritize(batch)
+	for i, w := range []uint64{2, 4, 0, 3, 1, 5} {
+		if f := batch[i].msg.From(); f != w {
+			t.Errorf("invalid message at %v: actual=%v want=%v", i, f, w)
+		}
+	}
+}
+
+type deadlineMsg time.Time
+
+func (m deadlineMsg) Deadline() time.Time { return time.Time(m) }
+
+func TestDropExpired(t *testing.T) {
+	now := time.Now()
+	batch := []msgAndHandler{
+		{msg: &msg{MsgData: deadlineMsg(now.Add(-time.Second)), MsgFrom: 1}},
+		{msg: &msg{MsgData: "nodeadline", MsgFrom: 2}},
+		{msg: &msg{MsgData: deadlineMsg(now.Add(time.Second)), MsgFrom: 3}},
+		{msg: &msg{MsgData: deadlineMsg(time.Time{}), MsgFrom: 4}},
+	}
+	batch = dropExpired("app", batch, now)
+	want := []uint64{2, 3, 4}
+	if len(batch) != len(want) {
+		t.Fatalf("invalid batch size: actual=%v want=%v", len(batch), len(want))
+	}
+	for i, w := range want {
+		if f := batch[i].msg.From(); f != w {
+			t.Errorf("invalid message at %v: actual=%v want=%v", i, f, w)
+		}
+	}
+}
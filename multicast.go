@@ -0,0 +1,41 @@
+package beehive
+
+import (
+	"fmt"
+)
+
+func (b *bee) Multicast(msgData interface{},
+	to ...uint64) map[uint64]error {
+
+	var errs map[uint64]error
+	for _, id := range to {
+		if err := b.canSendTo(MsgType(msgData), id); err != nil {
+			if errs == nil {
+				errs = make(map[uint64]error)
+			}
+			errs[id] = err
+			continue
+		}
+		b.SendToBee(msgData, id)
+	}
+	return errs
+}
+
+// canSendTo returns an error if a message of type t cannot be sent to bee id.
+func (b *bee) canSendTo(t string, id uint64) error {
+	info, err := b.hive.bee(id)
+	if err != nil {
+		return err
+	}
+	if info.Detached {
+		return nil
+	}
+	a, ok := b.hive.app(info.App)
+	if !ok {
+		return fmt.Errorf("%v has no app %v", b.hive, info.App)
+	}
+	if a.handler(t) == nil {
+		return fmt.Errorf("%v has no handler for %v", a, t)
+	}
+	return nil
+}
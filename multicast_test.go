@@ -0,0 +1,65 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type multicastTestMsg string
+type multicastTestCoord []uint64
+
+func TestMulticast(t *testing.T) {
+	bees := make(chan uint64, 10)
+	errs := make(chan map[uint64]error, 1)
+	h := newHiveForTest()
+	app := h.NewApp("multicast")
+	app.HandleFunc(multicastTestMsg(""), func(msg Msg,
+		ctx MapContext) MappedCells {
+
+		return MappedCells{{"M", string(msg.Data().(multicastTestMsg))}}
+	}, func(msg Msg, ctx RcvContext) error {
+		bees <- ctx.ID()
+		return nil
+	})
+	app.HandleFunc(multicastTestCoord{}, func(msg Msg,
+		ctx MapContext) MappedCells {
+
+		return MappedCells{{"C", "0"}}
+	}, func(msg Msg, ctx RcvContext) error {
+		errs <- ctx.Multicast(multicastTestMsg(""),
+			msg.Data().(multicastTestCoord)...)
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	rcv := func() uint64 {
+		select {
+		case id := <-bees:
+			return id
+		case <-time.After(5 * time.Second):
+			t.Fatal("message is not received")
+		}
+		return Nil
+	}
+
+	h.Emit(multicastTestMsg("a"))
+	b1 := rcv()
+	h.Emit(multicastTestMsg("b"))
+	b2 := rcv()
+
+	const invalid = 1 << 40
+	h.Emit(multicastTestCoord{b1, b2, invalid})
+	res := <-errs
+	if len(res) != 1 || res[invalid] == nil {
+		t.Errorf("invalid multicast errors: actual=%v want=[%v]", res, invalid)
+	}
+
+	rcvd := map[uint64]bool{rcv(): true, rcv(): true}
+	if !rcvd[b1] || !rcvd[b2] {
+		t.Errorf("multicast is not received by all bees: actual=%v want=%v,%v",
+			rcvd, b1, b2)
+	}
+}
@@ -0,0 +1,299 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/state"
+)
+
+const (
+	// orderDict is the dictionary that stores the next sequence of each stream
+	// of messages handled by a bee.
+	orderDict = "__order__"
+	// streamExpiry is how long a stream is kept after its last message.
+	streamExpiry = time.Hour
+	// streamSweep is how often the idle streams are expired.
+	streamSweep = time.Minute
+)
+
+// streamSeq is the next sequence of a stream stored in orderDict, and when
+// its last message is handled, in unix nanoseconds.
+type streamSeq struct {
+	Next uint64
+	Last int64
+}
+
+// FIFODelivery is an application option that guarantees that the messages
+// emitted by a bee to a cell of the application are handled in the order they
+// are emitted, even when the bee owning the cell is migrated or fails over.
+// Messages are sequenced per sender bee and the first cell returned by the map
+// function. A bee buffers the messages that arrive before their predecessors
+// for at most wait, after which it handles them in order, skipping the missing
+// messages. Transactional applications keep the sequences in the state of
+// their bees, so that they survive migrations and failovers.
+//
+// Messages are sequenced on the hive of their sender. As such, the messages
+// emitted before and after the sender bee migrates to another hive are not
+// ordered. Messages emitted by the hive (i.e., not by a bee) and messages sent
+// directly to a bee are not ordered either. Streams idle for an hour are
+// forgotten.
+func FIFODelivery(wait time.Duration) AppOption {
+	return func(a *app) {
+		a.fifoWait = wait
+	}
+}
+
+// streamKey identifies the stream of messages from a bee to a cell.
+type streamKey struct {
+	From uint64
+	Cell CellKey
+}
+
+// outStream is a stream of messages sequenced by a qee.
+type outStream struct {
+	id   uint64
+	seq  uint64
+	last time.Time
+}
+
+// sequence assigns the next sequence of the stream of the message to the
+// message.
+func (q *qee) sequence(mh *msgAndHandler, cells MappedCells) {
+	if q.app.fifoWait <= 0 || mh.msg.From() == Nil || len(cells) == 0 {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(q.streamsSwept) >= streamSweep {
+		q.expireOutStreams(now)
+		q.streamsSwept = now
+	}
+
+	k := streamKey{From: mh.msg.From(), Cell: cells[0]}
+	s, ok := q.streams[k]
+	if !ok {
+		if q.streams == nil {
+			q.streams = make(map[streamKey]*outStream)
+		}
+		// Streams have random IDs, so that they are not mixed with the streams of
+		// a previous incarnation of the hive.
+		s = &outStream{id: newTraceID()}
+		q.streams[k] = s
+	}
+	s.seq++
+	s.last = now
+
+	// Messages are shared among applications and must be copied.
+	m := *mh.msg
+	m.MsgStream = s.id
+	m.MsgStreamSeq = s.seq
+	mh.msg = &m
+}
+
+// expireOutStreams removes the streams that have no message since
+// streamExpiry. Their senders start new streams.
+func (q *qee) expireOutStreams(now time.Time) {
+	for k, s := range q.streams {
+		if now.Sub(s.last) >= streamExpiry {
+			delete(q.streams, k)
+		}
+	}
+}
+
+// inStream is a stream of messages received by a bee.
+type inStream struct {
+	// next is the sequence of the next message to handle, or 0 if the bee has
+	// not handled any message of the stream.
+	next uint64
+	// pending are the messages that have arrived before their predecessors,
+	// sorted by their sequence.
+	pending []msgAndHandler
+	// since is when the oldest pending message was buffered.
+	since time.Time
+	// last is when the last message of the stream was received.
+	last time.Time
+}
+
+func streamDictKey(id uint64) string {
+	return fmt.Sprintf("%016x", id)
+}
+
+func (b *bee) inStream(id uint64) *inStream {
+	if s, ok := b.streams[id]; ok {
+		return s
+	}
+
+	if b.streams == nil {
+		b.streams = make(map[uint64]*inStream)
+	}
+	s := &inStream{}
+	if b.stateL1 != nil {
+		v, err := b.stateL1.Dict(orderDict).Get(streamDictKey(id))
+		if ss, ok := v.(streamSeq); err == nil && ok {
+			s.next = ss.Next
+		}
+	}
+	b.streams[id] = s
+	return s
+}
+
+// reorder returns the messages that can be handled in order, and buffers the
+// messages that have arrived before their predecessors. Proxies do not buffer
+// any message, and relay the messages buffered before they became proxies.
+func (b *bee) reorder(mhs []msgAndHandler, now time.Time) []msgAndHandler {
+	if b.app.fifoWait <= 0 || b.detached {
+		return mhs
+	}
+	if b.proxy {
+		return append(mhs, b.expireStreams(time.Time{})...)
+	}
+
+	if now.Sub(b.streamsSwept) >= streamSweep {
+		b.expireIdleStreams(now)
+		b.streamsSwept = now
+	}
+
+	res := make([]msgAndHandler, 0, len(mhs))
+	for _, mh := range mhs {
+		m := mh.msg
+		if m.MsgStream == 0 {
+			res = append(res, mh)
+			continue
+		}
+
+		s := b.inStream(m.MsgStream)
+		s.last = now
+		switch {
+		case m.MsgStreamSeq == s.next || (s.next == 0 && m.MsgStreamSeq == 1):
+			res = append(res, mh)
+			s.next = m.MsgStreamSeq + 1
+			res = s.drain(res)
+		case m.MsgStreamSeq < s.next:
+			// The message has arrived after the wait, and its successors are
+			// already handled.
+			res = append(res, mh)
+		default:
+			glog.V(2).Infof("%v buffers out of order message %v", b, m)
+			s.buffer(mh, now)
+		}
+	}
+	return res
+}
+
+// expireStreams returns the messages that are buffered before now minus the
+// wait of the application, in order. If now is zero, it returns all the
+// buffered messages.
+func (b *bee) expireStreams(now time.Time) []msgAndHandler {
+	var res []msgAndHandler
+	for _, s := range b.streams {
+		if len(s.pending) == 0 ||
+			(!now.IsZero() && now.Sub(s.since) < b.app.fifoWait) {
+
+			continue
+		}
+
+		glog.V(2).Infof("%v skips %v messages waiting for their predecessors",
+			b, len(s.pending))
+		s.next = s.pending[0].msg.MsgStreamSeq
+		res = s.drain(res)
+		if len(s.pending) != 0 {
+			res = append(res, s.pending...)
+			s.next = s.pending[len(s.pending)-1].msg.MsgStreamSeq + 1
+			s.pending = nil
+		}
+	}
+	return res
+}
+
+// expireIdleStreams removes the streams that have no pending message and have
+// not received any message since streamExpiry.
+func (b *bee) expireIdleStreams(now time.Time) {
+	for id, s := range b.streams {
+		if len(s.pending) == 0 && now.Sub(s.last) >= streamExpiry {
+			delete(b.streams, id)
+		}
+	}
+}
+
+// recordOrder records the sequence of the message in the state of the bee.
+// It must be called in the transaction that handles the message.
+func (b *bee) recordOrder(m *msg) {
+	if m.MsgStream == 0 {
+		return
+	}
+
+	dicts, _ := b.currentState()
+	d := dicts.Dict(orderDict)
+	now := time.Now()
+	if now.Sub(b.orderSwept) >= streamSweep {
+		expireOrder(d, now)
+		b.orderSwept = now
+	}
+
+	k := streamDictKey(m.MsgStream)
+	v, err := d.Get(k)
+	if ss, ok := v.(streamSeq); err == nil && ok && ss.Next > m.MsgStreamSeq {
+		return
+	}
+	ss := streamSeq{Next: m.MsgStreamSeq + 1, Last: now.UnixNano()}
+	if err := d.Put(k, ss); err != nil {
+		glog.Errorf("%v cannot record the sequence of %v: %v", b, m, err)
+	}
+}
+
+// expireOrder removes the sequences of the streams that have no message since
+// streamExpiry from d.
+func expireOrder(d state.Dict, now time.Time) {
+	var expired []string
+	d.ForEach(func(k string, v interface{}) bool {
+		ss, ok := v.(streamSeq)
+		if !ok || now.Sub(time.Unix(0, ss.Last)) >= streamExpiry {
+			expired = append(expired, k)
+		}
+		return true
+	})
+	for _, k := range expired {
+		d.Del(k)
+	}
+}
+
+func (s *inStream) buffer(mh msgAndHandler, now time.Time) {
+	if len(s.pending) == 0 {
+		s.since = now
+	}
+	seq := mh.msg.MsgStreamSeq
+	i := sort.Search(len(s.pending), func(i int) bool {
+		return s.pending[i].msg.MsgStreamSeq >= seq
+	})
+	if i < len(s.pending) && s.pending[i].msg.MsgStreamSeq == seq {
+		// The message is redelivered.
+		return
+	}
+	s.pending = append(s.pending, msgAndHandler{})
+	copy(s.pending[i+1:], s.pending[i:])
+	s.pending[i] = mh
+}
+
+// drain appends the pending messages that are next in the stream to mhs.
+func (s *inStream) drain(mhs []msgAndHandler) []msgAndHandler {
+	i := 0
+	for ; i < len(s.pending) && s.pending[i].msg.MsgStreamSeq <= s.next; i++ {
+		mhs = append(mhs, s.pending[i])
+		if s.pending[i].msg.MsgStreamSeq == s.next {
+			s.next++
+		}
+	}
+	s.pending = s.pending[i:]
+	if len(s.pending) == 0 {
+		s.pending = nil
+	}
+	return mhs
+}
+
+func init() {
+	gob.Register(streamSeq{})
+}
@@ -0,0 +1,152 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/state"
+)
+
+func streamMsgs(stream uint64, seqs ...uint64) []msgAndHandler {
+	mhs := make([]msgAndHandler, 0, len(seqs))
+	for _, s := range seqs {
+		m := &msg{MsgData: int(s), MsgStream: stream, MsgStreamSeq: s}
+		mhs = append(mhs, msgAndHandler{msg: m})
+	}
+	return mhs
+}
+
+func streamSeqs(mhs []msgAndHandler) []uint64 {
+	seqs := make([]uint64, 0, len(mhs))
+	for _, mh := range mhs {
+		seqs = append(seqs, mh.msg.MsgStreamSeq)
+	}
+	return seqs
+}
+
+func checkSeqs(t *testing.T, mhs []msgAndHandler, want ...uint64) {
+	seqs := streamSeqs(mhs)
+	if len(seqs) != len(want) {
+		t.Errorf("invalid messages: actual=%v want=%v", seqs, want)
+		return
+	}
+	for i := range seqs {
+		if seqs[i] != want[i] {
+			t.Errorf("invalid messages: actual=%v want=%v", seqs, want)
+			return
+		}
+	}
+}
+
+func TestReorder(t *testing.T) {
+	b := &bee{app: &app{name: "ordered", fifoWait: time.Second}}
+	now := time.Now()
+
+	checkSeqs(t, b.reorder(streamMsgs(1, 2, 4), now))
+	checkSeqs(t, b.reorder(streamMsgs(1, 1), now), 1, 2)
+	checkSeqs(t, b.reorder(streamMsgs(1, 3, 5), now), 3, 4, 5)
+
+	// Messages of other streams are not blocked.
+	checkSeqs(t, b.reorder(streamMsgs(1, 7), now))
+	checkSeqs(t, b.reorder(streamMsgs(2, 1, 2), now), 1, 2)
+	checkSeqs(t, b.reorder([]msgAndHandler{{msg: &msg{}}}, now), 0)
+
+	// Missing messages are skipped after the wait.
+	checkSeqs(t, b.expireStreams(now.Add(time.Second/2)))
+	checkSeqs(t, b.expireStreams(now.Add(time.Second)), 7)
+	checkSeqs(t, b.reorder(streamMsgs(1, 8, 6), now), 8, 6)
+}
+
+func TestReorderProxy(t *testing.T) {
+	b := &bee{app: &app{name: "ordered", fifoWait: time.Second}}
+	now := time.Now()
+	checkSeqs(t, b.reorder(streamMsgs(1, 2, 3), now))
+
+	// Proxies relay the buffered messages.
+	b.proxy = true
+	checkSeqs(t, b.reorder(streamMsgs(1, 1), now), 1, 2, 3)
+}
+
+func TestReorderStreamExpiry(t *testing.T) {
+	b := &bee{app: &app{name: "ordered", fifoWait: time.Second}}
+	now := time.Now()
+	checkSeqs(t, b.reorder(streamMsgs(1, 1), now), 1)
+	checkSeqs(t, b.reorder(streamMsgs(2, 2), now))
+
+	now = now.Add(streamExpiry)
+	checkSeqs(t, b.reorder(nil, now))
+	if _, ok := b.streams[1]; ok {
+		t.Error("the idle stream is not expired")
+	}
+	if _, ok := b.streams[2]; !ok {
+		t.Error("the stream with pending messages is expired")
+	}
+}
+
+func TestRecordOrderExpiry(t *testing.T) {
+	b := &bee{app: &app{name: "ordered", fifoWait: time.Second}}
+	b.setState(state.NewInMem())
+	b.recordOrder(&msg{MsgStream: 1, MsgStreamSeq: 1})
+
+	d := b.stateL1.Dict(orderDict)
+	v, err := d.Get(streamDictKey(1))
+	if ss, ok := v.(streamSeq); err != nil || !ok || ss.Next != 2 {
+		t.Errorf("invalid sequence: actual=%v want=2 (%v)", v, err)
+	}
+	expireOrder(d, time.Now())
+	if _, err := d.Get(streamDictKey(1)); err != nil {
+		t.Errorf("sequences are expired before the expiry: %v", err)
+	}
+	expireOrder(d, time.Now().Add(streamExpiry))
+	if _, err := d.Get(streamDictKey(1)); err != state.ErrNoSuchKey {
+		t.Errorf("sequences are not expired: actual=%v want=%v", err,
+			state.ErrNoSuchKey)
+	}
+}
+
+func TestSequence(t *testing.T) {
+	q := &qee{app: &app{name: "ordered", fifoWait: time.Second}}
+	cells := MappedCells{{"D", "0"}}
+	m := &msg{MsgData: 1, MsgFrom: 1}
+
+	var streams []uint64
+	for i := uint64(1); i <= 2; i++ {
+		mh := msgAndHandler{msg: m}
+		q.sequence(&mh, cells)
+		if mh.msg == m {
+			t.Fatal("the sequenced message is not copied")
+		}
+		if mh.msg.MsgStreamSeq != i {
+			t.Errorf("invalid sequence: actual=%v want=%v", mh.msg.MsgStreamSeq, i)
+		}
+		streams = append(streams, mh.msg.MsgStream)
+	}
+	if streams[0] == 0 || streams[0] != streams[1] {
+		t.Errorf("invalid streams: %v", streams)
+	}
+
+	mh := msgAndHandler{msg: m}
+	q.sequence(&mh, MappedCells{{"D", "1"}})
+	if mh.msg.MsgStream == streams[0] || mh.msg.MsgStreamSeq != 1 {
+		t.Errorf("messages to different cells are in the same stream: %v",
+			mh.msg)
+	}
+}
+
+func TestSequenceExpiry(t *testing.T) {
+	q := &qee{app: &app{name: "ordered", fifoWait: time.Second}}
+	cells := MappedCells{{"D", "0"}}
+	m := &msg{MsgData: 1, MsgFrom: 1}
+	mh := msgAndHandler{msg: m}
+	q.sequence(&mh, cells)
+	id := mh.msg.MsgStream
+
+	k := streamKey{From: 1, Cell: cells[0]}
+	q.streams[k].last = q.streams[k].last.Add(-streamExpiry)
+	q.streamsSwept = time.Time{}
+	mh = msgAndHandler{msg: m}
+	q.sequence(&mh, cells)
+	if mh.msg.MsgStream == id || mh.msg.MsgStreamSeq != 1 {
+		t.Errorf("the idle stream is not expired: %v", mh.msg)
+	}
+}
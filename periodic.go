@@ -0,0 +1,224 @@
+package beehive
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// Every is an application option that emits msgData into the application
+// every d. The message is handled by the handler of the application for the
+// type of msgData, and is not delivered to other applications. Note that the
+// message is emitted on each hive that runs the application.
+func Every(d time.Duration, msgData interface{}) AppOption {
+	return func(a *app) {
+		a.Detached(newPeriodic(a, msgData, func(t time.Time) time.Time {
+			return t.Add(d)
+		}))
+	}
+}
+
+// Cron is an application option that emits msgData into the application on
+// the given schedule, in local time. Similar to Every, the message is emitted
+// into the application on each hive.
+func Cron(s CronSchedule, msgData interface{}) AppOption {
+	return func(a *app) {
+		a.Detached(newPeriodic(a, msgData, s.Next))
+	}
+}
+
+// MustCron is like Cron, but parses the schedule from expr using ParseCron. It
+// panics if expr is not a valid cron expression.
+func MustCron(expr string, msgData interface{}) AppOption {
+	s, err := ParseCron(expr)
+	if err != nil {
+		panic(fmt.Sprintf("beehive: invalid cron expression %q: %v", expr, err))
+	}
+	return Cron(s, msgData)
+}
+
+// periodic is a detached handler that emits a message into its application on
+// a schedule.
+type periodic struct {
+	app  *app
+	data interface{}
+	next func(t time.Time) time.Time
+	done chan struct{}
+	stop sync.Once
+}
+
+func newPeriodic(a *app, msgData interface{},
+	next func(t time.Time) time.Time) *periodic {
+
+	return &periodic{
+		app:  a,
+		data: msgData,
+		next: next,
+		done: make(chan struct{}),
+	}
+}
+
+func (p *periodic) Start(ctx RcvContext) {
+	for {
+		now := time.Now()
+		at := p.next(now)
+		if at.IsZero() {
+			glog.Errorf("%v has no next schedule for %v", p.app, MsgType(p.data))
+			return
+		}
+
+		t := time.NewTimer(at.Sub(now))
+		select {
+		case <-t.C:
+			p.emit()
+		case <-p.done:
+			t.Stop()
+			return
+		}
+	}
+}
+
+func (p *periodic) emit() {
+	m := &msg{MsgData: p.data, MsgTrace: newTraceID()}
+	h := p.app.handler(m.Type())
+	if h == nil {
+		glog.Errorf("%v has no handler for periodic message %v", p.app, m)
+		return
+	}
+	p.app.qee.enqueMsg(msgAndHandler{msg: m, handler: h})
+}
+
+func (p *periodic) Stop(ctx RcvContext) {
+	p.stop.Do(func() { close(p.done) })
+}
+
+func (p *periodic) Rcv(msg Msg, ctx RcvContext) error {
+	return nil
+}
+
+// CronSchedule is a parsed cron expression. Each field is a bitset of the
+// values that match the field.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// Whether the day of month or the day of week is *. When both are
+	// restricted, a day matches if either matches.
+	domStar, dowStar bool
+}
+
+var errCronFields = errors.New("cron expression must have five fields")
+
+// ParseCron parses a cron expression. The expression has five fields: minute,
+// hour, day of month, month and day of week. Each field is either *, a value, a
+// range (e.g., 1-5) or a list of them (e.g., 1,3-5), optionally followed by a
+// step (e.g., */15).
+func ParseCron(expr string) (CronSchedule, error) {
+	f := strings.Fields(expr)
+	if len(f) != 5 {
+		return CronSchedule{}, errCronFields
+	}
+
+	var s CronSchedule
+	var err error
+	if s.minute, err = parseCronField(f[0], 0, 59); err != nil {
+		return s, err
+	}
+	if s.hour, err = parseCronField(f[1], 0, 23); err != nil {
+		return s, err
+	}
+	if s.dom, err = parseCronField(f[2], 1, 31); err != nil {
+		return s, err
+	}
+	if s.month, err = parseCronField(f[3], 1, 12); err != nil {
+		return s, err
+	}
+	if s.dow, err = parseCronField(f[4], 0, 7); err != nil {
+		return s, err
+	}
+	// Both 0 and 7 are Sunday.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = strings.HasPrefix(f[2], "*")
+	s.dowStar = strings.HasPrefix(f[4], "*")
+	return s, nil
+}
+
+func parseCronField(f string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, p := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.Index(p, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(p[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", p)
+			}
+			p = p[:i]
+		}
+
+		lo, hi := min, max
+		switch i := strings.Index(p, "-"); {
+		case p == "*":
+		case i >= 0:
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(p[:i])
+			hi, err2 = strconv.Atoi(p[i+1:])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range %q", p)
+			}
+		default:
+			v, err := strconv.Atoi(p)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", p)
+			}
+			lo, hi = v, v
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range [%d, %d]", p, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// cronMaxYears is the number of years searched for the next schedule.
+const cronMaxYears = 5
+
+// Next returns the first time after t that matches the schedule, or the zero
+// time if there is none in the next five years.
+func (s CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(cronMaxYears, 0, 0)
+	for t.Before(end) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0,
+				t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s CronSchedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,95 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	tests := []struct {
+		expr string
+		now  string
+		next string
+	}{
+		{"* * * * *", "2016-03-01 10:00", "2016-03-01 10:01"},
+		{"*/15 * * * *", "2016-03-01 10:01", "2016-03-01 10:15"},
+		{"0 9-17 * * *", "2016-03-01 17:30", "2016-03-02 09:00"},
+		{"30 2 1 * *", "2016-03-01 03:00", "2016-04-01 02:30"},
+		{"0 0 29 2 *", "2016-03-01 00:00", "2020-02-29 00:00"},
+		// 2016-03-01 is a Tuesday.
+		{"0 12 * * 0", "2016-03-01 00:00", "2016-03-06 12:00"},
+		{"0 12 * * 7", "2016-03-01 00:00", "2016-03-06 12:00"},
+		{"0 0 10 * 3", "2016-03-01 00:00", "2016-03-02 00:00"},
+		{"5,10 1 * * 1-5", "2016-03-04 01:10", "2016-03-07 01:05"},
+	}
+	for _, test := range tests {
+		s, err := ParseCron(test.expr)
+		if err != nil {
+			t.Errorf("cannot parse %q: %v", test.expr, err)
+			continue
+		}
+		if n := s.Next(at(test.now)); !n.Equal(at(test.next)) {
+			t.Errorf("invalid next time for %q at %v: actual=%v want=%v",
+				test.expr, test.now, n, test.next)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "*/0 * * * *",
+		"5-1 * * * *", "a * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("invalid expression %q is parsed", expr)
+		}
+	}
+}
+
+type periodicTestMsg struct{}
+
+func TestEvery(t *testing.T) {
+	ch := make(chan struct{}, 10)
+	h := newHiveForTest()
+	app := h.NewApp("periodic", Every(20*time.Millisecond, periodicTestMsg{}))
+	app.HandleFunc(periodicTestMsg{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			ch <- struct{}{}
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatalf("periodic message %v is not emitted", i)
+		}
+	}
+}
+
+func TestMustCron(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic for an invalid cron expression")
+		}
+	}()
+	MustCron("* * * *", periodicTestMsg{})
+}
+
+func TestPeriodicStop(t *testing.T) {
+	p := newPeriodic(&app{}, periodicTestMsg{}, func(t time.Time) time.Time {
+		return t.Add(time.Hour)
+	})
+	p.Stop(nil)
+	p.Stop(nil)
+}
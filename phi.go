@@ -0,0 +1,102 @@
+package beehive
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// phiWindowSize is the number of inter-arrival times kept for each peer.
+const phiWindowSize = 100
+
+// phiDetector is an adaptive phi-accrual failure detector. Instead of a fixed
+// timeout, it keeps the history of the inter-arrival times of the messages
+// received from each peer, and computes the suspicion level (phi) of the peer
+// from the time elapsed since its last message. A phi of 1 means a 10% chance
+// of a false positive, a phi of 2 means 1%, and so on. As such, the detector
+// tolerates the jitters caused by GC pauses or load on peers that are usually
+// jittery, while it quickly suspects the peers that are usually steady.
+type phiDetector struct {
+	sync.Mutex
+	minStd  time.Duration
+	windows map[uint64]*arrivalWindow
+}
+
+func newPhiDetector(minStd time.Duration) *phiDetector {
+	return &phiDetector{
+		minStd:  minStd,
+		windows: make(map[uint64]*arrivalWindow),
+	}
+}
+
+// heartbeat records a message received from peer at t.
+func (d *phiDetector) heartbeat(peer uint64, t time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	w, ok := d.windows[peer]
+	if !ok {
+		w = &arrivalWindow{}
+		d.windows[peer] = w
+	}
+	w.add(t)
+}
+
+// phi returns the suspicion level of peer at now. It returns false if there is
+// not enough history for the peer.
+func (d *phiDetector) phi(peer uint64, now time.Time) (float64, bool) {
+	d.Lock()
+	defer d.Unlock()
+	w, ok := d.windows[peer]
+	if !ok || len(w.intervals) == 0 {
+		return 0, false
+	}
+	return w.phi(now, float64(d.minStd)), true
+}
+
+// arrivalWindow is a sliding window of inter-arrival times.
+type arrivalWindow struct {
+	last      time.Time
+	intervals []float64
+	next      int
+	sum       float64
+	sumSq     float64
+}
+
+func (w *arrivalWindow) add(t time.Time) {
+	if w.last.IsZero() {
+		w.last = t
+		return
+	}
+
+	i := float64(t.Sub(w.last))
+	w.last = t
+	if len(w.intervals) < phiWindowSize {
+		w.intervals = append(w.intervals, i)
+	} else {
+		o := w.intervals[w.next]
+		w.sum -= o
+		w.sumSq -= o * o
+		w.intervals[w.next] = i
+		w.next = (w.next + 1) % phiWindowSize
+	}
+	w.sum += i
+	w.sumSq += i * i
+}
+
+func (w *arrivalWindow) phi(now time.Time, minStd float64) float64 {
+	n := float64(len(w.intervals))
+	mean := w.sum / n
+	std := math.Sqrt(math.Max(w.sumSq/n-mean*mean, 0))
+	if std < minStd {
+		std = minStd
+	}
+
+	// The CDF of the normal distribution is approximated by a logistic
+	// function, which is accurate enough and does not overflow.
+	y := (float64(now.Sub(w.last)) - mean) / std
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if y > 0 {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
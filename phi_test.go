@@ -0,0 +1,50 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPhiDetector(t *testing.T) {
+	d := newPhiDetector(10 * time.Millisecond)
+	if _, ok := d.phi(1, time.Now()); ok {
+		t.Error("phi is computed without any history")
+	}
+
+	now := time.Now()
+	for i := 0; i < 2*phiWindowSize; i++ {
+		now = now.Add(100 * time.Millisecond)
+		d.heartbeat(1, now)
+	}
+
+	phi, ok := d.phi(1, now.Add(100*time.Millisecond))
+	if !ok {
+		t.Fatal("phi is not computed")
+	}
+	if phi > 1 {
+		t.Errorf("peer is suspected on time: phi=%v", phi)
+	}
+
+	phi, _ = d.phi(1, now.Add(time.Second))
+	if phi < 8 {
+		t.Errorf("peer is not suspected after a long silence: phi=%v", phi)
+	}
+}
+
+func TestPhiDetectorAdaptive(t *testing.T) {
+	d := newPhiDetector(10 * time.Millisecond)
+	now := time.Now()
+	for i := 0; i < phiWindowSize; i++ {
+		// A jittery peer that pauses every other heartbeat.
+		if i%2 == 0 {
+			now = now.Add(50 * time.Millisecond)
+		} else {
+			now = now.Add(350 * time.Millisecond)
+		}
+		d.heartbeat(2, now)
+	}
+
+	if phi, _ := d.phi(2, now.Add(400*time.Millisecond)); phi > 3 {
+		t.Errorf("jittery peer is suspected on a usual pause: phi=%v", phi)
+	}
+}
@@ -13,8 +13,9 @@ type PlacementMethod interface {
 	// Place returns the metadata of the hive chosen for cells. cells is the
 	// mapped cells of a message according to the map function of the
 	// application's message handler. thisHive is the local hive and liveHives
-	// contains the meta data about live hives. Note that liveHives contains
-	// thisHive.
+	// contains the meta data about the live hives allowed by the placement
+	// rules of the application (see PlaceOn and NotWith). Note that liveHives
+	// contains thisHive, unless it is excluded by those rules.
 	Place(cells MappedCells, thisHive Hive, liveHives []HiveInfo) HiveInfo
 }
 
@@ -29,3 +30,45 @@ func (r RandomPlacement) Place(cells MappedCells, thisHive Hive,
 
 	return liveHives[r.Intn(len(liveHives))]
 }
+
+// placementRules are the placement constraints of an application.
+type placementRules struct {
+	labels      []string // required labels of the hive.
+	notWith     []string // apps whose bees must not be on the hive.
+	preferLocal bool     // whether to place bees locally when possible.
+}
+
+func (r placementRules) empty() bool {
+	return len(r.labels) == 0 && len(r.notWith) == 0 && !r.preferLocal
+}
+
+// allows returns whether a bee can be placed on hive h.
+func (r placementRules) allows(h HiveInfo, reg *registry) bool {
+	for _, l := range r.labels {
+		if !h.HasLabel(l) {
+			return false
+		}
+	}
+	if len(r.notWith) == 0 {
+		return true
+	}
+	for _, b := range reg.beesOfHive(h.ID) {
+		for _, a := range r.notWith {
+			if b.App == a {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// filter returns the hives on which a bee can be placed.
+func (r placementRules) filter(hives []HiveInfo, reg *registry) []HiveInfo {
+	allowed := make([]HiveInfo, 0, len(hives))
+	for _, h := range hives {
+		if r.allows(h, reg) {
+			allowed = append(allowed, h)
+		}
+	}
+	return allowed
+}
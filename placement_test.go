@@ -74,3 +74,53 @@ func TestPlacement(t *testing.T) {
 		}
 	}
 }
+
+func TestPlaceOn(t *testing.T) {
+	ch := make(chan testPlacementRes)
+	var hives []Hive
+	for i := 0; i < 2; i++ {
+		var h Hive
+		if i == 0 {
+			h = newHiveForTest()
+		} else {
+			h = newHiveForTest(PeerAddrs(hives[0].(*hive).config.Addr),
+				Labels("x"))
+		}
+		hives = append(hives, h)
+		a := h.NewApp("placeonapp", NonTransactional(), PlaceOn("x"))
+		a.HandleFunc(int(0), func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", strconv.Itoa(msg.Data().(int))}}
+		}, func(msg Msg, ctx RcvContext) error {
+			ch <- testPlacementRes{hive: ctx.Hive().ID(), msg: msg.Data().(int)}
+			return nil
+		})
+		go h.Start()
+		defer h.Stop()
+		waitTilStareted(h)
+	}
+
+	hives[0].Emit(0)
+	if res := <-ch; res.hive != hives[1].ID() {
+		t.Errorf("invalid hive: actual=%v want=%v", res.hive, hives[1].ID())
+	}
+}
+
+func TestPlacementRules(t *testing.T) {
+	r := newRegistry("test")
+	r.addBee(BeeInfo{ID: 1, Hive: 2, App: "other"})
+	h1 := HiveInfo{ID: 1, Labels: []string{"x", "y"}}
+	h2 := HiveInfo{ID: 2, Labels: []string{"x"}}
+
+	rules := placementRules{labels: []string{"x", "y"}}
+	if !rules.allows(h1, r) || rules.allows(h2, r) {
+		t.Error("invalid placement by labels")
+	}
+
+	rules = placementRules{notWith: []string{"other"}}
+	if !rules.allows(h1, r) || rules.allows(h2, r) {
+		t.Error("invalid placement by colocated apps")
+	}
+	if hs := rules.filter([]HiveInfo{h1, h2}, r); len(hs) != 1 || hs[0].ID != 1 {
+		t.Errorf("invalid allowed hives: actual=%v want=[1]", hs)
+	}
+}
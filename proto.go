@@ -0,0 +1,239 @@
+package beehive
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/protobuf/proto"
+)
+
+// The encodings of the messages sent to other hives.
+const (
+	// EncodingGob encodes messages using gob.
+	EncodingGob = "gob"
+	// EncodingProto encodes the envelopes of messages using protobuf (see
+	// beehive.proto), and their data in one gob stream per batch.
+	EncodingProto = "proto"
+)
+
+// The fields of the protobuf messages in beehive.proto.
+const (
+	pbBatchMsgs = 1
+	pbBatchData = 2
+
+	pbMsgFrom        = 1
+	pbMsgTo          = 2
+	pbMsgSeq         = 3
+	pbMsgAckHive     = 4
+	pbMsgAckBee      = 5
+	pbMsgTrace       = 6
+	pbMsgSchema      = 7
+	pbMsgStream      = 8
+	pbMsgStreamSeq   = 9
+	pbMsgReceipt     = 10
+	pbMsgReceiptHive = 11
+)
+
+func appendPBKey(b []byte, field int, wire int) []byte {
+	return append(b, proto.EncodeVarint(uint64(field)<<3|uint64(wire))...)
+}
+
+func appendPBVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendPBKey(b, field, proto.WireVarint)
+	return append(b, proto.EncodeVarint(v)...)
+}
+
+func appendPBBytes(b []byte, field int, v []byte) []byte {
+	b = appendPBKey(b, field, proto.WireBytes)
+	b = append(b, proto.EncodeVarint(uint64(len(v)))...)
+	return append(b, v...)
+}
+
+// pbField is a field of a protobuf message. Val is the value of varint
+// fields, and Bytes is the value of length-delimited fields.
+type pbField struct {
+	Num   int
+	Val   uint64
+	Bytes []byte
+}
+
+// readPBFields calls fn for the fields of the protobuf message in b. Fields of
+// other wire types are skipped.
+func readPBFields(b []byte, fn func(f pbField)) error {
+	for len(b) != 0 {
+		k, n := proto.DecodeVarint(b)
+		if n == 0 {
+			return errors.New("proto: invalid field key")
+		}
+		b = b[n:]
+
+		f := pbField{Num: int(k >> 3)}
+		switch k & 7 {
+		case proto.WireVarint:
+			if f.Val, n = proto.DecodeVarint(b); n == 0 {
+				return errors.New("proto: invalid varint")
+			}
+			b = b[n:]
+		case proto.WireBytes:
+			l, n := proto.DecodeVarint(b)
+			if n == 0 || uint64(len(b)-n) < l {
+				return errors.New("proto: invalid length")
+			}
+			f.Bytes = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case proto.WireFixed64:
+			if len(b) < 8 {
+				return io.ErrUnexpectedEOF
+			}
+			b = b[8:]
+			continue
+		case proto.WireFixed32:
+			if len(b) < 4 {
+				return io.ErrUnexpectedEOF
+			}
+			b = b[4:]
+			continue
+		default:
+			return fmt.Errorf("proto: unsupported wire type %v", k&7)
+		}
+		fn(f)
+	}
+	return nil
+}
+
+// marshalMsgs encodes the messages as a MsgBatch.
+func marshalMsgs(msgs []msg) ([]byte, error) {
+	var data bytes.Buffer
+	enc := gob.NewEncoder(&data)
+	var b []byte
+	for i := range msgs {
+		m := &msgs[i]
+		if err := enc.Encode(&m.MsgData); err != nil {
+			return nil, err
+		}
+
+		var e []byte
+		e = appendPBVarint(e, pbMsgFrom, m.MsgFrom)
+		e = appendPBVarint(e, pbMsgTo, m.MsgTo)
+		e = appendPBVarint(e, pbMsgSeq, m.MsgSeq)
+		e = appendPBVarint(e, pbMsgAckHive, m.MsgAckHive)
+		e = appendPBVarint(e, pbMsgAckBee, m.MsgAckBee)
+		e = appendPBVarint(e, pbMsgTrace, m.MsgTrace)
+		e = appendPBVarint(e, pbMsgSchema, uint64(m.MsgSchema))
+		e = appendPBVarint(e, pbMsgStream, m.MsgStream)
+		e = appendPBVarint(e, pbMsgStreamSeq, m.MsgStreamSeq)
+		e = appendPBVarint(e, pbMsgReceipt, m.MsgReceipt)
+		e = appendPBVarint(e, pbMsgReceiptHive, m.MsgReceiptHive)
+		b = appendPBBytes(b, pbBatchMsgs, e)
+	}
+	return appendPBBytes(b, pbBatchData, data.Bytes()), nil
+}
+
+// unmarshalMsgs decodes a MsgBatch.
+func unmarshalMsgs(b []byte) ([]msg, error) {
+	var envs [][]byte
+	var data []byte
+	err := readPBFields(b, func(f pbField) {
+		switch f.Num {
+		case pbBatchMsgs:
+			envs = append(envs, f.Bytes)
+		case pbBatchData:
+			data = f.Bytes
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	msgs := make([]msg, len(envs))
+	for i, e := range envs {
+		m := &msgs[i]
+		err := readPBFields(e, func(f pbField) {
+			switch f.Num {
+			case pbMsgFrom:
+				m.MsgFrom = f.Val
+			case pbMsgTo:
+				m.MsgTo = f.Val
+			case pbMsgSeq:
+				m.MsgSeq = f.Val
+			case pbMsgAckHive:
+				m.MsgAckHive = f.Val
+			case pbMsgAckBee:
+				m.MsgAckBee = f.Val
+			case pbMsgTrace:
+				m.MsgTrace = f.Val
+			case pbMsgSchema:
+				m.MsgSchema = uint(f.Val)
+			case pbMsgStream:
+				m.MsgStream = f.Val
+			case pbMsgStreamSeq:
+				m.MsgStreamSeq = f.Val
+			case pbMsgReceipt:
+				m.MsgReceipt = f.Val
+			case pbMsgReceiptHive:
+				m.MsgReceiptHive = f.Val
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := dec.Decode(&m.MsgData); err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+// encodeProtoPayload encodes the messages as a MsgBatch payload, and
+// compresses it if it is larger than thresh.
+func encodeProtoPayload(msgs []msg, thresh uint) ([]byte, error) {
+	b, err := marshalMsgs(msgs)
+	if err != nil {
+		return nil, err
+	}
+	return compressPayload(append([]byte{codecProto}, b...), thresh)
+}
+
+// decodeProtoPayload decodes the messages of a MsgBatch read from r into v,
+// which must be a *[]msg.
+func decodeProtoPayload(r io.Reader, v interface{}) error {
+	msgs, ok := v.(*[]msg)
+	if !ok {
+		return fmt.Errorf("rpc: cannot decode %T from a proto payload", v)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	*msgs, err = unmarshalMsgs(b)
+	return err
+}
+
+// negotiateEncoding enables the encoding on the client, if the remote hive
+// supports it. Hives that do not support the encoding are sent gob.
+func (c *rpcClient) negotiateEncoding(enc string) {
+	if enc != EncodingProto {
+		return
+	}
+
+	var codecs []string
+	if err := c.cmd.Call("rpcServer.Codecs", struct{}{}, &codecs); err != nil {
+		glog.V(2).Infof("%v does not support %v: %v", c, enc, err)
+		return
+	}
+	for _, codec := range codecs {
+		if codec == codecNames[codecProto] {
+			c.proto = true
+			return
+		}
+	}
+}
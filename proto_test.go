@@ -0,0 +1,97 @@
+package beehive
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type protoTestMsg string
+
+func TestMarshalMsgs(t *testing.T) {
+	m := msg{MsgData: "data"}
+	v := reflect.ValueOf(&m).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		switch f := v.Field(i); f.Kind() {
+		case reflect.Uint, reflect.Uint64:
+			f.SetUint(uint64(i + 1))
+		}
+	}
+	msgs := []msg{m, {MsgData: 1, MsgTo: 2}}
+
+	b, err := marshalMsgs(msgs)
+	if err != nil {
+		t.Fatalf("cannot marshal the messages: %v", err)
+	}
+	res, err := unmarshalMsgs(b)
+	if err != nil {
+		t.Fatalf("cannot unmarshal the messages: %v", err)
+	}
+	if !reflect.DeepEqual(res, msgs) {
+		t.Errorf("invalid messages: actual=%+v want=%+v", res, msgs)
+	}
+
+	if _, err := unmarshalMsgs(b[:len(b)-1]); err == nil {
+		t.Error("no error for a truncated batch")
+	}
+}
+
+func TestProtoPayload(t *testing.T) {
+	msgs := []msg{{MsgData: strings.Repeat("a", 1024), MsgTo: 1}}
+	for _, thresh := range []uint{0, 1} {
+		p, err := encodeProtoPayload(msgs, thresh)
+		if err != nil {
+			t.Fatalf("cannot encode the payload: %v", err)
+		}
+		want := codecProto
+		if thresh == 1 {
+			want = codecProtoFlate
+		}
+		if p[0] != want {
+			t.Errorf("invalid codec for threshold %v: actual=%v want=%v", thresh,
+				p[0], want)
+		}
+
+		var res []msg
+		if err := decodePayload(p, &res); err != nil {
+			t.Fatalf("cannot decode the payload: %v", err)
+		}
+		if !reflect.DeepEqual(res, msgs) {
+			t.Errorf("invalid messages: actual=%v want=%v", res, msgs)
+		}
+	}
+}
+
+func TestProtoDelivery(t *testing.T) {
+	ch := make(chan protoTestMsg)
+	register := func(h Hive) {
+		a := h.NewApp("proto")
+		a.HandleFunc(protoTestMsg(""), func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"P", "0"}}
+		}, func(msg Msg, ctx RcvContext) error {
+			ch <- msg.Data().(protoTestMsg)
+			return nil
+		})
+	}
+
+	h1 := newHiveForTest()
+	register(h1)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(MsgEncoding(EncodingProto), PeerAddrs(h1.Config().Addr))
+	register(h2)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	h1.Emit(protoTestMsg("a"))
+	<-ch
+
+	// The message is sent by the proxy on h2.
+	h2.Emit(protoTestMsg("b"))
+	if m := <-ch; m != "b" {
+		t.Errorf("invalid message: actual=%v want=b", m)
+	}
+}
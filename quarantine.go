@@ -0,0 +1,48 @@
+package beehive
+
+import (
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// Quarantine is an application option that retries the messages whose
+// handler panics, and quarantines a message in the dead letters of the
+// application, along with the stack of the last panic, once it has failed n
+// times. Retried messages are enqueued at the end of the queue of the bee.
+// Without this option, or if n is at most 1, messages are quarantined on the
+// first panic.
+//
+// Note that the failures of a message are counted across reprocessing (see
+// App.Reprocess), and that errors returned by handlers are not retried.
+func Quarantine(n int) AppOption {
+	return func(a *app) {
+		a.quarantine = n
+	}
+}
+
+// recoverFromPanic retries the message if it has failed less than the
+// quarantine threshold of the application, and otherwise quarantines it.
+func (b *bee) recoverFromPanic(mh msgAndHandler, r interface{},
+	stack []byte) {
+
+	if _, ok := r.(time.Duration); ok {
+		// The handler is snoozed.
+		b.recoverFromError(mh, r)
+		return
+	}
+
+	b.AbortTx()
+	if mh.attempts+1 < b.app.quarantine {
+		mh.attempts++
+		glog.Errorf("%v retries %v after panic %d: %v", b, mh.msg.Type(),
+			mh.attempts, r)
+		go b.enqueMsg(mh)
+		return
+	}
+
+	glog.Errorf("%v quarantines %v after panic: %v\n%s", b, mh.msg.Type(), r,
+		stack)
+	quarantinedMsgs.WithLabelValues(b.app.Name()).Inc()
+	b.app.deadLetters.addWithStack(mh, r, stack)
+}
@@ -0,0 +1,57 @@
+package beehive
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type quarantineTestMsg int
+
+func TestQuarantine(t *testing.T) {
+	ch := make(chan quarantineTestMsg, 10)
+	h := newHiveForTest()
+	a := h.NewApp("quarantine", Quarantine(3))
+	a.HandleFunc(quarantineTestMsg(0), func(msg Msg,
+		ctx MapContext) MappedCells {
+
+		return MappedCells{{"Q", "0"}}
+	}, func(msg Msg, ctx RcvContext) error {
+		ch <- msg.Data().(quarantineTestMsg)
+		panic("poison")
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(quarantineTestMsg(1))
+	for i := 0; i < 3; i++ {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message is not retried after panic %v", i)
+		}
+	}
+
+	var l []DeadLetter
+	for i := 0; i < 100 && len(l) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		l = a.DeadLetters()
+	}
+	if len(l) != 1 {
+		t.Fatalf("invalid number of dead letters: actual=%v want=1", len(l))
+	}
+	if l[0].Attempts != 3 || l[0].Err != "poison" {
+		t.Errorf("invalid dead letter: %#v", l[0])
+	}
+	if !strings.Contains(l[0].Stack, "TestQuarantine") {
+		t.Errorf("dead letter has no stack of the panic: %v", l[0].Stack)
+	}
+
+	select {
+	case <-ch:
+		t.Error("message is retried after it is quarantined")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
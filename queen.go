@@ -3,9 +3,11 @@ package beehive
 import (
 	"errors"
 	"fmt"
+	"math/rand"
 	"runtime/debug"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
 	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
@@ -30,16 +32,46 @@ type qee struct {
 
 	bees         map[uint64]*bee
 	pendingCells map[CellKey]*pendingCells
+	// hibernated are the local bees that are hibernated. See Hibernate.
+	hibernated map[uint64]*hibernatedBee
+	// migrating are the local bees that are being migrated.
+	migrating map[uint64]struct{}
 
 	maxID  uint64
 	nextID uint64
+
+	// streams are the streams of ordered messages emitted by the local bees.
+	streams map[streamKey]*outStream
+	// streamsSwept is when the idle streams were last expired.
+	streamsSwept time.Time
+
+	// limited are the messages queued by the inbound rate of the application,
+	// by their sender hive.
+	limited map[uint64][]msgAndHandler
+	limitT  <-chan time.Time
+
+	// warm is the pool of warm bees. See WarmBees.
+	warm *warmPool
+	// maps is the pipeline of the map functions of the queen, if they are
+	// invoked concurrently. See ConcurrentMap.
+	maps *mapPipeline
+
+	metrics queenMetrics
 }
 
 func (q *qee) start() {
 	batch := make([]msgAndHandler, 0, q.hive.config.BatchSize)
 	q.stopped = false
 	dataCh := q.dataCh.out()
+	hibernateT, stopHibernate := q.hibernateTick()
+	defer stopHibernate()
+	q.startWarmPool()
+	mapCh := q.startMapPipeline()
 	for !q.stopped {
+		if q.drainCtrl(); q.stopped {
+			break
+		}
+
 		select {
 		case d := <-dataCh:
 			batch = append(batch, d)
@@ -50,15 +82,45 @@ func (q *qee) start() {
 			for i := 0; i < l; i++ {
 				batch = append(batch, <-dataCh)
 			}
-			q.handleMsgs(batch)
+			q.metrics.queueLen.Set(float64(q.dataCh.depth()))
+			prioritize(batch)
+			batch = dropExpired(q.app.Name(), batch, time.Now())
+			q.handleMsgs(q.limit(batch))
 			batch = batch[0:0]
 
+		case <-q.limitT:
+			if mhs := q.releaseLimited(); len(mhs) != 0 {
+				q.handleMsgs(mhs)
+			}
+
 		case p := <-q.placementCh:
 			// TODO(soheil): maybe batch.
-			q.handlePlacementRes(p)
+			if err := q.handlePlacementRes(p); err != nil {
+				q.dropMsgs(p.pCells.msgs, err)
+			}
 
 		case c := <-q.ctrlCh:
 			q.handleCmd(c)
+
+		case j := <-mapCh:
+			q.mapped(j)
+
+		case now := <-hibernateT:
+			q.hibernateIdle(now)
+		}
+	}
+}
+
+// drainCtrl handles the pending commands of the queen. It is called before
+// waiting on the channels of the queen, so that commands are not starved by a
+// backlog of messages.
+func (q *qee) drainCtrl() {
+	for !q.stopped {
+		select {
+		case c := <-q.ctrlCh:
+			q.handleCmd(c)
+		default:
+			return
 		}
 	}
 }
@@ -96,7 +158,11 @@ func (q *qee) Sync(ctx context.Context, req interface{}) (res interface{},
 func (q *qee) beeByID(id uint64) (b *bee, ok bool) {
 	q.RLock()
 	b, ok = q.bees[id]
+	h, hibernated := q.hibernated[id]
 	q.RUnlock()
+	if !ok && hibernated {
+		return q.revive(h), true
+	}
 	return b, ok
 }
 
@@ -111,7 +177,7 @@ func (q *qee) allocateBeeID() error {
 	a := allocateBeeIDs{
 		Len: q.hive.config.BatchSize,
 	}
-	res, err := q.hive.node.ProposeRetry(hiveGroup, a,
+	res, err := q.hive.proposeRetryAmongHives(a,
 		q.hive.config.RaftElectTimeout(), -1)
 	if err != nil {
 		return err
@@ -174,7 +240,7 @@ func (q *qee) defaultColony(bee uint64) Colony {
 
 func (q *qee) newLocalBeeWithID(id uint64, withColony bool) (*bee, error) {
 	b := q.defaultLocalBee(id)
-	b.setState(q.app.newState())
+	b.setState(q.app.newBeeState(id))
 
 	if withColony {
 		b.beeColony = q.defaultColony(id)
@@ -184,6 +250,7 @@ func (q *qee) newLocalBeeWithID(id uint64, withColony bool) (*bee, error) {
 	}
 
 	q.addBee(b)
+	q.metrics.created.Inc()
 	go b.start()
 	return b, nil
 }
@@ -206,7 +273,7 @@ func (q *qee) newDetachedBee(h DetachedHandler) (*bee, error) {
 		return nil, fmt.Errorf("%v cannot allocate a new bee ID: %v", q, err)
 	}
 	b := q.defaultLocalBee(id)
-	b.setState(q.app.newState())
+	b.setState(q.app.newBeeState(id))
 	b.becomeDetached(h)
 
 	if err := q.registerBee(q.defaultBeeInfo(id, true, false)); err != nil {
@@ -221,7 +288,7 @@ func (q *qee) newDetachedBee(h DetachedHandler) (*bee, error) {
 
 func (q *qee) registerBee(info BeeInfo) error {
 	// TODO(soheil): we should not block on this.
-	_, err := q.hive.node.ProposeRetry(hiveGroup, addBee(info),
+	_, err := q.hive.proposeRetryAmongHives(addBee(info),
 		2*q.hive.config.RaftElectTimeout(), -1)
 	return err
 }
@@ -307,7 +374,11 @@ func (q *qee) handleCmd(cc cmdAndChannel) {
 	case cmdStop:
 		q.stopped = true
 		glog.V(3).Infof("stopping bees of %p", q)
+		q.stopWarmPool()
 		q.stopBees()
+		if q.app.journal != nil {
+			q.app.journal.close()
+		}
 
 	case cmdFindBee:
 		id := cmd.ID
@@ -338,7 +409,22 @@ func (q *qee) handleCmd(cc cmdAndChannel) {
 		}
 
 	case cmdMigrate:
-		res, err = q.migrate(cmd.Bee, cmd.To)
+		if err = q.startMigration(cmd.Bee, cmd.To, cc); err == nil {
+			// The result is sent when the migration is done.
+			return
+		}
+
+	case cmdSplit:
+		res, err = q.split(cmd.Bee, cmd.Cells)
+
+	case cmdMoveCells:
+		err = q.moveCells(cmd.From, cmd.To, cmd.Cells)
+
+	case cmdLocalBcast:
+		err = q.hive.localBcast(&cmd.Msg, q.app.Name())
+
+	case cmdWhereIs:
+		res, err = q.whereIs(&cmd.Msg)
 
 	default:
 		err = fmt.Errorf("unknown queen bee command %#v", cmd)
@@ -362,7 +448,7 @@ func (q *qee) reloadBee(id uint64, col Colony) (*bee, error) {
 		return nil, err
 	}
 	b := q.defaultLocalBee(id)
-	b.setState(q.app.newState())
+	b.setState(q.app.newBeeState(id))
 	b.setColony(info.Colony)
 	if b.isLeader() {
 		b.becomeLeader()
@@ -375,17 +461,44 @@ func (q *qee) reloadBee(id uint64, col Colony) (*bee, error) {
 	return b, nil
 }
 
-func (q *qee) invokeMap(mh msgAndHandler) (ms MappedCells) {
+func (q *qee) invokeMap(mh msgAndHandler, ctx MapContext) (ms MappedCells) {
 	defer func() {
 		if r := recover(); r != nil {
 			glog.Errorf("error in map of %s: %v\n%s", q.app.Name(), r,
 				string(debug.Stack()))
+			q.app.deadLetters.add(mh, r)
 			ms = nil
 		}
 	}()
 
 	glog.V(2).Infof("%v invokes map for %v", q, mh.msg)
-	return mh.handler.Map(mh.msg, q)
+	start := time.Now()
+	ms = mh.handler.Map(mh.msg, ctx)
+	q.metrics.mapTime.Observe(time.Since(start).Seconds())
+	return ms
+}
+
+// mapMsgs invokes the map function of the broadcast messages in mhs, and
+// returns their mapped cells in the order of mhs. The cells of unicast
+// messages, and of the messages dropped by the interceptors, are nil.
+func (q *qee) mapMsgs(mhs []msgAndHandler) []MappedCells {
+	mapped := make([]MappedCells, len(mhs))
+	for i := range mhs {
+		if q.shouldMap(&mhs[i]) {
+			mapped[i] = q.invokeMap(mhs[i], q)
+		}
+	}
+	return mapped
+}
+
+// shouldMap returns whether the map function of mh should be invoked, and
+// applies the map interceptors on mh.
+func (q *qee) shouldMap(mh *msgAndHandler) bool {
+	if mh.msg.IsUnicast() {
+		return false
+	}
+	glog.V(2).Infof("%v broadcasts message %v", q, mh.msg)
+	return q.beforeMap(mh)
 }
 
 func (q *qee) isDetached(id uint64) bool {
@@ -446,8 +559,10 @@ type placementRes struct {
 type pendingCells struct {
 	visited bool
 
-	bee   *bee
-	beeID uint64
+	bee    *bee
+	beeID  uint64
+	warm   bool   // Whether bee is claimed from the warm pool.
+	colony Colony // The colony that owns some of the cells, if any.
 
 	cells map[CellKey]struct{}
 	msgs  []msgAndHandler
@@ -505,7 +620,14 @@ func (q *qee) handlePlacementRes(res placementRes) error {
 	defer q.removePending(res.pCells)
 
 	if res.colony.IsNil() {
-		b, err := q.newLocalBee(true)
+		var b *bee
+		var err error
+		overflow := q.atMaxBees(0)
+		if overflow {
+			b, err = q.overflowBee()
+		} else {
+			b, err = q.newLocalBee(true)
+		}
 		if err != nil {
 			return err
 		}
@@ -516,7 +638,7 @@ func (q *qee) handlePlacementRes(res placementRes) error {
 			Cells:  res.pCells.MappedCells(),
 		}
 
-		lockRes, err := q.hive.node.ProposeRetry(hiveGroup, lock,
+		lockRes, err := q.hive.proposeRetryAmongHives(lock,
 			q.hive.config.RaftElectTimeout(), -1)
 		if err != nil {
 			return err
@@ -526,6 +648,10 @@ func (q *qee) handlePlacementRes(res placementRes) error {
 		if col.Leader == b.ID() {
 			b.processCmd(cmdAddMappedCells{Cells: lock.Cells})
 		} else {
+			// We lost the race to another bee, and b has no cell.
+			if !overflow {
+				q.discardBee(b)
+			}
 			var err error
 			if b, err = q.beeByCells(lock.Cells); err != nil {
 				return err
@@ -556,32 +682,64 @@ func (q *qee) handlePlacementRes(res placementRes) error {
 }
 
 func (q *qee) handleMsgs(mhs []msgAndHandler) {
+	q.journalMsgs(mhs)
+	if q.maps != nil {
+		q.maps.push(q, mhs)
+		return
+	}
+	q.routeMsgs(mhs, q.mapMsgs(mhs))
+}
+
+// routeMsgs hands the messages off to their bees. mapped has the cells of the
+// broadcast messages of mhs.
+func (q *qee) routeMsgs(mhs []msgAndHandler, mapped []MappedCells) {
 	pendingC := make(map[CellKey]*pendingCells)
+	partialC := make(map[CellKey]*pendingCells)
 
 	for i := range mhs {
 		mh := mhs[i]
 		if mh.msg.IsUnicast() {
+			q.metrics.unicast.Inc()
 			q.handleUnicastMsg(mh)
 			continue
 		}
 
-		glog.V(2).Infof("%v broadcasts message %v", q, mh.msg)
-
-		cells := q.invokeMap(mh)
+		cells := mapped[i]
 		if cells == nil {
 			glog.V(2).Infof("%v drops message %v", q, mh.msg)
+			q.metrics.dropped.Inc()
+			continue
+		}
+
+		if cells.IsBroadcastAll() {
+			q.metrics.bcastAll.Inc()
+			q.handleBcastAll(mh)
 			continue
 		}
 
 		if cells.LocalBroadcast() {
+			q.metrics.localBcast.Inc()
 			q.handleLocalBcast(mh)
 			continue
 		}
 
+		q.metrics.mapped.Inc()
+
+		q.sequence(&mh, cells)
+
 		if q.queueIfPending(cells, mh) {
 			continue
 		}
 
+		if b, ok := q.readReplica(mh, cells); ok {
+			b.enqueMsg(mh)
+			continue
+		}
+
+		if q.queuePartial(partialC, cells, mh) {
+			continue
+		}
+
 		b, err := q.beeByCells(cells)
 		if err == nil {
 			b.enqueMsg(mh)
@@ -606,14 +764,17 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 			bcm.cells[c] = struct{}{}
 		}
 
-		bcm.msgs = append(bcm.msgs, mhs[i])
+		bcm.msgs = append(bcm.msgs, mh)
 	}
 
+	q.lockPartials(partialC)
+
 	if len(pendingC) == 0 {
 		return
 	}
 
 	var lockBatch batchReq
+	created := 0
 	for _, pc := range pendingC {
 		if pc.visited {
 			continue
@@ -634,6 +795,32 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 			continue
 		}
 
+		if q.atMaxBees(created) {
+			var err error
+			if pc.bee, err = q.overflowBee(); err != nil {
+				q.dropMsgs(pc.msgs, err)
+				continue
+			}
+			lockBatch.addReq(lockMappedCell{
+				Colony: pc.bee.colony(),
+				App:    q.app.Name(),
+				Cells:  mapped,
+			})
+			continue
+		}
+
+		created++
+		if pc.bee = q.warm.claim(); pc.bee != nil {
+			pc.warm = true
+			lockBatch.addReq(addBee(q.defaultBeeInfo(pc.bee.ID(), false, true)))
+			lockBatch.addReq(lockMappedCell{
+				Colony: pc.bee.colony(),
+				App:    q.app.Name(),
+				Cells:  mapped,
+			})
+			continue
+		}
+
 		var err error
 		pc.beeID, err = q.newBeeID()
 		if err != nil {
@@ -648,7 +835,7 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 		})
 	}
 
-	lockRes, err := q.hive.node.ProposeRetry(hiveGroup, lockBatch,
+	lockRes, err := q.hive.proposeRetryAmongHives(lockBatch,
 		2*q.hive.config.RaftElectTimeout(), -1)
 	if err != nil {
 		glog.Fatalf("error in lock cells: %v", err)
@@ -656,11 +843,21 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 
 	var wg sync.WaitGroup
 	for i, r := range lockRes.(batchRes) {
+		lock, ok := lockBatch.Reqs[i].(lockMappedCell)
 		if !r.Err.IsNil() {
-			glog.Fatalf("cannot lock the cells TODO: %v", r.Err)
+			if !ok {
+				glog.Fatalf("%v cannot add bee: %v", q, r.Err)
+			}
+			// The cells are locked by different bees, possibly because the map
+			// function is not consistent.
+			pc := pendingC[lock.Cells[0]]
+			if pc.warm {
+				q.returnWarmBee(pc.bee)
+			}
+			q.dropMsgs(pc.msgs, r.Err)
+			continue
 		}
 
-		lock, ok := lockBatch.Reqs[i].(lockMappedCell)
 		if !ok {
 			// We can simply ignore add bee requests in the batch.
 			continue
@@ -676,9 +873,14 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 					if pc.bee, err = q.newLocalBeeWithID(pc.beeID, true); err != nil {
 						glog.Fatalf("%v cannot create local bee %v", q, err)
 					}
+				} else if pc.warm {
+					q.addBee(pc.bee)
 				}
 				pc.bee.processCmd(cmdAddMappedCells{Cells: cells})
 			} else {
+				if pc.warm {
+					q.returnWarmBee(pc.bee)
+				}
 				// TODO(soheil): maybe, we can find by id.
 				var err error
 				if pc.bee, err = q.beeByCells(cells); err != nil {
@@ -697,6 +899,103 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 	wg.Wait()
 }
 
+// queuePartial queues the message in partialC, if its cells are partially
+// locked by a colony or if it shares a cell with the messages already queued.
+// The cells queued in partialC are locked in a batch by lockPartials.
+func (q *qee) queuePartial(partialC map[CellKey]*pendingCells,
+	cells MappedCells, mh msgAndHandler) bool {
+
+	var pc *pendingCells
+	for _, c := range cells {
+		if pc = partialC[c]; pc != nil {
+			break
+		}
+	}
+
+	if pc == nil {
+		info, all, err := q.hive.beeForCells(q.app.Name(), cells)
+		if err != nil || all {
+			return false
+		}
+		pc = newBeeCellMsgs()
+		pc.colony = info.Colony
+	}
+
+	for _, c := range cells {
+		partialC[c] = pc
+		pc.cells[c] = struct{}{}
+	}
+	pc.msgs = append(pc.msgs, mh)
+	return true
+}
+
+// lockPartials locks the partially locked cells in partialC with one registry
+// request, and enqueues their messages to the bees that own the cells.
+func (q *qee) lockPartials(partialC map[CellKey]*pendingCells) {
+	var pcs []*pendingCells
+	var lockBatch batchReq
+	for _, pc := range partialC {
+		if pc.visited {
+			continue
+		}
+		pc.visited = true
+		pcs = append(pcs, pc)
+		lockBatch.addReq(lockMappedCell{
+			Colony: pc.colony,
+			App:    q.app.Name(),
+			Cells:  pc.MappedCells(),
+		})
+	}
+
+	if len(pcs) == 0 {
+		return
+	}
+
+	lockRes, err := q.hive.proposeRetryAmongHives(lockBatch,
+		q.hive.config.RaftElectTimeout(), -1)
+	if err != nil {
+		for _, pc := range pcs {
+			q.dropMsgs(pc.msgs, err)
+		}
+		return
+	}
+
+	for i, r := range lockRes.(batchRes) {
+		pc := pcs[i]
+		if !r.Err.IsNil() {
+			q.dropMsgs(pc.msgs, r.Err)
+			continue
+		}
+
+		b, err := q.beeByCells(lockBatch.Reqs[i].(lockMappedCell).Cells)
+		if err != nil {
+			q.dropMsgs(pc.msgs, err)
+			continue
+		}
+		for _, mh := range pc.msgs {
+			b.enqueMsg(mh)
+		}
+	}
+}
+
+// dropMsgs drops messages that cannot be delivered to any bee.
+func (q *qee) dropMsgs(mhs []msgAndHandler, err error) {
+	for _, mh := range mhs {
+		glog.Errorf("%v drops %v: %v", q, mh.msg, err)
+		q.app.deadLetters.add(mh, err)
+	}
+}
+
+// discardBee stops a local bee that owns no cell and removes it from the
+// registry.
+func (q *qee) discardBee(b *bee) {
+	b.processCmd(cmdStop{})
+	q.Lock()
+	delete(q.bees, b.ID())
+	q.Unlock()
+	q.hive.delBeeFromRegistry(b.ID())
+}
+
 func (q *qee) newRemoteBee(pc *pendingCells, hive uint64) {
 	var col Colony
 	cmd := cmd{
@@ -733,22 +1032,73 @@ fallback:
 }
 
 func (q *qee) placeBee(cells MappedCells) (hiveID uint64) {
-	if q.app.placement == nil || q.app.placement == PlacementMethod(nil) {
-		return q.hive.ID()
+	local := q.hive.ID()
+	noMethod := q.app.placement == nil || q.app.placement == PlacementMethod(nil)
+	rules := q.app.placeRules
+	if noMethod && rules.empty() {
+		return local
+	}
+
+	hives := q.hive.registry.hives()
+	if !rules.empty() {
+		hives = rules.filter(hives, q.hive.registry)
+		if len(hives) == 0 {
+			glog.Warningf("%v finds no hive allowed by its placement rules for %v."+
+				" will place locally", q, cells)
+			return local
+		}
+	}
+
+	fallback := hives[rand.Intn(len(hives))].ID
+	for _, h := range hives {
+		if h.ID != local {
+			continue
+		}
+		if noMethod || rules.preferLocal {
+			return local
+		}
+		fallback = local
+	}
+	if noMethod {
+		return fallback
 	}
 
 	defer func() {
 		if r := recover(); r != nil {
-			hiveID = q.hive.ID()
+			hiveID = fallback
 		}
 	}()
 
-	h := q.app.placement.Place(cells, q.hive, q.hive.registry.hives())
+	h := q.app.placement.Place(cells, q.hive, hives)
 	return h.ID
 }
 
+// readReplica returns a local follower of the colony that owns the cells, if
+// the message can be handled by a read replica and the leader of the colony is
+// not on this hive.
+func (q *qee) readReplica(mh msgAndHandler, cells MappedCells) (*bee, bool) {
+	if !q.app.readRepl.enabled || !isReadOnly(mh.handler) {
+		return nil, false
+	}
+
+	info, all, err := q.hive.beeForCells(q.app.Name(), cells)
+	if err != nil || !all || q.isLocalBee(info) {
+		return nil, false
+	}
+
+	for _, f := range info.Colony.Followers {
+		if info.Colony.IsWitness(f) {
+			continue
+		}
+		if b, ok := q.beeByID(f); ok && !b.proxy && !b.detached {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
 func (q *qee) beeByCells(cells MappedCells) (*bee, error) {
-	info, all, err := q.hive.registry.beeForCells(q.app.Name(), cells)
+	info, all, err := q.hive.beeForCells(q.app.Name(), cells)
 	if err != nil {
 		return nil, err
 	}
@@ -760,7 +1110,7 @@ func (q *qee) beeByCells(cells MappedCells) (*bee, error) {
 			App:    q.app.Name(),
 			Cells:  cells,
 		}
-		if _, err := q.hive.node.ProposeRetry(hiveGroup, lock,
+		if _, err := q.hive.proposeRetryAmongHives(lock,
 			q.hive.config.RaftElectTimeout(), -1); err != nil {
 
 			return nil, err
@@ -784,6 +1134,40 @@ func (q *qee) beeByCells(cells MappedCells) (*bee, error) {
 	return b, err
 }
 
+// startMigration migrates bee bid to hive to in the background, and sends the
+// result to cc once the migration is done. Migrations block on other hives and
+// on the migrated bee, and must not block the queen: otherwise, two queens
+// that migrate bees to each other's hive wait for each other forever, and
+// the commands queued behind the migrations can fill the control channel.
+func (q *qee) startMigration(bid, to uint64, cc cmdAndChannel) error {
+	q.Lock()
+	if _, ok := q.migrating[bid]; ok {
+		q.Unlock()
+		return fmt.Errorf("%v is already migrating %v", q, bid)
+	}
+	q.migrating[bid] = struct{}{}
+	q.Unlock()
+
+	go func() {
+		newb, err := q.migrate(bid, to)
+
+		q.Lock()
+		delete(q.migrating, bid)
+		q.Unlock()
+
+		if err != nil {
+			glog.Errorf("%v cannot handle %v: %v", q, cc.cmd, err)
+		}
+		if cc.ch != nil {
+			cc.ch <- cmdResult{
+				Err:  err,
+				Data: newb,
+			}
+		}
+	}()
+	return nil
+}
+
 func (q *qee) migrate(bid uint64, to uint64) (newb uint64, err error) {
 	if q.isDetached(bid) {
 		return Nil, fmt.Errorf("cannot migrate a detached: %#v", bid)
@@ -806,6 +1190,10 @@ func (q *qee) migrate(bid uint64, to uint64) (newb uint64, err error) {
 	oldc := oldb.colony()
 	for _, f := range oldc.Followers {
 		if info, err := q.hive.bee(f); err == nil && info.Hive == to {
+			if oldc.IsWitness(f) {
+				return Nil, fmt.Errorf("%v cannot migrate %v to witness %v", q, bid,
+					f)
+			}
 			glog.V(2).Infof("%v found follower %v on %v, will hand off", q, f, to)
 			newb = f
 			goto handoff
@@ -873,17 +1261,19 @@ func (q *qee) defaultLocalBee(id uint64) *bee {
 		outb = bucket.New(q.app.rate.outRate, q.app.rate.outMaxTokens)
 	}
 
-	var batch uint
-	if uint(inb.Max()) < q.hive.config.BatchSize {
+	batch := q.hive.config.BatchSize
+	if q.app.batch.size != 0 {
+		batch = q.app.batch.size
+	}
+	if uint(inb.Max()) < batch {
 		batch = uint(inb.Max())
-	} else {
-		batch = q.hive.config.BatchSize
 	}
 
 	return &bee{
 		qee:       q,
 		beeID:     id,
 		dataCh:    newMsgChannel(q.hive.config.DataChBufSize),
+		room:      make(chan struct{}, 1),
 		outCh:     make(chan []*msg, cap(q.ctrlCh)),
 		ctrlCh:    make(chan cmdAndChannel, cap(q.ctrlCh)),
 		hive:      q.hive,
@@ -891,6 +1281,7 @@ func (q *qee) defaultLocalBee(id uint64) *bee {
 		batchSize: batch,
 		inBucket:  inb,
 		outBucket: outb,
+		active:    time.Now().UnixNano(),
 	}
 }
 
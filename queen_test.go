@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"strconv"
 	"testing"
+	"time"
+
+	dto "github.com/kandoo/beehive/Godeps/_workspace/src/github.com/prometheus/client_model/go"
 )
 
 func TestQueenMultipleKeys(t *testing.T) {
@@ -39,6 +42,47 @@ func TestQueenMultipleKeys(t *testing.T) {
 	}
 }
 
+func TestQueenPartiallyLockedKeys(t *testing.T) {
+	h := newHiveForTest()
+	type rcv struct {
+		bee  uint64
+		data string
+	}
+	ch := make(chan rcv)
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", msg.Data().(string)}, {"D", "K"}}
+	}
+	rcvf := func(msg Msg, ctx RcvContext) error {
+		ch <- rcv{bee: ctx.ID(), data: msg.Data().(string)}
+		return nil
+	}
+
+	a := h.NewApp("partialkey")
+	a.HandleFunc("", mapf, rcvf)
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit("K")
+	first := <-ch
+
+	// All these messages are partially locked by the first bee.
+	l := 10
+	for i := 0; i < l; i++ {
+		h.Emit(fmt.Sprintf("test%d", i))
+	}
+	for i := 0; i < l; i++ {
+		r := <-ch
+		if r.bee != first.bee {
+			t.Errorf("invalid bee receives the %d'th message: get=%d want=%d", i,
+				r.bee, first.bee)
+		}
+		if want := fmt.Sprintf("test%d", i); r.data != want {
+			t.Errorf("invalid message order: get=%v want=%v", r.data, want)
+		}
+	}
+}
+
 type qeeBenchHandler struct {
 	last string
 	done chan struct{}
@@ -118,3 +162,106 @@ func BenchmarkQueenBeeCreationSingle(b *testing.B) {
 func BenchmarkQueenBeeCreationClustered(b *testing.B) {
 	doBenchmarkQueenBeeCreation(b, 3)
 }
+
+type concMapTestMsg string
+
+func TestQueenConcurrentMap(t *testing.T) {
+	h := newHiveForTest()
+	release := make(chan struct{})
+	errs := make(chan error, 2)
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		d := msg.Data().(concMapTestMsg)
+		switch d {
+		case "slow":
+			select {
+			case <-release:
+			case <-time.After(5 * time.Second):
+				return nil
+			}
+		case "fast":
+			close(release)
+		}
+		errs <- ctx.Dict("D").Put("k", d)
+		return MappedCells{{"D", "0"}}
+	}
+	ch := make(chan concMapTestMsg, 2)
+	rcvf := func(msg Msg, ctx RcvContext) error {
+		ch <- msg.Data().(concMapTestMsg)
+		return nil
+	}
+	h.NewApp("concmap", ConcurrentMap(2)).HandleFunc(concMapTestMsg(""), mapf,
+		rcvf)
+
+	go h.Start()
+	defer h.Stop()
+
+	// The map function of fast is invoked while slow is being mapped, but
+	// slow is handed off first to their cell.
+	h.Emit(concMapTestMsg("slow"))
+	h.Emit(concMapTestMsg("fast"))
+	for _, want := range []concMapTestMsg{"slow", "fast"} {
+		if d := <-ch; d != want {
+			t.Errorf("invalid message order: actual=%v want=%v", d, want)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != ErrMapState {
+			t.Errorf("concurrent map function can use the state: actual=%v "+
+				"want=%v", err, ErrMapState)
+		}
+	}
+}
+
+type queenMetricsTestMsg string
+
+func TestQueenMetrics(t *testing.T) {
+	h := newHiveForTest()
+	ch := make(chan struct{})
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		d := msg.Data().(queenMetricsTestMsg)
+		if d == "drop" {
+			return nil
+		}
+		return MappedCells{{"D", string(d)}}
+	}
+	rcvf := func(msg Msg, ctx RcvContext) error {
+		ch <- struct{}{}
+		return nil
+	}
+	h.NewApp("queenmetrics").HandleFunc(queenMetricsTestMsg(""), mapf, rcvf)
+
+	a, _ := h.(*hive).app("queenmetrics")
+	m := a.qee.metrics
+	count := func(c interface {
+		Write(*dto.Metric) error
+	}) float64 {
+		var d dto.Metric
+		c.Write(&d)
+		return d.GetCounter().GetValue() + float64(d.GetHistogram().GetSampleCount())
+	}
+	// The metrics are global and may have been updated by earlier runs.
+	mapped, dropped, created, mapTime := count(m.mapped), count(m.dropped),
+		count(m.created), count(m.mapTime)
+
+	go h.Start()
+	defer h.Stop()
+
+	for _, d := range []queenMetricsTestMsg{"drop", "a", "b"} {
+		h.Emit(d)
+	}
+	<-ch
+	<-ch
+
+	if n := count(m.mapped) - mapped; n != 2 {
+		t.Errorf("invalid number of mapped messages: actual=%v want=2", n)
+	}
+	if n := count(m.dropped) - dropped; n != 1 {
+		t.Errorf("invalid number of dropped messages: actual=%v want=1", n)
+	}
+	if n := count(m.created) - created; n != 2 {
+		t.Errorf("invalid number of created bees: actual=%v want=2", n)
+	}
+	if n := count(m.mapTime) - mapTime; n != 3 {
+		t.Errorf("invalid number of map samples: actual=%v want=3", n)
+	}
+}
@@ -21,6 +21,7 @@ import (
 
 const (
 	numberOfCatchUpEntries = 5000
+	maxEntriesSize         = ^uint64(0)
 )
 
 var (
@@ -32,6 +33,9 @@ var (
 	ErrGroupExists = errors.New("raft: group exists")
 	// ErrNoSuchGroup is returned when the requested group does not exist.
 	ErrNoSuchGroup = errors.New("raft: no such group")
+	// ErrGap is returned when there is a gap in the committed entries that
+	// cannot be repaired from the raft log.
+	ErrGap = errors.New("raft: gap in committed entries")
 )
 
 type Reporter interface {
@@ -109,8 +113,11 @@ type group struct {
 	diskStorage  DiskStorage
 	fsyncTime    time.Duration
 	snapCount    uint64
+	catchUpEnts  uint64
+	snapOnJoin   bool
 
 	leader    uint64
+	term      uint64
 	confState raftpb.ConfState
 
 	savec   chan readySaved
@@ -119,6 +126,8 @@ type group struct {
 	applied uint64
 	snapmu  sync.RWMutex
 	snapped uint64
+	// joined is set when a node joins the group led by this node.
+	joined bool
 
 	stopc       chan struct{}
 	saverDone   chan struct{}
@@ -285,13 +294,19 @@ func (g *group) save(rdsv readySaved) error {
 }
 
 func (g *group) apply(ready etcdraft.Ready) error {
+	// The hard state is empty in readies that do not change it, such as the
+	// ready in which a candidate learns it is elected.
+	if !etcdraft.IsEmptyHardState(ready.HardState) {
+		g.term = ready.HardState.Term
+	}
+
 	if ready.SoftState != nil {
 		newLead := ready.SoftState.Lead
 		if g.leader != newLead {
 			g.stateMachine.ProcessStatusChange(LeaderChanged{
 				Old:  g.leader,
 				New:  newLead,
-				Term: ready.HardState.Term,
+				Term: g.term,
 			})
 			g.leader = newLead
 		}
@@ -316,11 +331,9 @@ func (g *group) apply(ready etcdraft.Ready) error {
 		return nil
 	}
 
-	firsti := es[0].Index
-	if firsti > g.applied+1 {
-		glog.Fatalf(
-			"1st index of committed entry[%d] should <= applied[%d] + 1",
-			firsti, g.applied)
+	es, err := g.fillGaps(es)
+	if err != nil {
+		return err
 	}
 
 	if glog.V(3) {
@@ -351,14 +364,69 @@ func (g *group) apply(ready etcdraft.Ready) error {
 		g.applied = e.Index
 	}
 
-	if g.applied-g.snapped > g.snapCount {
+	if g.joined {
+		// The new node catches up from the snapshot, and receives only the entries
+		// after the snapshot instead of the whole log.
+		g.joined = false
+		glog.Infof("%v snapshots for the joining node (applied: %d)", g, g.applied)
+		g.snapshot(0)
+	} else if g.applied-g.snapped > g.snapCount {
 		glog.Infof("%v start to snapshot (applied: %d, lastsnap: %d)", g,
 			g.applied, g.snapped)
-		g.snapshot()
+		g.snapshot(g.catchUpEnts)
 	}
 	return nil
 }
 
+// fillGaps detects gaps in the committed entries, from the last applied
+// index, and fetches the missing ranges from the raft log. It returns ErrGap
+// if the missing entries are already compacted.
+func (g *group) fillGaps(es []raftpb.Entry) ([]raftpb.Entry, error) {
+	next := g.applied + 1
+	gap := false
+	for _, e := range es {
+		if e.Index > next {
+			gap = true
+			break
+		}
+		if e.Index == next {
+			next++
+		}
+	}
+	if !gap {
+		return es, nil
+	}
+
+	filled := make([]raftpb.Entry, 0, len(es))
+	next = g.applied + 1
+	for _, e := range es {
+		if e.Index < next {
+			continue
+		}
+
+		if e.Index > next {
+			glog.Warningf("%v detected a gap in committed entries: [%d, %d)", g,
+				next, e.Index)
+			missing, err := g.raftStorage.Entries(next, e.Index, maxEntriesSize)
+			if err != nil {
+				glog.Errorf("%v cannot fetch entries [%d, %d): %v", g, next, e.Index,
+					err)
+				return nil, ErrGap
+			}
+			if uint64(len(missing)) != e.Index-next {
+				glog.Errorf("%v fetched %d entries instead of %d", g, len(missing),
+					e.Index-next)
+				return nil, ErrGap
+			}
+			filled = append(filled, missing...)
+		}
+
+		filled = append(filled, e)
+		next = e.Index + 1
+	}
+	return filled, nil
+}
+
 func (g *group) applyEntry(e raftpb.Entry) error {
 	glog.V(3).Infof("%v applies normal entry %v at index=%v,term=%v",
 		g, e.Type, e.Index, e.Term)
@@ -445,6 +513,12 @@ func (g *group) applyConfChange(e raftpb.Entry) error {
 	pbutil.MustUnmarshal(&cc, e.Data)
 	glog.V(2).Infof("%v applies conf change %v: %#v", g, e.Index, cc)
 
+	if g.snapOnJoin && cc.Type == raftpb.ConfChangeAddNode &&
+		g.leader == g.node.id && cc.NodeID != g.node.id {
+
+		g.joined = true
+	}
+
 	if len(cc.Context) == 0 {
 		g.stateMachine.ApplyConfChange(cc, GroupNode{})
 		return nil
@@ -471,7 +545,9 @@ func (g *group) applyConfChange(e raftpb.Entry) error {
 	return nil
 }
 
-func (g *group) snapshot() {
+// snapshot saves a snapshot of the state machine at the applied index, and
+// compacts the raft log keeping only keep entries before the snapshot.
+func (g *group) snapshot(keep uint64) {
 	d, err := g.stateMachine.Save()
 	if err != nil {
 		glog.Fatalf("error in seralizing the state machine: %v", err)
@@ -496,8 +572,8 @@ func (g *group) snapshot() {
 
 		// keep some in memory log entries for slow followers.
 		compacti := uint64(1)
-		if snapi > numberOfCatchUpEntries {
-			compacti = snapi - numberOfCatchUpEntries
+		if snapi > keep {
+			compacti = snapi - keep
 		}
 		if err = g.raftStorage.Compact(compacti); err != nil {
 			// the compaction was done asynchronously with the progress of raft.
@@ -528,8 +604,9 @@ type groupRequest struct {
 }
 
 type groupResponse struct {
-	group uint64
-	err   error
+	group   uint64
+	storage *etcdraft.MemoryStorage
+	err     error
 }
 
 type multiMessage struct {
@@ -809,6 +886,8 @@ type GroupConfig struct {
 	Peers          []etcdraft.Peer // Peers of this group.
 	DataDir        string          // Where to save raft state.
 	SnapCount      uint64          // How many entries to include in a snapshot.
+	CatchUpEntries uint64          // In-memory entries kept for slow followers.
+	SnapOnJoin     bool            // Whether to snapshot when a node joins.
 	FsyncTick      time.Duration   // The frequency of fsyncs.
 	ElectionTicks  int             // Number of ticks to fire an election.
 	HeartbeatTicks int             // Number of ticks to fire heartbeats.
@@ -833,6 +912,10 @@ func (n *MultiNode) CreateGroup(ctx context.Context, cfg GroupConfig) error {
 
 	n.gen.StartFrom((lei + cfg.SnapCount) << 8) // To avoid conflicts.
 
+	if cfg.CatchUpEntries == 0 {
+		cfg.CatchUpEntries = numberOfCatchUpEntries
+	}
+
 	c := &etcdraft.Config{
 		ID:              cfg.ID,
 		ElectionTick:    cfg.ElectionTicks,
@@ -854,6 +937,8 @@ func (n *MultiNode) CreateGroup(ctx context.Context, cfg GroupConfig) error {
 		savec:        make(chan readySaved, 1),
 		fsyncTime:    cfg.FsyncTick,
 		snapCount:    cfg.SnapCount,
+		catchUpEnts:  cfg.CatchUpEntries,
+		snapOnJoin:   cfg.SnapOnJoin,
 		snapped:      snap.Metadata.Index,
 		applied:      snap.Metadata.Index,
 		confState:    snap.Metadata.ConfState,
@@ -918,9 +1003,12 @@ func (n *MultiNode) handleGroupRequest(req groupRequest) {
 
 	case groupRequestStatus:
 		// TODO(soheil): add softstate to the response.
-		if _, ok := n.groups[req.group.id]; !ok {
+		g, ok := n.groups[req.group.id]
+		if !ok {
 			res.err = ErrNoSuchGroup
+			break
 		}
+		res.storage = g.raftStorage
 
 	default:
 		glog.Fatalf("invalid group request: %v", req.reqType)
@@ -1184,9 +1272,88 @@ func (n *MultiNode) Status(group uint64) *etcdraft.Status {
 	return n.node.Status(group)
 }
 
+// LogInfo has the metadata of the raft log of a group on a node, which can be
+// used to inspect the replication progress of the group.
+type LogInfo struct {
+	Group    uint64            // The group.
+	Term     uint64            // The current term of the group.
+	Leader   uint64            // The node of the current leader.
+	First    uint64            // The first index in the in-memory log.
+	Last     uint64            // The last index in the log.
+	Commit   uint64            // The committed watermark.
+	Applied  uint64            // The last index applied on the state machine.
+	Snapshot uint64            // The index of the latest snapshot.
+	Entries  int               // The number of entries in the in-memory log.
+	Size     int               // The size of entries in the in-memory log.
+	Matched  map[uint64]uint64 // The matched index of nodes on the leader.
+}
+
+// LogInfo returns the metadata of the raft log of the group on this node.
+func (n *MultiNode) LogInfo(ctx context.Context, gid uint64) (LogInfo,
+	error) {
+
+	ch := make(chan groupResponse, 1)
+	n.groupc <- groupRequest{
+		reqType: groupRequestStatus,
+		group:   &group{id: gid},
+		ch:      ch,
+	}
+	var res groupResponse
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		return LogInfo{}, ctx.Err()
+	case <-n.done:
+		return LogInfo{}, ErrStopped
+	}
+	if res.err != nil {
+		return LogInfo{}, res.err
+	}
+
+	info := LogInfo{Group: gid}
+	if status := n.node.Status(gid); status != nil {
+		info.Term = status.Term
+		info.Leader = status.Lead
+		info.Commit = status.Commit
+		info.Applied = status.Applied
+		if len(status.Progress) != 0 {
+			info.Matched = make(map[uint64]uint64, len(status.Progress))
+			for id, p := range status.Progress {
+				info.Matched[id] = p.Match
+			}
+		}
+	}
+
+	var err error
+	if info.First, err = res.storage.FirstIndex(); err != nil {
+		return info, err
+	}
+	if info.Last, err = res.storage.LastIndex(); err != nil {
+		return info, err
+	}
+	snap, err := res.storage.Snapshot()
+	if err != nil {
+		return info, err
+	}
+	info.Snapshot = snap.Metadata.Index
+	if info.Last < info.First {
+		return info, nil
+	}
+	es, err := res.storage.Entries(info.First, info.Last+1, maxEntriesSize)
+	if err != nil {
+		return info, err
+	}
+	info.Entries = len(es)
+	for _, e := range es {
+		info.Size += e.Size()
+	}
+	return info, nil
+}
+
 func init() {
 	gob.Register(Batch{})
 	gob.Register(GroupNode{})
+	gob.Register(LogInfo{})
 	gob.Register(RequestID{})
 	gob.Register(Request{})
 	gob.Register(Response{})
@@ -0,0 +1,110 @@
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/pkg/pbutil"
+	etcdraft "github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+)
+
+func testEntries(from, to uint64) (es []raftpb.Entry) {
+	for i := from; i < to; i++ {
+		es = append(es, raftpb.Entry{Index: i, Term: 1})
+	}
+	return
+}
+
+func TestFillGaps(t *testing.T) {
+	g := &group{raftStorage: etcdraft.NewMemoryStorage(), applied: 1}
+	if err := g.raftStorage.Append(testEntries(1, 8)); err != nil {
+		t.Fatal(err)
+	}
+
+	es := append(testEntries(1, 2), testEntries(4, 6)...)
+	es = append(es, testEntries(7, 8)...)
+	filled, err := g.fillGaps(es)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filled) != 6 {
+		t.Fatalf("invalid number of entries: actual=%v want=6", len(filled))
+	}
+	for i, e := range filled {
+		if e.Index != uint64(i+2) {
+			t.Errorf("invalid entry index: actual=%v want=%v", e.Index, i+2)
+		}
+	}
+
+	if err := g.raftStorage.Compact(5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.fillGaps(testEntries(7, 8)); err != ErrGap {
+		t.Errorf("gap is not detected: %v", err)
+	}
+}
+
+type testStateMachine struct{}
+
+func (m testStateMachine) Save() ([]byte, error)                      { return []byte{}, nil }
+func (m testStateMachine) Restore(b []byte) error                     { return nil }
+func (m testStateMachine) Apply(req interface{}) (interface{}, error) { return nil, nil }
+func (m testStateMachine) ApplyConfChange(cc raftpb.ConfChange,
+	gn GroupNode) error {
+
+	return nil
+}
+func (m testStateMachine) ProcessStatusChange(event interface{}) {}
+
+type testDiskStorage struct{}
+
+func (s testDiskStorage) Save(st raftpb.HardState, ents []raftpb.Entry) error {
+	return nil
+}
+func (s testDiskStorage) SaveSnap(snap raftpb.Snapshot) error { return nil }
+func (s testDiskStorage) Sync() error                         { return nil }
+func (s testDiskStorage) Close() error                        { return nil }
+
+func TestSnapshotOnJoin(t *testing.T) {
+	g := &group{
+		node:         &MultiNode{id: 1},
+		stateMachine: testStateMachine{},
+		raftStorage:  etcdraft.NewMemoryStorage(),
+		diskStorage:  testDiskStorage{},
+		snapCount:    1024,
+		catchUpEnts:  1024,
+		snapOnJoin:   true,
+		leader:       1,
+		applied:      6,
+	}
+	if err := g.raftStorage.Append(testEntries(1, 7)); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: 2}
+	e := raftpb.Entry{
+		Index: 7,
+		Term:  1,
+		Type:  raftpb.EntryConfChange,
+		Data:  pbutil.MustMarshal(&cc),
+	}
+	if err := g.raftStorage.Append([]raftpb.Entry{e}); err != nil {
+		t.Fatal(err)
+	}
+	ready := etcdraft.Ready{CommittedEntries: []raftpb.Entry{e}}
+	if err := g.apply(ready); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; ; i++ {
+		first, _ := g.raftStorage.FirstIndex()
+		if first == 8 {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("raft log is not compacted: first=%v want=8", first)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
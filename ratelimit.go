@@ -0,0 +1,263 @@
+package beehive
+
+import (
+	"fmt"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/bucket"
+)
+
+// RateLimitPolicy is what the queen of an application does with the messages
+// that exceed the inbound rate of the application. See InboundRate.
+type RateLimitPolicy int
+
+// Rate limit policies.
+const (
+	// RateLimitQueue queues the messages in the queen until there are enough
+	// tokens. This is the default policy. Note that the queue is not bounded.
+	RateLimitQueue RateLimitPolicy = iota
+	// RateLimitDrop drops the messages.
+	RateLimitDrop
+	// RateLimitPushBack rejects the messages sent by the proxies on other
+	// hives, which retry them when there are enough tokens. The messages of the
+	// local hive are queued.
+	RateLimitPushBack
+)
+
+// InboundRate is an application option that limits the rate of the messages
+// routed by the queen of the application on each hive, using a token bucket
+// with the given rate and the given maximum. The messages that exceed the rate
+// are handled according to the policy. Dropped and pushed back messages are
+// counted in the rate_limited_msgs_total metric.
+func InboundRate(rate bucket.Rate, max uint64, p RateLimitPolicy) AppOption {
+	return func(a *app) {
+		a.limiter = newRateLimiter(rate, max, p, false)
+	}
+}
+
+// InboundRatePerHive is the same as InboundRate, but uses a separate token
+// bucket for the messages sent from each hive. The sender of a message is the
+// hive of the bee that has emitted it.
+func InboundRatePerHive(rate bucket.Rate, max uint64,
+	p RateLimitPolicy) AppOption {
+
+	return func(a *app) {
+		a.limiter = newRateLimiter(rate, max, p, true)
+	}
+}
+
+// rateLimiter keeps the token buckets of an application.
+type rateLimiter struct {
+	sync.Mutex
+	rate    bucket.Rate
+	max     uint64
+	policy  RateLimitPolicy
+	perHive bool
+	buckets map[uint64]*bucket.Bucket
+}
+
+func newRateLimiter(rate bucket.Rate, max uint64, p RateLimitPolicy,
+	perHive bool) *rateLimiter {
+
+	return &rateLimiter{
+		rate:    rate,
+		max:     max,
+		policy:  p,
+		perHive: perHive,
+		buckets: make(map[uint64]*bucket.Bucket),
+	}
+}
+
+// bucket returns the bucket of the sender hive.
+func (l *rateLimiter) bucket(hive uint64) *bucket.Bucket {
+	if !l.perHive {
+		hive = Nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	b, ok := l.buckets[hive]
+	if !ok {
+		b = bucket.NewFull(l.rate, l.max)
+		l.buckets[hive] = b
+	}
+	return b
+}
+
+// senderHive returns the hive of the bee that has emitted the message.
+func (h *hive) senderHive(m *msg) uint64 {
+	if m.MsgFrom == Nil {
+		return h.ID()
+	}
+	info, err := h.bee(m.MsgFrom)
+	if err != nil {
+		return h.ID()
+	}
+	return info.Hive
+}
+
+// limit returns the messages admitted by the inbound rate of the application,
+// and queues or drops the rest.
+func (q *qee) limit(mhs []msgAndHandler) []msgAndHandler {
+	l := q.app.limiter
+	if l == nil {
+		return mhs
+	}
+
+	admitted := mhs[:0]
+	for _, mh := range mhs {
+		from := q.hive.senderHive(mh.msg)
+		if l.policy == RateLimitPushBack && from != q.hive.ID() {
+			// Admitted by the RPC server.
+			admitted = append(admitted, mh)
+			continue
+		}
+
+		if len(q.limited[from]) == 0 && l.bucket(from).Get(1) {
+			admitted = append(admitted, mh)
+			continue
+		}
+
+		if l.policy == RateLimitDrop {
+			glog.V(2).Infof("%v drops %v: rate limited", q, mh.msg)
+			rateLimitedMsgs.WithLabelValues(q.app.Name()).Inc()
+			continue
+		}
+
+		if q.limited == nil {
+			q.limited = make(map[uint64][]msgAndHandler)
+		}
+		q.limited[from] = append(q.limited[from], mh)
+	}
+
+	q.scheduleLimited()
+	return admitted
+}
+
+// releaseLimited returns the queued messages that are admitted by the inbound
+// rate of the application.
+func (q *qee) releaseLimited() []msgAndHandler {
+	q.limitT = nil
+	var mhs []msgAndHandler
+	for from, pending := range q.limited {
+		b := q.app.limiter.bucket(from)
+		n := 0
+		for n < len(pending) && b.Get(1) {
+			n++
+		}
+		mhs = append(mhs, pending[:n]...)
+		if n == len(pending) {
+			delete(q.limited, from)
+			continue
+		}
+		q.limited[from] = pending[n:]
+	}
+
+	q.scheduleLimited()
+	return mhs
+}
+
+// scheduleLimited sets the timer for the earliest time a queued message can
+// be admitted.
+func (q *qee) scheduleLimited() {
+	if q.limitT != nil || len(q.limited) == 0 {
+		return
+	}
+
+	d := time.Duration(-1)
+	for from := range q.limited {
+		if w := q.app.limiter.bucket(from).When(1); d < 0 || w < d {
+			d = w
+		}
+	}
+	q.limitT = time.After(d)
+}
+
+// errPushBackPrefix is the prefix of the errors returned to the proxies that
+// are pushed back.
+const errPushBackPrefix = "beehive: rate limited for "
+
+// pushBack takes the tokens of the messages sent to this hive by a proxy, and
+// returns an error if an application that pushes back does not have enough
+// tokens. In that case, none of the messages is admitted.
+func (h *hive) pushBack(msgs []msg) error {
+	var need map[*bucket.Bucket]uint64
+	var apps map[string]int
+	for i := range msgs {
+		m := &msgs[i]
+		if !m.IsUnicast() {
+			continue
+		}
+		info, err := h.bee(m.MsgTo)
+		if err != nil {
+			continue
+		}
+		a, ok := h.app(info.App)
+		if !ok || a.limiter == nil || a.limiter.policy != RateLimitPushBack {
+			continue
+		}
+		if need == nil {
+			need = make(map[*bucket.Bucket]uint64)
+			apps = make(map[string]int)
+		}
+		apps[a.name]++
+		b := a.limiter.bucket(h.senderHive(m))
+		// A large batch costs at most a full bucket.
+		if need[b] < b.Max() {
+			need[b]++
+		}
+	}
+
+	var wait time.Duration
+	for b, n := range need {
+		if w := b.When(n); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		for a, n := range apps {
+			rateLimitedMsgs.WithLabelValues(a).Add(float64(n))
+		}
+		return fmt.Errorf("%s%v", errPushBackPrefix, wait)
+	}
+
+	for b, n := range need {
+		if !b.Get(n) {
+			return fmt.Errorf("%s%v", errPushBackPrefix, b.When(n))
+		}
+	}
+	return nil
+}
+
+// retryPushedBack enqueues the messages pushed back by the remote hive again
+// after d. The messages are not redelivered.
+func (b *bee) retryPushedBack(mhs []msgAndHandler, msgs []msg,
+	d time.Duration) {
+
+	glog.V(2).Infof("%v is pushed back for %v", b, d)
+	for i := range msgs {
+		if msgs[i].MsgAckBee == b.ID() {
+			b.handleAck([]uint64{msgs[i].MsgSeq})
+		}
+		b.snooze(mhs[i], d)
+	}
+}
+
+// pushedBack returns how long the proxy should wait, if the error is returned
+// by pushBack.
+func pushedBack(err error) (time.Duration, bool) {
+	serr, ok := err.(rpc.ServerError)
+	if !ok || !strings.HasPrefix(string(serr), errPushBackPrefix) {
+		return 0, false
+	}
+	d, err := time.ParseDuration(strings.TrimPrefix(string(serr),
+		errPushBackPrefix))
+	if err != nil {
+		return 0, false
+	}
+	return d, true
+}
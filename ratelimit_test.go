@@ -0,0 +1,88 @@
+package beehive
+
+import (
+	"errors"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/bucket"
+)
+
+type rateLimitTestMsg int
+
+func startRateLimitTestApp(opt AppOption) (Hive,
+	chan rateLimitTestMsg) {
+
+	ch := make(chan rateLimitTestMsg, 100)
+	h := newHiveForTest()
+	app := h.NewApp("ratelimit", opt)
+	app.HandleFunc(rateLimitTestMsg(0), func(msg Msg,
+		ctx MapContext) MappedCells {
+
+		return MappedCells{{"L", "0"}}
+	}, func(msg Msg, ctx RcvContext) error {
+		ch <- msg.Data().(rateLimitTestMsg)
+		return nil
+	})
+
+	go h.Start()
+	waitTilStareted(h)
+	return h, ch
+}
+
+func TestInboundRateQueue(t *testing.T) {
+	h, ch := startRateLimitTestApp(
+		InboundRate(100*bucket.TPS, 1, RateLimitQueue))
+	defer h.Stop()
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		h.Emit(rateLimitTestMsg(i))
+	}
+	for i := 0; i < 10; i++ {
+		select {
+		case m := <-ch:
+			if m != rateLimitTestMsg(i) {
+				t.Errorf("invalid message: actual=%v want=%v", m, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %v is not received", i)
+		}
+	}
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Errorf("messages are not rate limited: received in %v", d)
+	}
+}
+
+func TestInboundRateDrop(t *testing.T) {
+	h, ch := startRateLimitTestApp(
+		InboundRate(1*bucket.TPS, 2, RateLimitDrop))
+	defer h.Stop()
+
+	for i := 0; i < 5; i++ {
+		h.Emit(rateLimitTestMsg(i))
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %v is not received", i)
+		}
+	}
+	select {
+	case m := <-ch:
+		t.Errorf("message %v is not dropped", m)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestPushedBack(t *testing.T) {
+	err := rpc.ServerError(errPushBackPrefix + "1.5s")
+	if d, ok := pushedBack(err); !ok || d != 1500*time.Millisecond {
+		t.Errorf("invalid push back: actual=%v,%v want=1.5s,true", d, ok)
+	}
+	if _, ok := pushedBack(errors.New(errPushBackPrefix + "1s")); ok {
+		t.Error("local error is parsed as push back")
+	}
+}
@@ -0,0 +1,85 @@
+package beehive
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// rebalance migrates a fraction (i.e., RebalanceFrac) of the local bees to
+// the hive that has just joined the cluster.
+func (h *hive) rebalance(to HiveInfo) {
+	if to.ID == h.ID() {
+		return
+	}
+
+	// Conf changes are replayed when the hive restarts. We wait until the hive
+	// is in sync with the cluster, and skip the hives that already have bees.
+	h.waitUntilStarted()
+	if len(h.registry.beesOfHive(to.ID)) != 0 {
+		glog.V(2).Infof("%v will not rebalance to %v: hive already has bees", h,
+			to.ID)
+		return
+	}
+
+	if err := h.waitForHive(to.ID); err != nil {
+		glog.Errorf("%v cannot rebalance to %v: %v", h, to.ID, err)
+		return
+	}
+
+	bees := h.rebalanceCandidates()
+	n := int(h.config.RebalanceFrac * float64(len(bees)))
+	if n == 0 {
+		return
+	}
+
+	glog.Infof("%v migrates %v of %v bees to new hive %v", h, n, len(bees),
+		to.ID)
+	for _, i := range rand.Perm(len(bees))[:n] {
+		bi := bees[i]
+		a, ok := h.app(bi.App)
+		if !ok {
+			continue
+		}
+		if _, err := a.qee.processCmd(cmdMigrate{Bee: bi.ID,
+			To: to.ID}); err != nil {
+
+			glog.Errorf("%v cannot migrate bee %v to %v: %v", h, bi.ID, to.ID, err)
+		}
+	}
+}
+
+// waitForHive waits until the hive is started and serves commands. Hives join
+// the cluster before they start, so they cannot host bees right away.
+func (h *hive) waitForHive(id uint64) (err error) {
+	deadline := time.Now().Add(h.config.ConnTimeout)
+	for time.Now().Before(deadline) {
+		if _, err = h.client.sendCmd(cmd{Hive: id, Data: cmdPing{}}); err == nil {
+			return nil
+		}
+		time.Sleep(h.config.RaftElectTimeout())
+	}
+	return err
+}
+
+// rebalanceCandidates returns the local bees that can be migrated to other
+// hives: the leaders of colonies of non-sticky applications.
+func (h *hive) rebalanceCandidates() []BeeInfo {
+	var bees []BeeInfo
+	for _, bi := range h.registry.beesOfHive(h.ID()) {
+		if bi.Detached || bi.Colony.Leader != bi.ID {
+			continue
+		}
+		// The bees of the collector are bound to their hive.
+		if bi.App == appCollector {
+			continue
+		}
+		a, ok := h.app(bi.App)
+		if !ok || a.sticky() {
+			continue
+		}
+		bees = append(bees, bi)
+	}
+	return bees
+}
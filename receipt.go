@@ -0,0 +1,137 @@
+package beehive
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// pendingReceipt is a message emitted with a receipt that is not handled by
+// all its applications yet.
+type pendingReceipt struct {
+	f    *Future
+	want int
+	apps map[string]struct{}
+}
+
+// receiptTable keeps the pending receipts of the messages emitted on a hive.
+type receiptTable struct {
+	sync.Mutex
+	pending map[uint64]*pendingReceipt
+}
+
+func newReceiptTable() *receiptTable {
+	return &receiptTable{
+		pending: make(map[uint64]*pendingReceipt),
+	}
+}
+
+func (t *receiptTable) add(id uint64, f *Future, apps int) {
+	t.Lock()
+	t.pending[id] = &pendingReceipt{
+		f:    f,
+		want: apps,
+		apps: make(map[string]struct{}),
+	}
+	t.Unlock()
+}
+
+// ack records that the message is handled by the app, and resolves its future
+// when the message is handled by all the applications.
+func (t *receiptTable) ack(id uint64, app string) {
+	t.Lock()
+	defer t.Unlock()
+
+	p, ok := t.pending[id]
+	if !ok {
+		return
+	}
+	p.apps[app] = struct{}{}
+	if len(p.apps) < p.want {
+		return
+	}
+	delete(t.pending, id)
+	p.f.resolve(nil, nil)
+}
+
+// fail resolves the future of the message with err, if it is still pending.
+func (t *receiptTable) fail(id uint64, err error) {
+	t.Lock()
+	defer t.Unlock()
+
+	p, ok := t.pending[id]
+	if !ok {
+		return
+	}
+	delete(t.pending, id)
+	p.f.resolve(nil, err)
+}
+
+func (h *hive) EmitWithReceipt(ctx context.Context,
+	msgData interface{}) *Future {
+
+	f := newFuture()
+	apps := len(h.qees[MsgType(msgData)])
+	if apps == 0 {
+		f.resolve(nil, fmt.Errorf("no application handles %v",
+			MsgType(msgData)))
+		return f
+	}
+
+	id := newTraceID()
+	h.receipts.add(id, f, apps)
+	h.enqueMsg(&msg{
+		MsgData:        msgData,
+		MsgReceipt:     id,
+		MsgReceiptHive: h.ID(),
+	})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			h.receipts.fail(id, ctx.Err())
+		case <-f.Done():
+		}
+	}()
+	return f
+}
+
+// maybeSendReceipts sends the receipts of the messages handled by the bee, if
+// the bee is the one handling them.
+func (b *bee) maybeSendReceipts(mhs []msgAndHandler) {
+	if b.proxy || b.detached || b.colony().Leader != b.ID() {
+		return
+	}
+
+	var cmds []cmd
+	for _, mh := range mhs {
+		if mh.msg == nil || mh.msg.MsgReceipt == 0 {
+			continue
+		}
+
+		id, rh := mh.msg.MsgReceipt, mh.msg.MsgReceiptHive
+		if rh == b.hive.ID() {
+			b.hive.receipts.ack(id, b.app.Name())
+			continue
+		}
+
+		cmds = append(cmds, cmd{
+			Hive: rh,
+			Data: cmdReceipt{ID: id, App: b.app.Name()},
+		})
+	}
+	if len(cmds) == 0 {
+		return
+	}
+
+	// The receipts to the same hive are sent in one round trip.
+	go func() {
+		for _, r := range b.hive.client.sendCmds(cmds) {
+			if r.Err != nil {
+				glog.V(2).Infof("%v cannot send receipt: %v", b, r.Err)
+			}
+		}
+	}()
+}
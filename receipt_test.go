@@ -0,0 +1,56 @@
+package beehive
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+type receiptTestMsg int
+
+func TestEmitWithReceipt(t *testing.T) {
+	block := make(chan struct{})
+	h := newHiveForTest()
+	for _, n := range []string{"receipt1", "receipt2"} {
+		app := h.NewApp(n)
+		app.HandleFunc(receiptTestMsg(0), func(msg Msg,
+			ctx MapContext) MappedCells {
+
+			return MappedCells{{"R", "0"}}
+		}, func(msg Msg, ctx RcvContext) error {
+			if msg.Data().(receiptTestMsg) == 2 {
+				<-block
+			}
+			ctx.Dict("R").Put("0", msg.Data())
+			return nil
+		})
+	}
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	f := h.EmitWithReceipt(ctx, receiptTestMsg(1))
+	if _, err := f.Result(); err != nil {
+		t.Fatalf("cannot get the receipt: %v", err)
+	}
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel2()
+	_, err := h.EmitWithReceipt(ctx2, receiptTestMsg(2)).Result()
+	close(block)
+	if err != context.DeadlineExceeded {
+		t.Errorf("invalid error of a blocked receipt: actual=%v want=%v", err,
+			context.DeadlineExceeded)
+	}
+
+	_, err = h.EmitWithReceipt(ctx, errors.New("unhandled")).Result()
+	if err == nil {
+		t.Error("no error for a message without handlers")
+	}
+}
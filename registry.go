@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
@@ -20,6 +21,7 @@ var (
 	ErrDuplicateHive      = errors.New("registry: duplicate hive")
 	ErrNoSuchBee          = errors.New("registry: no such bee")
 	ErrDuplicateBee       = errors.New("registry: duplicate bee")
+	ErrCellConflict       = errors.New("registry: cells locked by different bees")
 )
 
 // noOp is a barrier: a raft request to make sure all the updates are
@@ -78,10 +80,27 @@ type lockMappedCell struct {
 	Cells  MappedCells
 }
 
-// transferCells transfers cells of a colony to another colony.
+// renewLease renews the lease of a hive on the cells of its colonies until
+// Now+TTL. It also expires the leases of other hives that have not been renewed
+// before Now.
+type renewLease struct {
+	Hive uint64
+	Now  time.Time
+	TTL  time.Duration
+}
+
+// restoreRegistry replaces the bees, the cells and the colonies of the
+// registry with the ones in a registry dump (i.e., the output of Save).
+type restoreRegistry struct {
+	Data []byte
+}
+
+// transferCells transfers cells of a colony to another colony. If Cells is
+// empty, all the cells of the colony are transferred.
 type transferCells struct {
-	From Colony
-	To   Colony
+	From  Colony
+	To    Colony
+	Cells MappedCells
 }
 
 // batchReq is a batch of registery requests that should be processed in a
@@ -113,6 +132,72 @@ type registry struct {
 	Hives  map[uint64]HiveInfo
 	Bees   map[uint64]BeeInfo
 	Store  cellStore
+	// hive id -> the expiry time of its lease.
+	Leases map[uint64]time.Time
+
+	// joined, if set, is called when a new hive joins the cluster.
+	joined func(h HiveInfo)
+
+	watchers  []registryWatcher
+	watcherID uint64
+	events    []RegistryEvent
+}
+
+// RegistryEvent is a change in the ownership of cells or in the colonies,
+// which is streamed to the watchers of the registry.
+type RegistryEvent interface{}
+
+// ColonyUpdated is emitted when a colony is updated (e.g., when it has a new
+// leader or its followers are changed).
+type ColonyUpdated struct {
+	App string
+	Old Colony
+	New Colony
+}
+
+// CellsLocked is emitted when cells are locked for a colony.
+type CellsLocked struct {
+	App    string
+	Colony Colony
+	Cells  MappedCells
+}
+
+// CellsTransferred is emitted when the cells of a colony are transferred to
+// another colony.
+type CellsTransferred struct {
+	App   string
+	From  Colony
+	To    Colony
+	Cells MappedCells
+}
+
+// CellsReleased is emitted when the cells of a colony are released, because
+// the lease of its leader's hive has expired.
+type CellsReleased struct {
+	App    string
+	Colony Colony
+	Cells  MappedCells
+}
+
+// BeeMoved is emitted when a bee is moved to another hive.
+type BeeMoved struct {
+	ID   uint64
+	From uint64
+	To   uint64
+}
+
+// BeeDeleted is emitted when a bee is removed from the registry.
+type BeeDeleted struct {
+	ID uint64
+}
+
+// RegistryRestored is emitted when the registry is restored from a snapshot.
+// Watchers should drop everything they have cached.
+type RegistryRestored struct{}
+
+type registryWatcher struct {
+	id uint64
+	f  func(ev RegistryEvent)
 }
 
 func newRegistry(name string) *registry {
@@ -123,6 +208,7 @@ func newRegistry(name string) *registry {
 		Hives:  make(map[uint64]HiveInfo),
 		Bees:   make(map[uint64]BeeInfo),
 		Store:  newCellStore(),
+		Leases: make(map[uint64]time.Time),
 	}
 }
 
@@ -135,20 +221,78 @@ func (r *registry) Save() ([]byte, error) {
 
 func (r *registry) Restore(b []byte) error {
 	r.m.Lock()
-	defer r.m.Unlock()
 	glog.V(2).Info("registry restored")
-	return bhgob.Decode(r, b)
+	err := bhgob.Decode(r, b)
+	if err == nil {
+		r.emit(RegistryRestored{})
+	}
+	r.m.Unlock()
+
+	r.notify()
+	return err
 }
 
 func (r *registry) Apply(req interface{}) (interface{}, error) {
+	start := time.Now()
+	r.m.Lock()
+	registryLockWait.Observe(time.Since(start).Seconds())
+	res, err := r.doApply(req)
+	r.m.Unlock()
+
+	r.notify()
+	return res, err
+}
+
+// watch registers f to be called for every change in the cells and colonies
+// of the registry, and returns a function that cancels the watch. f is called
+// in the order of changes from the goroutine that applies them. It should not
+// block, but it is safe for f to read the registry.
+func (r *registry) watch(f func(ev RegistryEvent)) (cancel func()) {
 	r.m.Lock()
 	defer r.m.Unlock()
 
-	return r.doApply(req)
+	r.watcherID++
+	id := r.watcherID
+	r.watchers = append(r.watchers, registryWatcher{id: id, f: f})
+	return func() {
+		r.m.Lock()
+		defer r.m.Unlock()
+		for i, w := range r.watchers {
+			if w.id == id {
+				r.watchers = append(r.watchers[:i:i], r.watchers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// emit queues ev for the watchers. It must be called with r.m locked.
+func (r *registry) emit(ev RegistryEvent) {
+	if len(r.watchers) == 0 {
+		return
+	}
+	r.events = append(r.events, ev)
+}
+
+// notify delivers the queued events to the watchers. It must be called with
+// r.m unlocked.
+func (r *registry) notify() {
+	r.m.Lock()
+	events := r.events
+	r.events = nil
+	watchers := r.watchers
+	r.m.Unlock()
+
+	for _, ev := range events {
+		for _, w := range watchers {
+			w.f(ev)
+		}
+	}
 }
 
 func (r *registry) doApply(req interface{}) (interface{}, error) {
 	glog.V(2).Infof("%v applies: %#v", r, req)
+	registryRequests.WithLabelValues(registryOp(req)).Inc()
 
 	switch req := req.(type) {
 	case noOp:
@@ -169,6 +313,10 @@ func (r *registry) doApply(req interface{}) (interface{}, error) {
 		return r.lockCell(req)
 	case transferCells:
 		return nil, r.transfer(req)
+	case renewLease:
+		return nil, r.renewLease(req)
+	case restoreRegistry:
+		return nil, r.restoreDump(req.Data)
 	case batchReq:
 		return r.handleBatch(req), nil
 	}
@@ -195,12 +343,20 @@ func (r *registry) ApplyConfChange(cc raftpb.ConfChange, gn raft.GroupNode) (
 				cc.NodeID)
 		}
 		if gn.Data != nil {
-			hi := HiveInfo{
-				ID:   gn.Node,
-				Addr: gn.Data.(string),
+			var hi HiveInfo
+			switch d := gn.Data.(type) {
+			case HiveInfo:
+				hi = d
+			case string:
+				// Hives added before hive labels were introduced.
+				hi = HiveInfo{ID: gn.Node, Addr: d}
 			}
+			_, existed := r.Hives[hi.ID]
 			r.addHive(hi)
 			glog.V(2).Infof("%v adds hive %v@%v", r, hi.ID, hi.Addr)
+			if !existed && r.joined != nil {
+				r.joined(hi)
+			}
 		}
 
 	case raftpb.ConfChangeRemoveNode:
@@ -289,6 +445,7 @@ func (r *registry) delBee(id uint64) error {
 		return ErrNoSuchBee
 	}
 	delete(r.Bees, id)
+	r.emit(BeeDeleted{ID: id})
 	return nil
 }
 
@@ -308,6 +465,7 @@ func (r *registry) moveBee(m moveBee) error {
 
 	b.Hive = m.ToHive
 	r.Bees[m.ID] = b
+	r.emit(BeeMoved{ID: m.ID, From: m.FromHive, To: m.ToHive})
 	return nil
 }
 
@@ -350,6 +508,7 @@ func (r *registry) updateColony(up updateColony) error {
 	b.Colony = up.New
 	r.Bees[up.New.Leader] = b
 
+	r.emit(ColonyUpdated{App: b.App, Old: up.Old, New: up.New})
 	return nil
 }
 
@@ -361,42 +520,38 @@ func (r *registry) mustFindBee(id uint64) BeeInfo {
 	return info
 }
 
+// lockCell locks the cells for the colony. If some of the cells are already
+// locked, the rest of cells are locked for the colony of those cells, which is
+// returned. If the cells are locked by different colonies, lockCell returns
+// ErrCellConflict without locking any cell.
 func (r *registry) lockCell(l lockMappedCell) (Colony, error) {
 	if l.Colony.Leader == 0 {
 		return Colony{}, ErrInvalidParam
 	}
 
 	locked := false
-	openk := make(MappedCells, 0, 10)
+	openk := make(MappedCells, 0, len(l.Cells))
 	for _, k := range l.Cells {
 		c, ok := r.Store.colony(l.App, k)
 		if !ok {
-			if locked {
-				r.Store.assign(l.App, k, l.Colony)
-			} else {
-				openk = append(openk, k)
-			}
+			openk = append(openk, k)
 			continue
 		}
 
 		if locked && !c.Equals(l.Colony) {
-			// FIXME(soheil): Fix this bug after refactoring the code.
-			glog.Fatal("TODO registery conflict between colonies")
+			glog.Errorf("%v: cell %v is locked by %v instead of %v", r, k, c,
+				l.Colony)
+			registryConflicts.Inc()
+			return Colony{}, ErrCellConflict
 		}
 
 		locked = true
 		l.Colony = c
 	}
 
-	if locked {
-		for _, k := range openk {
-			r.Store.assign(l.App, k, l.Colony)
-		}
-		return l.Colony, nil
-	}
-
-	for _, k := range l.Cells {
-		r.Store.assign(l.App, k, l.Colony)
+	r.Store.assignCells(l.App, openk, l.Colony)
+	if len(openk) != 0 {
+		r.emit(CellsLocked{App: l.App, Colony: l.Colony, Cells: openk})
 	}
 	return l.Colony, nil
 }
@@ -406,16 +561,83 @@ func (r *registry) transfer(t transferCells) error {
 	if !ok {
 		return ErrNoSuchBee
 	}
-	keys := r.Store.cells(t.From.Leader)
+	keys := t.Cells
+	for _, k := range keys {
+		if c, ok := r.Store.colony(i.App, k); !ok || c.ID != t.From.ID {
+			return ErrInvalidParam
+		}
+	}
+	if len(keys) == 0 {
+		keys = r.Store.cells(t.From.Leader)
+	}
 	if len(keys) == 0 {
 		return ErrInvalidParam
 	}
-	for _, k := range keys {
-		r.Store.assign(i.App, k, t.To)
+	r.Store.assignCells(i.App, keys, t.To)
+	r.emit(CellsTransferred{App: i.App, From: t.From, To: t.To, Cells: keys})
+	return nil
+}
+
+// restoreDump restores the bees, the cells, and the colonies from the dump of
+// a registry. The hives of the registry are kept intact, since the cluster may
+// be rebuilt with a new set of hives. The bees of the hives that are not in the
+// cluster are kept, so that their cells are not lost; they will be recovered
+// by their followers or released when their leases expire.
+func (r *registry) restoreDump(b []byte) error {
+	d := newRegistry(r.name)
+	if err := bhgob.Decode(d, b); err != nil {
+		return err
+	}
+
+	glog.Infof("%v restores %v bees from a dump", r, len(d.Bees))
+	if r.HiveID < d.HiveID {
+		r.HiveID = d.HiveID
+	}
+	if r.BeeID < d.BeeID {
+		r.BeeID = d.BeeID
+	}
+	r.Bees = d.Bees
+	r.Store = d.Store
+	r.Leases = d.Leases
+	r.emit(RegistryRestored{})
+	return nil
+}
+
+func (r *registry) renewLease(l renewLease) error {
+	if l.TTL <= 0 {
+		return ErrInvalidParam
+	}
+
+	if r.Leases == nil {
+		r.Leases = make(map[uint64]time.Time)
+	}
+	r.Leases[l.Hive] = l.Now.Add(l.TTL)
+
+	// Note that l.Now is the clock of the renewing hive. Since it is in the
+	// raft log, all replicas expire the same leases.
+	for h, exp := range r.Leases {
+		if h != l.Hive && exp.Before(l.Now) {
+			r.expireLease(h)
+		}
 	}
 	return nil
 }
 
+// expireLease releases the cells of the colonies led by the bees of hive h.
+func (r *registry) expireLease(h uint64) {
+	glog.Warningf("%v expires the lease of hive %v", r, h)
+	delete(r.Leases, h)
+	for _, b := range r.Bees {
+		if b.Hive != h || b.Colony.Leader != b.ID {
+			continue
+		}
+		cells := r.Store.release(b.App, b.ID)
+		if len(cells) != 0 {
+			r.emit(CellsReleased{App: b.App, Colony: b.Colony, Cells: cells})
+		}
+	}
+}
+
 func (r *registry) hives() []HiveInfo {
 	r.m.RLock()
 	hives := make([]HiveInfo, 0, len(r.Hives))
@@ -468,6 +690,54 @@ func (r *registry) bee(id uint64) (BeeInfo, error) {
 	return i, nil
 }
 
+// cellOwner returns the leader of the colony that owns the cell of app.
+func (r *registry) cellOwner(app string, cell CellKey) (BeeInfo, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	c, ok := r.Store.colony(app, cell)
+	if !ok {
+		return BeeInfo{}, ErrNoSuchBee
+	}
+	return r.Bees[c.Leader], nil
+}
+
+// colonyCells returns the cells owned by the colony of the bee, which can be
+// the leader or a follower of the colony.
+func (r *registry) colonyCells(bee uint64) (MappedCells, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	b, ok := r.Bees[bee]
+	if !ok {
+		return nil, ErrNoSuchBee
+	}
+	if b.Colony.IsNil() {
+		return nil, nil
+	}
+	return r.Store.cells(b.Colony.Leader), nil
+}
+
+// colonyTerm returns the term of the latest leader of the colony.
+func (r *registry) colonyTerm(colony uint64) uint64 {
+	r.m.RLock()
+	t := r.Store.Colonies[colony]
+	r.m.RUnlock()
+	return t
+}
+
+// checkFence returns a StaleTermError if f is older than the term of its
+// colony.
+func (r *registry) checkFence(f fence) error {
+	if f.IsNil() {
+		return nil
+	}
+	if t := r.colonyTerm(f.Colony); f.Term < t {
+		return StaleTermError{Colony: f.Colony, Term: f.Term, Current: t}
+	}
+	return nil
+}
+
 func (r *registry) beeAndHive(id uint64) (BeeInfo, HiveInfo, error) {
 	r.m.RLock()
 	defer r.m.RUnlock()
@@ -560,6 +830,8 @@ func init() {
 	gob.Register(lockMappedCell{})
 	gob.Register(newHiveID{})
 	gob.Register(noOp{})
+	gob.Register(renewLease{})
+	gob.Register(restoreRegistry{})
 	gob.Register(transferCells{})
 	gob.Register(updateColony{})
 }
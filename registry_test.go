@@ -0,0 +1,206 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+
+	dto "github.com/kandoo/beehive/Godeps/_workspace/src/github.com/prometheus/client_model/go"
+)
+
+func TestRegistryLockCellConflict(t *testing.T) {
+	r := newRegistry("test")
+	lock := func(leader uint64, cells ...string) (Colony, error) {
+		l := lockMappedCell{App: "app", Colony: Colony{Leader: leader}}
+		for _, k := range cells {
+			l.Cells = append(l.Cells, CellKey{Dict: "D", Key: k})
+		}
+		return r.lockCell(l)
+	}
+
+	for i, k := range []string{"a", "b"} {
+		if _, err := lock(uint64(i+1), k); err != nil {
+			t.Fatalf("cannot lock %v: %v", k, err)
+		}
+	}
+
+	conflicts := func() float64 {
+		var m dto.Metric
+		registryConflicts.Write(&m)
+		return m.GetCounter().GetValue()
+	}
+	before := conflicts()
+	if _, err := lock(3, "a", "b", "c"); err != ErrCellConflict {
+		t.Errorf("conflict is not detected: %v", err)
+	}
+	if after := conflicts(); after != before+1 {
+		t.Errorf("conflict is not counted: actual=%v want=%v", after, before+1)
+	}
+	if _, ok := r.Store.colony("app", CellKey{Dict: "D", Key: "c"}); ok {
+		t.Error("cell is locked in a conflicting lock")
+	}
+
+	c, err := lock(3, "a", "c")
+	if err != nil {
+		t.Fatalf("cannot lock cells: %v", err)
+	}
+	if c.Leader != 1 {
+		t.Errorf("invalid colony leader: actual=%v want=1", c.Leader)
+	}
+}
+
+func TestRegistryCheckFence(t *testing.T) {
+	r := newRegistry("test")
+	r.Store.Colonies[1] = 2
+
+	if err := r.checkFence(fence{}); err != nil {
+		t.Errorf("unfenced command is rejected: %v", err)
+	}
+	if err := r.checkFence(fence{Colony: 1, Term: 2}); err != nil {
+		t.Errorf("command of the current leader is rejected: %v", err)
+	}
+	if err := r.checkFence(fence{Colony: 1, Term: 3}); err != nil {
+		t.Errorf("command of a newly elected leader is rejected: %v", err)
+	}
+	if err := r.checkFence(fence{Colony: 1, Term: 1}); !IsStaleTerm(err) {
+		t.Errorf("command of a deposed leader is accepted: %v", err)
+	}
+}
+
+func TestRegistryWatch(t *testing.T) {
+	r := newRegistry("test")
+	r.Bees[1] = BeeInfo{ID: 1, App: "app", Colony: Colony{ID: 1, Leader: 1}}
+	r.Bees[2] = BeeInfo{ID: 2, App: "app"}
+
+	var events []RegistryEvent
+	cancel := r.watch(func(ev RegistryEvent) {
+		// Watchers must be able to read the registry.
+		r.bees()
+		events = append(events, ev)
+	})
+
+	cells := MappedCells{{Dict: "D", Key: "a"}}
+	old := Colony{ID: 1, Leader: 1}
+	if _, err := r.Apply(lockMappedCell{App: "app", Colony: old,
+		Cells: cells}); err != nil {
+		t.Fatalf("cannot lock cells: %v", err)
+	}
+	// Locking an already locked cell is not a change.
+	r.Apply(lockMappedCell{App: "app", Colony: old, Cells: cells})
+
+	up := updateColony{
+		Term: 1,
+		Old:  old,
+		New:  Colony{ID: 1, Leader: 2, Followers: []uint64{1}},
+	}
+	if _, err := r.Apply(up); err != nil {
+		t.Fatalf("cannot update colony: %v", err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("invalid number of events: actual=%v want=2", len(events))
+	}
+	if l, ok := events[0].(CellsLocked); !ok || !l.Colony.Equals(old) {
+		t.Errorf("invalid lock event: %#v", events[0])
+	}
+	if u, ok := events[1].(ColonyUpdated); !ok || !u.New.Equals(up.New) {
+		t.Errorf("invalid colony event: %#v", events[1])
+	}
+
+	cancel()
+	r.Apply(transferCells{From: up.New, To: Colony{ID: 3, Leader: 3}})
+	if len(events) != 2 {
+		t.Errorf("canceled watcher is notified: %#v", events[2:])
+	}
+}
+
+func TestRegistryLeaseExpiry(t *testing.T) {
+	r := newRegistry("test")
+	r.Bees[1] = BeeInfo{ID: 1, Hive: 1, App: "app",
+		Colony: Colony{ID: 1, Leader: 1}}
+	r.Bees[2] = BeeInfo{ID: 2, Hive: 2, App: "app",
+		Colony: Colony{ID: 2, Leader: 2}}
+	for _, b := range r.Bees {
+		l := lockMappedCell{App: "app", Colony: b.Colony,
+			Cells: MappedCells{{Dict: "D", Key: string(rune('a' + b.ID))}}}
+		if _, err := r.lockCell(l); err != nil {
+			t.Fatalf("cannot lock cells: %v", err)
+		}
+	}
+
+	now := time.Now()
+	renew := func(h uint64, at time.Time) {
+		if _, err := r.Apply(renewLease{Hive: h, Now: at,
+			TTL: time.Second}); err != nil {
+			t.Fatalf("cannot renew the lease of %v: %v", h, err)
+		}
+	}
+	renew(1, now)
+	renew(2, now)
+	renew(1, now.Add(time.Second/2))
+	if _, ok := r.Store.colony("app", CellKey{Dict: "D", Key: "c"}); !ok {
+		t.Error("cells are released before the lease is expired")
+	}
+
+	renew(1, now.Add(2*time.Second))
+	if _, ok := r.Store.colony("app", CellKey{Dict: "D", Key: "c"}); ok {
+		t.Error("cells are not released after the lease is expired")
+	}
+	if _, ok := r.Store.colony("app", CellKey{Dict: "D", Key: "b"}); !ok {
+		t.Error("cells of a live hive are released")
+	}
+}
+
+func TestRegistryRestoreDump(t *testing.T) {
+	r := newRegistry("test")
+	r.Hives[1] = HiveInfo{ID: 1, Addr: "old"}
+	r.BeeID = 10
+	r.Bees[2] = BeeInfo{ID: 2, Hive: 1, App: "app",
+		Colony: Colony{ID: 2, Leader: 2}}
+	cell := CellKey{Dict: "D", Key: "a"}
+	r.Store.assign("app", cell, Colony{ID: 2, Leader: 2})
+	b, err := r.Save()
+	if err != nil {
+		t.Fatalf("cannot dump the registry: %v", err)
+	}
+
+	n := newRegistry("test")
+	n.Hives[2] = HiveInfo{ID: 2, Addr: "new"}
+	if _, err := n.Apply(restoreRegistry{Data: b}); err != nil {
+		t.Fatalf("cannot restore the registry: %v", err)
+	}
+	if _, ok := n.Hives[2]; !ok || len(n.Hives) != 1 {
+		t.Errorf("hives of the cluster are changed: %v", n.Hives)
+	}
+	if n.BeeID != 10 {
+		t.Errorf("invalid bee ID: actual=%v want=10", n.BeeID)
+	}
+	if c, ok := n.Store.colony("app", cell); !ok || c.Leader != 2 {
+		t.Errorf("cell is not restored: %v", c)
+	}
+	if _, err := n.bee(2); err != nil {
+		t.Errorf("bee is not restored: %v", err)
+	}
+}
+
+func TestRegistryIntrospection(t *testing.T) {
+	r := newRegistry("test")
+	c := Colony{ID: 1, Leader: 1, Followers: []uint64{2}}
+	r.Bees[1] = BeeInfo{ID: 1, Hive: 1, App: "app", Colony: c}
+	r.Bees[2] = BeeInfo{ID: 2, Hive: 2, App: "app", Colony: c}
+	cell := CellKey{Dict: "D", Key: "a"}
+	r.Store.assign("app", cell, c)
+
+	if b, err := r.cellOwner("app", cell); err != nil || b.ID != 1 {
+		t.Errorf("invalid owner of %v: actual=%v want=1 (%v)", cell, b.ID, err)
+	}
+	if _, err := r.cellOwner("app", CellKey{Dict: "D", Key: "b"}); err == nil {
+		t.Error("found an owner for an unlocked cell")
+	}
+
+	for _, id := range []uint64{1, 2} {
+		cells, err := r.colonyCells(id)
+		if err != nil || len(cells) != 1 || cells[0] != cell {
+			t.Errorf("invalid cells for bee %v: %v (%v)", id, cells, err)
+		}
+	}
+}
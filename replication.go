@@ -1,18 +1,27 @@
 package beehive
 
-import "math/rand"
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/kandoo/beehive/bucket"
+)
 
 type replicationStrategy interface {
-	// SelectHives selects n hives that are not blacklisted. If not possible, it
-	// returns an empty slice.
-	selectHives(blackList []uint64, n int) []uint64
+	// SelectHives selects n hives that are not blacklisted and are allowed by
+	// rules. If not possible, it returns an empty slice.
+	selectHives(rules placementRules, blackList []uint64, n int) []uint64
 }
 
 type rndRepliction struct {
 	hive *hive
 }
 
-func (r *rndRepliction) selectHives(blacklist []uint64, n int) []uint64 {
+func (r *rndRepliction) selectHives(rules placementRules, blacklist []uint64,
+	n int) []uint64 {
+
 	if n <= 0 {
 		return nil
 	}
@@ -25,7 +34,9 @@ func (r *rndRepliction) selectHives(blacklist []uint64, n int) []uint64 {
 	lives := r.hive.registry.hives()
 	whitelist := make([]uint64, 0, len(lives))
 	for _, h := range lives {
-		if h.ID == r.hive.ID() || blmap[h.ID] != 0 {
+		if h.ID == r.hive.ID() || blmap[h.ID] != 0 ||
+			!rules.allows(h, r.hive.registry) {
+
 			continue
 		}
 		whitelist = append(whitelist, h.ID)
@@ -52,3 +63,101 @@ func newRndReplication(h *hive) *rndRepliction {
 	}
 	return r
 }
+
+// replLimiter limits the rate of re-replication on a hive. Waiters with a
+// higher priority are served first, and waiters with the same priority are
+// served in order.
+type replLimiter struct {
+	sync.Mutex
+	bucket  *bucket.Bucket
+	waiters replWaiters
+	seq     uint64
+	signal  chan struct{}
+	once    sync.Once
+}
+
+func newReplLimiter(rate bucket.Rate) *replLimiter {
+	return &replLimiter{
+		bucket: bucket.New(rate, uint64(rate)),
+		signal: make(chan struct{}, 1),
+	}
+}
+
+// wait blocks until a token is available for a waiter with priority prio.
+func (l *replLimiter) wait(prio int) {
+	if l.bucket.Unlimited() {
+		return
+	}
+
+	l.once.Do(func() { go l.dispatch() })
+
+	ch := make(chan struct{})
+	l.Lock()
+	l.seq++
+	heap.Push(&l.waiters, replWaiter{prio: prio, seq: l.seq, ch: ch})
+	l.Unlock()
+
+	select {
+	case l.signal <- struct{}{}:
+	default:
+	}
+	<-ch
+}
+
+// dispatch hands out the tokens of the bucket to the waiters.
+func (l *replLimiter) dispatch() {
+	for range l.signal {
+		for {
+			l.Lock()
+			n := len(l.waiters)
+			l.Unlock()
+			if n == 0 {
+				break
+			}
+
+			if d := l.bucket.When(1); d > 0 {
+				time.Sleep(d)
+			}
+			if !l.bucket.Get(1) {
+				continue
+			}
+
+			// The waiter is picked after the wait, so that the waiters that
+			// arrived meanwhile with a higher priority are served first.
+			l.Lock()
+			w := heap.Pop(&l.waiters).(replWaiter)
+			l.Unlock()
+			close(w.ch)
+		}
+	}
+}
+
+type replWaiter struct {
+	prio int
+	seq  uint64
+	ch   chan struct{}
+}
+
+// replWaiters is a heap of waiters ordered by their priority.
+type replWaiters []replWaiter
+
+func (w replWaiters) Len() int { return len(w) }
+
+func (w replWaiters) Less(i, j int) bool {
+	if w[i].prio != w[j].prio {
+		return w[i].prio > w[j].prio
+	}
+	return w[i].seq < w[j].seq
+}
+
+func (w replWaiters) Swap(i, j int) { w[i], w[j] = w[j], w[i] }
+
+func (w *replWaiters) Push(x interface{}) { *w = append(*w, x.(replWaiter)) }
+
+func (w *replWaiters) Pop() interface{} {
+	old := *w
+	n := len(old)
+	x := old[n-1]
+	*w = old[:n-1]
+	return x
+}
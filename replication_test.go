@@ -0,0 +1,46 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/bucket"
+)
+
+func TestReplLimiterPriority(t *testing.T) {
+	l := newReplLimiter(10 * bucket.TPS)
+	ch := make(chan int, 3)
+	wait := func(id, prio int) {
+		l.wait(prio)
+		ch <- id
+	}
+
+	go wait(1, 0)
+	time.Sleep(10 * time.Millisecond)
+	go wait(2, 0)
+	time.Sleep(10 * time.Millisecond)
+	go wait(3, 1)
+
+	for _, want := range []int{3, 1, 2} {
+		if got := <-ch; got != want {
+			t.Errorf("invalid order of waiters: actual=%v want=%v", got, want)
+		}
+	}
+}
+
+func TestReplLimiterUnlimited(t *testing.T) {
+	l := newReplLimiter(bucket.Unlimited)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			l.wait(0)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("unlimited limiter blocks")
+	}
+}
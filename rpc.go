@@ -2,9 +2,11 @@ package beehive
 
 import (
 	"fmt"
+	"math/rand"
 	"net"
 	"net/rpc"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	etcdraft "github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft"
@@ -37,6 +39,19 @@ func (e *rpcBackoffError) Error() string {
 func (e *rpcBackoffError) Temporary() bool { return true }
 func (e *rpcBackoffError) Timeout() bool   { return true }
 
+// rpcTimeoutError is returned when a remote hive does not respond to a call
+// in time.
+type rpcTimeoutError struct {
+	After time.Duration
+}
+
+func (e *rpcTimeoutError) Error() string {
+	return fmt.Sprintf("rpc-client: no response in %v", e.After)
+}
+
+func (e *rpcTimeoutError) Temporary() bool { return true }
+func (e *rpcTimeoutError) Timeout() bool   { return true }
+
 func isBackoffError(err error) bool {
 	_, ok := err.(*rpcBackoffError)
 	return ok
@@ -65,7 +80,8 @@ type rpcClientPool struct {
 	hiveClients map[uint64]*rpcClient
 	beeClients  map[uint64]*rpcClient
 
-	retries map[uint64]*dialTry
+	retries  map[uint64]*dialTry
+	breakers map[uint64]*circuitBreaker
 }
 
 func newRPCClientPool(h *hive) *rpcClientPool {
@@ -74,6 +90,7 @@ func newRPCClientPool(h *hive) *rpcClientPool {
 		hiveClients: make(map[uint64]*rpcClient),
 		beeClients:  make(map[uint64]*rpcClient),
 		retries:     make(map[uint64]*dialTry),
+		breakers:    make(map[uint64]*circuitBreaker),
 	}
 }
 
@@ -86,6 +103,47 @@ func (p *rpcClientPool) stop() {
 	}
 }
 
+// reapTick returns how often the clients are reaped, or 0 if they are never
+// reaped.
+func reapTick(cfg HiveConfig) time.Duration {
+	t := cfg.IdleTimeout
+	if t == 0 || (cfg.MaxConnAge != 0 && cfg.MaxConnAge < t) {
+		t = cfg.MaxConnAge
+	}
+	return t / 2
+}
+
+// reap closes the clients that are idle for HiveConfig.IdleTimeout, and
+// retires the clients older than HiveConfig.MaxConnAge. The hives of the
+// removed clients are redialed on the next send. Retired clients are closed
+// after maxWait, so that their in-flight calls can finish.
+func (p *rpcClientPool) reap() {
+	cfg := p.hive.config
+	var idle, old []*rpcClient
+	p.Lock()
+	for h, c := range p.hiveClients {
+		switch {
+		case cfg.IdleTimeout != 0 && c.idle() > cfg.IdleTimeout:
+			idle = append(idle, c)
+		case cfg.MaxConnAge != 0 && time.Since(c.created) > cfg.MaxConnAge:
+			old = append(old, c)
+		default:
+			continue
+		}
+		delete(p.hiveClients, h)
+	}
+	p.Unlock()
+
+	for _, c := range idle {
+		glog.V(2).Infof("%v closes idle %v", p.hive, c)
+		c.stop()
+	}
+	for _, c := range old {
+		glog.V(2).Infof("%v retires %v", p.hive, c)
+		time.AfterFunc(maxWait, c.stop)
+	}
+}
+
 func (p *rpcClientPool) shouldReset(err error) bool {
 	if err == nil {
 		return false
@@ -138,16 +196,110 @@ func (p *rpcClientPool) sendMsg(msgs []msg) (err error) {
 	return err
 }
 
+// sendCmd sends the command to its hive, using the default timeout of the
+// hive. See sendCmdWithTimeout.
 func (p *rpcClientPool) sendCmd(cmd cmd) (res interface{}, err error) {
-	client, err := p.hiveClient(cmd.Hive)
+	return p.sendCmdWithTimeout(cmd, p.hive.config.CmdTimeout)
+}
+
+// sendCmdWithTimeout sends the command to its hive, and fails if the hive does
+// not respond within the timeout. See sendBatch.
+func (p *rpcClientPool) sendCmdWithTimeout(cm cmd, timeout time.Duration) (
+	interface{}, error) {
+
+	r, err := p.sendBatch(cm.Hive, []cmd{cm}, timeout)
 	if err != nil {
 		return nil, err
 	}
+	return r[0].get()
+}
 
-	if res, err = client.sendCmd(cmd); p.shouldReset(err) {
-		p.resetHiveClient(cmd.Hive, client)
+// sendCmds sends the commands to their hives, using one round trip per hive.
+// The round trips to different hives are concurrent. It returns the results of
+// the commands in order. The commands to a hive that cannot be reached fail
+// with the error of the round trip.
+func (p *rpcClientPool) sendCmds(cmds []cmd) []cmdResult {
+	hives := make(map[uint64][]int)
+	for i := range cmds {
+		hives[cmds[i].Hive] = append(hives[cmds[i].Hive], i)
 	}
-	return
+
+	res := make([]cmdResult, len(cmds))
+	var wg sync.WaitGroup
+	for h, idx := range hives {
+		wg.Add(1)
+		go func(h uint64, idx []int) {
+			defer wg.Done()
+			batch := make([]cmd, 0, len(idx))
+			for _, i := range idx {
+				batch = append(batch, cmds[i])
+			}
+			r, err := p.sendBatch(h, batch, p.hive.config.CmdTimeout)
+			for j, i := range idx {
+				if err != nil {
+					res[i] = cmdResult{Err: err}
+				} else {
+					res[i] = r[j]
+				}
+			}
+		}(h, idx)
+	}
+	wg.Wait()
+	return res
+}
+
+// sendBatch sends the commands to the hive in one round trip, and fails if the
+// hive does not respond within the timeout. If the connection to the hive
+// cannot be established, the batch is retried for HiveConfig.CmdRetries times.
+// If the connection breaks or the call times out after the batch is sent, the
+// batch is retried only if all its commands are idempotent. The batch fails
+// fast if the circuit breaker of the hive is open.
+func (p *rpcClientPool) sendBatch(hive uint64, cmds []cmd,
+	timeout time.Duration) (res []cmdResult, err error) {
+
+	for try := uint(0); ; try++ {
+		if berr := p.allow(hive); berr != nil {
+			if try == 0 {
+				err = berr
+			}
+			return nil, err
+		}
+
+		var client *rpcClient
+		if client, err = p.hiveClient(hive); err == nil {
+			res, err = client.sendCmds(cmds, timeout)
+		}
+		p.done(hive, err)
+		if err == nil || !p.shouldRetry(err) {
+			return res, err
+		}
+		if client != nil && p.shouldReset(err) {
+			p.dropHiveClient(hive, client)
+		}
+
+		// The commands may have been processed.
+		sent := client != nil
+		if try >= p.hive.config.CmdRetries || (sent && !allIdempotent(cmds)) {
+			return nil, err
+		}
+
+		glog.V(2).Infof("%v retries %v commands to hive %v: %v", p.hive,
+			len(cmds), hive, err)
+		if berr, ok := err.(*rpcBackoffError); ok {
+			time.Sleep(berr.Until.Sub(time.Now()))
+		}
+	}
+}
+
+// shouldRetry returns whether a command that failed with err should be
+// retried.
+func (p *rpcClientPool) shouldRetry(err error) bool {
+	if err == rpc.ErrShutdown {
+		return true
+	}
+
+	_, ok := err.(net.Error)
+	return ok
 }
 
 func (p *rpcClientPool) lookupHive(hive uint64) (client *rpcClient, ok bool) {
@@ -169,6 +321,16 @@ func (p *rpcClientPool) deleteHive(hive uint64) {
 	p.Unlock()
 }
 
+// dropHiveClient removes the broken client of the hive, unless it is already
+// replaced. The hive is redialed on the next send.
+func (p *rpcClientPool) dropHiveClient(hive uint64, client *rpcClient) {
+	p.Lock()
+	if p.hiveClients[hive] == client {
+		delete(p.hiveClients, hive)
+	}
+	p.Unlock()
+}
+
 func (p *rpcClientPool) lookupRetry(hive uint64) (t *dialTry) {
 	p.Lock()
 	t, ok := p.retries[hive]
@@ -234,25 +396,39 @@ func (p *rpcClientPool) newClient(hive uint64) (client *rpcClient, err error) {
 		return nil, err
 	}
 
-	if client, err = newRPCClient(i.Addr); err != nil {
+	if client, err = newRPCClient(i.Addr, p.hive.transport); err != nil {
 		// contention here.
 		t.tries++
 		t.wait *= 2
 		if t.wait > maxWait {
 			t.wait = maxWait
 		}
-		t.next = now.Add(t.wait)
+		t.next = now.Add(jitter(t.wait))
 		p.setRetry(hive, t)
 		return nil, err
 	}
 
-	t.wait = 1 * time.Second
+	client.negotiate(p.hive.config.CompressThresh)
+	client.negotiateFragments(p.hive.config.FragmentSize)
+	client.negotiateSchemas()
+	client.negotiateEncoding(p.hive.config.MsgEncoding)
+	t.wait = minWait
 	t.next = now
 	p.setRetry(hive, t)
 	p.setHive(hive, client)
 	return client, nil
 }
 
+// jitter returns a random duration in [d/2, d), so that hives do not redial
+// a peer in lockstep.
+func jitter(d time.Duration) time.Duration {
+	h := d / 2
+	if h <= 0 {
+		return d
+	}
+	return h + time.Duration(rand.Int63n(int64(h)))
+}
+
 func (p *rpcClientPool) beeClient(bee uint64) (client *rpcClient, err error) {
 	i, err := p.hive.bee(bee)
 	if err != nil {
@@ -280,42 +456,68 @@ type rpcClient struct {
 	msg  *rpc.Client
 	raft *rpc.Client
 	prio *rpc.Client
+	// compress is the size above which payloads are compressed. It is 0 if
+	// compression is disabled or is not supported by the remote hive.
+	compress uint
+	// raftFlate is whether raft batches larger than compress are compressed,
+	// which makes replicating large transactions across data centers practical.
+	raftFlate bool
+	// fragment is the maximum size of the payloads of messages. Larger payloads
+	// are sent in fragments. It is 0 if fragmentation is disabled or is not
+	// supported by the remote hive.
+	fragment uint
+	// schemas are the schema versions of the remote hive.
+	schemas map[string]uint
+	// proto is whether messages are encoded using protobuf. See
+	// EncodingProto.
+	proto bool
+
+	created time.Time
+	// used is the time of the latest call in unix nanoseconds. It is accessed
+	// atomically.
+	used int64
 }
 
 func (c rpcClient) String() string {
 	return fmt.Sprintf("rpc client to %s", c.addr)
 }
 
-func newRPCClient(addr string) (client *rpcClient, err error) {
+func newRPCClient(addr string, tr *transport) (client *rpcClient,
+	err error) {
+
 	client = &rpcClient{
-		addr: addr,
+		addr:    addr,
+		created: time.Now(),
+		used:    time.Now().UnixNano(),
 	}
 
-	cmdConn, err := net.DialTimeout("tcp", addr, maxWait)
+	ctrl, data := tr.buckets()
+
+	cmdConn, err := tr.dial(addr)
 	if err != nil {
 		return nil, err
 	}
-	client.cmd = rpc.NewClient(cmdConn)
+	client.cmd = rpc.NewClient(throttle(cmdConn, ctrl, trafficCtrl))
 
-	raftConn, err := net.DialTimeout("tcp", addr, maxWait)
+	raftConn, err := tr.dial(addr)
 	if err != nil {
 		client.raft = client.cmd
 	} else {
-		client.raft = rpc.NewClient(raftConn)
+		client.raft = rpc.NewClient(throttle(raftConn, data, trafficData))
 	}
 
-	prioConn, err := net.DialTimeout("tcp", addr, maxWait)
+	prioConn, err := tr.dial(addr)
 	if err != nil {
 		client.prio = client.raft
 	} else {
-		client.prio = rpc.NewClient(prioConn)
+		client.prio = rpc.NewClient(throttle(prioConn, ctrl, trafficCtrl))
 	}
 
-	msgConn, err := net.DialTimeout("tcp", addr, maxWait)
+	msgConn, err := tr.dial(addr)
 	if err != nil {
 		client.msg = client.cmd
 	} else {
-		client.msg = rpc.NewClient(msgConn)
+		client.msg = rpc.NewClient(throttle(msgConn, data, trafficData))
 	}
 
 	return client, nil
@@ -324,17 +526,109 @@ func newRPCClient(addr string) (client *rpcClient, err error) {
 func (c *rpcClient) sendMsg(msgs []msg) error {
 	var f struct{}
 	glog.V(3).Infof("%v sends %v messages", c, len(msgs))
-	return c.msg.Call("rpcServer.EnqueMsg", msgs, &f)
+	c.touch()
+	if c.compress == 0 && c.fragment == 0 && !c.proto {
+		return c.msg.Call("rpcServer.EnqueMsg", msgs, &f)
+	}
+
+	var p []byte
+	var err error
+	if c.proto {
+		p, err = encodeProtoPayload(msgs, c.compress)
+	} else {
+		p, err = encodePayload(msgs, c.compress)
+	}
+	if err != nil {
+		return err
+	}
+	if c.fragment != 0 && uint(len(p)) > c.fragment {
+		return c.sendFragments(p)
+	}
+	return c.msg.Call("rpcServer.EnqueMsgPayload", p, &f)
 }
 
 func (c *rpcClient) sendCmd(cm cmd) (res interface{}, err error) {
-	glog.V(3).Infof("%v sends %v", c, cm)
-	r := make([]cmdResult, 1)
-	err = c.cmd.Call("rpcServer.ProcessCmd", []cmd{cm}, &r)
+	return c.sendCmdWithTimeout(cm, 0)
+}
+
+// sendCmdWithTimeout sends the command, and fails with an rpcTimeoutError if
+// the remote hive does not respond in time. 0 means no timeout.
+func (c *rpcClient) sendCmdWithTimeout(cm cmd, timeout time.Duration) (
+	res interface{}, err error) {
+
+	r, err := c.sendCmds([]cmd{cm}, timeout)
 	if err != nil {
 		return
 	}
-	return r[0].Data, r[0].Err
+	return r[0].get()
+}
+
+// sendCmds sends the commands in one round trip, and returns their results in
+// order. The remote hive enqueues the commands in order, and processes them
+// concurrently if they are for different bees.
+func (c *rpcClient) sendCmds(cms []cmd, timeout time.Duration) ([]cmdResult,
+	error) {
+
+	glog.V(3).Infof("%v sends %v", c, cms)
+	c.touch()
+	// State transfers are data traffic, and are sent on the connection of
+	// messages.
+	conn := c.cmd
+	for _, cm := range cms {
+		if isStateTransfer(cm.Data) {
+			conn = c.msg
+			break
+		}
+	}
+
+	r := make([]cmdResult, len(cms))
+	var err error
+	if c.compress == 0 {
+		err = callWithTimeout(conn, "rpcServer.ProcessCmd", cms, &r, timeout)
+	} else {
+		err = c.sendCmdPayload(conn, cms, &r, timeout)
+	}
+	if err == nil && len(r) != len(cms) {
+		err = fmt.Errorf("rpc-client: %v results for %v commands", len(r),
+			len(cms))
+	}
+	return r, err
+}
+
+func (c *rpcClient) sendCmdPayload(conn *rpc.Client, cms []cmd,
+	r *[]cmdResult, timeout time.Duration) error {
+
+	p, err := encodePayload(cms, c.compress)
+	if err != nil {
+		return err
+	}
+	var res []byte
+	err = callWithTimeout(conn, "rpcServer.ProcessCmdPayload", p, &res, timeout)
+	if err != nil {
+		return err
+	}
+	return decodePayload(res, r)
+}
+
+// callWithTimeout calls the method, and returns an rpcTimeoutError if the call
+// does not return in time. The call is abandoned, and its reply must not be
+// used afterwards.
+func callWithTimeout(c *rpc.Client, method string, args interface{},
+	reply interface{}, timeout time.Duration) error {
+
+	if timeout == 0 {
+		return c.Call(method, args, reply)
+	}
+
+	call := c.Go(method, args, reply, make(chan *rpc.Call, 1))
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-t.C:
+		return &rpcTimeoutError{After: timeout}
+	}
 }
 
 func snapStatus(err error) (ss etcdraft.SnapshotStatus) {
@@ -366,11 +660,19 @@ func report(err error, batch *raft.Batch, r raft.Reporter) {
 
 func (c *rpcClient) sendRaft(batch *raft.Batch, r raft.Reporter) (err error) {
 	glog.V(3).Infof("%v sends a raft batch", c)
-	var dummy bool
+	c.touch()
+	conn := c.raft
 	if batch.Priority == raft.High {
-		err = c.prio.Call("rpcServer.ProcessRaft", batch, &dummy)
+		conn = c.prio
+	}
+	var dummy bool
+	if c.raftFlate {
+		var p []byte
+		if p, err = encodePayload(batch, c.compress); err == nil {
+			err = conn.Call("rpcServer.ProcessRaftPayload", p, &dummy)
+		}
 	} else {
-		err = c.raft.Call("rpcServer.ProcessRaft", batch, &dummy)
+		err = conn.Call("rpcServer.ProcessRaft", batch, &dummy)
 	}
 	report(err, batch, r)
 	return err
@@ -381,8 +683,8 @@ func (c *rpcClient) hiveState() (state HiveState, err error) {
 	return
 }
 
-func getHiveState(addr string) (state HiveState, err error) {
-	client, err := newRPCClient(addr)
+func getHiveState(addr string, tr *transport) (state HiveState, err error) {
+	client, err := newRPCClient(addr, tr)
 	if err != nil {
 		return
 	}
@@ -390,6 +692,16 @@ func getHiveState(addr string) (state HiveState, err error) {
 	return client.hiveState()
 }
 
+// touch records that the client is used now.
+func (c *rpcClient) touch() {
+	atomic.StoreInt64(&c.used, time.Now().UnixNano())
+}
+
+// idle returns how long the client has not been used.
+func (c *rpcClient) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.used)))
+}
+
 func (c *rpcClient) stop() {
 	c.cmd.Close()
 	c.msg.Close()
@@ -398,7 +710,8 @@ func (c *rpcClient) stop() {
 }
 
 type rpcServer struct {
-	h *hive
+	h     *hive
+	frags reassembler
 }
 
 func newRPCServer(h *hive) *rpcServer {
@@ -435,6 +748,12 @@ func (s *rpcServer) ProcessCmd(cmds []cmd, res *[]cmdResult) error {
 			continue
 		}
 
+		if err := s.h.registry.checkFence(c.Fence); err != nil {
+			// StaleTermError is registered in gob and is sent as is.
+			ch <- cmdResult{Err: err}
+			continue
+		}
+
 		var ctrlCh chan cmdAndChannel
 		if c.App == "" {
 			glog.V(3).Infof("%v handles command to hive: %v", s.h, c)
@@ -471,13 +790,14 @@ func (s *rpcServer) ProcessCmd(cmds []cmd, res *[]cmdResult) error {
 	}
 
 	for i, ch := range chs {
+	wait:
 		for {
 			select {
 			case r := <-ch:
 				glog.V(3).Infof("server %v returned result %#v for command %v",
-					s.h, res, cmds[i])
+					s.h, r, cmds[i])
 				(*res)[i] = r
-				return nil
+				break wait
 
 			case <-time.After(10 * time.Second):
 				glog.Errorf("%v is blocked on %v (chan %p size=%d)", s.h, cmds[i], ch,
@@ -495,6 +815,7 @@ func (s *rpcServer) ProcessRaft(batch raft.Batch, dummy *bool) (err error) {
 	}
 
 	glog.V(3).Infof("%v handles a batch from %v", s.h, batch.From)
+	s.h.detector.heartbeat(batch.From, time.Now())
 	ctx, cnl := context.WithTimeout(context.Background(),
 		s.h.config.RaftHBTimeout())
 	err = s.h.node.StepBatch(ctx, batch, 2*s.h.config.RaftHBTimeout())
@@ -503,7 +824,18 @@ func (s *rpcServer) ProcessRaft(batch raft.Batch, dummy *bool) (err error) {
 }
 
 func (s *rpcServer) EnqueMsg(msgs []msg, dummy *struct{}) error {
+	if err := s.h.pushBack(msgs); err != nil {
+		return err
+	}
 	for i := range msgs {
+		if err := s.h.decryptMsg(&msgs[i]); err != nil {
+			glog.Errorf("%v rejects message to %v: %v", s.h, msgs[i].MsgTo, err)
+			continue
+		}
+		if err := s.h.toLocalSchema(&msgs[i]); err != nil {
+			glog.Errorf("%v rejects message %v: %v", s.h, msgs[i], err)
+			continue
+		}
 		s.h.enqueMsg(&msgs[i])
 	}
 	return nil
@@ -0,0 +1,190 @@
+package beehive
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCmdRetries(t *testing.T) {
+	h1 := newHiveForTest()
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	// Each value of CmdRetries needs its own hive, since the configuration of
+	// a running hive cannot be changed.
+	ping := cmd{Hive: h1.ID(), Data: cmdPing{}}
+	clients := make(map[uint]*rpcClientPool)
+	for _, retries := range []uint{0, 2} {
+		h := newHiveForTest(PeerAddrs(h1.Config().Addr), CmdRetries(retries))
+		go h.Start()
+		defer h.Stop()
+		waitTilStareted(h)
+		clients[retries] = h.(*hive).client
+	}
+
+	for retries, p := range clients {
+		c, err := p.hiveClient(h1.ID())
+		if err != nil {
+			t.Fatalf("cannot connect to %v: %v", h1, err)
+		}
+		// Break the connection.
+		c.cmd.Close()
+
+		_, err = p.sendCmd(ping)
+		if retries == 0 && err == nil {
+			t.Error("command is retried when retries are disabled")
+		}
+		if retries != 0 && err != nil {
+			t.Errorf("command is not retried: %v", err)
+		}
+	}
+
+	// Commands that are not idempotent are not retried, once sent.
+	p := clients[2]
+	c, _ := p.hiveClient(h1.ID())
+	c.cmd.Close()
+	if _, err := p.sendCmd(cmd{Hive: h1.ID(), Data: cmdNewHiveID{}}); err == nil {
+		t.Error("command that is not idempotent is retried")
+	}
+}
+
+func TestSendCmds(t *testing.T) {
+	h1 := newHiveForTest()
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	cmds := []cmd{
+		{Hive: h1.ID(), Data: cmdPing{}},
+		{Hive: h2.ID(), Data: cmdLiveHives{}},
+		{Hive: h1.ID(), App: "nosuchapp", Data: cmdPing{}},
+		{Hive: h1.ID(), Data: cmdLiveHives{}},
+	}
+	res := h2.(*hive).client.sendCmds(cmds)
+	if len(res) != len(cmds) {
+		t.Fatalf("invalid number of results: actual=%v want=%v", len(res),
+			len(cmds))
+	}
+	for i, r := range res {
+		if (r.Err != nil) != (i == 2) {
+			t.Errorf("invalid error for command %v: %v", i, r.Err)
+		}
+	}
+	for _, i := range []int{1, 3} {
+		if hives, ok := res[i].Data.([]HiveInfo); !ok || len(hives) != 2 {
+			t.Errorf("invalid result for command %v: %v", i, res[i].Data)
+		}
+	}
+}
+
+func TestCmdTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer l.Close()
+	// The peer accepts connections, but never responds.
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	c, err := newRPCClient(l.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+	defer c.stop()
+
+	_, err = c.sendCmdWithTimeout(cmd{Data: cmdPing{}}, 10*time.Millisecond)
+	if _, ok := err.(*rpcTimeoutError); !ok {
+		t.Errorf("command does not time out: %v", err)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Second); d < time.Second/2 || d >= time.Second {
+			t.Fatalf("invalid jitter: %v", d)
+		}
+	}
+}
+
+func TestReapClients(t *testing.T) {
+	h1 := newHiveForTest()
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr), IdleTimeout(time.Hour),
+		MaxConnAge(time.Hour))
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	p := h2.(*hive).client
+	c, err := p.hiveClient(h1.ID())
+	if err != nil {
+		t.Fatalf("cannot connect to %v: %v", h1, err)
+	}
+
+	p.reap()
+	if _, ok := p.lookupHive(h1.ID()); !ok {
+		t.Fatal("client in use is reaped")
+	}
+
+	// Retired clients are removed, but are not closed right away.
+	c.created = time.Now().Add(-2 * time.Hour)
+	p.reap()
+	if _, ok := p.lookupHive(h1.ID()); ok {
+		t.Error("old client is not retired")
+	}
+	if _, err := c.hiveState(); err != nil {
+		t.Errorf("retired client is closed: %v", err)
+	}
+
+	c, err = p.hiveClient(h1.ID())
+	if err != nil {
+		t.Fatalf("cannot connect to %v: %v", h1, err)
+	}
+	atomic.StoreInt64(&c.used, time.Now().Add(-2*time.Hour).UnixNano())
+	p.reap()
+	if _, ok := p.lookupHive(h1.ID()); ok {
+		t.Error("idle client is not reaped")
+	}
+	if _, err := c.hiveState(); err == nil {
+		t.Error("idle client is not closed")
+	}
+
+	// The hive is redialed.
+	if _, err := p.sendCmd(cmd{Hive: h1.ID(), Data: cmdPing{}}); err != nil {
+		t.Errorf("cannot redial %v: %v", h1, err)
+	}
+}
+
+func TestReapTick(t *testing.T) {
+	for _, c := range []struct {
+		idle, age, tick time.Duration
+	}{
+		{0, 0, 0},
+		{time.Minute, 0, 30 * time.Second},
+		{0, time.Minute, 30 * time.Second},
+		{time.Hour, time.Minute, 30 * time.Second},
+	} {
+		cfg := HiveConfig{IdleTimeout: c.idle, MaxConnAge: c.age}
+		if tick := reapTick(cfg); tick != c.tick {
+			t.Errorf("invalid tick for %v, %v: actual=%v want=%v", c.idle, c.age,
+				tick, c.tick)
+		}
+	}
+}
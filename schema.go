@@ -0,0 +1,185 @@
+package beehive
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// SchemaConverter converts the data of a message from one version of its
+// schema to another.
+type SchemaConverter func(data interface{}) (interface{}, error)
+
+// SchemaError is the error of a message that is rejected because its schema
+// is not compatible with the schema of the receiving hive.
+type SchemaError struct {
+	Type    string // The type of the message.
+	Version uint   // The schema version of the message.
+	Want    uint   // The schema version of the receiving hive.
+	Err     error  // The error of the converter, if any.
+}
+
+func (e *SchemaError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("cannot convert %v from schema %v to %v: %v", e.Type,
+			e.Version, e.Want, e.Err)
+	}
+	return fmt.Sprintf("no converter for %v from schema %v to %v", e.Type,
+		e.Version, e.Want)
+}
+
+type schemaConv struct {
+	Type     string
+	From, To uint
+}
+
+var schemas = struct {
+	sync.RWMutex
+	versions map[string]uint
+	convs    map[schemaConv]SchemaConverter
+}{
+	versions: make(map[string]uint),
+	convs:    make(map[schemaConv]SchemaConverter),
+}
+
+// RegisterSchema registers the schema version of the type of msgData in this
+// binary. Hives exchange their schema versions when they connect, and a
+// message is sent to a hive with a different version of its schema only if
+// there is a converter between the two versions (see
+// RegisterSchemaConverter). Otherwise, the message is rejected with a
+// *SchemaError and is added to the dead letters of its application. Messages
+// of types with no registered schema are sent as is.
+//
+// Versions must be positive.
+func RegisterSchema(msgData interface{}, version uint) {
+	if version == 0 {
+		glog.Fatalf("invalid schema version for %v", MsgType(msgData))
+	}
+
+	schemas.Lock()
+	schemas.versions[MsgType(msgData)] = version
+	schemas.Unlock()
+}
+
+// RegisterSchemaConverter registers a converter for the type of msgData from
+// schema version from to version to. Converters are not chained: a message is
+// converted only if there is a converter from its version directly to the
+// version of the receiving hive. Messages are converted by the sending hive,
+// if it has a converter, and otherwise by the receiving hive.
+func RegisterSchemaConverter(msgData interface{}, from, to uint,
+	c SchemaConverter) {
+
+	schemas.Lock()
+	schemas.convs[schemaConv{MsgType(msgData), from, to}] = c
+	schemas.Unlock()
+}
+
+func schemaVersion(t string) (v uint, ok bool) {
+	schemas.RLock()
+	v, ok = schemas.versions[t]
+	schemas.RUnlock()
+	return
+}
+
+func schemaVersions() map[string]uint {
+	schemas.RLock()
+	defer schemas.RUnlock()
+	res := make(map[string]uint, len(schemas.versions))
+	for t, v := range schemas.versions {
+		res[t] = v
+	}
+	return res
+}
+
+// convertSchema converts the data of the message from version from to version
+// to of its schema.
+func convertSchema(m *msg, from, to uint) error {
+	t := m.Type()
+	schemas.RLock()
+	c, ok := schemas.convs[schemaConv{t, from, to}]
+	schemas.RUnlock()
+	if !ok {
+		return &SchemaError{Type: t, Version: from, Want: to}
+	}
+
+	d, err := c(m.MsgData)
+	if err != nil {
+		return &SchemaError{Type: t, Version: from, Want: to, Err: err}
+	}
+	m.MsgData = d
+	m.MsgSchema = to
+	return nil
+}
+
+// Schemas returns the schema versions registered on the server.
+func (s *rpcServer) Schemas(dummy struct{}, versions *map[string]uint) error {
+	*versions = schemaVersions()
+	return nil
+}
+
+// negotiateSchemas retrieves the schema versions of the remote hive. Hives
+// that do not support schemas are sent messages as is.
+func (c *rpcClient) negotiateSchemas() {
+	var versions map[string]uint
+	if err := c.cmd.Call("rpcServer.Schemas", struct{}{}, &versions); err != nil {
+		glog.V(2).Infof("%v does not support schemas: %v", c, err)
+		return
+	}
+	c.schemas = versions
+}
+
+// toRemoteSchema stamps the message with its schema version, and converts it
+// to the schema of the remote hive if they are different.
+func (c *rpcClient) toRemoteSchema(m *msg) error {
+	v, ok := schemaVersion(m.Type())
+	if !ok {
+		return nil
+	}
+	m.MsgSchema = v
+
+	rv, ok := c.schemas[m.Type()]
+	if !ok || rv == v {
+		return nil
+	}
+	return convertSchema(m, v, rv)
+}
+
+// toLocalSchema converts a message received from another hive to the local
+// schema of its type.
+func (h *hive) toLocalSchema(m *msg) error {
+	if m.MsgSchema == 0 {
+		return nil
+	}
+
+	v, ok := schemaVersion(m.Type())
+	if !ok || v == m.MsgSchema {
+		return nil
+	}
+	return convertSchema(m, m.MsgSchema, v)
+}
+
+// toRemoteSchemas converts the messages of the proxy bee to the schemas of
+// its remote hive, and returns the converted messages along with their
+// original messages. The messages that cannot be converted are added to the
+// dead letters of the application, and are not redelivered.
+func (b *bee) toRemoteSchemas(mhs []msgAndHandler,
+	msgs []msg) ([]msgAndHandler, []msg) {
+
+	res := msgs[:0]
+	kept := make([]msgAndHandler, 0, len(mhs))
+	for i := range msgs {
+		m := msgs[i]
+		if err := b.prxClient.client.toRemoteSchema(&m); err != nil {
+			glog.Errorf("%v rejects message %v: %v", b, mhs[i].msg, err)
+			if m.MsgAckBee == b.ID() {
+				b.handleAck([]uint64{m.MsgSeq})
+			}
+			b.app.deadLetters.add(mhs[i], err)
+			continue
+		}
+		res = append(res, m)
+		kept = append(kept, mhs[i])
+	}
+	return kept, res
+}
@@ -0,0 +1,87 @@
+package beehive
+
+import "testing"
+
+type schemaTestMsg struct {
+	Name string
+}
+
+type schemaTestOther struct{}
+
+func resetSchemasForTest() {
+	schemas.Lock()
+	schemas.versions = make(map[string]uint)
+	schemas.convs = make(map[schemaConv]SchemaConverter)
+	schemas.Unlock()
+}
+
+func TestSchemaToRemote(t *testing.T) {
+	defer resetSchemasForTest()
+	RegisterSchema(schemaTestMsg{}, 2)
+	RegisterSchemaConverter(schemaTestMsg{}, 2, 1,
+		func(data interface{}) (interface{}, error) {
+			d := data.(schemaTestMsg)
+			d.Name = "v1:" + d.Name
+			return d, nil
+		})
+
+	c := &rpcClient{
+		schemas: map[string]uint{
+			MsgType(schemaTestMsg{}):   1,
+			MsgType(schemaTestOther{}): 1,
+		},
+	}
+
+	m := msg{MsgData: schemaTestMsg{Name: "a"}}
+	if err := c.toRemoteSchema(&m); err != nil {
+		t.Fatalf("cannot convert message: %v", err)
+	}
+	if m.MsgSchema != 1 || m.MsgData.(schemaTestMsg).Name != "v1:a" {
+		t.Errorf("invalid converted message: schema=%v data=%v", m.MsgSchema,
+			m.MsgData)
+	}
+
+	// Types with no local schema are sent as is.
+	m = msg{MsgData: schemaTestOther{}}
+	if err := c.toRemoteSchema(&m); err != nil || m.MsgSchema != 0 {
+		t.Errorf("unregistered message is converted: schema=%v err=%v",
+			m.MsgSchema, err)
+	}
+
+	c.schemas[MsgType(schemaTestMsg{})] = 3
+	m = msg{MsgData: schemaTestMsg{Name: "a"}}
+	err := c.toRemoteSchema(&m)
+	serr, ok := err.(*SchemaError)
+	if !ok {
+		t.Fatalf("invalid error for incompatible schemas: %v", err)
+	}
+	if serr.Version != 2 || serr.Want != 3 {
+		t.Errorf("invalid schema error: %#v", serr)
+	}
+}
+
+func TestSchemaToLocal(t *testing.T) {
+	defer resetSchemasForTest()
+	RegisterSchema(schemaTestMsg{}, 2)
+	RegisterSchemaConverter(schemaTestMsg{}, 1, 2,
+		func(data interface{}) (interface{}, error) {
+			d := data.(schemaTestMsg)
+			d.Name = "v2:" + d.Name
+			return d, nil
+		})
+
+	h := &hive{}
+	m := msg{MsgData: schemaTestMsg{Name: "a"}, MsgSchema: 1}
+	if err := h.toLocalSchema(&m); err != nil {
+		t.Fatalf("cannot convert message: %v", err)
+	}
+	if m.MsgSchema != 2 || m.MsgData.(schemaTestMsg).Name != "v2:a" {
+		t.Errorf("invalid converted message: schema=%v data=%v", m.MsgSchema,
+			m.MsgData)
+	}
+
+	m = msg{MsgData: schemaTestMsg{Name: "a"}, MsgSchema: 3}
+	if _, ok := h.toLocalSchema(&m).(*SchemaError); !ok {
+		t.Error("incompatible message is not rejected")
+	}
+}
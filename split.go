@@ -0,0 +1,214 @@
+package beehive
+
+import (
+	"fmt"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/state"
+)
+
+// cellSplit is enqueued on the data channel of a bee whose cells are split or
+// moved. Since it has the lowest priority, it is dequeued after the messages
+// routed to the bee before the split, and the bee hands off the state of the
+// cells only after handling those messages.
+type cellSplit struct {
+	cells MappedCells
+	to    uint64
+	ch    chan error
+}
+
+func (s cellSplit) Priority() Priority {
+	return PriorityLow
+}
+
+// split moves each group of the cells of a local bee to a new local bee, along
+// with their state, and returns the IDs of the new bees. The messages of the
+// application must not map cells of different groups, or cells of a group and
+// the cells that remain with the bee, together.
+//
+// The queen does not route messages while splitting, so the messages of the
+// split cells are handled by the new bees once the split is done.
+func (q *qee) split(bid uint64, groups []MappedCells) (newbs []uint64,
+	err error) {
+
+	if q.app.persistent() {
+		return nil, fmt.Errorf("%v cannot split the bees of persistent apps", q)
+	}
+
+	b, ok := q.beeByID(bid)
+	if !ok || b.proxy || b.detached || !b.isLeader() {
+		return nil, fmt.Errorf("%v cannot split nonlocal bee %v", q, bid)
+	}
+
+	owned, err := q.hive.registry.colonyCells(bid)
+	if err != nil {
+		return nil, err
+	}
+	left := make(map[CellKey]bool, len(owned))
+	for _, c := range owned {
+		left[c] = true
+	}
+	for _, g := range groups {
+		if len(g) == 0 {
+			return nil, fmt.Errorf("%v cannot split %v to no cells", q, bid)
+		}
+		for _, c := range g {
+			if !left[c] {
+				return nil, fmt.Errorf("%v does not own cell %v", b, c)
+			}
+			delete(left, c)
+		}
+	}
+	if len(left) == 0 {
+		return nil, fmt.Errorf("%v cannot split all the cells of %v", q, bid)
+	}
+
+	for _, g := range groups {
+		var nb *bee
+		if nb, err = q.newLocalBee(true); err != nil {
+			return newbs, err
+		}
+		if err = q.handOffCells(b, nb, g); err != nil {
+			return newbs, err
+		}
+		glog.V(2).Infof("%v split %v off %v to %v", q, g, b, nb)
+		newbs = append(newbs, nb.ID())
+	}
+	return newbs, nil
+}
+
+// moveCells moves cells, along with their state, from local bee from to local
+// bee to. Unlike a migration, the rest of the cells of from stay with it. Like
+// split, the messages of the application must not map the moved cells together
+// with the cells that remain with from.
+func (q *qee) moveCells(from, to uint64, cells MappedCells) error {
+	if q.app.persistent() {
+		return fmt.Errorf("%v cannot move the cells of persistent apps", q)
+	}
+	if len(cells) == 0 || from == to {
+		return fmt.Errorf("%v cannot move %v from %v to %v", q, cells, from, to)
+	}
+
+	var bees [2]*bee
+	for i, id := range [...]uint64{from, to} {
+		b, ok := q.beeByID(id)
+		if !ok || b.proxy || b.detached || !b.isLeader() {
+			return fmt.Errorf("%v cannot move cells of nonlocal bee %v", q, id)
+		}
+		bees[i] = b
+	}
+
+	owned, err := q.hive.registry.colonyCells(from)
+	if err != nil {
+		return err
+	}
+	left := make(map[CellKey]bool, len(owned))
+	for _, c := range owned {
+		left[c] = true
+	}
+	for _, c := range cells {
+		if !left[c] {
+			return fmt.Errorf("%v does not own cell %v", bees[0], c)
+		}
+	}
+
+	if err := q.handOffCells(bees[0], bees[1], cells); err != nil {
+		return err
+	}
+	glog.V(2).Infof("%v moved %v from %v to %v", q, cells, bees[0], bees[1])
+	return nil
+}
+
+// handOffCells assigns cells of local bee b to local bee to, and hands off
+// their state once b has handled the messages routed to it so far. The state
+// is handed off before the ownership of the cells is published, so that to
+// never receives a message of the cells before their state. If the ownership
+// cannot be published, the cells and their state are handed back to b.
+func (q *qee) handOffCells(b, to *bee, cells MappedCells) error {
+	if _, err := to.processCmd(cmdAddMappedCells{Cells: cells}); err != nil {
+		return err
+	}
+	if err := b.splitOff(cells, to.ID()); err != nil {
+		return err
+	}
+
+	t := transferCells{From: b.colony(), To: to.colony(), Cells: cells}
+	_, err := q.hive.proposeRetryAmongHives(t,
+		q.hive.config.RaftElectTimeout(), -1)
+	if err == nil {
+		return nil
+	}
+
+	glog.Errorf("%v cannot transfer %v from %v to %v: %v", q, cells, b, to, err)
+	if _, aerr := b.processCmd(cmdAddMappedCells{Cells: cells}); aerr != nil {
+		glog.Errorf("%v cannot hand %v back to %v: %v", q, cells, b, aerr)
+		return err
+	}
+	if herr := to.splitOff(cells, b.ID()); herr != nil {
+		glog.Errorf("%v cannot hand %v back to %v: %v", q, cells, b, herr)
+	}
+	return err
+}
+
+// splitOff enqueues a split of cells to bee to, and waits until the bee hands
+// off their state.
+func (b *bee) splitOff(cells MappedCells, to uint64) error {
+	ch := make(chan error, 1)
+	b.dataCh.in() <- msgAndHandler{
+		msg: &msg{
+			MsgData: cellSplit{cells: cells, to: to, ch: ch},
+			MsgTo:   b.ID(),
+		},
+	}
+	return <-ch
+}
+
+// takeSplits moves the splits in the batch to splits.
+func takeSplits(batch, splits []msgAndHandler) ([]msgAndHandler,
+	[]msgAndHandler) {
+
+	res := batch[:0]
+	for _, mh := range batch {
+		if _, ok := mh.msg.MsgData.(cellSplit); ok {
+			splits = append(splits, mh)
+			continue
+		}
+		res = append(res, mh)
+	}
+	return res, splits
+}
+
+// splitCells hands off the state of the cells of the splits to their new bees,
+// and returns the emptied splits.
+func (b *bee) splitCells(splits []msgAndHandler) []msgAndHandler {
+	for _, mh := range splits {
+		s := mh.msg.MsgData.(cellSplit)
+		s.ch <- b.moveCells(s.cells, s.to)
+	}
+	return splits[:0]
+}
+
+// moveCells moves the state of the cells to the bee to.
+func (b *bee) moveCells(cells MappedCells, to uint64) error {
+	var ops []state.Op
+	for _, c := range cells {
+		if v, err := b.stateL1.Dict(c.Dict).Get(c.Key); err == nil {
+			ops = append(ops, state.Op{T: state.Put, D: c.Dict, K: c.Key, V: v})
+		}
+	}
+	if len(ops) != 0 {
+		if _, err := b.qee.sendCmdToBee(to, cmdApplyOps{Ops: ops}); err != nil {
+			return err
+		}
+	}
+	for _, o := range ops {
+		b.stateL1.Dict(o.D).Del(o.K)
+	}
+
+	b.Lock()
+	for _, c := range cells {
+		delete(b.cells, c)
+	}
+	b.Unlock()
+	return nil
+}
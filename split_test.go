@@ -0,0 +1,119 @@
+package beehive
+
+import "testing"
+
+type splitTestMsg string
+
+type splitTestRcv struct {
+	bee uint64
+	cnt int
+}
+
+// registerSplitApp registers an app that counts the characters of the
+// messages in dictionary S, and sends the count of the last character to ch.
+func registerSplitApp(h Hive, name string, ch chan splitTestRcv) {
+	a := h.NewApp(name)
+	a.HandleFunc(splitTestMsg(""), func(msg Msg, ctx MapContext) MappedCells {
+		var cells MappedCells
+		for _, k := range msg.Data().(splitTestMsg) {
+			cells = append(cells, CellKey{Dict: "S", Key: string(k)})
+		}
+		return cells
+	}, func(msg Msg, ctx RcvContext) error {
+		d := ctx.Dict("S")
+		cnt := 0
+		for _, k := range msg.Data().(splitTestMsg) {
+			n := 0
+			if v, err := d.Get(string(k)); err == nil {
+				n = v.(int)
+			}
+			n++
+			d.Put(string(k), n)
+			cnt = n
+		}
+		ch <- splitTestRcv{bee: ctx.ID(), cnt: cnt}
+		return nil
+	})
+}
+
+func TestSplit(t *testing.T) {
+	ch := make(chan splitTestRcv)
+	h := newHiveForTest()
+	registerSplitApp(h, "split", ch)
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(splitTestMsg("abc"))
+	first := <-ch
+
+	q := h.(*hive).apps["split"].qee
+	res, err := q.processCmd(cmdSplit{
+		Bee:   first.bee,
+		Cells: []MappedCells{{{Dict: "S", Key: "c"}}},
+	})
+	if err != nil {
+		t.Fatalf("cannot split the bee: %v", err)
+	}
+	newbs := res.([]uint64)
+	if len(newbs) != 1 {
+		t.Fatalf("invalid new bees: %v", newbs)
+	}
+
+	h.Emit(splitTestMsg("c"))
+	if r := <-ch; r.bee != newbs[0] || r.cnt != 2 {
+		t.Errorf("invalid split cell: actual=%v want=%v with 2", r, newbs[0])
+	}
+	h.Emit(splitTestMsg("a"))
+	if r := <-ch; r.bee != first.bee || r.cnt != 2 {
+		t.Errorf("invalid remaining cell: actual=%v want=%v with 2", r,
+			first.bee)
+	}
+
+	if _, err := q.processCmd(cmdSplit{
+		Bee:   first.bee,
+		Cells: []MappedCells{{{Dict: "S", Key: "a"}, {Dict: "S", Key: "b"}}},
+	}); err == nil {
+		t.Error("all the cells of a bee are split")
+	}
+}
+
+func TestMoveCells(t *testing.T) {
+	ch := make(chan splitTestRcv)
+	h := newHiveForTest()
+	registerSplitApp(h, "move", ch)
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(splitTestMsg("ab"))
+	from := (<-ch).bee
+	h.Emit(splitTestMsg("c"))
+	to := (<-ch).bee
+	if from == to {
+		t.Fatalf("cells are mapped to the same bee %v", from)
+	}
+
+	q := h.(*hive).apps["move"].qee
+	b := CellKey{Dict: "S", Key: "b"}
+	if _, err := q.processCmd(cmdMoveCells{From: from, To: to,
+		Cells: MappedCells{b}}); err != nil {
+
+		t.Fatalf("cannot move the cell: %v", err)
+	}
+
+	h.Emit(splitTestMsg("b"))
+	if r := <-ch; r.bee != to || r.cnt != 2 {
+		t.Errorf("invalid moved cell: actual=%v want=%v with 2", r, to)
+	}
+	h.Emit(splitTestMsg("a"))
+	if r := <-ch; r.bee != from || r.cnt != 2 {
+		t.Errorf("invalid remaining cell: actual=%v want=%v with 2", r, from)
+	}
+
+	if _, err := q.processCmd(cmdMoveCells{From: from, To: to,
+		Cells: MappedCells{b}}); err == nil {
+
+		t.Error("a cell is moved from a bee that does not own it")
+	}
+}
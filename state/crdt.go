@@ -0,0 +1,210 @@
+package state
+
+import (
+	"encoding/gob"
+	"fmt"
+)
+
+// Mergeable is implemented by values that are merged with the existing value
+// of a key, instead of overwriting it, when diverged replicas are reconciled
+// (see Transactional.Reconcile). Replicated transactions are always applied
+// as they were committed.
+//
+// Merge must be commutative, associative and idempotent.
+type Mergeable interface {
+	// Merge returns the result of merging the value with v. If v is not of the
+	// same type, Merge returns the value itself.
+	Merge(v interface{}) interface{}
+}
+
+// Counter is a replicated counter (PN-Counter) that can be incremented and
+// decremented on multiple replicas and merged without losing updates. Counter
+// is immutable: Add returns a new Counter.
+//
+// Replicas are identified by strings and each replica must only update its
+// own entry. A good replica ID is the ID of the bee updating the counter.
+type Counter struct {
+	P map[string]int64 // Increments of each replica.
+	N map[string]int64 // Decrements of each replica.
+}
+
+// Value returns the value of the counter.
+func (c Counter) Value() (v int64) {
+	for _, p := range c.P {
+		v += p
+	}
+	for _, n := range c.N {
+		v -= n
+	}
+	return
+}
+
+// Add adds d to the counter on behalf of replica, and returns the new counter.
+func (c Counter) Add(replica string, d int64) Counter {
+	res := Counter{P: copyCounts(c.P), N: copyCounts(c.N)}
+	if d >= 0 {
+		res.P[replica] += d
+	} else {
+		res.N[replica] -= d
+	}
+	return res
+}
+
+func (c Counter) Merge(v interface{}) interface{} {
+	o, ok := v.(Counter)
+	if !ok {
+		return c
+	}
+
+	return Counter{P: maxCounts(c.P, o.P), N: maxCounts(c.N, o.N)}
+}
+
+func (c Counter) String() string {
+	return fmt.Sprintf("%d", c.Value())
+}
+
+func copyCounts(m map[string]int64) map[string]int64 {
+	c := make(map[string]int64, len(m))
+	for r, n := range m {
+		c[r] = n
+	}
+	return c
+}
+
+func maxCounts(m1, m2 map[string]int64) map[string]int64 {
+	m := copyCounts(m1)
+	for r, n := range m2 {
+		if m[r] < n {
+			m[r] = n
+		}
+	}
+	return m
+}
+
+// Set is a replicated set of strings (an observed-remove set) that can be
+// updated on multiple replicas and merged without losing updates. When an
+// element is concurrently added and removed, the add wins. Set is immutable:
+// Add and Remove return a new Set.
+//
+// Similar to Counter, each replica must use a unique ID.
+type Set struct {
+	Elems map[string]map[string]bool // The live tags of each element.
+	Tombs map[string]bool            // The removed tags.
+	Seqs  map[string]uint64          // The last tag sequence of replicas.
+}
+
+// Contains returns whether e is in the set.
+func (s Set) Contains(e string) bool {
+	return len(s.Elems[e]) != 0
+}
+
+// Elements returns the elements of the set.
+func (s Set) Elements() []string {
+	elems := make([]string, 0, len(s.Elems))
+	for e := range s.Elems {
+		elems = append(elems, e)
+	}
+	return elems
+}
+
+// Len returns the number of elements in the set.
+func (s Set) Len() int {
+	return len(s.Elems)
+}
+
+// Add adds e to the set on behalf of replica, and returns the new set.
+func (s Set) Add(replica string, e string) Set {
+	res := s.clone()
+	res.Seqs[replica]++
+	tag := fmt.Sprintf("%s/%d", replica, res.Seqs[replica])
+	tags := make(map[string]bool, len(s.Elems[e])+1)
+	for t := range s.Elems[e] {
+		tags[t] = true
+	}
+	tags[tag] = true
+	res.Elems[e] = tags
+	return res
+}
+
+// Remove removes e from the set, and returns the new set.
+func (s Set) Remove(e string) Set {
+	if !s.Contains(e) {
+		return s
+	}
+
+	res := s.clone()
+	for t := range s.Elems[e] {
+		res.Tombs[t] = true
+	}
+	delete(res.Elems, e)
+	return res
+}
+
+func (s Set) Merge(v interface{}) interface{} {
+	o, ok := v.(Set)
+	if !ok {
+		return s
+	}
+
+	res := s.clone()
+	for t := range o.Tombs {
+		res.Tombs[t] = true
+	}
+	for r, q := range o.Seqs {
+		if res.Seqs[r] < q {
+			res.Seqs[r] = q
+		}
+	}
+	for e, tags := range o.Elems {
+		merged := make(map[string]bool, len(tags)+len(res.Elems[e]))
+		for t := range res.Elems[e] {
+			merged[t] = true
+		}
+		for t := range tags {
+			merged[t] = true
+		}
+		res.Elems[e] = merged
+	}
+	for e, tags := range res.Elems {
+		live := make(map[string]bool, len(tags))
+		for t := range tags {
+			if !res.Tombs[t] {
+				live[t] = true
+			}
+		}
+		if len(live) == 0 {
+			delete(res.Elems, e)
+			continue
+		}
+		res.Elems[e] = live
+	}
+	return res
+}
+
+func (s Set) clone() Set {
+	res := Set{
+		Elems: make(map[string]map[string]bool, len(s.Elems)),
+		Tombs: make(map[string]bool, len(s.Tombs)),
+		Seqs:  make(map[string]uint64, len(s.Seqs)),
+	}
+	// Tag sets are copied on write, so they can be shared.
+	for e, tags := range s.Elems {
+		res.Elems[e] = tags
+	}
+	for t := range s.Tombs {
+		res.Tombs[t] = true
+	}
+	for r, q := range s.Seqs {
+		res.Seqs[r] = q
+	}
+	return res
+}
+
+func (s Set) String() string {
+	return fmt.Sprintf("%v", s.Elements())
+}
+
+func init() {
+	gob.Register(Counter{})
+	gob.Register(Set{})
+}
@@ -0,0 +1,91 @@
+package state
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func TestCounterMerge(t *testing.T) {
+	var c Counter
+	c1 := c.Add("1", 3)
+	c2 := c1.Add("2", 2).Add("2", -1)
+	c1 = c1.Add("1", 1)
+
+	m := c1.Merge(c2).(Counter)
+	if v := m.Value(); v != 5 {
+		t.Errorf("invalid merged counter: actual=%v want=5", v)
+	}
+	if m2 := c2.Merge(c1).(Counter); m2.Value() != m.Value() {
+		t.Errorf("merge is not commutative: %v != %v", m2, m)
+	}
+	if m3 := m.Merge(c1).(Counter); m3.Value() != m.Value() {
+		t.Errorf("merge is not idempotent: %v != %v", m3, m)
+	}
+}
+
+func TestSetMerge(t *testing.T) {
+	var s Set
+	s = s.Add("1", "a").Add("1", "b")
+
+	s1 := s.Remove("a")
+	s2 := s.Add("2", "a").Add("2", "c").Remove("b")
+
+	m := s1.Merge(s2).(Set)
+	for e, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if m.Contains(e) != want {
+			t.Errorf("invalid membership for %v: actual=%v want=%v", e,
+				m.Contains(e), want)
+		}
+	}
+	if m.Len() != s2.Merge(s1).(Set).Len() {
+		t.Errorf("merge is not commutative")
+	}
+	if s.Contains("b") == false {
+		t.Errorf("merge modified the original set")
+	}
+}
+
+func TestApplyMergeable(t *testing.T) {
+	var c Counter
+	tx := NewTransactional(NewInMem())
+	tx.Dict("d").Put("k", c.Add("1", 2))
+	ops := []Op{{T: Put, D: "d", K: "k", V: c.Add("2", 3)}}
+	if err := tx.Apply(ops); err != nil {
+		t.Fatalf("cannot apply ops: %v", err)
+	}
+	v, _ := tx.Dict("d").Get("k")
+	if n := v.(Counter).Value(); n != 3 {
+		t.Errorf("invalid counter after apply: actual=%v want=3", n)
+	}
+}
+
+func TestReconcileMergeable(t *testing.T) {
+	var c Counter
+	tx := NewTransactional(NewInMem())
+	tx.Dict("d").Put("k", c.Add("1", 2))
+	ops := []Op{{T: Put, D: "d", K: "k", V: c.Add("2", 3)}}
+	if err := tx.Reconcile(ops); err != nil {
+		t.Fatalf("cannot reconcile ops: %v", err)
+	}
+	v, _ := tx.Dict("d").Get("k")
+	if n := v.(Counter).Value(); n != 5 {
+		t.Errorf("invalid counter after reconcile: actual=%v want=5", n)
+	}
+}
+
+func TestCRDTGob(t *testing.T) {
+	var s Set
+	var v interface{} = s.Add("1", "a")
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+		t.Fatalf("cannot encode set: %v", err)
+	}
+	var d interface{}
+	if err := gob.NewDecoder(&buf).Decode(&d); err != nil {
+		t.Fatalf("cannot decode set: %v", err)
+	}
+	if !d.(Set).Contains("a") {
+		t.Errorf("invalid decoded set: %v", d)
+	}
+}
@@ -0,0 +1,165 @@
+package state
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// DictDigest returns a hash of the entries of the dictionary that does not
+// depend on the order of entries. Values are hashed using their canonical
+// encoding (see writeCanonical): dictionaries with the same keys and equal
+// values have the same digest.
+func DictDigest(d Dict) uint64 {
+	var keys []string
+	vals := make(map[string]interface{})
+	d.ForEach(func(k string, v interface{}) bool {
+		keys = append(keys, k)
+		vals[k] = v
+		return true
+	})
+	sort.Strings(keys)
+
+	h := fnv.New64a()
+	for _, k := range keys {
+		writeString(h, k)
+		h.Write(canonical(vals[k]))
+	}
+	return h.Sum64()
+}
+
+// canonical returns the canonical encoding of v.
+func canonical(v interface{}) []byte {
+	var buf bytes.Buffer
+	writeCanonical(&buf, reflect.ValueOf(&v).Elem())
+	return buf.Bytes()
+}
+
+// writeCanonical writes an encoding of v to w that is equal for equal values.
+// Unlike gob, entries of maps are written in the order of their encoded keys,
+// and the dynamic types of interfaces are written along with their values.
+// Pointers are followed, and v must not be cyclic.
+func writeCanonical(w io.Writer, v reflect.Value) {
+	var n [8]byte
+	writeUint := func(u uint64) {
+		binary.BigEndian.PutUint64(n[:], u)
+		w.Write(n[:])
+	}
+
+	switch v.Kind() {
+	case reflect.Invalid:
+		w.Write([]byte{0})
+	case reflect.Bool:
+		if v.Bool() {
+			w.Write([]byte{1})
+		} else {
+			w.Write([]byte{0})
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeUint(uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		writeUint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		writeUint(math.Float64bits(v.Float()))
+	case reflect.Complex64, reflect.Complex128:
+		writeUint(math.Float64bits(real(v.Complex())))
+		writeUint(math.Float64bits(imag(v.Complex())))
+	case reflect.String:
+		writeString(w, v.String())
+	case reflect.Slice, reflect.Array:
+		writeUint(uint64(v.Len()))
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			w.Write(v.Bytes())
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			writeCanonical(w, v.Index(i))
+		}
+	case reflect.Map:
+		entries := make([][]byte, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			var buf bytes.Buffer
+			writeCanonical(&buf, k)
+			writeCanonical(&buf, v.MapIndex(k))
+			entries = append(entries, buf.Bytes())
+		}
+		sort.Sort(byteSlices(entries))
+		writeUint(uint64(len(entries)))
+		for _, e := range entries {
+			w.Write(e)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			writeCanonical(w, v.Field(i))
+		}
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			w.Write([]byte{0})
+			return
+		}
+		w.Write([]byte{1})
+		if v.Kind() == reflect.Interface {
+			writeString(w, v.Elem().Type().String())
+		}
+		writeCanonical(w, v.Elem())
+	default:
+		// Channels and functions are only identified by their types.
+		writeString(w, v.Type().String())
+	}
+}
+
+type byteSlices [][]byte
+
+func (s byteSlices) Len() int           { return len(s) }
+func (s byteSlices) Less(i, j int) bool { return bytes.Compare(s[i], s[j]) < 0 }
+func (s byteSlices) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func writeString(w io.Writer, s string) {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(len(s)))
+	w.Write(n[:])
+	io.WriteString(w, s)
+}
+
+// Digest returns the digest of each non-empty dictionary in the state.
+func Digest(s State) map[string]uint64 {
+	digests := make(map[string]uint64)
+	for _, d := range s.Dicts() {
+		empty := true
+		d.ForEach(func(k string, v interface{}) bool {
+			empty = false
+			return false
+		})
+		if empty {
+			continue
+		}
+		digests[d.Name()] = DictDigest(d)
+	}
+	return digests
+}
+
+// DiffDict returns the operations that make dictionary "to" equal to "from".
+func DiffDict(from, to Dict) []Op {
+	var ops []Op
+	to.ForEach(func(k string, v interface{}) bool {
+		if _, err := from.Get(k); err == ErrNoSuchKey {
+			ops = append(ops, Op{T: Del, D: to.Name(), K: k})
+		}
+		return true
+	})
+	from.ForEach(func(k string, v interface{}) bool {
+		if tv, err := to.Get(k); err == nil &&
+			bytes.Equal(canonical(tv), canonical(v)) {
+
+			return true
+		}
+		ops = append(ops, Op{T: Put, D: to.Name(), K: k, V: v})
+		return true
+	})
+	return ops
+}
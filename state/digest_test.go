@@ -0,0 +1,73 @@
+package state
+
+import "testing"
+
+func TestDigest(t *testing.T) {
+	s1 := NewInMem()
+	s2 := NewInMem()
+	for i, k := range []string{"a", "b", "c"} {
+		s1.Dict("D").Put(k, i)
+	}
+	for i, k := range []string{"c", "b", "a"} {
+		s2.Dict("D").Put(k, 2-i)
+	}
+	s2.Dict("E")
+
+	d1 := Digest(s1)
+	d2 := Digest(s2)
+	if len(d2) != 1 || d1["D"] != d2["D"] {
+		t.Errorf("digests of equal states are different: %v != %v", d1, d2)
+	}
+
+	s2.Dict("D").Put("b", 3)
+	s2.Dict("D").Put("d", 4)
+	s2.Dict("D").Del("c")
+	if DictDigest(s1.Dict("D")) == DictDigest(s2.Dict("D")) {
+		t.Error("digests of different dictionaries are equal")
+	}
+
+	ops := DiffDict(s1.Dict("D"), s2.Dict("D"))
+	if len(ops) != 3 {
+		t.Errorf("invalid number of ops: actual=%v want=3", len(ops))
+	}
+	for _, op := range ops {
+		if err := applyTestOp(s2, op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if DictDigest(s1.Dict("D")) != DictDigest(s2.Dict("D")) {
+		t.Error("dictionaries are different after applying the diff")
+	}
+}
+
+func applyTestOp(s State, op Op) error {
+	if op.T == Del {
+		return s.Dict(op.D).Del(op.K)
+	}
+	return s.Dict(op.D).Put(op.K, op.V)
+}
+
+func TestDigestMaps(t *testing.T) {
+	s1 := NewInMem()
+	s2 := NewInMem()
+	m1 := make(map[string]int)
+	m2 := make(map[string]int)
+	for i := 0; i < 64; i++ {
+		m1[string(rune('a'+i))] = i
+		m2[string(rune('a'+63-i))] = 63 - i
+	}
+	s1.Dict("D").Put("k", m1)
+	s2.Dict("D").Put("k", m2)
+	if DictDigest(s1.Dict("D")) != DictDigest(s2.Dict("D")) {
+		t.Error("digests of equal maps are different")
+	}
+	if ops := DiffDict(s1.Dict("D"), s2.Dict("D")); len(ops) != 0 {
+		t.Errorf("invalid number of ops: actual=%v want=0", len(ops))
+	}
+
+	s2.Dict("D").Put("k", int64(1))
+	s1.Dict("D").Put("k", 1)
+	if DictDigest(s1.Dict("D")) == DictDigest(s2.Dict("D")) {
+		t.Error("digests of values of different types are equal")
+	}
+}
@@ -3,11 +3,18 @@ package state
 import (
 	"bytes"
 	"encoding/gob"
+	"unsafe"
 )
 
+// inMemEntrySize is the approximate size of an entry in the map of a dict.
+const inMemEntrySize = int(unsafe.Sizeof("")) +
+	int(unsafe.Sizeof(interface{}(nil))) + 1
+
 // InMem is a simple dictionary that uses in memory maps.
 type InMem struct {
 	InMemDicts map[string]*inMemDict
+
+	tracking bool
 }
 
 // NewInMem creates a new InMem state.
@@ -51,14 +58,99 @@ func (s *InMem) inMemDict(name string) *inMemDict {
 			DictName: name,
 			Dict:     make(map[string]interface{}),
 		}
+		if s.tracking {
+			d.dirty = make(map[string]struct{})
+		}
 		s.InMemDicts[name] = d
 	}
 	return d
 }
 
+func (s *InMem) Snapshot() State {
+	snap := NewInMem()
+	for n, d := range s.InMemDicts {
+		d.shared = true
+		d.dirty = make(map[string]struct{})
+		snap.InMemDicts[n] = &inMemDict{
+			DictName: n,
+			Dict:     d.Dict,
+		}
+	}
+	s.tracking = true
+	return snap
+}
+
+func (s *InMem) Changes() []Op {
+	var ops []Op
+	for n, d := range s.InMemDicts {
+		for k := range d.dirty {
+			if v, ok := d.Dict[k]; ok {
+				ops = append(ops, Op{T: Put, D: n, K: k, V: v})
+			} else {
+				ops = append(ops, Op{T: Del, D: n, K: k})
+			}
+		}
+		d.dirty = nil
+		d.shared = false
+	}
+	s.tracking = false
+	return ops
+}
+
+func (s *InMem) Garbage() (n int) {
+	for _, d := range s.InMemDicts {
+		n += d.garbage
+	}
+	return
+}
+
+func (s *InMem) Compact() (reclaimed int) {
+	for _, d := range s.InMemDicts {
+		if d.garbage == 0 {
+			continue
+		}
+		// Go maps never shrink. The only way to release the buckets of deleted
+		// keys is to copy the live entries into a new map.
+		m := make(map[string]interface{}, len(d.Dict))
+		for k, v := range d.Dict {
+			m[k] = v
+		}
+		d.Dict = m
+		d.shared = false
+		reclaimed += d.garbage * inMemEntrySize
+		d.garbage = 0
+	}
+	return
+}
+
 type inMemDict struct {
 	DictName string
 	Dict     map[string]interface{}
+
+	// shared is true when Dict is shared with a snapshot and must be copied
+	// before any modification.
+	shared bool
+	// dirty is the set of keys modified since the last snapshot.
+	dirty map[string]struct{}
+	// garbage is the number of keys deleted since the last compaction.
+	garbage int
+}
+
+func (d *inMemDict) modify(k string) {
+	if d.dirty != nil {
+		d.dirty[k] = struct{}{}
+	}
+
+	if !d.shared {
+		return
+	}
+
+	m := make(map[string]interface{}, len(d.Dict))
+	for dk, dv := range d.Dict {
+		m[dk] = dv
+	}
+	d.Dict = m
+	d.shared = false
 }
 
 func (d inMemDict) Name() string {
@@ -74,6 +166,7 @@ func (d *inMemDict) Get(k string) (interface{}, error) {
 }
 
 func (d *inMemDict) Put(k string, v interface{}) error {
+	d.modify(k)
 	d.Dict[k] = v
 	return nil
 }
@@ -83,7 +176,9 @@ func (d *inMemDict) Del(k string) error {
 		return ErrNoSuchKey
 	}
 
+	d.modify(k)
 	delete(d.Dict, k)
+	d.garbage++
 	return nil
 }
 
@@ -1,6 +1,9 @@
 package state
 
-import "testing"
+import (
+	"strconv"
+	"testing"
+)
 
 func testInMemTx(t *testing.T, abort bool) {
 	state := NewTransactional(NewInMem())
@@ -171,3 +174,89 @@ func TestInMemNoTx(t *testing.T) {
 		t.Error("value fount for deleted key")
 	}
 }
+
+func TestInMemSnapshot(t *testing.T) {
+	inm := NewInMem()
+	inm.Dict("d").Put("k1", "v1")
+	inm.Dict("d").Put("k2", "v2")
+
+	snap := inm.Snapshot()
+	inm.Dict("d").Put("k1", "v1'")
+	inm.Dict("d").Del("k2")
+	inm.Dict("d2").Put("k", "v")
+
+	if v, _ := snap.Dict("d").Get("k1"); v.(string) != "v1" {
+		t.Errorf("snapshot is modified: actual=%v want=v1", v)
+	}
+	if _, err := snap.Dict("d").Get("k2"); err != nil {
+		t.Error("deleted key is removed from the snapshot")
+	}
+
+	ops := inm.Changes()
+	if len(ops) != 3 {
+		t.Errorf("invalid number of changes: actual=%v want=3", len(ops))
+	}
+
+	dst := NewTransactional(NewInMem())
+	b, err := snap.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Apply(ops); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := dst.Dict("d").Get("k1"); v.(string) != "v1'" {
+		t.Errorf("invalid value after applying changes: actual=%v want=v1'", v)
+	}
+	if _, err := dst.Dict("d").Get("k2"); err == nil {
+		t.Error("deleted key is not removed after applying changes")
+	}
+	if _, err := dst.Dict("d2").Get("k"); err != nil {
+		t.Error("new dictionary is not created after applying changes")
+	}
+}
+
+func TestInMemCompact(t *testing.T) {
+	inm := NewInMem()
+	d := inm.Dict("d")
+	for i := 0; i < 100; i++ {
+		d.Put(strconv.Itoa(i), i)
+	}
+	for i := 0; i < 90; i++ {
+		d.Del(strconv.Itoa(i))
+	}
+
+	if g := inm.Garbage(); g != 90 {
+		t.Errorf("invalid garbage: actual=%v want=90", g)
+	}
+	if r := inm.Compact(); r != 90*inMemEntrySize {
+		t.Errorf("invalid reclaimed bytes: actual=%v want=%v", r, 90*inMemEntrySize)
+	}
+	if g := inm.Garbage(); g != 0 {
+		t.Errorf("invalid garbage after compaction: actual=%v want=0", g)
+	}
+	for i := 90; i < 100; i++ {
+		if v, err := d.Get(strconv.Itoa(i)); err != nil || v.(int) != i {
+			t.Errorf("invalid value after compaction: actual=%v want=%v", v, i)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	inm := NewInMem()
+	inm.Dict("d").Put("k", 1)
+
+	ro := ReadOnly(inm)
+	if v, err := ro.Dict("d").Get("k"); err != nil || v.(int) != 1 {
+		t.Errorf("invalid value in read-only view: actual=%v want=1", v)
+	}
+	if err := ro.Dict("d").Put("k", 2); err != ErrReadOnly {
+		t.Errorf("read-only view accepts puts: %v", err)
+	}
+	if err := ro.Dicts()[0].Del("k"); err != ErrReadOnly {
+		t.Errorf("read-only view accepts deletes: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package state
+
+import "errors"
+
+var (
+	ErrReadOnly error = errors.New("state: read-only state")
+)
+
+// ReadOnly returns a read-only view of s. Modifying the view or its
+// dictionaries returns ErrReadOnly.
+func ReadOnly(s State) State {
+	return readOnly{State: s}
+}
+
+type readOnly struct {
+	State
+}
+
+func (s readOnly) Dict(name string) Dict {
+	return readOnlyDict{Dict: s.State.Dict(name)}
+}
+
+func (s readOnly) Dicts() []Dict {
+	dicts := s.State.Dicts()
+	for i := range dicts {
+		dicts[i] = readOnlyDict{Dict: dicts[i]}
+	}
+	return dicts
+}
+
+func (s readOnly) Restore(b []byte) error {
+	return ErrReadOnly
+}
+
+type readOnlyDict struct {
+	Dict
+}
+
+func (d readOnlyDict) Put(k string, v interface{}) error {
+	return ErrReadOnly
+}
+
+func (d readOnlyDict) Del(k string) error {
+	return ErrReadOnly
+}
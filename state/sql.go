@@ -0,0 +1,437 @@
+package state
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// SQLDialect represents the flavor of SQL spoken by a database.
+type SQLDialect int
+
+// Supported SQL dialects.
+const (
+	MySQL SQLDialect = iota
+	Postgres
+)
+
+// arg returns the i'th (1-based) placeholder of a query.
+func (d SQLDialect) arg(i int) string {
+	if d == Postgres {
+		return "$" + strconv.Itoa(i)
+	}
+	return "?"
+}
+
+func (d SQLDialect) blob() string {
+	if d == Postgres {
+		return "BYTEA"
+	}
+	return "LONGBLOB"
+}
+
+// SQL is the state of a bee stored in a table of a SQL database, which makes
+// the state queryable by external tools. The states of all the bees of an
+// application can share a table: each entry is stored in a row of (bee, dict,
+// k, v, v_json), where bee is the ID of the bee owning the state, v is the gob
+// encoded value and v_json is its JSON encoding for reporting purposes.
+//
+// Reads are cached in memory, and writes are buffered until Flush is called.
+// Transactional flushes the state on each commit, so all the writes of a
+// transaction are stored in one database transaction.
+//
+// Note that the database is the source of truth: ForEach iterates over all the
+// entries of a dictionary of the bee in the table, not only the ones written
+// through this state.
+//
+// A detached state keeps its entries only in memory and does not write to the
+// database, which is used for the bees that are not the leaders of their
+// colonies.
+type SQL struct {
+	db       *sql.DB
+	dialect  SQLDialect
+	table    string
+	bee      uint64
+	dicts    map[string]*sqlDict
+	detached bool
+}
+
+// NewSQL creates a new SQL state that stores the dictionaries of bee in table.
+// The table must be created using CreateTable.
+func NewSQL(db *sql.DB, dialect SQLDialect, table string, bee uint64) *SQL {
+	return &SQL{
+		db:      db,
+		dialect: dialect,
+		table:   table,
+		bee:     bee,
+		dicts:   make(map[string]*sqlDict),
+	}
+}
+
+// CreateTable creates the table of the state if it does not exist.
+func (s *SQL) CreateTable() error {
+	q := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s ("+
+		"bee BIGINT NOT NULL, "+
+		"dict VARCHAR(255) NOT NULL, "+
+		"k VARCHAR(255) NOT NULL, "+
+		"v %s NOT NULL, "+
+		"v_json TEXT, "+
+		"PRIMARY KEY (bee, dict, k))", s.table, s.dialect.blob())
+	_, err := s.db.Exec(q)
+	return err
+}
+
+func (s *SQL) Dict(name string) Dict {
+	return s.sqlDict(name)
+}
+
+func (s *SQL) sqlDict(name string) *sqlDict {
+	d, ok := s.dicts[name]
+	if !ok {
+		d = s.newDict(name)
+		s.dicts[name] = d
+	}
+	return d
+}
+
+func (s *SQL) newDict(name string) *sqlDict {
+	return &sqlDict{
+		state:   s,
+		name:    name,
+		cache:   make(map[string]interface{}),
+		pending: make(map[string]Op),
+		loaded:  s.detached,
+	}
+}
+
+func (s *SQL) Dicts() []Dict {
+	if !s.detached {
+		s.loadDicts()
+	}
+
+	dicts := make([]Dict, 0, len(s.dicts))
+	for _, d := range s.dicts {
+		dicts = append(dicts, d)
+	}
+	return dicts
+}
+
+// loadDicts adds the dictionaries of the bee in the table to the state.
+func (s *SQL) loadDicts() {
+	q := fmt.Sprintf("SELECT DISTINCT dict FROM %s WHERE bee = %s", s.table,
+		s.dialect.arg(1))
+	rows, err := s.db.Query(q, int64(s.bee))
+	if err != nil {
+		glog.Errorf("cannot list dictionaries in %s: %v", s.table, err)
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			var n string
+			if err := rows.Scan(&n); err != nil {
+				glog.Errorf("cannot list dictionaries in %s: %v", s.table, err)
+				break
+			}
+			s.sqlDict(n)
+		}
+	}
+}
+
+// Save saves the state in the same format as InMem.
+func (s *SQL) Save() ([]byte, error) {
+	inm := NewInMem()
+	for _, d := range s.Dicts() {
+		imd := inm.Dict(d.Name())
+		d.ForEach(func(k string, v interface{}) bool {
+			imd.Put(k, v)
+			return true
+		})
+	}
+	return inm.Save()
+}
+
+// Restore replaces the state with the output of InMem.Save or SQL.Save. The
+// rows of the bee are replaced in one database transaction.
+func (s *SQL) Restore(b []byte) error {
+	inm := NewInMem()
+	if err := inm.Restore(b); err != nil {
+		return err
+	}
+
+	dicts := make(map[string]*sqlDict)
+	for n, imd := range inm.InMemDicts {
+		d := s.newDict(n)
+		d.loaded = true
+		for k, v := range imd.Dict {
+			d.Put(k, v)
+		}
+		dicts[n] = d
+	}
+	if err := s.write(dicts, true); err != nil {
+		return err
+	}
+	s.dicts = dicts
+	return nil
+}
+
+// Flush stores the buffered writes in the database in one transaction. If
+// there is an error, the writes are kept and retried on the next flush.
+func (s *SQL) Flush() error {
+	return s.write(s.dicts, false)
+}
+
+// Detach loads all the entries of the bee in memory and deletes its rows from
+// the database. The state is not written to the database until it is attached
+// again.
+func (s *SQL) Detach() error {
+	if s.detached {
+		return nil
+	}
+
+	for _, d := range s.Dicts() {
+		if err := d.(*sqlDict).load(); err != nil {
+			return err
+		}
+	}
+
+	s.detached = true
+	for _, d := range s.dicts {
+		d.pending = make(map[string]Op)
+	}
+	q := fmt.Sprintf("DELETE FROM %s WHERE bee = %s", s.table, s.dialect.arg(1))
+	_, err := s.db.Exec(q, int64(s.bee))
+	return err
+}
+
+// Attach replaces the rows of the bee in the database with the entries of the
+// detached state, and resumes writing to the database.
+func (s *SQL) Attach() error {
+	if !s.detached {
+		return nil
+	}
+
+	for _, d := range s.dicts {
+		for k, v := range d.cache {
+			d.pending[k] = Op{T: Put, D: d.name, K: k, V: v}
+		}
+	}
+	s.detached = false
+	if err := s.write(s.dicts, true); err != nil {
+		s.detached = true
+		return err
+	}
+	return nil
+}
+
+// write stores the pending writes of dicts in the database in one
+// transaction. If replace is true, all the other rows of the bee are deleted
+// in the same transaction.
+func (s *SQL) write(dicts map[string]*sqlDict, replace bool) error {
+	if s.detached {
+		for _, d := range dicts {
+			d.pending = make(map[string]Op)
+		}
+		return nil
+	}
+
+	n := 0
+	for _, d := range dicts {
+		n += len(d.pending)
+	}
+	if n == 0 && !replace {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if replace {
+		q := fmt.Sprintf("DELETE FROM %s WHERE bee = %s", s.table,
+			s.dialect.arg(1))
+		if _, err = tx.Exec(q, int64(s.bee)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	del := fmt.Sprintf("DELETE FROM %s WHERE bee = %s AND dict = %s AND k = %s",
+		s.table, s.dialect.arg(1), s.dialect.arg(2), s.dialect.arg(3))
+	ins := fmt.Sprintf("INSERT INTO %s (bee, dict, k, v, v_json) VALUES "+
+		"(%s, %s, %s, %s, %s)", s.table, s.dialect.arg(1), s.dialect.arg(2),
+		s.dialect.arg(3), s.dialect.arg(4), s.dialect.arg(5))
+	for _, d := range dicts {
+		for k, op := range d.pending {
+			// When replacing, the rows of the bee are already deleted.
+			if !replace {
+				if _, err = tx.Exec(del, int64(s.bee), d.name, k); err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+
+			if op.T != Put {
+				continue
+			}
+
+			var v []byte
+			if v, err = encodeSQLValue(op.V); err != nil {
+				tx.Rollback()
+				return err
+			}
+
+			var j sql.NullString
+			if b, err := json.Marshal(op.V); err == nil {
+				j = sql.NullString{String: string(b), Valid: true}
+			}
+
+			if _, err = tx.Exec(ins, int64(s.bee), d.name, k, v, j); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, d := range dicts {
+		d.pending = make(map[string]Op)
+	}
+	return nil
+}
+
+func encodeSQLValue(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeSQLValue(b []byte) (v interface{}, err error) {
+	err = gob.NewDecoder(bytes.NewBuffer(b)).Decode(&v)
+	return
+}
+
+type sqlDict struct {
+	state *SQL
+	name  string
+
+	// cache has the entries read from or written to the database.
+	cache map[string]interface{}
+	// pending has the writes that are not flushed yet.
+	pending map[string]Op
+	// loaded is true when all the entries of the dict are in cache.
+	loaded bool
+}
+
+func (d *sqlDict) Name() string {
+	return d.name
+}
+
+func (d *sqlDict) Get(k string) (interface{}, error) {
+	if op, ok := d.pending[k]; ok && op.T == Del {
+		return nil, ErrNoSuchKey
+	}
+
+	if v, ok := d.cache[k]; ok {
+		return v, nil
+	}
+
+	if d.loaded {
+		return nil, ErrNoSuchKey
+	}
+
+	s := d.state
+	q := fmt.Sprintf("SELECT v FROM %s WHERE bee = %s AND dict = %s AND k = %s",
+		s.table, s.dialect.arg(1), s.dialect.arg(2), s.dialect.arg(3))
+	var b []byte
+	switch err := s.db.QueryRow(q, int64(s.bee), d.name, k).Scan(&b); {
+	case err == sql.ErrNoRows:
+		return nil, ErrNoSuchKey
+	case err != nil:
+		return nil, err
+	}
+
+	v, err := decodeSQLValue(b)
+	if err != nil {
+		return nil, err
+	}
+	d.cache[k] = v
+	return v, nil
+}
+
+func (d *sqlDict) Put(k string, v interface{}) error {
+	d.cache[k] = v
+	d.pending[k] = Op{T: Put, D: d.name, K: k, V: v}
+	return nil
+}
+
+func (d *sqlDict) Del(k string) error {
+	if _, err := d.Get(k); err != nil {
+		return err
+	}
+
+	delete(d.cache, k)
+	d.pending[k] = Op{T: Del, D: d.name, K: k}
+	return nil
+}
+
+func (d *sqlDict) ForEach(f IterFn) {
+	if err := d.load(); err != nil {
+		glog.Errorf("cannot load dictionary %s from %s: %v", d.name, d.state.table,
+			err)
+		return
+	}
+
+	for k, v := range d.cache {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+// load reads all the entries of the dictionary into the cache.
+func (d *sqlDict) load() error {
+	if d.loaded {
+		return nil
+	}
+
+	s := d.state
+	q := fmt.Sprintf("SELECT k, v FROM %s WHERE bee = %s AND dict = %s", s.table,
+		s.dialect.arg(1), s.dialect.arg(2))
+	rows, err := s.db.Query(q, int64(s.bee), d.name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var k string
+		var b []byte
+		if err := rows.Scan(&k, &b); err != nil {
+			return err
+		}
+		if _, ok := d.pending[k]; ok {
+			continue
+		}
+		v, err := decodeSQLValue(b)
+		if err != nil {
+			return err
+		}
+		d.cache[k] = v
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	d.loaded = true
+	return nil
+}
@@ -0,0 +1,386 @@
+package state
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSQLDialectArg(t *testing.T) {
+	if a := MySQL.arg(2); a != "?" {
+		t.Errorf("invalid mysql placeholder: actual=%v want=?", a)
+	}
+	if a := Postgres.arg(2); a != "$2" {
+		t.Errorf("invalid postgres placeholder: actual=%v want=$2", a)
+	}
+}
+
+func TestSQLValueCodec(t *testing.T) {
+	for _, v := range []interface{}{1, "v", []byte("b")} {
+		b, err := encodeSQLValue(v)
+		if err != nil {
+			t.Fatalf("cannot encode %v: %v", v, err)
+		}
+		d, err := decodeSQLValue(b)
+		if err != nil {
+			t.Fatalf("cannot decode %v: %v", v, err)
+		}
+		if s, ok := v.([]byte); ok {
+			if string(d.([]byte)) != string(s) {
+				t.Errorf("invalid value: actual=%v want=%v", d, v)
+			}
+			continue
+		}
+		if d != v {
+			t.Errorf("invalid value: actual=%v want=%v", d, v)
+		}
+	}
+}
+
+// fakeSQL is a database/sql driver that keeps the rows of the SQL state in
+// memory. It only understands the queries issued by SQL.
+type fakeSQL struct {
+	sync.Mutex
+	created    bool
+	failCreate bool
+	rows       map[fakeSQLKey][]byte
+}
+
+type fakeSQLKey struct {
+	bee  int64
+	dict string
+	k    string
+}
+
+var (
+	fakeSQLM   sync.Mutex
+	fakeSQLDBs = make(map[string]*fakeSQL)
+)
+
+func init() {
+	sql.Register("fakesql", fakeSQLDriver{})
+}
+
+// openFakeSQL opens a new fake database.
+func openFakeSQL(t *testing.T, name string) (*sql.DB, *fakeSQL) {
+	f := &fakeSQL{rows: make(map[fakeSQLKey][]byte)}
+	fakeSQLM.Lock()
+	fakeSQLDBs[name] = f
+	fakeSQLM.Unlock()
+
+	db, err := sql.Open("fakesql", name)
+	if err != nil {
+		t.Fatalf("cannot open the fake database: %v", err)
+	}
+	return db, f
+}
+
+type fakeSQLDriver struct{}
+
+func (fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	fakeSQLM.Lock()
+	defer fakeSQLM.Unlock()
+	f, ok := fakeSQLDBs[name]
+	if !ok {
+		return nil, errors.New("no such database")
+	}
+	return fakeSQLConn{f}, nil
+}
+
+type fakeSQLConn struct{ f *fakeSQL }
+
+func (c fakeSQLConn) Prepare(q string) (driver.Stmt, error) {
+	return fakeSQLStmt{f: c.f, q: q}, nil
+}
+
+func (c fakeSQLConn) Close() error              { return nil }
+func (c fakeSQLConn) Begin() (driver.Tx, error) { return c, nil }
+func (c fakeSQLConn) Commit() error             { return nil }
+func (c fakeSQLConn) Rollback() error           { return nil }
+
+type fakeSQLStmt struct {
+	f *fakeSQL
+	q string
+}
+
+func (s fakeSQLStmt) Close() error  { return nil }
+func (s fakeSQLStmt) NumInput() int { return -1 }
+
+func (s fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.f.Lock()
+	defer s.f.Unlock()
+
+	if strings.HasPrefix(s.q, "CREATE TABLE") {
+		if s.f.failCreate {
+			return nil, errors.New("cannot create table")
+		}
+		s.f.created = true
+		return driver.RowsAffected(0), nil
+	}
+	if !s.f.created {
+		return nil, errors.New("no such table")
+	}
+
+	if strings.HasPrefix(s.q, "DELETE") && len(args) == 1 {
+		for k := range s.f.rows {
+			if k.bee == args[0].(int64) {
+				delete(s.f.rows, k)
+			}
+		}
+		return driver.RowsAffected(1), nil
+	}
+
+	k := fakeSQLKey{args[0].(int64), args[1].(string), args[2].(string)}
+	switch {
+	case strings.HasPrefix(s.q, "DELETE"):
+		delete(s.f.rows, k)
+	case strings.HasPrefix(s.q, "INSERT"):
+		s.f.rows[k] = args[3].([]byte)
+	default:
+		return nil, errors.New("invalid query " + s.q)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.f.Lock()
+	defer s.f.Unlock()
+
+	if !s.f.created {
+		return nil, errors.New("no such table")
+	}
+
+	r := &fakeSQLRows{}
+	dicts := make(map[string]bool)
+	for k, v := range s.f.rows {
+		if k.bee != args[0].(int64) {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(s.q, "SELECT DISTINCT dict"):
+			if !dicts[k.dict] {
+				dicts[k.dict] = true
+				r.vals = append(r.vals, []driver.Value{k.dict})
+			}
+		case strings.HasPrefix(s.q, "SELECT k, v"):
+			if k.dict == args[1].(string) {
+				r.vals = append(r.vals, []driver.Value{k.k, v})
+			}
+		case strings.HasPrefix(s.q, "SELECT v"):
+			if k.dict == args[1].(string) && k.k == args[2].(string) {
+				r.vals = append(r.vals, []driver.Value{v})
+			}
+		default:
+			return nil, errors.New("invalid query " + s.q)
+		}
+	}
+	return r, nil
+}
+
+type fakeSQLRows struct {
+	vals [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string {
+	if len(r.vals) == 0 {
+		return nil
+	}
+	return make([]string, len(r.vals[0]))
+}
+
+func (r *fakeSQLRows) Close() error { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.vals) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.vals[0])
+	r.vals = r.vals[1:]
+	return nil
+}
+
+func TestSQLBees(t *testing.T) {
+	db, _ := openFakeSQL(t, "bees")
+	if err := NewSQL(db, MySQL, "t", 0).CreateTable(); err != nil {
+		t.Fatalf("cannot create table: %v", err)
+	}
+
+	s1 := NewSQL(db, MySQL, "t", 1)
+	s1.Dict("D").Put("k", 1)
+	s2 := NewSQL(db, MySQL, "t", 2)
+	s2.Dict("D").Put("k", 2)
+	s2.Dict("E").Put("k", 3)
+	for _, s := range []*SQL{s1, s2} {
+		if err := s.Flush(); err != nil {
+			t.Fatalf("cannot flush the state: %v", err)
+		}
+	}
+
+	// The states are read back from the database.
+	r1 := NewSQL(db, MySQL, "t", 1)
+	if v, err := r1.Dict("D").Get("k"); v != 1 {
+		t.Errorf("invalid value of bee 1: actual=%v want=1 (%v)", v, err)
+	}
+	if _, err := r1.Dict("E").Get("k"); err != ErrNoSuchKey {
+		t.Errorf("bee 1 reads the dict of bee 2: actual=%v want=%v", err,
+			ErrNoSuchKey)
+	}
+	r2 := NewSQL(db, MySQL, "t", 2)
+	if v, err := r2.Dict("D").Get("k"); v != 2 {
+		t.Errorf("invalid value of bee 2: actual=%v want=2 (%v)", v, err)
+	}
+	if d := NewSQL(db, MySQL, "t", 1).Dicts(); len(d) != 1 ||
+		d[0].Name() != "D" {
+
+		t.Errorf("invalid dicts of bee 1: actual=%v want=[D]", d)
+	}
+	if d := NewSQL(db, MySQL, "t", 2).Dicts(); len(d) != 2 {
+		t.Errorf("invalid number of dicts of bee 2: actual=%v want=2", len(d))
+	}
+}
+
+func TestSQLDel(t *testing.T) {
+	db, f := openFakeSQL(t, "del")
+	if err := NewSQL(db, MySQL, "t", 0).CreateTable(); err != nil {
+		t.Fatalf("cannot create table: %v", err)
+	}
+
+	s := NewSQL(db, MySQL, "t", 1)
+	s.Dict("D").Put("k1", 1)
+	s.Dict("D").Put("k2", 2)
+	if err := s.Flush(); err != nil {
+		t.Fatalf("cannot flush the state: %v", err)
+	}
+	if err := s.Dict("D").Del("k1"); err != nil {
+		t.Fatalf("cannot delete k1: %v", err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("cannot flush the state: %v", err)
+	}
+	if len(f.rows) != 1 {
+		t.Errorf("invalid number of rows: actual=%v want=1", len(f.rows))
+	}
+
+	n := 0
+	NewSQL(db, MySQL, "t", 1).Dict("D").ForEach(func(k string,
+		v interface{}) bool {
+
+		if k != "k2" || v != 2 {
+			t.Errorf("invalid entry: actual=%v:%v want=k2:2", k, v)
+		}
+		n++
+		return true
+	})
+	if n != 1 {
+		t.Errorf("invalid number of entries: actual=%v want=1", n)
+	}
+}
+
+func TestSQLRestore(t *testing.T) {
+	db, f := openFakeSQL(t, "restore")
+	if err := NewSQL(db, MySQL, "t", 0).CreateTable(); err != nil {
+		t.Fatalf("cannot create table: %v", err)
+	}
+
+	s := NewSQL(db, MySQL, "t", 1)
+	s.Dict("D").Put("k1", 1)
+	s.Dict("E").Put("k2", 2)
+	if err := s.Flush(); err != nil {
+		t.Fatalf("cannot flush the state: %v", err)
+	}
+
+	inm := NewInMem()
+	inm.Dict("D").Put("k3", 3)
+	b, err := inm.Save()
+	if err != nil {
+		t.Fatalf("cannot save the state: %v", err)
+	}
+	if err := s.Restore(b); err != nil {
+		t.Fatalf("cannot restore the state: %v", err)
+	}
+	if len(f.rows) != 1 {
+		t.Errorf("invalid number of rows: actual=%v want=1", len(f.rows))
+	}
+	r := NewSQL(db, MySQL, "t", 1)
+	if _, err := r.Dict("D").Get("k1"); err != ErrNoSuchKey {
+		t.Errorf("old entry is not deleted: actual=%v want=%v", err,
+			ErrNoSuchKey)
+	}
+	if v, err := r.Dict("D").Get("k3"); v != 3 {
+		t.Errorf("invalid value: actual=%v want=3 (%v)", v, err)
+	}
+	if _, err := s.Dict("E").Get("k2"); err != ErrNoSuchKey {
+		t.Errorf("old entry is not deleted: actual=%v want=%v", err,
+			ErrNoSuchKey)
+	}
+}
+
+func TestSQLDetach(t *testing.T) {
+	db, f := openFakeSQL(t, "detach")
+	if err := NewSQL(db, MySQL, "t", 0).CreateTable(); err != nil {
+		t.Fatalf("cannot create table: %v", err)
+	}
+
+	s := NewSQL(db, MySQL, "t", 1)
+	s.Dict("D").Put("k1", 1)
+	if err := s.Flush(); err != nil {
+		t.Fatalf("cannot flush the state: %v", err)
+	}
+	if err := s.Detach(); err != nil {
+		t.Fatalf("cannot detach the state: %v", err)
+	}
+	if len(f.rows) != 0 {
+		t.Errorf("rows are not deleted: actual=%v want=0", len(f.rows))
+	}
+
+	// Detached states are kept in memory.
+	s.Dict("D").Put("k2", 2)
+	if err := s.Flush(); err != nil {
+		t.Fatalf("cannot flush the state: %v", err)
+	}
+	if len(f.rows) != 0 {
+		t.Errorf("detached state is written: actual=%v want=0", len(f.rows))
+	}
+	if v, err := s.Dict("D").Get("k1"); v != 1 {
+		t.Errorf("invalid value: actual=%v want=1 (%v)", v, err)
+	}
+
+	if err := s.Attach(); err != nil {
+		t.Fatalf("cannot attach the state: %v", err)
+	}
+	if len(f.rows) != 2 {
+		t.Errorf("invalid number of rows: actual=%v want=2", len(f.rows))
+	}
+}
+
+func TestSQLFlushError(t *testing.T) {
+	db, f := openFakeSQL(t, "flush")
+	s := NewSQL(db, MySQL, "t", 1)
+	s.Dict("D").Put("k", 1)
+	if err := s.Flush(); err == nil {
+		t.Error("no error when flushing without a table")
+	}
+
+	// The writes are kept and retried on the next flush.
+	if err := s.CreateTable(); err != nil {
+		t.Fatalf("cannot create table: %v", err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("cannot flush the state: %v", err)
+	}
+	if len(f.rows) != 1 {
+		t.Errorf("invalid number of rows: actual=%v want=1", len(f.rows))
+	}
+}
+
+func TestSQLCreateTableError(t *testing.T) {
+	db, f := openFakeSQL(t, "create")
+	f.failCreate = true
+	if err := NewSQL(db, MySQL, "t", 0).CreateTable(); err == nil {
+		t.Error("no error when the table cannot be created")
+	}
+}
@@ -17,3 +17,30 @@ type State interface {
 	// Restore restores the state from b.
 	Restore(b []byte) error
 }
+
+// Snapshotter is implemented by states that support copy-on-write snapshots.
+type Snapshotter interface {
+	// Snapshot returns a read-only snapshot of the state, and starts tracking
+	// the keys modified after the snapshot. Taking a snapshot is cheap: the
+	// state is copied only when it is modified.
+	Snapshot() State
+	// Changes returns the operations that bring the last snapshot up to date,
+	// and stops tracking changes. The snapshot must not be used afterwards.
+	Changes() []Op
+}
+
+// Compacter is implemented by states that can reclaim the memory used by
+// deleted keys.
+type Compacter interface {
+	// Garbage returns the number of deleted keys that are not reclaimed yet.
+	Garbage() int
+	// Compact reclaims the memory of deleted keys, and returns the approximate
+	// number of bytes reclaimed.
+	Compact() int
+}
+
+// Flusher is implemented by states that buffer their writes.
+type Flusher interface {
+	// Flush stores the buffered writes.
+	Flush() error
+}
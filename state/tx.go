@@ -17,8 +17,9 @@ const (
 )
 
 var (
-	ErrOpenTx error = errors.New("tx: transaction is already open")
-	ErrNoTx   error = errors.New("tx: no open transaction")
+	ErrOpenTx    error = errors.New("tx: transaction is already open")
+	ErrNoTx      error = errors.New("tx: no open transaction")
+	ErrSavepoint error = errors.New("tx: savepoint is not in this transaction")
 )
 
 // Tx represents the side effects of an operation: messages emitted during the
@@ -65,6 +66,7 @@ type Transactional struct {
 	State
 	stage  map[string]*TxDict
 	status TxStatus
+	txID   uint64
 }
 
 func (t *Transactional) TxStatus() TxStatus {
@@ -78,6 +80,7 @@ func (t *Transactional) BeginTx() error {
 
 	t.maybeNewTransaction()
 	t.status = TxOpen
+	t.txID++
 	return nil
 }
 func (t *Transactional) maybeNewTransaction() {
@@ -121,7 +124,16 @@ func (t *Transactional) CommitTx() error {
 		d.CommitTx()
 	}
 	t.Reset()
-	return nil
+	return t.flush()
+}
+
+// flush flushes the underlying state, if it is a Flusher.
+func (t *Transactional) flush() error {
+	f, ok := t.State.(Flusher)
+	if !ok {
+		return nil
+	}
+	return f.Flush()
 }
 
 func (t *Transactional) AbortTx() error {
@@ -143,23 +155,128 @@ func (t *Transactional) Reset() {
 	}
 }
 
+// Savepoint is a point in a transaction that the transaction can be rolled
+// back to.
+type Savepoint struct {
+	owner *Transactional
+	txID  uint64
+	ops   map[string]map[string]Op
+}
+
+// Savepoint returns a savepoint at the current point of the open transaction.
+func (t *Transactional) Savepoint() (Savepoint, error) {
+	if t.status != TxOpen {
+		return Savepoint{}, ErrNoTx
+	}
+
+	sp := Savepoint{
+		owner: t,
+		txID:  t.txID,
+		ops:   make(map[string]map[string]Op, len(t.stage)),
+	}
+	for n, d := range t.stage {
+		sp.ops[n] = copyOps(d.Ops)
+	}
+	return sp, nil
+}
+
+// RollbackTo discards the operations of the open transaction made after sp,
+// and keeps the transaction open.
+func (t *Transactional) RollbackTo(sp Savepoint) error {
+	if t.status != TxOpen {
+		return ErrNoTx
+	}
+	if sp.owner != t || sp.txID != t.txID {
+		return ErrSavepoint
+	}
+
+	for n, d := range t.stage {
+		d.Ops = copyOps(sp.ops[n])
+	}
+	return nil
+}
+
+func copyOps(ops map[string]Op) map[string]Op {
+	c := make(map[string]Op, len(ops))
+	for k, op := range ops {
+		c[k] = op
+	}
+	return c
+}
+
+// AddOps adds ops to the open transaction as they are. Unlike Del, a deletion
+// is added even if the key does not exist.
+func (t *Transactional) AddOps(ops []Op) error {
+	if t.status != TxOpen {
+		return ErrNoTx
+	}
+	for _, o := range ops {
+		t.Dict(o.D).(*TxDict).Ops[o.K] = o
+	}
+	return nil
+}
+
 func (t *Transactional) HasEmptyTx() bool {
 	return len(t.stage) == 0
 }
 
+// Apply replays ops exactly as they were made on the original state.
 func (t *Transactional) Apply(ops []Op) error {
+	return t.apply(ops, false)
+}
+
+// Reconcile applies ops, merging the values that are Mergeable with the
+// existing values of their keys instead of overwriting them. Reconcile should
+// only be used to reconcile diverged replicas, since the result differs from
+// the state on which ops were made.
+func (t *Transactional) Reconcile(ops []Op) error {
+	return t.apply(ops, true)
+}
+
+func (t *Transactional) apply(ops []Op, merge bool) error {
 	if t.status == TxOpen {
 		return ErrOpenTx
 	}
 	for _, o := range ops {
 		switch o.T {
 		case Put:
-			t.Dict(o.D).Put(o.K, o.V)
+			d := t.Dict(o.D)
+			v := o.V
+			if m, ok := v.(Mergeable); ok && merge {
+				if prev, err := d.Get(o.K); err == nil {
+					v = m.Merge(prev)
+				}
+			}
+			d.Put(o.K, v)
 		case Del:
 			t.Dict(o.D).Del(o.K)
 		}
 	}
-	return nil
+	return t.flush()
+}
+
+// Garbage returns the garbage of the underlying state, if it is a Compacter.
+func (t *Transactional) Garbage() int {
+	c, ok := t.State.(Compacter)
+	if !ok {
+		return 0
+	}
+	return c.Garbage()
+}
+
+// Compact drops the dictionaries staged by previous transactions and compacts
+// the underlying state, if it is a Compacter. It is a no-op when there is an
+// open transaction.
+func (t *Transactional) Compact() int {
+	if t.status == TxOpen {
+		return 0
+	}
+	t.stage = nil
+	c, ok := t.State.(Compacter)
+	if !ok {
+		return 0
+	}
+	return c.Compact()
 }
 
 func (t *Transactional) Save() ([]byte, error) {
@@ -66,3 +66,60 @@ func BenchmarkTransactions(b *testing.B) {
 		tx.CommitTx()
 	}
 }
+
+func TestSavepoint(t *testing.T) {
+	tx := NewTransactional(NewInMem())
+	if _, err := tx.Savepoint(); err != ErrNoTx {
+		t.Errorf("savepoint outside a transaction: %v", err)
+	}
+
+	tx.BeginTx()
+	tx.Dict("d").Put("k1", 1)
+	sp, err := tx.Savepoint()
+	if err != nil {
+		t.Fatalf("cannot create savepoint: %v", err)
+	}
+	tx.Dict("d").Put("k1", 2)
+	tx.Dict("d").Put("k2", 2)
+	tx.Dict("e").Put("k", 2)
+	if err := tx.RollbackTo(sp); err != nil {
+		t.Fatalf("cannot rollback: %v", err)
+	}
+	tx.CommitTx()
+
+	if v, err := tx.Dict("d").Get("k1"); err != nil || v.(int) != 1 {
+		t.Errorf("invalid value for k1: actual=%v want=1", v)
+	}
+	for _, k := range []string{"d/k2", "e/k"} {
+		if _, err := tx.Dict(k[:1]).Get(k[2:]); err == nil {
+			t.Errorf("%v is not rolled back", k)
+		}
+	}
+
+	tx.BeginTx()
+	if err := tx.RollbackTo(sp); err != ErrSavepoint {
+		t.Errorf("rollback to a savepoint of another transaction: %v", err)
+	}
+}
+
+func TestAddOps(t *testing.T) {
+	tx := NewTransactional(NewInMem())
+	ops := []Op{{T: Put, D: "d", K: "k1", V: 1}, {T: Del, D: "d", K: "k2"}}
+	if err := tx.AddOps(ops); err != ErrNoTx {
+		t.Errorf("invalid error without a tx: actual=%v want=%v", err, ErrNoTx)
+	}
+
+	tx.BeginTx()
+	if err := tx.AddOps(ops); err != nil {
+		t.Fatalf("cannot add ops: %v", err)
+	}
+	if n := len(tx.TxOps()); n != 2 {
+		t.Errorf("invalid number of ops: actual=%v want=2", n)
+	}
+	if err := tx.CommitTx(); err != nil {
+		t.Errorf("error in commit tx: %v", err)
+	}
+	if v, err := tx.Dict("d").Get("k1"); err != nil || v != 1 {
+		t.Errorf("invalid value: actual=%v want=1 (err=%v)", v, err)
+	}
+}
@@ -0,0 +1,28 @@
+package state
+
+// Update atomically applies the changes that fn makes in s. fn receives a
+// transactional view of s, and its changes are committed into s only if fn
+// returns nil. Otherwise, all the changes are discarded and the error is
+// returned.
+//
+// If s is a Transactional with an open transaction, the changes are committed
+// into that transaction and are applied when it is committed.
+func Update(s State, fn func(tx State) error) (err error) {
+	tx := NewTransactional(s)
+	if err = tx.BeginTx(); err != nil {
+		return err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			tx.AbortTx()
+			panic(r)
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		tx.AbortTx()
+		return err
+	}
+	return tx.CommitTx()
+}
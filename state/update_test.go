@@ -0,0 +1,63 @@
+package state
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUpdateCommit(t *testing.T) {
+	s := NewInMem()
+	err := Update(s, func(tx State) error {
+		tx.Dict("d1").Put("k", "v1")
+		tx.Dict("d2").Put("k", "v2")
+		if _, err := s.Dict("d1").Get("k"); err == nil {
+			t.Error("value is in the dictionary before commit")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("error in update: %v", err)
+	}
+	for _, d := range []string{"d1", "d2"} {
+		if _, err := s.Dict(d).Get("k"); err != nil {
+			t.Errorf("value is not in %v after commit", d)
+		}
+	}
+}
+
+func TestUpdateAbort(t *testing.T) {
+	s := NewInMem()
+	want := errors.New("abort")
+	err := Update(s, func(tx State) error {
+		tx.Dict("d1").Put("k", "v1")
+		tx.Dict("d2").Put("k", "v2")
+		return want
+	})
+	if err != want {
+		t.Errorf("invalid error: actual=%v want=%v", err, want)
+	}
+	for _, d := range []string{"d1", "d2"} {
+		if _, err := s.Dict(d).Get("k"); err == nil {
+			t.Errorf("value is in %v after abort", d)
+		}
+	}
+}
+
+func TestUpdateInOpenTx(t *testing.T) {
+	inm := NewInMem()
+	s := NewTransactional(inm)
+	s.BeginTx()
+	Update(s, func(tx State) error {
+		return tx.Dict("d").Put("k", "v")
+	})
+	if _, err := inm.Dict("d").Get("k"); err == nil {
+		t.Error("value is in the dictionary before the outer tx is committed")
+	}
+	if _, err := s.Dict("d").Get("k"); err != nil {
+		t.Error("value is not in the outer tx")
+	}
+	s.CommitTx()
+	if _, err := inm.Dict("d").Get("k"); err != nil {
+		t.Error("value is not in the dictionary after commit")
+	}
+}
@@ -37,7 +37,9 @@ type collectorApp struct {
 
 func newAppStatCollector(h *hive) collector {
 	c := &collectorApp{hive: h}
-	a := h.NewApp(appCollector, NonTransactional())
+	a := h.NewApp(appCollector, NonTransactional(),
+		Every(1*time.Second, pollOptimizer{}),
+		Every(1*time.Second, pollLocalStat{}))
 	a.Handle(beeRecord{}, localCollector{})
 	a.Handle(cmdMigrate{}, localCollector{})
 	a.Handle(pollLocalStat{}, localStatPoller{
@@ -47,11 +49,6 @@ func newAppStatCollector(h *hive) collector {
 	a.Handle(beeMatrixUpdate{}, optimizerCollector{})
 	a.Handle(pollOptimizer{}, optimizer{defaultMinScore})
 
-	a.Detached(NewTimer(1*time.Second, func() {
-		h.Emit(pollOptimizer{})
-		h.Emit(pollLocalStat{})
-	}))
-
 	a.Handle(statRequest{}, statRequestHandler{})
 	a.HandleHTTP("/stats", &statHTTPHandler{hive: h})
 
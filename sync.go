@@ -48,6 +48,35 @@ func (r syncRes) Type() string {
 	return "syncRes-" + MsgType(r.Data)
 }
 
+// Future is the pending response of an asynchronous sync request.
+type Future struct {
+	done chan struct{}
+	res  interface{}
+	err  error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+func (f *Future) resolve(res interface{}, err error) {
+	f.res = res
+	f.err = err
+	close(f.done)
+}
+
+// Done returns a channel that is closed when the future is resolved.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Result blocks until the future is resolved, and returns the response of the
+// request.
+func (f *Future) Result() (res interface{}, err error) {
+	<-f.done
+	return f.res, f.err
+}
+
 type syncReqAndChan struct {
 	req syncReq
 	ch  chan syncRes
@@ -175,9 +204,10 @@ type syncHandler struct {
 func (h syncHandler) Rcv(m Msg, ctx RcvContext) error {
 	req := m.Data().(syncReq)
 	sm := msg{
-		MsgData: req.Data,
-		MsgFrom: m.From(),
-		MsgTo:   m.To(),
+		MsgData:  req.Data,
+		MsgFrom:  m.From(),
+		MsgTo:    m.To(),
+		MsgTrace: m.Trace(),
 	}
 	sc := syncRcvContext{
 		RcvContext: ctx,
@@ -203,6 +233,10 @@ func (h syncHandler) Rcv(m Msg, ctx RcvContext) error {
 	return nil
 }
 
+func (h syncHandler) ReadOnly() bool {
+	return isReadOnly(h.handler)
+}
+
 func (h syncHandler) Map(m Msg, ctx MapContext) MappedCells {
 	s := msg{
 		MsgData: m.Data().(syncReq).Data,
@@ -36,6 +36,38 @@ func TestSync(t *testing.T) {
 	}
 }
 
+func TestSyncAsync(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("syncAsync")
+	rcvf := func(msg Msg, ctx RcvContext) error {
+		ctx.Reply(msg, msg.Data().(query))
+		return nil
+	}
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		return ctx.LocalMappedCells()
+	}
+	app.HandleFunc(query(""), mapf, rcvf)
+
+	go h.Start()
+	defer h.Stop()
+
+	var futures []*Future
+	for i := 0; i < 10; i++ {
+		req := query(fmt.Sprintf("test%d", i))
+		futures = append(futures, h.SyncAsync(context.Background(), req))
+	}
+	for i, f := range futures {
+		<-f.Done()
+		res, err := f.Result()
+		if err != nil {
+			t.Fatalf("error in process: %v", err)
+		}
+		if want := query(fmt.Sprintf("test%d", i)); res != want {
+			t.Errorf("invalid response: actual=%v want=%v", res, want)
+		}
+	}
+}
+
 func TestSyncCancel(t *testing.T) {
 	h := newHiveForTest()
 	req := query("test")
@@ -0,0 +1,69 @@
+package beehive
+
+import (
+	"net"
+	"time"
+
+	"github.com/kandoo/beehive/bucket"
+)
+
+// The traffic classes of the connections to other hives. Control traffic is
+// commands and raft heartbeats. Data traffic is messages, raft log
+// replication and state transfers.
+const (
+	trafficCtrl = "control"
+	trafficData = "data"
+)
+
+// buckets returns the token buckets that limit the egress bandwidth of the
+// control and data traffic to a peer hive. Buckets are created per peer, and
+// are unlimited if their rate is 0.
+func (t *transport) buckets() (ctrl, data *bucket.Bucket) {
+	if t == nil {
+		return nil, nil
+	}
+	return bucket.New(t.ctrlRate, uint64(t.ctrlRate)),
+		bucket.New(t.dataRate, uint64(t.dataRate))
+}
+
+// throttledConn is a connection whose writes are limited by a token bucket
+// of bytes.
+type throttledConn struct {
+	net.Conn
+	bucket *bucket.Bucket
+	class  string
+}
+
+// throttle limits the writes of conn using b, if b is limited.
+func throttle(conn net.Conn, b *bucket.Bucket, class string) net.Conn {
+	if b.Unlimited() {
+		return conn
+	}
+	return throttledConn{Conn: conn, bucket: b, class: class}
+}
+
+func (c throttledConn) Write(p []byte) (n int, err error) {
+	for len(p) != 0 {
+		chunk := uint64(len(p))
+		if chunk > c.bucket.Max() {
+			chunk = c.bucket.Max()
+		}
+
+		if !c.bucket.Get(chunk) {
+			start := time.Now()
+			for !c.bucket.Get(chunk) {
+				time.Sleep(c.bucket.When(chunk))
+			}
+			throttledTime.WithLabelValues(c.class).Add(
+				time.Since(start).Seconds())
+		}
+
+		w, err := c.Conn.Write(p[:chunk])
+		n += w
+		if err != nil {
+			return n, err
+		}
+		p = p[chunk:]
+	}
+	return n, nil
+}
@@ -0,0 +1,43 @@
+package beehive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/bucket"
+)
+
+func TestThrottledConn(t *testing.T) {
+	var tr *transport
+	if ctrl, data := tr.buckets(); !ctrl.Unlimited() || !data.Unlimited() {
+		t.Error("connections are throttled by default")
+	}
+
+	tr = &transport{dataRate: 10 * bucket.KTPS}
+	_, data := tr.buckets()
+	c1, c2 := net.Pipe()
+	conn := throttle(c1, data, trafficData)
+
+	sent := bytes.Repeat([]byte{1}, 2000)
+	go func() {
+		conn.Write(sent)
+		conn.Close()
+	}()
+
+	start := time.Now()
+	rcvd, err := ioutil.ReadAll(c2)
+	if err != nil {
+		t.Fatalf("cannot read: %v", err)
+	}
+	if !bytes.Equal(rcvd, sent) {
+		t.Errorf("invalid data: actual=%v bytes want=%v bytes", len(rcvd),
+			len(sent))
+	}
+	// The bucket starts empty, and fills 2000 bytes in 200ms.
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("writes are not throttled: %v", d)
+	}
+}
@@ -0,0 +1,500 @@
+package beehive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/kandoo/beehive/state"
+)
+
+// ErrTxTimeout is returned when a handler does not return before the
+// transaction deadline of its application.
+var ErrTxTimeout = errors.New("transaction timed out")
+
+// TxTimeout is an application option that sets a deadline for the handlers
+// of the application. If a handler does not return within d, the bee logs the
+// stack of the handler and aborts its transaction.
+//
+// If restart is false, the bee still waits for the handler to return before
+// processing the next message. Otherwise, the bee abandons the blocked handler
+// and continues on a new goroutine. The context of an abandoned handler is
+// detached from the bee: once the handler is unblocked, the calls it makes on
+// its context fail with ErrTxTimeout or are ignored. This option also makes
+// the application transactional.
+func TxTimeout(d time.Duration, restart bool) AppOption {
+	return func(a *app) {
+		a.flags |= appFlagTransactional
+		a.txTimeout.d = d
+		a.txTimeout.restart = restart
+	}
+}
+
+type appTxTimeout struct {
+	d       time.Duration
+	restart bool
+}
+
+// rcvPanic is a panic recovered from the goroutine of a handler.
+type rcvPanic struct {
+	val interface{}
+}
+
+func (p rcvPanic) String() string {
+	return fmt.Sprintf("%v", p.val)
+}
+
+// rcvWithTimeout calls rcv, the handler of messages of type t, on a separate
+// goroutine and waits for it at most the transaction timeout of the
+// application.
+//
+// If the application restarts timed out handlers, rcv is given a handlerCtx
+// instead of the bee, and the context is abandoned on timeout. Otherwise, the
+// bee waits for rcv to return before using its state again.
+func (b *bee) rcvWithTimeout(t string, rcv func(ctx RcvContext) error) error {
+	var ctx RcvContext = b
+	var hctx *handlerCtx
+	if b.app.txTimeout.restart {
+		hctx = newHandlerCtx(b)
+		ctx = hctx
+	}
+
+	res := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				glog.Errorf("%v panic in handler: %v\n%s", b, r, stack(false))
+				res <- rcvPanic{val: r}
+			}
+		}()
+		res <- rcv(ctx)
+	}()
+
+	timer := time.NewTimer(b.app.txTimeout.d)
+	defer timer.Stop()
+	select {
+	case r := <-res:
+		return rcvResult(r)
+	case <-timer.C:
+	}
+
+	glog.Errorf("%v: handler of %v timed out after %v\n%s", b, t,
+		b.app.txTimeout.d, handlerStacks(goroutineID()))
+	if hctx != nil {
+		hctx.abandon()
+		return ErrTxTimeout
+	}
+
+	if r := rcvResult(<-res); r != nil {
+		glog.Errorf("%v: timed out handler of %v returned: %v", b, t, r)
+	}
+	return ErrTxTimeout
+}
+
+func rcvResult(r interface{}) error {
+	switch r := r.(type) {
+	case nil:
+		return nil
+	case rcvPanic:
+		panic(r)
+	case error:
+		return r
+	}
+	return fmt.Errorf("invalid handler result %v", r)
+}
+
+func stack(all bool) []byte {
+	buf := make([]byte, 4096)
+	for {
+		n := runtime.Stack(buf, all)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// goroutineID returns the ID of the current goroutine as printed in its stack.
+// It is expensive, and is only called when a handler times out.
+func goroutineID() string {
+	s := stack(false)
+	s = bytes.TrimPrefix(s, []byte("goroutine "))
+	if i := bytes.IndexByte(s, ' '); i > 0 {
+		return string(s[:i])
+	}
+	return ""
+}
+
+// handlerStacks returns the stacks of the handler goroutines started by the
+// bee goroutine with the given ID. If the runtime does not record the creator
+// of goroutines, it returns the stacks of the handler goroutines of all bees.
+func handlerStacks(bee string) []byte {
+	var all, created [][]byte
+	for _, s := range bytes.Split(stack(true), []byte("\n\n")) {
+		if !bytes.Contains(s, []byte("created by "+rcvWithTimeoutFunc)) {
+			continue
+		}
+		all = append(all, s)
+		if bytes.Contains(s, []byte("in goroutine "+bee+"\n")) {
+			created = append(created, s)
+		}
+	}
+	if len(created) != 0 {
+		all = created
+	}
+	return bytes.Join(all, []byte("\n\n"))
+}
+
+// rcvWithTimeoutFunc is the name of rcvWithTimeout in the stack traces.
+const rcvWithTimeoutFunc = "github.com/kandoo/beehive.(*bee).rcvWithTimeout"
+
+// handlerCtx is the context of a handler that the bee abandons if the handler
+// times out. The calls of the handler are counted, and abandon waits for the
+// calls in progress. Once abandoned, the handler cannot reach the state of the
+// bee: its calls fail with ErrTxTimeout or are ignored. As such, the handler
+// does not race with the bee or the handlers of the next messages.
+type handlerCtx struct {
+	b *bee
+
+	m         sync.Mutex
+	done      *sync.Cond
+	calls     int
+	abandoned bool
+}
+
+func newHandlerCtx(b *bee) *handlerCtx {
+	c := &handlerCtx{b: b}
+	c.done = sync.NewCond(&c.m)
+	return c
+}
+
+// enter returns false if the context is abandoned. Otherwise, the caller must
+// call exit once it is done with the bee.
+func (c *handlerCtx) enter() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.abandoned {
+		return false
+	}
+	c.calls++
+	return true
+}
+
+func (c *handlerCtx) exit() {
+	c.m.Lock()
+	c.calls--
+	if c.calls == 0 {
+		c.done.Broadcast()
+	}
+	c.m.Unlock()
+}
+
+// isAbandoned returns whether the context is abandoned.
+func (c *handlerCtx) isAbandoned() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.abandoned
+}
+
+// abandon waits for the calls in progress, and abandons the context. The calls
+// must not run user code, which may block.
+func (c *handlerCtx) abandon() {
+	c.m.Lock()
+	c.abandoned = true
+	for c.calls != 0 {
+		c.done.Wait()
+	}
+	c.m.Unlock()
+}
+
+func (c *handlerCtx) ID() uint64             { return c.b.ID() }
+func (c *handlerCtx) App() string            { return c.b.App() }
+func (c *handlerCtx) Hive() Hive             { return c.b.Hive() }
+func (c *handlerCtx) Snooze(d time.Duration) { c.b.Snooze(d) }
+
+func (c *handlerCtx) Printf(format string, a ...interface{}) {
+	if !c.enter() {
+		fmt.Printf("%v> "+format, append([]interface{}{c.b}, a...)...)
+		return
+	}
+	defer c.exit()
+	c.b.Printf(format, a...)
+}
+
+func (c *handlerCtx) Sync(ctx context.Context, req interface{}) (
+	res interface{}, err error) {
+
+	return c.b.Sync(ctx, req)
+}
+
+func (c *handlerCtx) Dict(name string) state.Dict {
+	if !c.enter() {
+		return handlerDict{c: c, name: name}
+	}
+	defer c.exit()
+	return handlerDict{c: c, name: name, d: c.b.Dict(name)}
+}
+
+func (c *handlerCtx) LocalState() state.Dict {
+	if !c.enter() {
+		return handlerDict{c: c, name: localStateDict}
+	}
+	defer c.exit()
+	return handlerDict{c: c, name: localStateDict, d: c.b.LocalState()}
+}
+
+func (c *handlerCtx) Emit(msgData interface{}) {
+	if c.enter() {
+		defer c.exit()
+		c.b.Emit(msgData)
+	}
+}
+
+func (c *handlerCtx) EmitAfter(d time.Duration, msgData interface{}) {
+	if c.enter() {
+		defer c.exit()
+		c.b.EmitAfter(d, msgData)
+	}
+}
+
+func (c *handlerCtx) SendToCell(msgData interface{}, app string,
+	cell CellKey) {
+
+	if c.enter() {
+		defer c.exit()
+		c.b.SendToCell(msgData, app, cell)
+	}
+}
+
+func (c *handlerCtx) SendToBee(msgData interface{}, to uint64) {
+	if c.enter() {
+		defer c.exit()
+		c.b.SendToBee(msgData, to)
+	}
+}
+
+func (c *handlerCtx) Multicast(msgData interface{},
+	to ...uint64) map[uint64]error {
+
+	if !c.enter() {
+		errs := make(map[uint64]error)
+		for _, id := range to {
+			errs[id] = ErrTxTimeout
+		}
+		return errs
+	}
+	defer c.exit()
+	return c.b.Multicast(msgData, to...)
+}
+
+func (c *handlerCtx) Reply(msg Msg, replyData interface{}) error {
+	if !c.enter() {
+		return ErrTxTimeout
+	}
+	defer c.exit()
+	return c.b.Reply(msg, replyData)
+}
+
+func (c *handlerCtx) DeferReply(msg Msg) Repliable {
+	return c.b.DeferReply(msg)
+}
+
+func (c *handlerCtx) BroadcastToHives(msgData interface{}) map[uint64]error {
+	if !c.enter() {
+		return map[uint64]error{c.b.hive.ID(): ErrTxTimeout}
+	}
+	// The message is built in the context, but is broadcast outside of it
+	// since the broadcast blocks.
+	m := c.b.newBcastMsg(msgData)
+	c.exit()
+	return c.b.hive.broadcastToHives(m, "")
+}
+
+func (c *handlerCtx) StartDetached(h DetachedHandler) uint64 {
+	return c.b.StartDetached(h)
+}
+
+func (c *handlerCtx) StartDetachedFunc(start StartFunc, stop StopFunc,
+	rcv RcvFunc) uint64 {
+
+	return c.b.StartDetachedFunc(start, stop, rcv)
+}
+
+func (c *handlerCtx) LockCells(keys []CellKey) error {
+	if !c.enter() {
+		return ErrTxTimeout
+	}
+	defer c.exit()
+	return c.b.LockCells(keys)
+}
+
+func (c *handlerCtx) BeeLocal() interface{} {
+	if !c.enter() {
+		return nil
+	}
+	defer c.exit()
+	return c.b.BeeLocal()
+}
+
+func (c *handlerCtx) SetBeeLocal(d interface{}) {
+	if c.enter() {
+		defer c.exit()
+		c.b.SetBeeLocal(d)
+	}
+}
+
+func (c *handlerCtx) BeginTx() error {
+	if !c.enter() {
+		return ErrTxTimeout
+	}
+	defer c.exit()
+	return c.b.BeginTx()
+}
+
+func (c *handlerCtx) CommitTx() error {
+	if !c.enter() {
+		return ErrTxTimeout
+	}
+	defer c.exit()
+	return c.b.CommitTx()
+}
+
+func (c *handlerCtx) AbortTx() error {
+	if !c.enter() {
+		return ErrTxTimeout
+	}
+	defer c.exit()
+	return c.b.AbortTx()
+}
+
+func (c *handlerCtx) Savepoint() (Savepoint, error) {
+	if !c.enter() {
+		return Savepoint{}, ErrTxTimeout
+	}
+	defer c.exit()
+	return c.b.Savepoint()
+}
+
+func (c *handlerCtx) RollbackTo(sp Savepoint) error {
+	if !c.enter() {
+		return ErrTxTimeout
+	}
+	defer c.exit()
+	return c.b.RollbackTo(sp)
+}
+
+func (c *handlerCtx) CommitWith(writes []CellWrite) error {
+	if !c.enter() {
+		return ErrTxTimeout
+	}
+	defer c.exit()
+	return c.b.CommitWith(writes)
+}
+
+// Update runs fn on a transactional view of the dictionaries of the context,
+// so that abandon does not wait for fn, and applies its changes at once.
+func (c *handlerCtx) Update(fn func(tx StateTx) error) error {
+	tx := state.NewTransactional(handlerState{c: c})
+	tx.BeginTx()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	ops := tx.TxOps()
+
+	if !c.enter() {
+		return ErrTxTimeout
+	}
+	defer c.exit()
+	return c.b.Update(func(s StateTx) error {
+		for _, op := range ops {
+			if err := applyOp(s, op); err != nil && err != state.ErrNoSuchKey {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *handlerCtx) BeeState(id uint64) (state.State, error) {
+	return c.b.BeeState(id)
+}
+
+// handlerState is the dictionaries of a handlerCtx viewed as a state. It is
+// only used in transactions, and cannot be saved or restored.
+type handlerState struct {
+	c *handlerCtx
+}
+
+func (s handlerState) Dict(name string) state.Dict { return s.c.Dict(name) }
+func (s handlerState) Dicts() []state.Dict         { return nil }
+
+func (s handlerState) Save() ([]byte, error) {
+	return nil, errors.New("cannot save the state of a handler")
+}
+
+func (s handlerState) Restore(b []byte) error {
+	return errors.New("cannot restore the state of a handler")
+}
+
+// handlerDict is a dictionary returned by a handlerCtx. d is nil if the
+// context was abandoned when the dictionary was requested.
+type handlerDict struct {
+	c    *handlerCtx
+	name string
+	d    state.Dict
+}
+
+func (d handlerDict) Name() string { return d.name }
+
+func (d handlerDict) Get(key string) (interface{}, error) {
+	if d.d == nil || !d.c.enter() {
+		return nil, ErrTxTimeout
+	}
+	defer d.c.exit()
+	return d.d.Get(key)
+}
+
+func (d handlerDict) Put(key string, val interface{}) error {
+	if d.d == nil || !d.c.enter() {
+		return ErrTxTimeout
+	}
+	defer d.c.exit()
+	return d.d.Put(key, val)
+}
+
+func (d handlerDict) Del(key string) error {
+	if d.d == nil || !d.c.enter() {
+		return ErrTxTimeout
+	}
+	defer d.c.exit()
+	return d.d.Del(key)
+}
+
+// ForEach calls f on a copy of the entries, so that abandon does not wait for
+// f. The iteration stops once the context is abandoned.
+func (d handlerDict) ForEach(f state.IterFn) {
+	if d.d == nil || !d.c.enter() {
+		return
+	}
+	type entry struct {
+		k string
+		v interface{}
+	}
+	var entries []entry
+	d.d.ForEach(func(k string, v interface{}) bool {
+		entries = append(entries, entry{k: k, v: v})
+		return true
+	})
+	d.c.exit()
+
+	for _, e := range entries {
+		if d.c.isAbandoned() || !f(e.k, e.v) {
+			return
+		}
+	}
+}
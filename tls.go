@@ -0,0 +1,136 @@
+package beehive
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// tlsCreds are the certificate, the key and the CA of a hive. They are
+// reloaded when their files change, so that they can be rotated without
+// restarting the hive. Established connections keep their credentials.
+type tlsCreds struct {
+	sync.Mutex
+	cfg   HiveConfig
+	mtime time.Time // the latest modification time of the files.
+	cert  tls.Certificate
+	pool  *x509.CertPool
+}
+
+// newTLSCreds loads the credentials of the hive, and returns nil if TLS is
+// disabled.
+func newTLSCreds(cfg HiveConfig) (*tlsCreds, error) {
+	if cfg.TLSCert == "" && cfg.TLSKey == "" {
+		return nil, nil
+	}
+	if cfg.TLSCert == "" || cfg.TLSKey == "" {
+		return nil, errors.New("both certificate and key are required")
+	}
+
+	c := &tlsCreds{cfg: cfg}
+	mtime, err := c.modTime()
+	if err != nil {
+		return nil, err
+	}
+	if err = c.load(mtime); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *tlsCreds) files() []string {
+	f := []string{c.cfg.TLSCert, c.cfg.TLSKey}
+	if c.cfg.TLSCA != "" {
+		f = append(f, c.cfg.TLSCA)
+	}
+	return f
+}
+
+func (c *tlsCreds) modTime() (mtime time.Time, err error) {
+	for _, f := range c.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return mtime, err
+		}
+		if fi.ModTime().After(mtime) {
+			mtime = fi.ModTime()
+		}
+	}
+	return mtime, nil
+}
+
+func (c *tlsCreds) load(mtime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.cfg.TLSCert, c.cfg.TLSKey)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if c.cfg.TLSCA != "" {
+		pem, err := ioutil.ReadFile(c.cfg.TLSCA)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate in %v", c.cfg.TLSCA)
+		}
+	}
+
+	c.cert = cert
+	c.pool = pool
+	c.mtime = mtime
+	return nil
+}
+
+// current returns the current credentials, and reloads them if their files
+// have changed. If the new files cannot be loaded (e.g., they are partially
+// written), the previous credentials are returned.
+func (c *tlsCreds) current() (tls.Certificate, *x509.CertPool) {
+	c.Lock()
+	defer c.Unlock()
+
+	mtime, err := c.modTime()
+	if err == nil && mtime.After(c.mtime) {
+		if err = c.load(mtime); err == nil {
+			glog.Infof("reloaded tls credentials from %v", c.cfg.TLSCert)
+		}
+	}
+	if err != nil {
+		glog.Errorf("cannot reload tls credentials: %v", err)
+	}
+	return c.cert, c.pool
+}
+
+// client returns the TLS configuration used to connect to other hives.
+func (c *tlsCreds) client() *tls.Config {
+	cert, pool := c.current()
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}
+}
+
+// server returns the TLS configuration of the listener of the hive, which
+// uses the current credentials for each connection. If the hive has a CA, the
+// hives connecting to it must present a certificate signed by the CA.
+func (c *tlsCreds) server() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := c.current()
+			sc := &tls.Config{Certificates: []tls.Certificate{cert}}
+			if pool != nil {
+				sc.ClientCAs = pool
+				sc.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return sc, nil
+		},
+	}
+}
@@ -0,0 +1,177 @@
+package beehive
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type tlsTestMsg string
+
+// writeTestCerts writes a CA certificate, and a certificate for 127.0.0.1
+// signed by the CA to dir.
+func writeTestCerts(t *testing.T, dir string) (cert, key, ca string) {
+	write := func(name, typ string, der []byte) string {
+		p := filepath.Join(dir, name)
+		b := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+		if err := ioutil.WriteFile(p, b, 0600); err != nil {
+			t.Fatalf("cannot write %v: %v", p, err)
+		}
+		return p
+	}
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "beehive test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl,
+		&caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("cannot create the ca certificate: %v", err)
+	}
+
+	hiveKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	hiveTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "beehive test hive"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+	}
+	hiveDER, err := x509.CreateCertificate(rand.Reader, hiveTmpl, caTmpl,
+		&hiveKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("cannot create the hive certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(hiveKey)
+	if err != nil {
+		t.Fatalf("cannot marshal the hive key: %v", err)
+	}
+
+	return write("hive.crt", "CERTIFICATE", hiveDER),
+		write("hive.key", "EC PRIVATE KEY", keyDER),
+		write("ca.crt", "CERTIFICATE", caDER)
+}
+
+func TestTLSDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bhtls")
+	if err != nil {
+		t.Fatalf("cannot create a temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key, ca := writeTestCerts(t, dir)
+
+	ch := make(chan tlsTestMsg)
+	register := func(h Hive) {
+		a := h.NewApp("tls")
+		a.HandleFunc(tlsTestMsg(""), func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"T", "0"}}
+		}, func(msg Msg, ctx RcvContext) error {
+			ch <- msg.Data().(tlsTestMsg)
+			return nil
+		})
+	}
+
+	h1 := newHiveForTest(TLSCert(cert), TLSKey(key), TLSCA(ca))
+	register(h1)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(TLSCert(cert), TLSKey(key), TLSCA(ca),
+		PeerAddrs(h1.Config().Addr))
+	register(h2)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	h1.Emit(tlsTestMsg("a"))
+	<-ch
+
+	// The message is sent by the proxy on h2.
+	h2.Emit(tlsTestMsg("b"))
+	select {
+	case m := <-ch:
+		if m != "b" {
+			t.Errorf("invalid message: actual=%v want=b", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not received over tls")
+	}
+
+	// Hives require client certificates signed by the CA.
+	_, pool := h1.(*hive).tls.current()
+	conn, err := tls.Dial("tcp", h1.Config().Addr, &tls.Config{RootCAs: pool})
+	if err == nil {
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+	}
+	if err == nil {
+		t.Error("connection without a client certificate is accepted")
+	}
+}
+
+func TestTLSCredsReload(t *testing.T) {
+	if c, err := newTLSCreds(HiveConfig{}); c != nil || err != nil {
+		t.Errorf("tls is not disabled by default: %v, %v", c, err)
+	}
+	if _, err := newTLSCreds(HiveConfig{TLSCert: "hive.crt"}); err == nil {
+		t.Error("no error for a certificate without a key")
+	}
+
+	dir, err := ioutil.TempDir("", "bhtls")
+	if err != nil {
+		t.Fatalf("cannot create a temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key, ca := writeTestCerts(t, dir)
+
+	c, err := newTLSCreds(HiveConfig{TLSCert: cert, TLSKey: key, TLSCA: ca})
+	if err != nil {
+		t.Fatalf("cannot load the credentials: %v", err)
+	}
+	before := c.client().Certificates[0].Certificate[0]
+
+	// Rotate the credentials.
+	writeTestCerts(t, dir)
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{cert, key, ca} {
+		os.Chtimes(f, later, later)
+	}
+	after := c.client().Certificates[0].Certificate[0]
+	if bytes.Equal(before, after) {
+		t.Error("the certificate is not reloaded")
+	}
+
+	// Invalid files do not replace the credentials.
+	ioutil.WriteFile(key, []byte("partial"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(key, later, later)
+	if cur := c.client().Certificates[0].Certificate[0]; !bytes.Equal(cur,
+		after) {
+
+		t.Error("the certificate is replaced by an invalid one")
+	}
+}
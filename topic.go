@@ -0,0 +1,55 @@
+package beehive
+
+import "encoding/gob"
+
+// topicMsg is a message published on a topic.
+type topicMsg struct {
+	Topic string
+	Data  interface{}
+}
+
+func (t topicMsg) Type() string {
+	return topicType(t.Topic)
+}
+
+// topicType returns the message type of the messages published on topic.
+func topicType(topic string) string {
+	return "topic:" + topic
+}
+
+// Publish publishes msgData on the topic, using e which is either a hive or
+// the context of a handler. The message is delivered to the handlers of all
+// the applications subscribed to the topic (see App.Subscribe), regardless of
+// the type of msgData. If the subscribers are on other hives, the type of
+// msgData must be registered on the hives (see Hive.RegisterMsg).
+func Publish(e Emitter, topic string, msgData interface{}) {
+	e.Emit(topicMsg{Topic: topic, Data: msgData})
+}
+
+// topicHandler passes the data of the messages published on a topic to the
+// handler subscribed to the topic.
+type topicHandler struct {
+	handler Handler
+}
+
+func (h topicHandler) Map(m Msg, ctx MapContext) MappedCells {
+	return h.handler.Map(unwrapTopicMsg(m), ctx)
+}
+
+func (h topicHandler) Rcv(m Msg, ctx RcvContext) error {
+	return h.handler.Rcv(unwrapTopicMsg(m), ctx)
+}
+
+func unwrapTopicMsg(m Msg) Msg {
+	tm, ok := m.(*msg)
+	if !ok {
+		return m
+	}
+	um := *tm
+	um.MsgData = tm.MsgData.(topicMsg).Data
+	return &um
+}
+
+func init() {
+	gob.Register(topicMsg{})
+}
@@ -0,0 +1,53 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type topicTestEvent struct {
+	N int
+}
+
+func TestPublish(t *testing.T) {
+	type rcv struct {
+		app  string
+		data interface{}
+	}
+	ch := make(chan rcv, 10)
+	subscribe := func(a App, topic string) {
+		a.SubscribeFunc(topic, func(msg Msg, ctx MapContext) MappedCells {
+			return ctx.LocalMappedCells()
+		}, func(msg Msg, ctx RcvContext) error {
+			ch <- rcv{app: ctx.App(), data: msg.Data()}
+			return nil
+		})
+	}
+
+	h := newHiveForTest()
+	subscribe(h.NewApp("topic1"), "events")
+	subscribe(h.NewApp("topic2"), "events")
+	subscribe(h.NewApp("topic3"), "others")
+
+	go h.Start()
+	defer h.Stop()
+
+	Publish(h, "events", topicTestEvent{N: 1})
+	apps := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		r := <-ch
+		if e, ok := r.data.(topicTestEvent); !ok || e.N != 1 {
+			t.Errorf("invalid data published on the topic: %#v", r.data)
+		}
+		apps[r.app] = true
+	}
+	if !apps["topic1"] || !apps["topic2"] {
+		t.Errorf("invalid subscribers: %v", apps)
+	}
+
+	select {
+	case r := <-ch:
+		t.Errorf("message is delivered to an app not subscribed: %v", r.app)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,128 @@
+package beehive
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/kandoo/beehive/bucket"
+)
+
+// rpcHTTPPath is the HTTP endpoint of hives that tunnels RPC connections. See
+// RPCOverHTTP.
+const rpcHTTPPath = "/_beehive/rpc"
+
+// transport is how a hive connects to other hives. A nil transport connects
+// over plain TCP.
+type transport struct {
+	tls   *tlsCreds // nil if TLS is disabled.
+	http  bool      // whether RPC connections are tunneled in HTTP.
+	proxy string    // the address of the HTTP proxy. Empty if none.
+
+	keepAlive time.Duration // the TCP keep-alive period. Negative disables.
+
+	// The egress rates of control and data traffic to each peer, in bytes per
+	// second. See throttle.go.
+	ctrlRate bucket.Rate
+	dataRate bucket.Rate
+}
+
+func newTransport(cfg HiveConfig, tc *tlsCreds) *transport {
+	return &transport{
+		tls:   tc,
+		http:  cfg.RPCOverHTTP,
+		proxy: cfg.HTTPProxy,
+
+		keepAlive: keepAlivePeriod(cfg),
+
+		ctrlRate: bucket.Rate(cfg.CtrlRate),
+		dataRate: bucket.Rate(cfg.DataRate),
+	}
+}
+
+// keepAlivePeriod returns the TCP keep-alive period of the connections of the
+// hive, which is negative if keep-alives are disabled.
+func keepAlivePeriod(cfg HiveConfig) time.Duration {
+	if cfg.KeepAlive == 0 {
+		return -1
+	}
+	return cfg.KeepAlive
+}
+
+// dial connects to the RPC server of the hive at addr.
+func (t *transport) dial(addr string) (net.Conn, error) {
+	if t == nil {
+		return net.DialTimeout("tcp", addr, maxWait)
+	}
+
+	var conn net.Conn
+	var err error
+	d := net.Dialer{Timeout: maxWait, KeepAlive: t.keepAlive}
+	if t.proxy == "" {
+		conn, err = d.Dial("tcp", addr)
+	} else {
+		conn, err = d.Dial("tcp", t.proxy)
+		if err == nil {
+			err = connect(conn, addr, addr)
+		}
+	}
+
+	if err == nil && t.tls != nil {
+		conn, err = t.handshake(conn, addr)
+	}
+
+	if err == nil && t.http {
+		err = connect(conn, rpcHTTPPath, addr)
+	}
+
+	if err != nil && conn != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, err
+}
+
+// handshake establishes a TLS connection to the hive at addr over conn.
+func (t *transport) handshake(conn net.Conn, addr string) (net.Conn, error) {
+	cfg := t.tls.client()
+	if cfg.ServerName, _, _ = net.SplitHostPort(addr); cfg.ServerName == "" {
+		cfg.ServerName = addr
+	}
+
+	tc := tls.Client(conn, cfg)
+	tc.SetDeadline(time.Now().Add(maxWait))
+	if err := tc.Handshake(); err != nil {
+		return conn, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// connect sends an HTTP CONNECT request for target to host over conn, and
+// fails if the server does not accept it. Target is either the address of a
+// hive, when conn is connected to an HTTP proxy, or rpcHTTPPath.
+func connect(conn net.Conn, target, host string) error {
+	conn.SetDeadline(time.Now().Add(maxWait))
+	defer conn.SetDeadline(time.Time{})
+
+	_, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target,
+		host)
+	if err != nil {
+		return err
+	}
+	// The server does not send anything else before the client, so nothing is
+	// lost in the buffer of the reader.
+	res, err := http.ReadResponse(bufio.NewReader(conn),
+		&http.Request{Method: "CONNECT"})
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("transport: cannot connect to %v: %v", target,
+			res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package beehive
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+type transportTestMsg string
+
+// connectProxy is an HTTP proxy that serves CONNECT requests.
+type connectProxy struct {
+	net.Listener
+	tunnels int32
+}
+
+func newConnectProxy(t *testing.T) *connectProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	p := &connectProxy{Listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *connectProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil || req.Method != "CONNECT" {
+		return
+	}
+	dst, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer dst.Close()
+	atomic.AddInt32(&p.tunnels, 1)
+	io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n")
+	go io.Copy(dst, r)
+	io.Copy(conn, dst)
+}
+
+func TestRPCOverHTTP(t *testing.T) {
+	p := newConnectProxy(t)
+	defer p.Close()
+
+	ch := make(chan transportTestMsg)
+	register := func(h Hive) {
+		a := h.NewApp("transport")
+		a.HandleFunc(transportTestMsg(""), func(msg Msg,
+			ctx MapContext) MappedCells {
+
+			return MappedCells{{"T", "0"}}
+		}, func(msg Msg, ctx RcvContext) error {
+			ch <- msg.Data().(transportTestMsg)
+			return nil
+		})
+	}
+
+	h1 := newHiveForTest()
+	register(h1)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(RPCOverHTTP(true), HTTPProxy(p.Addr().String()),
+		PeerAddrs(h1.Config().Addr))
+	register(h2)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	h1.Emit(transportTestMsg("a"))
+	<-ch
+
+	// The message is sent by the proxy bee on h2 through the http proxy.
+	h2.Emit(transportTestMsg("b"))
+	if m := <-ch; m != "b" {
+		t.Errorf("invalid message: actual=%v want=b", m)
+	}
+	if atomic.LoadInt32(&p.tunnels) == 0 {
+		t.Error("connections are not tunneled through the http proxy")
+	}
+
+	// Connections without the tunnel are still accepted.
+	c, err := newRPCClient(h1.Config().Addr, nil)
+	if err != nil {
+		t.Fatalf("cannot connect to %v: %v", h1, err)
+	}
+	defer c.stop()
+	if _, err := c.hiveState(); err != nil {
+		t.Errorf("cannot call %v: %v", h1, err)
+	}
+}
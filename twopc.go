@@ -0,0 +1,399 @@
+package beehive
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/state"
+)
+
+var (
+	ErrTxConflict = errors.New("cells are prepared in another transaction")
+	ErrNoPrepared = errors.New("no such prepared transaction")
+	ErrTxAborted  = errors.New("transaction is already aborted")
+)
+
+// preparedExpiry is how long a participant keeps the cells of a prepared
+// transaction locked, and remembers an aborted transaction. Coordinators retry
+// committing a prepared transaction for as long.
+const preparedExpiry = time.Minute
+
+// preparedTx is a distributed transaction prepared by a participant.
+type preparedTx struct {
+	ops    []state.Op
+	expiry time.Time
+}
+
+// CellWrite is a write on a cell of an application that is committed
+// atomically with the transaction of the current bee using
+// RcvContext.CommitWith.
+type CellWrite struct {
+	App   string      // The application that owns the cell.
+	Cell  CellKey     // The cell.
+	Value interface{} // The new value of the cell.
+	Del   bool        // Whether to delete the cell instead.
+}
+
+func (w CellWrite) op() state.Op {
+	if w.Del {
+		return state.Op{T: state.Del, D: w.Cell.Dict, K: w.Cell.Key}
+	}
+	return state.Op{T: state.Put, D: w.Cell.Dict, K: w.Cell.Key, V: w.Value}
+}
+
+// participant is a bee participating in a distributed transaction.
+type participant struct {
+	app string
+	bee uint64
+	ops []state.Op
+}
+
+// distTx is a distributed transaction prepared by its coordinator, and
+// committed or aborted with the transaction of the coordinator.
+type distTx struct {
+	id    string
+	parts []*participant
+	// l2 is whether the transaction is prepared in the L2 transaction of the
+	// coordinator.
+	l2 bool
+}
+
+func (b *bee) CommitWith(writes []CellWrite) error {
+	dicts, _ := b.currentState()
+	if dicts.TxStatus() != state.TxOpen {
+		return state.ErrNoTx
+	}
+
+	var parts []*participant
+	byBee := make(map[uint64]*participant)
+	for _, w := range writes {
+		info, _, err := b.hive.registry.beeForCells(w.App, MappedCells{w.Cell})
+		if err != nil {
+			return err
+		}
+		if info.ID == 0 {
+			return fmt.Errorf("no bee in app %v owns cell %v", w.App, w.Cell)
+		}
+		if info.ID == b.ID() {
+			op := w.op()
+			if err := applyOp(dicts, op); err != nil {
+				return err
+			}
+			continue
+		}
+
+		p, ok := byBee[info.ID]
+		if !ok {
+			p = &participant{app: w.App, bee: info.ID}
+			byBee[info.ID] = p
+			parts = append(parts, p)
+		}
+		p.ops = append(p.ops, w.op())
+	}
+
+	if len(parts) == 0 {
+		return nil
+	}
+
+	b.txSeq++
+	id := fmt.Sprintf("%v-%v", b.ID(), b.txSeq)
+
+	// Phase 1: prepare. Participants prepare without their own goroutine, so
+	// waiting for their votes cannot deadlock with a participant that is
+	// coordinating a transaction towards this bee.
+	t := 2 * b.hive.config.RaftElectTimeout()
+	errs := make(chan error, len(parts))
+	for _, p := range parts {
+		go func(p *participant) {
+			_, err := cmdWithTimeout(t, func() (interface{}, error) {
+				return b.sendCmdToParticipant(p, cmdPrepareTx{ID: id, Ops: p.ops})
+			})
+			if err != nil {
+				glog.Errorf("%v cannot prepare %v on bee %v: %v", b, id, p.bee, err)
+			}
+			errs <- err
+		}(p)
+	}
+
+	var err error
+	for range parts {
+		if perr := <-errs; perr != nil && err == nil {
+			err = perr
+		}
+	}
+
+	tx := distTx{id: id, parts: parts, l2: dicts == b.stateL2}
+	if err != nil {
+		// The participants that prepared or are yet to prepare are aborted.
+		go b.endDistTx(tx, false)
+		return err
+	}
+
+	// Phase 2 is driven by the commit or the abort of the current transaction.
+	b.distTxs = append(b.distTxs, tx)
+	return nil
+}
+
+// commitDistTxs commits the distributed transactions prepared in the
+// transaction of the bee, which has just been committed.
+func (b *bee) commitDistTxs() {
+	for _, tx := range b.distTxs {
+		go b.endDistTx(tx, true)
+	}
+	b.distTxs = nil
+}
+
+// abortDistTxs aborts the distributed transactions prepared in the aborted
+// transaction of the bee. If l2 is true, only the transactions prepared in the
+// L2 transaction are aborted.
+func (b *bee) abortDistTxs(l2 bool) {
+	var keep []distTx
+	for _, tx := range b.distTxs {
+		if l2 && !tx.l2 {
+			keep = append(keep, tx)
+			continue
+		}
+		go b.endDistTx(tx, false)
+	}
+	b.distTxs = keep
+}
+
+// promoteDistTxs moves the distributed transactions of the committed L2
+// transaction to the L1 transaction of the bee.
+func (b *bee) promoteDistTxs() {
+	for i := range b.distTxs {
+		b.distTxs[i].l2 = false
+	}
+}
+
+// endDistTx commits or aborts tx on its participants. Commits are retried
+// until the participants acknowledge them or their prepares expire. It must
+// not be called in the bee's goroutine.
+func (b *bee) endDistTx(tx distTx, commit bool) {
+	if !commit {
+		for _, p := range tx.parts {
+			// Participants that have not prepared tx have nothing to abort, and
+			// the ones that cannot be reached expire the prepare.
+			if _, err := b.sendCmdToParticipant(p,
+				cmdAbortPrepared{ID: tx.id}); err != nil {
+
+				glog.V(2).Infof("%v cannot abort %v on bee %v: %v", b, tx.id, p.bee,
+					err)
+			}
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, p := range tx.parts {
+		wg.Add(1)
+		go func(p *participant) {
+			defer wg.Done()
+			b.commitParticipant(tx.id, p)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// commitParticipant commits the prepared transaction id on p, retrying until
+// p acknowledges the commit.
+func (b *bee) commitParticipant(id string, p *participant) {
+	t := 2 * b.hive.config.RaftElectTimeout()
+	deadline := time.Now().Add(preparedExpiry)
+	for i := 0; ; i++ {
+		_, err := cmdWithTimeout(t, func() (interface{}, error) {
+			return b.sendCmdToParticipant(p, cmdCommitPrepared{ID: id})
+		})
+		switch {
+		case err == nil:
+			return
+		case isNoPrepared(err):
+			if i == 0 {
+				glog.Errorf("%v cannot commit %v on bee %v: %v", b, id, p.bee, err)
+			}
+			// Otherwise, a previous attempt has committed the transaction.
+			return
+		case time.Now().After(deadline):
+			glog.Errorf("%v gives up committing %v on bee %v: %v", b, id, p.bee,
+				err)
+			return
+		}
+		glog.Warningf("%v retries committing %v on bee %v: %v", b, id, p.bee, err)
+		time.Sleep(b.hive.config.RaftElectTimeout())
+	}
+}
+
+func isNoPrepared(err error) bool {
+	return err != nil && err.Error() == ErrNoPrepared.Error()
+}
+
+func (b *bee) sendCmdToParticipant(p *participant, cmd interface{}) (
+	interface{}, error) {
+
+	a, ok := b.hive.app(p.app)
+	if !ok {
+		return nil, fmt.Errorf("%v cannot find app %v", b.hive, p.app)
+	}
+	return a.qee.sendCmdToBee(p.bee, cmd)
+}
+
+// handleTxCmd handles the commands that prepare and abort distributed
+// transactions, which only lock and unlock cells, without waiting for the
+// bee's goroutine. It returns false if cc is not such a command.
+func (b *bee) handleTxCmd(cc cmdAndChannel) bool {
+	var err error
+	switch cmd := cc.cmd.Data.(type) {
+	case cmdPrepareTx:
+		err = b.prepareTx(cmd.ID, cmd.Ops)
+	case cmdAbortPrepared:
+		err = b.abortPrepared(cmd.ID)
+	default:
+		return false
+	}
+
+	// The sender may wait for the result only after enqueuing the command.
+	if cc.ch != nil {
+		go func() {
+			cc.ch <- cmdResult{Err: err}
+		}()
+	}
+	return true
+}
+
+// prepareTx prepares the operations of a distributed transaction, and votes
+// to commit it if they do not conflict with another prepared transaction.
+// Transactions that are already aborted cannot be prepared.
+func (b *bee) prepareTx(id string, ops []state.Op) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.prepared == nil {
+		b.prepared = make(map[string]preparedTx)
+		b.preparedCells = make(map[CellKey]string)
+	}
+	if b.abortedTxs == nil {
+		b.abortedTxs = make(map[string]time.Time)
+	}
+	now := time.Now()
+	b.expirePrepared(now)
+
+	if _, ok := b.abortedTxs[id]; ok {
+		return ErrTxAborted
+	}
+
+	for _, op := range ops {
+		if tx, ok := b.preparedCells[CellKey{Dict: op.D, Key: op.K}]; ok &&
+			tx != id {
+
+			return ErrTxConflict
+		}
+	}
+
+	for _, op := range ops {
+		b.preparedCells[CellKey{Dict: op.D, Key: op.K}] = id
+	}
+	ptx := b.prepared[id]
+	ptx.ops = append(ptx.ops, ops...)
+	ptx.expiry = now.Add(preparedExpiry)
+	b.prepared[id] = ptx
+	glog.V(2).Infof("%v prepares %v", b, id)
+	return nil
+}
+
+// expirePrepared aborts the prepared transactions and forgets the aborted
+// transactions that are expired. It must be called with the bee locked.
+func (b *bee) expirePrepared(now time.Time) {
+	for id, ptx := range b.prepared {
+		if now.After(ptx.expiry) {
+			glog.Warningf("%v aborts expired transaction %v", b, id)
+			b.releasePrepared(id)
+			b.abortedTxs[id] = now.Add(preparedExpiry)
+		}
+	}
+	for id, expiry := range b.abortedTxs {
+		if now.After(expiry) {
+			delete(b.abortedTxs, id)
+		}
+	}
+}
+
+// commitPrepared commits a prepared transaction in a local transaction of the
+// bee, which is replicated if the application is persistent.
+func (b *bee) commitPrepared(id string) error {
+	b.Lock()
+	ptx, ok := b.prepared[id]
+	if ok {
+		b.releasePrepared(id)
+	}
+	b.Unlock()
+	if !ok {
+		return ErrNoPrepared
+	}
+
+	if err := b.BeginTx(); err != nil {
+		return err
+	}
+	dicts, _ := b.currentState()
+	for _, op := range ptx.ops {
+		if err := applyOp(dicts, op); err != nil && err != state.ErrNoSuchKey {
+			b.AbortTx()
+			return err
+		}
+	}
+	glog.V(2).Infof("%v commits prepared %v", b, id)
+	return b.CommitTx()
+}
+
+// abortPrepared aborts a prepared transaction. The transaction is remembered
+// as aborted, even if it is not prepared yet, so that a late prepare is
+// rejected.
+func (b *bee) abortPrepared(id string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.abortedTxs == nil {
+		b.abortedTxs = make(map[string]time.Time)
+	}
+	b.abortedTxs[id] = time.Now().Add(preparedExpiry)
+
+	if _, ok := b.prepared[id]; !ok {
+		return ErrNoPrepared
+	}
+	b.releasePrepared(id)
+	glog.V(2).Infof("%v aborts prepared %v", b, id)
+	return nil
+}
+
+// releasePrepared unlocks the cells of a prepared transaction. It must be
+// called with the bee locked.
+func (b *bee) releasePrepared(id string) {
+	for _, op := range b.prepared[id].ops {
+		delete(b.preparedCells, CellKey{Dict: op.D, Key: op.K})
+	}
+	delete(b.prepared, id)
+}
+
+// hasPrepared returns whether the bee has a prepared transaction that is not
+// expired.
+func (b *bee) hasPrepared() bool {
+	b.Lock()
+	defer b.Unlock()
+	if len(b.prepared) == 0 {
+		return false
+	}
+	b.expirePrepared(time.Now())
+	return len(b.prepared) != 0
+}
+
+func applyOp(s StateTx, op state.Op) error {
+	switch op.T {
+	case state.Put:
+		return s.Dict(op.D).Put(op.K, op.V)
+	case state.Del:
+		return s.Dict(op.D).Del(op.K)
+	}
+	return fmt.Errorf("invalid op %v", op)
+}
@@ -0,0 +1,237 @@
+package beehive
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/state"
+)
+
+type twoPCTestRead struct{}
+type twoPCTestWrite struct{}
+type twoPCTestAbort struct{}
+type twoPCTestSwap struct{}
+
+func TestCommitWith(t *testing.T) {
+	h := newHiveForTest()
+
+	vals := make(chan interface{})
+	acc := h.NewApp("accounts")
+	acc.HandleFunc(twoPCTestRead{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"B", "x"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			v, err := ctx.Dict("B").Get("x")
+			if err != nil {
+				vals <- err
+				return nil
+			}
+			vals <- v
+			return nil
+		})
+
+	errs := make(chan error)
+	led := h.NewApp("ledger")
+	led.HandleFunc(twoPCTestWrite{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"L", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			ctx.Dict("L").Put("0", 10)
+			err := ctx.CommitWith([]CellWrite{
+				{App: "accounts", Cell: CellKey{Dict: "B", Key: "x"}, Value: 10},
+			})
+			errs <- err
+			return err
+		})
+
+	go h.Start()
+	defer h.Stop()
+
+	// Creates the bee that owns the cell.
+	h.Emit(twoPCTestRead{})
+	<-vals
+
+	h.Emit(twoPCTestWrite{})
+	if err := <-errs; err != nil {
+		t.Fatalf("cannot commit the distributed transaction: %v", err)
+	}
+
+	if v := readTwoPCTest(h, vals, 10); v != 10 {
+		t.Errorf("invalid value after commit: actual=%v want=10", v)
+	}
+}
+
+// readTwoPCTest reads the cell of the accounts application until it is want,
+// since the participants commit after the coordinator.
+func readTwoPCTest(h Hive, vals chan interface{}, want interface{}) (
+	v interface{}) {
+
+	for i := 0; i < 50; i++ {
+		h.Emit(twoPCTestRead{})
+		if v = <-vals; v == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return
+}
+
+func TestCommitWithAbort(t *testing.T) {
+	h := newHiveForTest()
+
+	vals := make(chan interface{}, 1)
+	acc := h.NewApp("accounts")
+	acc.HandleFunc(twoPCTestRead{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"B", "x"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			v, err := ctx.Dict("B").Get("x")
+			if err != nil {
+				vals <- err
+				return nil
+			}
+			vals <- v
+			return nil
+		})
+
+	errs := make(chan error, 1)
+	led := h.NewApp("ledger")
+	led.HandleFunc(twoPCTestAbort{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"L", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			err := ctx.CommitWith([]CellWrite{
+				{App: "accounts", Cell: CellKey{Dict: "B", Key: "x"}, Value: 20},
+			})
+			errs <- err
+			return errors.New("abort")
+		})
+	led.HandleFunc(twoPCTestWrite{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"L", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			err := ctx.CommitWith([]CellWrite{
+				{App: "accounts", Cell: CellKey{Dict: "B", Key: "x"}, Value: 10},
+			})
+			errs <- err
+			return err
+		})
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(twoPCTestRead{})
+	<-vals
+
+	h.Emit(twoPCTestAbort{})
+	if err := <-errs; err != nil {
+		t.Fatalf("cannot prepare the distributed transaction: %v", err)
+	}
+
+	// The aborted transaction eventually releases the cell.
+	var err error
+	for i := 0; i < 50; i++ {
+		h.Emit(twoPCTestWrite{})
+		if err = <-errs; err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("cannot commit after an aborted transaction: %v", err)
+	}
+
+	if v := readTwoPCTest(h, vals, 10); v != 10 {
+		t.Errorf("invalid value after abort: actual=%v want=10", v)
+	}
+}
+
+func TestCommitWithEachOther(t *testing.T) {
+	h := newHiveForTest()
+
+	var ready sync.WaitGroup
+	ready.Add(2)
+	errs := make(chan error, 2)
+	for _, name := range []string{"a", "b"} {
+		other := "a"
+		if name == "a" {
+			other = "b"
+		}
+		app := h.NewApp(name)
+		app.HandleFunc(twoPCTestSwap{},
+			func(msg Msg, ctx MapContext) MappedCells {
+				return MappedCells{{"D", "k"}}
+			},
+			func(msg Msg, ctx RcvContext) error {
+				// Both bees coordinate a transaction towards each other at the
+				// same time.
+				ready.Done()
+				ready.Wait()
+				err := ctx.CommitWith([]CellWrite{
+					{App: other, Cell: CellKey{Dict: "D", Key: "k"}, Value: name},
+				})
+				errs <- err
+				return err
+			})
+	}
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(twoPCTestSwap{})
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Errorf("cannot commit the distributed transaction: %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("distributed transactions are deadlocked")
+		}
+	}
+}
+
+func TestPrepareAfterAbort(t *testing.T) {
+	b := &bee{beeID: 1, hive: newHiveForTest().(*hive), app: &app{name: "tx"}}
+	ops := []state.Op{{T: state.Put, D: "D", K: "k", V: 1}}
+	if err := b.abortPrepared("1"); err != ErrNoPrepared {
+		t.Errorf("invalid abort error: actual=%v want=%v", err, ErrNoPrepared)
+	}
+	if err := b.prepareTx("1", ops); err != ErrTxAborted {
+		t.Errorf("invalid prepare error: actual=%v want=%v", err, ErrTxAborted)
+	}
+	if len(b.preparedCells) != 0 {
+		t.Errorf("aborted transaction locks cells: %v", b.preparedCells)
+	}
+}
+
+func TestPreparedExpiry(t *testing.T) {
+	b := &bee{beeID: 1, hive: newHiveForTest().(*hive), app: &app{name: "tx"}}
+	ops := []state.Op{{T: state.Put, D: "D", K: "k", V: 1}}
+	if err := b.prepareTx("1", ops); err != nil {
+		t.Fatalf("cannot prepare: %v", err)
+	}
+	if err := b.prepareTx("2", ops); err != ErrTxConflict {
+		t.Errorf("invalid prepare error: actual=%v want=%v", err, ErrTxConflict)
+	}
+
+	ptx := b.prepared["1"]
+	ptx.expiry = time.Now().Add(-time.Second)
+	b.prepared["1"] = ptx
+	if b.hasPrepared() {
+		t.Error("expired transaction is still prepared")
+	}
+	if err := b.prepareTx("2", ops); err != nil {
+		t.Errorf("cannot prepare after expiry: %v", err)
+	}
+	if err := b.commitPrepared("1"); err != ErrNoPrepared {
+		t.Errorf("invalid commit error: actual=%v want=%v", err, ErrNoPrepared)
+	}
+}
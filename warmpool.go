@@ -0,0 +1,171 @@
+package beehive
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// WarmBees is an application option that keeps a pool of n pre-warmed local
+// bees for the application. A warm bee has its ID, its channels, its state,
+// and its goroutine ready before it is needed, and the queen claims it for the
+// cells of a message that have no bee. As such, creating a bee does not add to
+// the latency of the first message of its cells. The pool is refilled in the
+// background.
+//
+// Warm bees are registered only once they are claimed, and they do not
+// receive local broadcasts or count towards MaxBees until then.
+func WarmBees(n int) AppOption {
+	return func(a *app) {
+		a.warmBees = n
+	}
+}
+
+// warmPool is the pool of the warm bees of a queen.
+type warmPool struct {
+	sync.Mutex
+	bees    []*bee
+	size    int
+	stopped bool
+
+	// need is signaled when a bee is claimed from the pool.
+	need chan struct{}
+	stop chan struct{}
+}
+
+func newWarmPool(size int) *warmPool {
+	return &warmPool{
+		size: size,
+		need: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+}
+
+// claim returns a warm bee, or nil if the pool is empty.
+func (p *warmPool) claim() *bee {
+	if p == nil {
+		return nil
+	}
+
+	p.Lock()
+	if len(p.bees) == 0 {
+		p.Unlock()
+		return nil
+	}
+	b := p.bees[len(p.bees)-1]
+	p.bees = p.bees[:len(p.bees)-1]
+	p.Unlock()
+
+	select {
+	case p.need <- struct{}{}:
+	default:
+	}
+	return b
+}
+
+// put adds b to the pool. It returns false if the pool is full or stopped, in
+// which case the caller should stop b.
+func (p *warmPool) put(b *bee) bool {
+	p.Lock()
+	defer p.Unlock()
+	if p.stopped || len(p.bees) >= p.size {
+		return false
+	}
+	p.bees = append(p.bees, b)
+	return true
+}
+
+// full returns whether the pool has all its bees.
+func (p *warmPool) full() bool {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.bees) >= p.size
+}
+
+// startWarmPool starts the warm pool of the queen, if the application has
+// one.
+func (q *qee) startWarmPool() {
+	if q.app.warmBees <= 0 {
+		return
+	}
+	q.warm = newWarmPool(q.app.warmBees)
+	go q.fillWarmPool(q.warm)
+}
+
+// stopWarmPool stops the warm bees of the queen.
+func (q *qee) stopWarmPool() {
+	p := q.warm
+	if p == nil {
+		return
+	}
+	q.warm = nil
+
+	p.Lock()
+	p.stopped = true
+	bees := p.bees
+	p.bees = nil
+	p.Unlock()
+	close(p.stop)
+
+	for _, b := range bees {
+		b.processCmd(cmdStop{})
+	}
+}
+
+// returnWarmBee returns a claimed bee that did not lock its cells to the pool,
+// or stops it if the pool is full.
+func (q *qee) returnWarmBee(b *bee) {
+	if q.warm == nil || !q.warm.put(b) {
+		b.processCmd(cmdStop{})
+	}
+}
+
+// fillWarmPool creates warm bees until p is full, and refills p whenever a bee
+// is claimed. The IDs of warm bees are allocated in batches, independent of
+// the IDs allocated by the queen.
+func (q *qee) fillWarmPool(p *warmPool) {
+	var next, max uint64
+	for {
+		for !p.full() {
+			if next == max {
+				res, err := q.hive.proposeRetryAmongHives(
+					allocateBeeIDs{Len: uint(p.size)},
+					q.hive.config.RaftElectTimeout(), -1)
+				if err != nil {
+					glog.Errorf("%v cannot allocate IDs for warm bees: %v", q,
+						err)
+					break
+				}
+				ares := res.(allocateBeeIDResult)
+				next, max = ares.From, ares.To
+			}
+
+			b := q.newWarmBee(next)
+			next++
+			if !p.put(b) {
+				b.processCmd(cmdStop{})
+				break
+			}
+		}
+
+		select {
+		case <-p.need:
+		case <-time.After(q.hive.config.RaftElectTimeout()):
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// newWarmBee creates a local leader with id, which owns no cell and is not
+// registered.
+func (q *qee) newWarmBee(id uint64) *bee {
+	b := q.defaultLocalBee(id)
+	b.setState(q.app.newBeeState(id))
+	b.beeColony = q.defaultColony(id)
+	b.becomeLeader()
+	q.metrics.created.Inc()
+	go b.start()
+	return b
+}
@@ -0,0 +1,53 @@
+package beehive
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWarmBees(t *testing.T) {
+	h := newHiveForTest()
+	ch := make(chan uint64)
+	a := h.NewApp("warmbees", WarmBees(2))
+	a.HandleFunc(int(0), func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", strconv.Itoa(msg.Data().(int))}}
+	}, func(msg Msg, ctx RcvContext) error {
+		ch <- ctx.ID()
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(0)
+	<-ch
+
+	p := a.(*app).qee.warm
+	for i := 0; !p.full(); i++ {
+		if i == 100 {
+			t.Fatal("warm pool is not filled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	warm := make(map[uint64]bool)
+	p.Lock()
+	for _, b := range p.bees {
+		warm[b.ID()] = true
+	}
+	p.Unlock()
+
+	h.Emit(1)
+	id := <-ch
+	if !warm[id] {
+		t.Errorf("bee %v is not claimed from the warm pool %v", id, warm)
+	}
+	h.Emit(1)
+	if b := <-ch; b != id {
+		t.Errorf("invalid bee for a locked cell: actual=%v want=%v", b, id)
+	}
+	info, err := h.(*hive).registry.bee(id)
+	if err != nil || info.Hive != h.ID() {
+		t.Errorf("claimed bee is not registered: %v", err)
+	}
+}
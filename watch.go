@@ -0,0 +1,85 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"fmt"
+
+	"github.com/kandoo/beehive/state"
+)
+
+// DictChange is the message emitted when a key is created, updated or deleted
+// in a watched dictionary. Apps watch their dictionaries using the Watch
+// option, and other handlers (local or remote) subscribe to the changes simply
+// by handling DictChange. Changes are emitted when the transaction that makes
+// them is committed, and are never emitted for aborted transactions. Multiple
+// changes of a key in the same transaction are coalesced into one DictChange.
+type DictChange struct {
+	App   string       // The app that owns the dictionary.
+	Dict  string       // The name of the dictionary.
+	Key   string       // The changed key.
+	Op    state.OpType // state.Put for creates and updates, state.Del otherwise.
+	Value interface{}  // The new value. It is nil for deletes.
+}
+
+// IsDel returns whether the key is deleted.
+func (c DictChange) IsDel() bool {
+	return c.Op == state.Del
+}
+
+func (c DictChange) String() string {
+	op := "put"
+	if c.IsDel() {
+		op = "del"
+	}
+	return fmt.Sprintf("%s %s/%s/%s", op, c.App, c.Dict, c.Key)
+}
+
+// Watch is an application option that emits a DictChange message for every
+// committed change on the given dictionaries of the application. Changes are
+// detected in transactions, and this option also makes the application
+// transactional.
+func Watch(dicts ...string) AppOption {
+	return func(a *app) {
+		a.flags |= appFlagTransactional
+		if a.watched == nil {
+			a.watched = make(map[string]struct{})
+		}
+		for _, d := range dicts {
+			a.watched[d] = struct{}{}
+		}
+	}
+}
+
+func (a *app) watches(dict string) bool {
+	_, ok := a.watched[dict]
+	return ok
+}
+
+// dictChanges returns the DictChange messages of ops on the watched
+// dictionaries of the bee's app.
+func (b *bee) dictChanges(ops []state.Op) (msgs []*msg) {
+	if len(b.app.watched) == 0 {
+		return nil
+	}
+
+	for _, op := range ops {
+		if !b.app.watches(op.D) {
+			continue
+		}
+		c := DictChange{
+			App:  b.app.Name(),
+			Dict: op.D,
+			Key:  op.K,
+			Op:   op.T,
+		}
+		if op.T == state.Put {
+			c.Value = op.V
+		}
+		msgs = append(msgs, newMsgFromData(c, b.ID(), 0))
+	}
+	return
+}
+
+func init() {
+	gob.Register(DictChange{})
+}
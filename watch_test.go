@@ -0,0 +1,54 @@
+package beehive
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/kandoo/beehive/state"
+)
+
+func TestWatch(t *testing.T) {
+	h := newHiveForTest()
+
+	p := h.NewApp("producer", Watch("D"))
+	p.HandleFunc(AppTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			k := strconv.Itoa(int(msg.Data().(AppTestMsg)))
+			d := ctx.Dict("D")
+			if _, err := d.Get(k); err == nil {
+				d.Del(k)
+				return nil
+			}
+			d.Put(k, k)
+			ctx.Dict("U").Put(k, k)
+			return nil
+		})
+
+	ch := make(chan DictChange)
+	c := h.NewApp("consumer")
+	c.HandleFunc(DictChange{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"C", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			ch <- msg.Data().(DictChange)
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+
+	want := []DictChange{
+		{App: "producer", Dict: "D", Key: "1", Op: state.Put, Value: "1"},
+		{App: "producer", Dict: "D", Key: "1", Op: state.Del},
+	}
+	for _, w := range want {
+		h.Emit(AppTestMsg(1))
+		if c := <-ch; c != w {
+			t.Errorf("invalid change: actual=%v want=%v", c, w)
+		}
+	}
+}
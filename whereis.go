@@ -0,0 +1,93 @@
+package beehive
+
+import (
+	"fmt"
+)
+
+// Route is where an application routes a message. See Hive.WhereIs.
+type Route struct {
+	App   string      // The application.
+	Cells MappedCells // The cells mapped for the message.
+
+	Dropped   bool // Whether the map function drops the message.
+	Broadcast bool // Whether the message is broadcast to all the bees.
+	Local     bool // Whether the message is sent to all the local bees.
+
+	// The bee that owns the cells and its hive. Bee is Nil if none of the cells
+	// is owned yet, in which case a new bee is created for the message.
+	Bee  uint64
+	Hive uint64
+	// Whether the bee owns only some of the cells, in which case the rest of
+	// the cells are locked for the bee.
+	Partial bool
+}
+
+func (r Route) String() string {
+	switch {
+	case r.Dropped:
+		return fmt.Sprintf("%v drops the message", r.App)
+	case r.Broadcast:
+		return fmt.Sprintf("%v broadcasts the message to all bees", r.App)
+	case r.Local:
+		return fmt.Sprintf("%v broadcasts the message to local bees", r.App)
+	case r.Bee == Nil:
+		return fmt.Sprintf("%v maps the message to new cells %v", r.App,
+			r.Cells)
+	}
+	return fmt.Sprintf("%v maps the message to %v owned by %v/%v", r.App,
+		r.Cells, r.Hive, r.Bee)
+}
+
+func (h *hive) WhereIs(app string, msgData interface{}) (Route, error) {
+	a, ok := h.app(app)
+	if !ok {
+		return Route{}, fmt.Errorf("no such application %s", app)
+	}
+	res, err := a.qee.processCmd(cmdWhereIs{Msg: msg{MsgData: msgData}})
+	if err != nil {
+		return Route{}, err
+	}
+	return res.(Route), nil
+}
+
+// whereIs invokes the map function for the message and looks up the owner of
+// the mapped cells, without routing the message.
+func (q *qee) whereIs(m *msg) (r Route, err error) {
+	h := q.app.handler(m.Type())
+	if h == nil {
+		return r, fmt.Errorf("%v has no handler for %v", q.app, m.Type())
+	}
+
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("error in map of %v: %v", q.app, x)
+		}
+	}()
+
+	r.App = q.app.Name()
+	r.Cells = h.Map(m, q)
+	switch {
+	case r.Cells == nil:
+		r.Dropped = true
+		return r, nil
+	case r.Cells.IsBroadcastAll():
+		r.Broadcast = true
+		return r, nil
+	case r.Cells.LocalBroadcast():
+		r.Local = true
+		return r, nil
+	}
+
+	info, all, err := q.hive.beeForCells(q.app.Name(), r.Cells)
+	switch {
+	case err == ErrNoSuchBee:
+		// None of the cells is owned.
+		return r, nil
+	case err != nil:
+		return r, err
+	}
+	r.Bee = info.ID
+	r.Hive = info.Hive
+	r.Partial = !all
+	return r, nil
+}
@@ -0,0 +1,64 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type whereIsTestMsg string
+
+func TestWhereIs(t *testing.T) {
+	ch := make(chan uint64, 1)
+	h := newHiveForTest()
+	app := h.NewApp("whereis")
+	app.HandleFunc(whereIsTestMsg(""), func(msg Msg,
+		ctx MapContext) MappedCells {
+
+		k := string(msg.Data().(whereIsTestMsg))
+		if k == "" {
+			return nil
+		}
+		return MappedCells{{"W", k}}
+	}, func(msg Msg, ctx RcvContext) error {
+		ch <- ctx.ID()
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	r, err := h.WhereIs("whereis", whereIsTestMsg("k"))
+	if err != nil {
+		t.Fatalf("cannot find the route: %v", err)
+	}
+	if r.Bee != Nil || len(r.Cells) != 1 || r.Cells[0].Key != "k" {
+		t.Errorf("invalid route before the cell is owned: %v", r)
+	}
+
+	h.Emit(whereIsTestMsg("k"))
+	var bee uint64
+	select {
+	case bee = <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not received")
+	}
+
+	r, err = h.WhereIs("whereis", whereIsTestMsg("k"))
+	if err != nil {
+		t.Fatalf("cannot find the route: %v", err)
+	}
+	if r.Bee != bee || r.Hive != h.ID() || r.Partial {
+		t.Errorf("invalid route: actual=%v want=%v/%v", r, h.ID(), bee)
+	}
+
+	if r, _ = h.WhereIs("whereis", whereIsTestMsg("")); !r.Dropped {
+		t.Errorf("message is not dropped: %v", r)
+	}
+	if _, err = h.WhereIs("nosuchapp", whereIsTestMsg("k")); err == nil {
+		t.Error("no error for an invalid application")
+	}
+	if _, err = h.WhereIs("whereis", 1); err == nil {
+		t.Error("no error for a message without a handler")
+	}
+}